@@ -0,0 +1,186 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// parseCIDROrIP parses a CIDR, or a single address.
+func parseCIDROrIP(s string) (*net.IPNet, error) {
+	if !strings.Contains(s, "/") {
+		ip := net.ParseIP(s)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid address or CIDR '%s'", s)
+		}
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = 8 * net.IPv4len
+		}
+		return &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}, nil
+	}
+	_, ipNet, err := net.ParseCIDR(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid address or CIDR '%s'", s)
+	}
+	return ipNet, nil
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	nets := []*net.IPNet{}
+	for _, cidr := range cidrs {
+		ipNet, err := parseCIDROrIP(cidr)
+		if err != nil {
+			return nil, err
+		}
+		nets = append(nets, ipNet)
+	}
+	return nets, nil
+}
+
+func containsIP(nets []*net.IPNet, ip net.IP) bool {
+	for _, ipNet := range nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ClientResolver tells the client of requests. The client of requests coming
+// from trusted proxies is taken from their X-Forwarded-For, or else
+// X-Real-IP, header, which is ignored otherwise. A nil *ClientResolver
+// trusts no proxy.
+type ClientResolver struct {
+	trustedProxies []*net.IPNet
+}
+
+func NewClientResolver(trustedProxies []string) (*ClientResolver, error) {
+	proxyNets, err := parseCIDRs(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &ClientResolver{trustedProxies: proxyNets}, nil
+}
+
+func (c *ClientResolver) trusted(ip net.IP) bool {
+	return c != nil && containsIP(c.trustedProxies, ip)
+}
+
+// ClientIP returns the address of the client of the request, or nil if it
+// cannot be told. Behind trusted proxies, it is the last address of
+// X-Forwarded-For not added by one of them, as clients can put anything in
+// the header.
+func (c *ClientResolver) ClientIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil || !c.trusted(ip) {
+		return ip
+	}
+	forwarded := []string{}
+	for _, header := range r.Header["X-Forwarded-For"] {
+		forwarded = append(forwarded, strings.Split(header, ",")...)
+	}
+	if len(forwarded) == 0 {
+		if realIP := r.Header.Get("X-Real-IP"); realIP != "" {
+			return net.ParseIP(strings.TrimSpace(realIP))
+		}
+	}
+	for i := len(forwarded) - 1; i >= 0; i-- {
+		ip = net.ParseIP(strings.TrimSpace(forwarded[i]))
+		if ip == nil || !c.trusted(ip) {
+			return ip
+		}
+	}
+	return ip
+}
+
+// SourceAllowlist restricts the clients allowed to send webhooks, as told by
+// a ClientResolver.
+type SourceAllowlist struct {
+	allowed []*net.IPNet
+	clients *ClientResolver
+}
+
+// NewSourceAllowlist returns nil if allowed is empty, which allows all
+// clients.
+func NewSourceAllowlist(allowed []string, trustedProxies []string) (*SourceAllowlist, error) {
+	if len(allowed) == 0 {
+		return nil, nil
+	}
+	allowedNets, err := parseCIDRs(allowed)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := NewClientResolver(trustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	return &SourceAllowlist{allowed: allowedNets, clients: clients}, nil
+}
+
+// ClientIP returns the address of the client of the request, see
+// ClientResolver.
+func (a *SourceAllowlist) ClientIP(r *http.Request) net.IP {
+	return a.clients.ClientIP(r)
+}
+
+// Allowed tells whether the client of the request may send webhooks, and
+// returns its address.
+func (a *SourceAllowlist) Allowed(r *http.Request) (bool, net.IP) {
+	if a == nil {
+		return true, nil
+	}
+	ip := a.ClientIP(r)
+	return ip != nil && containsIP(a.allowed, ip), ip
+}
+
+// ChannelAllowlist tells the channels webhooks may be relayed to. Channels
+// named in their payload must be configured channels or in
+// webhook_channel_allowlist. Channels named in the URL path may be any, as
+// the relay joins them as needed, unless webhook_channel_allowlist is set.
+type ChannelAllowlist struct {
+	channels     map[string]bool
+	restrictPath bool
+}
+
+func NewChannelAllowlist(config *Config) *ChannelAllowlist {
+	allowlist := &ChannelAllowlist{
+		channels:     make(map[string]bool),
+		restrictPath: len(config.WebhookChannelAllowlist) > 0,
+	}
+	for _, connection := range config.ConnectionConfigs() {
+		for _, channel := range connection.IRCChannels {
+			allowlist.channels[channel.Name] = true
+		}
+	}
+	for _, channel := range config.WebhookChannelAllowlist {
+		allowlist.channels[channel] = true
+	}
+	return allowlist
+}
+
+// Allowed tells whether webhooks may be relayed to the channel, named in
+// their payload if fromPayload is set, or else in the URL path.
+func (a *ChannelAllowlist) Allowed(channel string, fromPayload bool) bool {
+	return a.channels[channel] || (!fromPayload && !a.restrictPath)
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestSourceAllowlist(t *testing.T) {
+	allowlist, err := NewSourceAllowlist(
+		[]string{"192.0.2.0/24", "2001:db8::1"},
+		[]string{"10.0.0.1", "10.1.0.0/16"})
+	if err != nil {
+		t.Fatalf("Could not create allowlist: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name          string
+		remoteAddr    string
+		forwardedFor  []string
+		expectedIP    string
+		expectAllowed bool
+	}{
+		{"direct", "192.0.2.10:1234", nil, "192.0.2.10", true},
+		{"direct ipv6", "[2001:db8::1]:1234", nil, "2001:db8::1", true},
+		{"direct denied", "198.51.100.1:1234", nil, "198.51.100.1", false},
+		{"untrusted proxy", "198.51.100.1:1234", []string{"192.0.2.10"}, "198.51.100.1", false},
+		{"trusted proxy", "10.0.0.1:1234", []string{"192.0.2.10"}, "192.0.2.10", true},
+		{"trusted proxy denied", "10.0.0.1:1234", []string{"198.51.100.1"}, "198.51.100.1", false},
+		{"proxy chain", "10.0.0.1:1234", []string{"192.0.2.10, 10.1.2.3"}, "192.0.2.10", true},
+		{"spoofed header", "10.0.0.1:1234", []string{"192.0.2.10", "198.51.100.1"}, "198.51.100.1", false},
+		{"proxy without header", "10.0.0.1:1234", nil, "10.0.0.1", false},
+		{"garbage header", "10.0.0.1:1234", []string{"192.0.2.10, junk"}, "", false},
+	} {
+		request := httptest.NewRequest("POST", "/somechannel", nil)
+		request.RemoteAddr = tc.remoteAddr
+		for _, header := range tc.forwardedFor {
+			request.Header.Add("X-Forwarded-For", header)
+		}
+		allowed, ip := allowlist.Allowed(request)
+		if allowed != tc.expectAllowed {
+			t.Errorf("%s: expected allowed %t, got %t", tc.name, tc.expectAllowed, allowed)
+		}
+		if (tc.expectedIP == "" && ip != nil) || (tc.expectedIP != "" && ip.String() != tc.expectedIP) {
+			t.Errorf("%s: expected client %s, got %s", tc.name, tc.expectedIP, ip)
+		}
+	}
+}
+
+func TestNoSourceAllowlist(t *testing.T) {
+	allowlist, err := NewSourceAllowlist(nil, []string{"10.0.0.1"})
+	if err != nil {
+		t.Fatalf("Could not create allowlist: %s", err)
+	}
+	request := httptest.NewRequest("POST", "/somechannel", nil)
+	if allowed, _ := allowlist.Allowed(request); !allowed {
+		t.Errorf("Expected all clients to be allowed without allowlist")
+	}
+
+	if _, err := NewSourceAllowlist([]string{"192.0.2.0/33"}, nil); err == nil {
+		t.Errorf("Expected invalid CIDR to be rejected")
+	}
+}
+
+func TestClientResolver(t *testing.T) {
+	clients, err := NewClientResolver([]string{"10.0.0.1"})
+	if err != nil {
+		t.Fatalf("Could not create client resolver: %s", err)
+	}
+
+	for _, tc := range []struct {
+		name         string
+		resolver     *ClientResolver
+		remoteAddr   string
+		forwardedFor string
+		realIP       string
+		expectedIP   string
+	}{
+		{"direct", clients, "192.0.2.10:1234", "", "", "192.0.2.10"},
+		{"real ip", clients, "10.0.0.1:1234", "", "192.0.2.10", "192.0.2.10"},
+		{"forwarded for first", clients, "10.0.0.1:1234", "192.0.2.10", "192.0.2.11", "192.0.2.10"},
+		{"spoofed real ip", clients, "198.51.100.1:1234", "", "192.0.2.10", "198.51.100.1"},
+		{"no trusted proxy", nil, "10.0.0.1:1234", "192.0.2.10", "192.0.2.10", "10.0.0.1"},
+	} {
+		request := httptest.NewRequest("POST", "/somechannel", nil)
+		request.RemoteAddr = tc.remoteAddr
+		if tc.forwardedFor != "" {
+			request.Header.Set("X-Forwarded-For", tc.forwardedFor)
+		}
+		if tc.realIP != "" {
+			request.Header.Set("X-Real-IP", tc.realIP)
+		}
+		if ip := tc.resolver.ClientIP(request); ip.String() != tc.expectedIP {
+			t.Errorf("%s: expected client %s, got %s", tc.name, tc.expectedIP, ip)
+		}
+	}
+}
+
+func TestChannelAllowlist(t *testing.T) {
+	config := &Config{
+		IRCChannels: []IRCChannel{{Name: "#configured"}},
+	}
+	for _, tc := range []struct {
+		name          string
+		allowlist     []string
+		channel       string
+		fromPayload   bool
+		expectAllowed bool
+	}{
+		{"configured from payload", nil, "#configured", true, true},
+		{"other from payload", nil, "#other", true, false},
+		{"other from path", nil, "#other", false, true},
+		{"allowlisted from payload", []string{"#listed"}, "#listed", true, true},
+		{"allowlisted from path", []string{"#listed"}, "#listed", false, true},
+		{"configured with allowlist", []string{"#listed"}, "#configured", false, true},
+		{"other from path with allowlist", []string{"#listed"}, "#other", false, false},
+	} {
+		config.WebhookChannelAllowlist = tc.allowlist
+		allowlist := NewChannelAllowlist(config)
+		if allowed := allowlist.Allowed(tc.channel, tc.fromPayload); allowed != tc.expectAllowed {
+			t.Errorf("%s: expected allowed %t, got %t", tc.name, tc.expectAllowed, allowed)
+		}
+	}
+}
@@ -18,6 +18,7 @@ import (
 	"context"
 	"math"
 	"math/rand"
+	"sync"
 	"time"
 
 	"github.com/google/alertmanager-irc-relay/logging"
@@ -25,6 +26,15 @@ import (
 
 type JitterFunc func(int) int
 
+// Jitter applied to the exponential backoff schedule: "full" picks a random
+// delay up to the scheduled one, "decorrelated" a random delay between one
+// unit and three times the previous delay, "none" keeps the schedule as is.
+const (
+	backoffJitterFull         = "full"
+	backoffJitterDecorrelated = "decorrelated"
+	backoffJitterNone         = "none"
+)
+
 type DelayerMaker interface {
 	NewDelayer(float64, float64, time.Duration) Delayer
 }
@@ -39,7 +49,9 @@ type Backoff struct {
 	maxBackoff   float64
 	resetDelta   float64
 	lastAttempt  time.Time
+	lastDelay    float64
 	durationUnit time.Duration
+	jitter       string
 	jitterer     JitterFunc
 	timeTeller   TimeTeller
 }
@@ -51,22 +63,26 @@ func jitterFunc(input int) int {
 	return rand.Intn(input)
 }
 
-type BackoffMaker struct{}
+// BackoffMaker makes backoffs applying Jitter, full jitter if empty.
+type BackoffMaker struct {
+	Jitter string
+}
 
 func (bm *BackoffMaker) NewDelayer(maxBackoff float64, resetDelta float64, durationUnit time.Duration) Delayer {
 	timeTeller := &RealTime{}
 	return NewBackoffForTesting(
-		maxBackoff, resetDelta, durationUnit, jitterFunc, timeTeller)
+		maxBackoff, resetDelta, durationUnit, bm.Jitter, jitterFunc, timeTeller)
 }
 
 func NewBackoffForTesting(maxBackoff float64, resetDelta float64,
-	durationUnit time.Duration, jitterer JitterFunc, timeTeller TimeTeller) *Backoff {
+	durationUnit time.Duration, jitter string, jitterer JitterFunc, timeTeller TimeTeller) *Backoff {
 	return &Backoff{
 		step:         0,
 		maxBackoff:   maxBackoff,
 		resetDelta:   resetDelta,
 		lastAttempt:  timeTeller.Now(),
 		durationUnit: durationUnit,
+		jitter:       jitter,
 		jitterer:     jitterer,
 		timeTeller:   timeTeller,
 	}
@@ -98,10 +114,34 @@ func (b *Backoff) GetDelay() time.Duration {
 	} else {
 		synchronizedDuration = b.maxBackoff
 	}
-	duration := time.Duration(b.jitterer(int(synchronizedDuration)))
+
+	var duration time.Duration
+	switch b.jitter {
+	case backoffJitterNone:
+		duration = time.Duration(synchronizedDuration)
+	case backoffJitterDecorrelated:
+		duration = time.Duration(b.decorrelatedDelay(synchronizedDuration))
+	default:
+		duration = time.Duration(b.jitterer(int(synchronizedDuration)))
+	}
 	return duration * b.durationUnit
 }
 
+// decorrelatedDelay returns a random delay between one unit and three times
+// the previous one, capped to maxBackoff, rather than following the
+// schedule, so that clients starting together drift apart.
+func (b *Backoff) decorrelatedDelay(synchronizedDuration float64) float64 {
+	// Do not add any delay the first time either.
+	if synchronizedDuration == 0 {
+		b.lastDelay = 0
+		return 0
+	}
+	upper := math.Max(b.lastDelay, 1) * 3
+	delay := math.Min(1+float64(b.jitterer(int(upper-1))), b.maxBackoff)
+	b.lastDelay = delay
+	return delay
+}
+
 func (b *Backoff) Delay() {
 	b.DelayContext(context.Background())
 }
@@ -118,3 +158,49 @@ func (b *Backoff) DelayContext(ctx context.Context) bool {
 	}
 	return true
 }
+
+// Spacer is a Delayer shared by several users, which hands out turns at least
+// spacing apart: each delay ends spacing after the previous one, or right away
+// if that was long enough ago.
+type Spacer struct {
+	spacing    time.Duration
+	timeTeller TimeTeller
+
+	mu   sync.Mutex
+	next time.Time
+}
+
+func NewSpacer(spacing time.Duration, timeTeller TimeTeller) *Spacer {
+	return &Spacer{
+		spacing:    spacing,
+		timeTeller: timeTeller,
+	}
+}
+
+func (s *Spacer) Delay() {
+	s.DelayContext(context.Background())
+}
+
+// DelayContext waits for the next turn. A turn canceled by the context is
+// not given to anyone else.
+func (s *Spacer) DelayContext(ctx context.Context) bool {
+	s.mu.Lock()
+	now := s.timeTeller.Now()
+	turn := s.next
+	if turn.Before(now) {
+		turn = now
+	}
+	s.next = turn.Add(s.spacing)
+	s.mu.Unlock()
+
+	delay := turn.Sub(now)
+	if delay <= 0 {
+		return true
+	}
+	select {
+	case <-s.timeTeller.After(delay):
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
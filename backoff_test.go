@@ -25,6 +25,10 @@ func FakeJitter(input int) int {
 }
 
 func MakeTestingBackoff(maxBackoff float64, resetDelta float64, elapsedTime []int) (*Backoff, *FakeTime) {
+	return MakeTestingBackoffWithJitter(maxBackoff, resetDelta, elapsedTime, backoffJitterFull, FakeJitter)
+}
+
+func MakeTestingBackoffWithJitter(maxBackoff float64, resetDelta float64, elapsedTime []int, jitter string, jitterer JitterFunc) (*Backoff, *FakeTime) {
 	fakeTime := &FakeTime{
 		timeseries:   elapsedTime,
 		lastIndex:    0,
@@ -32,7 +36,7 @@ func MakeTestingBackoff(maxBackoff float64, resetDelta float64, elapsedTime []in
 		afterChan:    make(chan time.Time, 1),
 	}
 	backoff := NewBackoffForTesting(maxBackoff, resetDelta, time.Millisecond,
-		FakeJitter, fakeTime)
+		jitter, jitterer, fakeTime)
 	return backoff, fakeTime
 }
 
@@ -87,3 +91,76 @@ func TestBackoffDelayContext(t *testing.T) {
 		t.Errorf("Canceled context does not return false")
 	}
 }
+
+func TestBackoffDecorrelatedJitter(t *testing.T) {
+	backoff, _ := MakeTestingBackoffWithJitter(8, 32,
+		[]int{0, 0, 1, 2, 3, 4, 50}, backoffJitterDecorrelated, FakeJitter)
+
+	// Up to three times the previous delay, capped, until reset.
+	for i, value := range []int{0, 3, 8, 8, 8, 0} {
+		expected_delay := time.Duration(value) * time.Millisecond
+		if delay := backoff.GetDelay(); expected_delay != delay {
+			t.Errorf("Call #%d of GetDelay returned %s (expected %s)",
+				i, delay, expected_delay)
+		}
+	}
+}
+
+func TestBackoffNoJitter(t *testing.T) {
+	backoff, _ := MakeTestingBackoffWithJitter(8, 32,
+		[]int{0, 0, 1, 2, 3}, backoffJitterNone, func(int) int {
+			t.Errorf("Jitter applied")
+			return 0
+		})
+
+	for i, value := range []int{0, 2, 4, 8} {
+		expected_delay := time.Duration(value) * time.Millisecond
+		if delay := backoff.GetDelay(); expected_delay != delay {
+			t.Errorf("Call #%d of GetDelay returned %s (expected %s)",
+				i, delay, expected_delay)
+		}
+	}
+}
+
+func TestBackoffJitterBounds(t *testing.T) {
+	elapsedTime := make([]int, 1001)
+	for _, jitter := range []string{backoffJitterFull, backoffJitterDecorrelated} {
+		backoff, _ := MakeTestingBackoffWithJitter(300, 1800, elapsedTime, jitter, jitterFunc)
+		// The first delay is always 0.
+		backoff.GetDelay()
+
+		previous := time.Millisecond
+		for i := 0; i < 999; i++ {
+			delay := backoff.GetDelay()
+			if delay < 0 || delay > 300*time.Millisecond {
+				t.Fatalf("Delay %s with %s jitter exceeds the max backoff", delay, jitter)
+			}
+			if jitter == backoffJitterDecorrelated &&
+				(delay < time.Millisecond || delay >= 3*previous) {
+				t.Fatalf("Delay %s with %s jitter not between 1ms and three times %s",
+					delay, jitter, previous)
+			}
+			previous = delay
+		}
+	}
+}
+
+func TestSpacer(t *testing.T) {
+	fakeTime := &FakeTime{
+		timeseries:   []int{0, 0, 5, 25, 100},
+		durationUnit: time.Millisecond,
+		afterChan:    make(chan time.Time, 1),
+	}
+	spacer := NewSpacer(10*time.Millisecond, fakeTime)
+
+	// With a canceled context, only turns which are due right away are
+	// taken.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for i, expected := range []bool{true, false, false, false, true} {
+		if ok := spacer.DelayContext(ctx); ok != expected {
+			t.Errorf("Call #%d of DelayContext returned %t (expected %t)", i, ok, expected)
+		}
+	}
+}
@@ -0,0 +1,30 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build go1.19
+// +build go1.19
+
+package main
+
+import (
+	"errors"
+	"net/http"
+)
+
+// isBodyTooLarge tells whether err was returned by a http.MaxBytesReader
+// because its limit was exceeded, be it the limit of the request body or of
+// the decompressed body.
+func isBodyTooLarge(err error) bool {
+	return errors.As(err, new(*http.MaxBytesError))
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/ianaindex"
+	"golang.org/x/text/encoding/unicode"
+)
+
+// charsetReplacement replaces the characters which the charset of the
+// messages cannot represent.
+const charsetReplacement = '?'
+
+// newCharsetEncoder returns the encoder for the IANA charset name given with
+// irc_charset, or nil for UTF-8, in which messages are already written.
+func newCharsetEncoder(charset string) (*encoding.Encoder, error) {
+	if charset == "" {
+		return nil, nil
+	}
+	enc, err := ianaindex.IANA.Encoding(charset)
+	if err != nil || enc == nil {
+		return nil, fmt.Errorf("unsupported charset '%s'", charset)
+	}
+	if enc == unicode.UTF8 {
+		return nil, nil
+	}
+	return enc.NewEncoder(), nil
+}
+
+// encodeMessage transcodes msg with encoder, replacing the characters it
+// cannot represent rather than failing.
+func encodeMessage(encoder *encoding.Encoder, msg string) string {
+	if encoder == nil {
+		return msg
+	}
+	var encoded strings.Builder
+	for _, r := range msg {
+		if r < utf8.RuneSelf {
+			encoded.WriteRune(r)
+			continue
+		}
+		s, err := encoder.String(string(r))
+		if err != nil || r == utf8.RuneError {
+			encoded.WriteRune(charsetReplacement)
+			continue
+		}
+		encoded.WriteString(s)
+	}
+	return encoded.String()
+}
@@ -0,0 +1,53 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestEncodeMessage(t *testing.T) {
+	type testCase struct {
+		charset  string
+		msg      string
+		expected string
+	}
+
+	testCases := []testCase{
+		{"", "Café ☃ down", "Café ☃ down"},
+		{"UTF-8", "Café ☃ down", "Café ☃ down"},
+		{"ISO-8859-1", "Café ☃ down", "Caf\xe9 ? down"},
+		{"latin1", "\x0304Ünïcode\x03 🔥", "\x0304\xdcn\xefcode\x03 ?"},
+		{"ISO-8859-15", "5 €", "5 \xa4"},
+		{"ISO-8859-1", "bad \xff byte", "bad ? byte"},
+	}
+
+	for _, tc := range testCases {
+		encoder, err := newCharsetEncoder(tc.charset)
+		if err != nil {
+			t.Fatalf("Unexpected error for charset %s: %s", tc.charset, err)
+		}
+		if encoded := encodeMessage(encoder, tc.msg); encoded != tc.expected {
+			t.Errorf("Unexpected encoding of %q in %s, expected %q, got %q",
+				tc.msg, tc.charset, tc.expected, encoded)
+		}
+	}
+}
+
+func TestUnsupportedCharset(t *testing.T) {
+	if _, err := newCharsetEncoder("klingon"); err == nil {
+		t.Error("Expected an error for an unknown charset")
+	}
+}
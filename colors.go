@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ircColors are the codes of the colors understood by IRC clients.
+var ircColors = map[string]string{
+	"white":      "00",
+	"black":      "01",
+	"blue":       "02",
+	"green":      "03",
+	"red":        "04",
+	"brown":      "05",
+	"purple":     "06",
+	"orange":     "07",
+	"yellow":     "08",
+	"lightgreen": "09",
+	"cyan":       "10",
+	"lightcyan":  "11",
+	"lightblue":  "12",
+	"pink":       "13",
+	"grey":       "14",
+	"lightgrey":  "15",
+}
+
+// severityLabel is the label whose value selects the color of an alert.
+const severityLabel = "severity"
+
+// colorNames lists the known colors, for errors.
+func colorNames() string {
+	names := []string{}
+	for name := range ircColors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// validateSeverityColors reports the colors of a severity_colors map which
+// are not known.
+func validateSeverityColors(errs *ConfigErrors, context string, colors map[string]string) {
+	for severity, color := range colors {
+		if _, ok := ircColors[color]; !ok {
+			errs.add("%sunknown color '%s' for severity '%s', must be one of %s",
+				context, color, severity, colorNames())
+		}
+	}
+}
+
+// LabelRule selects the alerts, or alert groups by their common labels, sent
+// to Channel if set, whose labels have the values of all Matchers. Lists of
+// rules are tried in order, the first matching rule applying, so that rules
+// without matchers can serve as defaults after more specific ones.
+type LabelRule struct {
+	Channel  string            `yaml:"channel"`
+	Matchers map[string]string `yaml:"matchers"`
+}
+
+// Matches tells whether the rule applies to an alert sent to the channel.
+func (r *LabelRule) Matches(ircChannel string, labels map[string]string) bool {
+	if r.Channel != "" && r.Channel != ircChannel {
+		return false
+	}
+	for name, value := range r.Matchers {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// ColorRule colors the messages of the firing alerts it matches, before
+// severity_colors.
+type ColorRule struct {
+	LabelRule  `yaml:",inline"`
+	Color      string `yaml:"color"`
+	Background string `yaml:"background"`
+}
+
+func (r *ColorRule) validate(errs *ConfigErrors, index int) {
+	context := fmt.Sprintf("color_rules entry %d: ", index)
+	if r.Color == "" {
+		errs.add("%scolor is required", context)
+	} else if _, ok := ircColors[r.Color]; !ok {
+		errs.add("%sunknown color '%s', must be one of %s", context, r.Color, colorNames())
+	}
+	if _, ok := ircColors[r.Background]; r.Background != "" && !ok {
+		errs.add("%sunknown background '%s', must be one of %s", context, r.Background, colorNames())
+	}
+}
+
+// code returns the IRC color code of the rule.
+func (r *ColorRule) code() string {
+	if r.Background == "" {
+		return ircColors[r.Color]
+	}
+	return ircColors[r.Color] + "," + ircColors[r.Background]
+}
+
+// colorLine colors a whole line with the code of an IRC color. The code is
+// always two digits long, so that lines starting with digits are not
+// mistaken for part of it.
+func colorLine(line string, code string) string {
+	return "\x03" + code + line + "\x03"
+}
@@ -0,0 +1,57 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"io"
+	"strings"
+)
+
+var errUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+
+// isZlibHeader tells whether a deflate body starts with a zlib header, as
+// HTTP says it should, rather than being raw deflate, as some clients send.
+func isZlibHeader(header []byte) bool {
+	return len(header) == 2 && header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0
+}
+
+// decompressedBody returns a reader of body decompressed as encoding, a
+// Content-Encoding, tells: gzip, deflate or none. Other encodings return
+// errUnsupportedEncoding. Callers must bound what they read, as little
+// data may decompress to a lot.
+func decompressedBody(body io.Reader, encoding string) (io.Reader, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return body, nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		reader := bufio.NewReader(body)
+		header, err := reader.Peek(2)
+		if err != nil && err != io.EOF {
+			return nil, err
+		}
+		if isZlibHeader(header) {
+			return zlib.NewReader(reader)
+		}
+		return flate.NewReader(reader), nil
+	}
+	return nil, errUnsupportedEncoding
+}
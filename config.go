@@ -15,9 +15,15 @@
 package main
 
 import (
+	"fmt"
 	"gopkg.in/yaml.v2"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+	"time"
 
 	"github.com/google/alertmanager-irc-relay/logging"
 )
@@ -25,59 +31,515 @@ import (
 const (
 	defaultMsgOnceTemplate = "Alert {{ .GroupLabels.alertname }} for {{ .GroupLabels.job }} is {{ .Status }}"
 	defaultMsgTemplate     = "Alert {{ .Labels.alertname }} on {{ .Labels.instance }} is {{ .Status }}"
+
+	defaultConnectionName = "default"
+
+	defaultMaxWebhookBytes = 4 << 20
+
+	defaultChannelLabelSeparator = ","
+
+	defaultMaxRenderBytes = 4 << 10
+	defaultRenderTimeout  = time.Second
 )
 
 type IRCChannel struct {
 	Name     string `yaml:"name"`
 	Password string `yaml:"password"`
+	// PasswordFile, if set, is a file the key of the channel is read from
+	// instead of Password, so that it can be kept with other secrets.
+	// It is read again when the config is reloaded.
+	PasswordFile string `yaml:"password_file"`
+	// TimestampFormat, if set, is the Go time layout of the time prefixed
+	// to the messages sent to the channel, in TimestampTimezone (local
+	// time if empty).
+	TimestampFormat   string `yaml:"timestamp_format"`
+	TimestampTimezone string `yaml:"timestamp_timezone"`
+	// SeverityColors override the global severity_colors for the channel.
+	SeverityColors map[string]string `yaml:"severity_colors"`
+	// SendConcurrency, if above 1, is how many alerts may be sent to the
+	// channel at once, not necessarily in order. Alerts to the other
+	// channels are delivered strictly in order.
+	SendConcurrency int `yaml:"send_concurrency"`
+	// JoinPriority orders the joins of the channels, higher first. The
+	// channels of a priority are joined once those of the previous one
+	// are joined, or were tried a couple of times.
+	JoinPriority int `yaml:"join_priority"`
+	// RejoinMessage, if set, is the template of the message sent to the
+	// channel once joined again after being kicked, see RejoinData.
+	RejoinMessage string `yaml:"rejoin_message"`
+	// DigestInterval, if set, puts the channel in digest mode: its alerts
+	// are not relayed as they arrive, but summarized every DigestInterval.
+	DigestInterval time.Duration `yaml:"digest_interval"`
+	// RenderMode, if first_detailed, renders only the most severe alert
+	// of a group with its template, and the others with msg_template_rest.
+	RenderMode string `yaml:"render_mode"`
+	// Disabled channels are not joined, and parted if joined when the
+	// config is reloaded. Alerts to them are dropped, or relayed to
+	// RedirectTo instead if set.
+	Disabled   bool   `yaml:"disabled"`
+	RedirectTo string `yaml:"redirect_to"`
+	// QuietHours, if set, holds the alerts to the channel during its
+	// quiet hours, and relays them once they are over.
+	QuietHours *QuietHoursConfig `yaml:"quiet_hours"`
+	// EscalationChannel, if set, receives the alerts to the channel once
+	// they could not be delivered to it for EscalationAfter, until it is
+	// joined again. The alerts which could not be delivered are then
+	// relayed to the channel if EscalationReplay is set.
+	EscalationChannel string        `yaml:"escalation_channel"`
+	EscalationAfter   time.Duration `yaml:"escalation_after"`
+	EscalationReplay  bool          `yaml:"escalation_replay"`
+	// Storm, if set, summarizes the alerts to the channel while they
+	// arrive faster than it allows.
+	Storm *StormConfig `yaml:"storm"`
+}
+
+// StormConfig puts a channel in storm mode once more than Threshold alerts
+// arrived within Window: its alerts are then summarized with Template every
+// Interval instead of being relayed as they arrive. It leaves storm mode
+// once at most CalmThreshold alerts arrived within Window for CoolDown.
+type StormConfig struct {
+	Threshold     int           `yaml:"threshold"`
+	Window        time.Duration `yaml:"window"`
+	CalmThreshold int           `yaml:"calm_threshold"`
+	CoolDown      time.Duration `yaml:"cool_down"`
+	Interval      time.Duration `yaml:"interval"`
+	// Template renders the summaries, see StormSummary, the default one
+	// being like digests.
+	Template string `yaml:"template"`
+}
+
+// QuietHoursConfig holds the alerts to a channel during Ranges, on the wall
+// clock of Timezone (local time if empty).
+type QuietHoursConfig struct {
+	Timezone string            `yaml:"timezone"`
+	Ranges   []QuietHoursRange `yaml:"ranges"`
+	// At most MaxAlerts are held, for at most TTL, the oldest being
+	// dropped first.
+	MaxAlerts int           `yaml:"max_alerts"`
+	TTL       time.Duration `yaml:"ttl"`
+	// Summary relays a summary of the alerts held instead of their
+	// messages once the quiet hours are over.
+	Summary bool `yaml:"summary"`
+	// Alerts whose severity label is in BypassSeverities are relayed
+	// right away.
+	BypassSeverities []string `yaml:"bypass_severities"`
+}
+
+// QuietHoursRange is quiet from Start to End, given as "15:04", on Weekdays
+// (every day if empty). A range whose End is before its Start ends the next
+// day.
+type QuietHoursRange struct {
+	Weekdays []string `yaml:"weekdays"`
+	Start    string   `yaml:"start"`
+	End      string   `yaml:"end"`
+}
+
+// redirectTo returns the channel the alerts to the disabled channel go to,
+// or "" if they are dropped.
+func (c *IRCChannel) redirectTo() string {
+	if c.RedirectTo == "" {
+		return ""
+	}
+	return normalizeChannel(c.RedirectTo)
+}
+
+func (c *IRCChannel) validate(errs *ConfigErrors) {
+	validateSeverityColors(errs, "channel "+c.Name+": ", c.SeverityColors)
+	if c.SendConcurrency < 0 {
+		errs.add("channel %s: send_concurrency must not be negative", c.Name)
+	}
+	if c.DigestInterval < 0 {
+		errs.add("channel %s: digest_interval must not be negative", c.Name)
+	}
+	if c.RenderMode != "" && c.RenderMode != renderModeFirstDetailed {
+		errs.add("channel %s: render_mode must be '%s', not '%s'",
+			c.Name, renderModeFirstDetailed, c.RenderMode)
+	}
+	if _, err := parseRejoinMessage(c.RejoinMessage); err != nil {
+		errs.add("channel %s: rejoin_message: %s", c.Name, err)
+	}
+	if c.RedirectTo != "" && !c.Disabled {
+		errs.add("channel %s: redirect_to is set but the channel is not disabled", c.Name)
+	}
+	if c.RedirectTo != "" && c.redirectTo() == c.Name {
+		errs.add("channel %s: redirect_to must be another channel", c.Name)
+	}
+	if c.EscalationChannel != "" && normalizeChannel(c.EscalationChannel) == c.Name {
+		errs.add("channel %s: escalation_channel must be another channel", c.Name)
+	}
+	if c.EscalationAfter < 0 {
+		errs.add("channel %s: escalation_after must not be negative", c.Name)
+	}
+	if c.Storm != nil {
+		if c.Storm.Threshold <= 0 {
+			errs.add("channel %s: storm threshold must be positive", c.Name)
+		}
+		if c.Storm.CalmThreshold < 0 || (c.Storm.Threshold > 0 && c.Storm.CalmThreshold >= c.Storm.Threshold) {
+			errs.add("channel %s: storm calm_threshold must be below threshold", c.Name)
+		}
+		if c.Storm.Window < 0 || c.Storm.CoolDown < 0 || c.Storm.Interval < 0 {
+			errs.add("channel %s: storm window, cool_down and interval must not be negative", c.Name)
+		}
+		if _, err := parseStormTemplate(c.Storm.Template); err != nil {
+			errs.add("channel %s: storm template: %s", c.Name, err)
+		}
+		if c.DigestInterval > 0 {
+			errs.add("channel %s: storm cannot be combined with digest_interval", c.Name)
+		}
+	}
+	if c.QuietHours != nil {
+		if _, err := newQuietSchedule(c.QuietHours); err != nil {
+			errs.add("channel %s: quiet_hours: %s", c.Name, err)
+		}
+		if c.QuietHours.MaxAlerts < 0 || c.QuietHours.TTL < 0 {
+			errs.add("channel %s: quiet_hours max_alerts and ttl must not be negative", c.Name)
+		}
+		if c.DigestInterval > 0 {
+			errs.add("channel %s: quiet_hours cannot be combined with digest_interval", c.Name)
+		}
+	}
+	if c.TimestampTimezone == "" {
+		return
+	}
+	if c.TimestampFormat == "" {
+		errs.add("channel %s: timestamp_timezone is set without timestamp_format", c.Name)
+	}
+	if _, err := time.LoadLocation(c.TimestampTimezone); err != nil {
+		errs.add("channel %s: invalid timestamp_timezone: %s", c.Name, err)
+	}
+}
+
+// TemplateRoute selects a named message template (or msg_template if empty)
+// for the alerts matching all of its non-empty fields. Matching alerts whose
+// status is in IgnoreStatuses are not relayed at all.
+type TemplateRoute struct {
+	Channel        string            `yaml:"channel"`
+	Status         string            `yaml:"status"`
+	Receiver       string            `yaml:"receiver"`
+	GroupKey       string            `yaml:"group_key"`
+	Matchers       map[string]string `yaml:"matchers"`
+	Template       string            `yaml:"template"`
+	IgnoreStatuses []string          `yaml:"ignore_statuses"`
+}
+
+// Matches tells whether the route applies to an alert, or to an alert group
+// when labels are its common labels. receiver and groupKey are those of the
+// webhook.
+func (r *TemplateRoute) Matches(ircChannel string, status string, labels map[string]string, receiver string, groupKey string) bool {
+	if r.Channel != "" && r.Channel != ircChannel {
+		return false
+	}
+	if r.Status != "" && r.Status != status {
+		return false
+	}
+	if r.Receiver != "" && r.Receiver != receiver {
+		return false
+	}
+	if r.GroupKey != "" && r.GroupKey != groupKey {
+		return false
+	}
+	for name, value := range r.Matchers {
+		if labels[name] != value {
+			return false
+		}
+	}
+	return true
+}
+
+// Ignores tells whether alerts in this status are dropped by the route.
+func (r *TemplateRoute) Ignores(status string) bool {
+	for _, ignored := range r.IgnoreStatuses {
+		if ignored == status {
+			return true
+		}
+	}
+	return false
+}
+
+// IRCConnection describes an additional connection to the IRC server, using
+// its own identity and serving its own set of channels. Empty identity fields
+// are inherited from the top-level configuration.
+type IRCConnection struct {
+	Name        string       `yaml:"name"`
+	IRCNick     string       `yaml:"irc_nickname"`
+	IRCNickPass string       `yaml:"irc_nickname_password"`
+	IRCIdent    string       `yaml:"irc_ident"`
+	IRCRealName string       `yaml:"irc_realname"`
+	IRCCharset  string       `yaml:"irc_charset"`
+	IRCChannels []IRCChannel `yaml:"irc_channels"`
 }
 
 type Config struct {
-	HTTPHost        string       `yaml:"http_host"`
-	HTTPPort        int          `yaml:"http_port"`
-	IRCNick         string       `yaml:"irc_nickname"`
-	IRCNickPass     string       `yaml:"irc_nickname_password"`
-	IRCRealName     string       `yaml:"irc_realname"`
-	IRCHost         string       `yaml:"irc_host"`
-	IRCPort         int          `yaml:"irc_port"`
-	IRCHostPass     string       `yaml:"irc_host_password"`
-	IRCUseSSL       bool         `yaml:"irc_use_ssl"`
-	IRCVerifySSL    bool         `yaml:"irc_verify_ssl"`
-	IRCChannels     []IRCChannel `yaml:"irc_channels"`
-	MsgTemplate     string       `yaml:"msg_template"`
-	MsgOnce         bool         `yaml:"msg_once_per_alert_group"`
-	UsePrivmsg      bool         `yaml:"use_privmsg"`
-	AlertBufferSize int          `yaml:"alert_buffer_size"`
-
-	NickservName    string       `yaml:"nickserv_name"`
+	HTTPHost               string            `yaml:"http_host"`
+	HTTPPort               int               `yaml:"http_port"`
+	InternalHTTPHost       string            `yaml:"internal_http_host"`
+	InternalHTTPPort       int               `yaml:"internal_http_port"`
+	IRCNick                string            `yaml:"irc_nickname"`
+	IRCNickPass            string            `yaml:"irc_nickname_password"`
+	IRCIdent               string            `yaml:"irc_ident"`
+	IRCRealName            string            `yaml:"irc_realname"`
+	IRCCharset             string            `yaml:"irc_charset"`
+	IRCHost                string            `yaml:"irc_host"`
+	IRCPort                int               `yaml:"irc_port"`
+	IRCHostPass            string            `yaml:"irc_host_password"`
+	IRCUseSSL              bool              `yaml:"irc_use_ssl"`
+	IRCVerifySSL           bool              `yaml:"irc_verify_ssl"`
+	IRCIdleTimeout         time.Duration     `yaml:"irc_idle_timeout"`
+	IRCRegistrationTimeout time.Duration     `yaml:"irc_registration_timeout"`
+	IRCMOTDTimeout         time.Duration     `yaml:"irc_motd_timeout"`
+	IRCWriteTimeout        time.Duration     `yaml:"irc_write_timeout"`
+	IRCInterruptedMessages string            `yaml:"irc_interrupted_messages"`
+	IRCBacklogTTL          time.Duration     `yaml:"irc_backlog_ttl"`
+	IRCMultiline           bool              `yaml:"irc_multiline"`
+	IRCReconnectNotices    []string          `yaml:"irc_reconnect_notices"`
+	IRCTCPKeepAlive        TCPKeepAlive      `yaml:"irc_tcp_keepalive"`
+	IRCMaxConnectAttempts  int               `yaml:"irc_max_reconnect_attempts"`
+	IRCGiveUpAction        string            `yaml:"irc_give_up_action"`
+	IRCGiveUpRetryInterval time.Duration     `yaml:"irc_give_up_retry_interval"`
+	IRCBannedAction        string            `yaml:"irc_banned_action"`
+	IRCBannedRetryInterval time.Duration     `yaml:"irc_banned_retry_interval"`
+	BackoffJitter          string            `yaml:"backoff_jitter"`
+	IRCChannels            []IRCChannel      `yaml:"irc_channels"`
+	MsgTemplate            string            `yaml:"msg_template"`
+	MsgOnce                bool              `yaml:"msg_once_per_alert_group"`
+	MsgTemplateRest        string            `yaml:"msg_template_rest"`
+	SeverityOrder          []string          `yaml:"severity_order"`
+	MsgTemplates           map[string]string `yaml:"msg_templates"`
+	TemplatesByReceiver    map[string]string `yaml:"templates_by_receiver"`
+	MsgTemplatePartials    map[string]string `yaml:"msg_template_partials"`
+	MsgTemplatePartialsDir string            `yaml:"msg_template_partials_dir"`
+	TemplateRoutes         []TemplateRoute   `yaml:"template_routes"`
+	RunbookAnnotation      string            `yaml:"runbook_annotation"`
+	RunbookPrefix          string            `yaml:"runbook_prefix"`
+	RunbookShorten         bool              `yaml:"runbook_shorten"`
+	SeverityColors         map[string]string `yaml:"severity_colors"`
+	ColorRules             []ColorRule       `yaml:"color_rules"`
+	TemplateLeftovers      string            `yaml:"template_leftovers"`
+	AnnotationsMarkdown    string            `yaml:"annotations_markdown"`
+	LabelAllowlist         []string          `yaml:"label_allowlist"`
+	LabelDenylist          []string          `yaml:"label_denylist"`
+	MessageOrdering        string            `yaml:"message_ordering"`
+	WebhookOrdering        string            `yaml:"webhook_ordering"`
+	MaxLinesPerAlert       int               `yaml:"max_lines_per_alert"`
+	MaxAlertsPerWebhook    int               `yaml:"max_alerts_per_webhook"`
+	MaxRenderBytes         int               `yaml:"max_render_bytes"`
+	RenderTimeout          time.Duration     `yaml:"render_timeout"`
+	UsePrivmsg             bool              `yaml:"use_privmsg"`
+	AlertBufferSize        int               `yaml:"alert_buffer_size"`
+	AlertCooldown          time.Duration     `yaml:"alert_cooldown"`
+	WebhookDedupTTL        time.Duration     `yaml:"webhook_dedup_ttl"`
+	LogEmptyWebhooks       bool              `yaml:"log_empty_webhooks"`
+	FlapThreshold          int               `yaml:"flap_threshold"`
+	FlapWindow             time.Duration     `yaml:"flap_window"`
+	FlapStablePeriod       time.Duration     `yaml:"flap_stable_period"`
+	WatchdogAlertName      string            `yaml:"watchdog_alertname"`
+	WatchdogTimeout        time.Duration     `yaml:"watchdog_timeout"`
+	WatchdogChannel        string            `yaml:"watchdog_channel"`
+	MaxWebhookBytes        int64             `yaml:"max_webhook_bytes"`
+	StaticLabels           map[string]string `yaml:"static_labels"`
+	StaticLabelsOverride   bool              `yaml:"static_labels_override"`
+
+	NickservName             string   `yaml:"nickserv_name"`
 	NickservIdentifyPatterns []string `yaml:"nickserv_identify_patterns"`
-	ChanservName    string       `yaml:"chanserv_name"`
+	ChanservName             string   `yaml:"chanserv_name"`
+
+	// Identifying is retried if NickServ does not confirm it in time.
+	NickservConfirmPatterns []string      `yaml:"nickserv_confirm_patterns"`
+	NickservIdentifyTimeout time.Duration `yaml:"nickserv_identify_timeout"`
+	NickservRetryInterval   time.Duration `yaml:"nickserv_retry_interval"`
+
+	CTCPReplies   []string      `yaml:"ctcp_replies"`
+	CTCPRateLimit CTCPRateLimit `yaml:"ctcp_rate_limit"`
+
+	ChannelMembershipMetrics bool `yaml:"channel_membership_metrics"`
+
+	NotificationChannel              string        `yaml:"notification_channel"`
+	NotificationJoinFailureThreshold time.Duration `yaml:"notification_join_failure_threshold"`
+
+	// Joining a channel the server says does not exist is given up after
+	// that many attempts, for channels of irc_channels and for the other
+	// channels alerts are sent to. 0 retries forever.
+	IRCNoSuchChannelAttempts        int `yaml:"irc_no_such_channel_attempts"`
+	IRCNoSuchChannelAttemptsDynamic int `yaml:"irc_no_such_channel_attempts_dynamic"`
+
+	// Joining a channel we are banned from is only tried again every
+	// IRCChannelBanRetryInterval, if set, instead of backing off.
+	IRCChannelBanRetryInterval time.Duration `yaml:"irc_channel_ban_retry_interval"`
+
+	// With the shared join policy, join attempts of all channels are at
+	// least IRCJoinSpacing apart, on top of the backoff of each channel.
+	IRCJoinPolicy  string        `yaml:"irc_join_policy"`
+	IRCJoinSpacing time.Duration `yaml:"irc_join_spacing"`
+
+	// A join is deemed failed without confirmation within IRCJoinWait.
+	// Failed joins are retried with a backoff growing up to
+	// IRCJoinMaxBackoff, which is reset after IRCJoinBackoffReset
+	// without failures.
+	IRCJoinWait         time.Duration `yaml:"irc_join_wait"`
+	IRCJoinMaxBackoff   time.Duration `yaml:"irc_join_max_backoff"`
+	IRCJoinBackoffReset time.Duration `yaml:"irc_join_backoff_reset"`
+
+	// Every IRCPresenceCheckInterval, if set, we check that we are still
+	// in the channels we believe joined, asking for the NAMES of one
+	// channel every IRCPresenceCheckSpacing.
+	IRCPresenceCheckInterval time.Duration `yaml:"irc_presence_check_interval"`
+	IRCPresenceCheckSpacing  time.Duration `yaml:"irc_presence_check_spacing"`
+
+	IRCConnections []IRCConnection `yaml:"irc_connections"`
+
+	OTLPTracesEndpoint string `yaml:"otlp_traces_endpoint"`
+	TracingServiceName string `yaml:"tracing_service_name"`
+
+	// StateFile, if set, is where the state handed over to a standby is
+	// saved every StateSaveInterval and on shutdown, and restored from.
+	StateFile         string        `yaml:"state_file"`
+	StateSaveInterval time.Duration `yaml:"state_save_interval"`
+
+	// Each webhook delivery gets a correlation ID, taken from the
+	// CorrelationIDHeader of the request if set, generated otherwise. It
+	// prefixes the logs about the delivery, and ends its messages if
+	// CorrelationIDInMessages.
+	CorrelationIDHeader     string `yaml:"correlation_id_header"`
+	CorrelationIDInMessages bool   `yaml:"correlation_id_in_messages"`
+
+	// WebhookAllowedCIDRs, if set, restricts the clients allowed to send
+	// webhooks. X-Forwarded-For is only honored from
+	// WebhookTrustedProxies.
+	WebhookAllowedCIDRs   []string `yaml:"webhook_allowed_cidrs"`
+	WebhookTrustedProxies []string `yaml:"webhook_trusted_proxies"`
+
+	// HTTPProxyProtocolUpstreams, if set, are the load balancers which
+	// send the PROXY protocol header telling the client of connections.
+	HTTPProxyProtocolUpstreams []string `yaml:"http_proxy_protocol_upstreams"`
+
+	// Webhooks posted to /api/webhook name their channel in the
+	// WebhookChannelField field of their payload, or else in the
+	// WebhookChannelLabel label of their alerts.
+	WebhookChannelField string `yaml:"webhook_channel_field"`
+	WebhookChannelLabel string `yaml:"webhook_channel_label"`
+	// WebhookChannelAllowlist, if set, are the channels webhooks may be
+	// relayed to on top of the configured ones, see ChannelAllowlist.
+	WebhookChannelAllowlist []string `yaml:"webhook_channel_allowlist"`
+	// The WebhookChannelLabel label of an alert may name several channels,
+	// separated by WebhookChannelLabelSeparator, the alert being relayed
+	// to them on top of the channels of the webhook, if they are allowed
+	// by WebhookChannelAllowlist.
+	WebhookChannelLabelSeparator string `yaml:"webhook_channel_label_separator"`
+
+	// QueueAPIToken, if set, is the bearer token required to list the
+	// messages waiting to be sent on /queue, which is not served
+	// otherwise.
+	QueueAPIToken string `yaml:"queue_api_token"`
+
+	// HTTPLegacyRoutes serves the endpoints on their unversioned paths,
+	// e.g. /{channel} for webhooks, besides under /api/v1.
+	HTTPLegacyRoutes bool `yaml:"http_legacy_routes"`
+
+	// WebhookHMACSecret, if set, is the secret webhooks must be signed
+	// with, at most WebhookSignatureMaxSkew before or after they are
+	// received. Each signature is accepted once.
+	WebhookHMACSecret       string        `yaml:"webhook_hmac_secret"`
+	WebhookSignatureMaxSkew time.Duration `yaml:"webhook_signature_max_skew"`
+
+	// WebhookAllowMissingContentType accepts webhooks without a
+	// Content-Type header. Those with another than JSON are rejected.
+	WebhookAllowMissingContentType bool `yaml:"webhook_allow_missing_content_type"`
+
+	// The alerts delivered to each channel are remembered by group key,
+	// fingerprint and status for WebhookRetryDedupTTL, if set, up to
+	// WebhookRetryDedupMaxEntries, and skipped in retried webhooks.
+	WebhookRetryDedupTTL        time.Duration `yaml:"webhook_retry_dedup_ttl"`
+	WebhookRetryDedupMaxEntries int           `yaml:"webhook_retry_dedup_max_entries"`
+
+	// ChannelDisplayNames map channel names to the human-friendly names
+	// rendered by the channelDisplayName template function.
+	ChannelDisplayNames map[string]string `yaml:"channel_display_names"`
+
+	// ConnectionName identifies the connection a derived config belongs
+	// to, see ConnectionConfigs.
+	ConnectionName string `yaml:"-"`
 }
 
 func LoadConfig(configFile string) (*Config, error) {
 	config := &Config{
-		HTTPHost:        "localhost",
-		HTTPPort:        8000,
-		IRCNick:         "alertmanager-irc-relay",
-		IRCNickPass:     "",
-		IRCRealName:     "Alertmanager IRC Relay",
-		IRCHost:         "example.com",
-		IRCPort:         7000,
-		IRCHostPass:     "",
-		IRCUseSSL:       true,
-		IRCVerifySSL:    true,
-		IRCChannels:     []IRCChannel{},
-		MsgOnce:         false,
-		UsePrivmsg:      false,
-		AlertBufferSize: 2048,
-		NickservName:    "NickServ",
+		HTTPHost:               "localhost",
+		HTTPPort:               8000,
+		IRCNick:                "alertmanager-irc-relay",
+		IRCNickPass:            "",
+		IRCRealName:            "Alertmanager IRC Relay",
+		IRCHost:                "example.com",
+		IRCPort:                7000,
+		IRCHostPass:            "",
+		IRCUseSSL:              true,
+		IRCVerifySSL:           true,
+		IRCRegistrationTimeout: defaultIRCRegistrationTimeout,
+		IRCWriteTimeout:        defaultIRCWriteTimeout,
+		IRCInterruptedMessages: interruptedMessagesResend,
+		IRCTCPKeepAlive:        TCPKeepAlive{Interval: defaultTCPKeepAliveInterval},
+		IRCGiveUpAction:        giveUpActionExit,
+		IRCGiveUpRetryInterval: defaultIRCGiveUpRetryInterval,
+		IRCBannedAction:        bannedActionBackoff,
+		BackoffJitter:          backoffJitterFull,
+		IRCChannels:            []IRCChannel{},
+		MsgOnce:                false,
+		RunbookPrefix:          "📖 ",
+		UsePrivmsg:             false,
+		AlertBufferSize:        2048,
+		MaxWebhookBytes:        defaultMaxWebhookBytes,
+		MaxRenderBytes:         defaultMaxRenderBytes,
+		RenderTimeout:          defaultRenderTimeout,
+		FlapWindow:             2 * time.Minute,
+		FlapStablePeriod:       10 * time.Minute,
+		WatchdogTimeout:        10 * time.Minute,
+		NickservName:           "NickServ",
 		NickservIdentifyPatterns: []string{
 			"Please choose a different nickname, or identify via",
 			"identify via /msg NickServ identify <password>",
 			"type /msg NickServ IDENTIFY password",
 			"authenticate yourself to services with the IDENTIFY command",
 		},
-		ChanservName:    "ChanServ",
+		ChanservName:       "ChanServ",
+		TracingServiceName: "alertmanager-irc-relay",
+
+		NotificationJoinFailureThreshold: 15 * time.Minute,
+
+		IRCNoSuchChannelAttempts:        5,
+		IRCNoSuchChannelAttemptsDynamic: 2,
+
+		IRCChannelBanRetryInterval: time.Hour,
+
+		IRCJoinPolicy:  joinPolicyPerChannel,
+		IRCJoinSpacing: time.Second,
+
+		IRCJoinWait:         10 * time.Second,
+		IRCJoinMaxBackoff:   5 * time.Minute,
+		IRCJoinBackoffReset: 30 * time.Minute,
+
+		IRCPresenceCheckInterval: 10 * time.Minute,
+		IRCPresenceCheckSpacing:  5 * time.Second,
+
+		StateSaveInterval: time.Minute,
+
+		CorrelationIDHeader: "X-Correlation-ID",
+
+		WebhookChannelField:          "channel",
+		WebhookChannelLabelSeparator: defaultChannelLabelSeparator,
+		HTTPLegacyRoutes:             true,
+
+		WebhookSignatureMaxSkew: defaultWebhookSignatureMaxSkew,
+
+		WebhookRetryDedupMaxEntries: defaultWebhookRetryDedupMaxEntries,
+
+		NickservConfirmPatterns: []string{
+			"You are now identified",
+			"Password accepted",
+			"You are now logged in",
+		},
+		NickservIdentifyTimeout: 30 * time.Second,
+		NickservRetryInterval:   time.Minute,
+
+		CTCPReplies:   []string{"VERSION", "PING"},
+		CTCPRateLimit: CTCPRateLimit{Burst: 5, Interval: 10 * time.Second},
 	}
 
 	if configFile != "" {
@@ -85,10 +547,22 @@ func LoadConfig(configFile string) (*Config, error) {
 		if err != nil {
 			return nil, err
 		}
-		data = []byte(os.ExpandEnv(string(data)))
-		if err := yaml.Unmarshal(data, config); err != nil {
+		expander, err := newIdentityExpander()
+		if err != nil {
 			return nil, err
 		}
+		data = []byte(os.Expand(string(data), expander.expandVariable))
+		if err := yaml.UnmarshalStrict(data, config); err != nil {
+			return nil, withFieldSuggestions(err)
+		}
+	}
+
+	if err := config.loadTemplatePartials(); err != nil {
+		return nil, err
+	}
+
+	if err := config.loadChannelKeys(); err != nil {
+		return nil, err
 	}
 
 	// Set default template if config does not have one.
@@ -100,8 +574,546 @@ func LoadConfig(configFile string) (*Config, error) {
 		}
 	}
 
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+
 	loadedConfig, _ := yaml.Marshal(config)
 	logging.Debug("Loaded config:\n%s", loadedConfig)
 
 	return config, nil
 }
+
+// loadTemplatePartials adds the partials defined in the *.tmpl files of
+// MsgTemplatePartialsDir to MsgTemplatePartials, named after the files.
+func (c *Config) loadTemplatePartials() error {
+	if c.MsgTemplatePartialsDir == "" {
+		return nil
+	}
+	files, err := filepath.Glob(filepath.Join(c.MsgTemplatePartialsDir, "*.tmpl"))
+	if err != nil {
+		return err
+	}
+	if c.MsgTemplatePartials == nil {
+		c.MsgTemplatePartials = make(map[string]string)
+	}
+	for _, file := range files {
+		name := strings.TrimSuffix(filepath.Base(file), ".tmpl")
+		if _, ok := c.MsgTemplatePartials[name]; ok {
+			return fmt.Errorf("template partial '%s' defined both in msg_template_partials and in %s", name, file)
+		}
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			return err
+		}
+		// The final newline of the file would split messages.
+		c.MsgTemplatePartials[name] = strings.TrimSuffix(string(data), "\n")
+	}
+	return nil
+}
+
+// loadChannelKeys sets the Password of the channels with a PasswordFile to
+// the content of the file.
+func (c *Config) loadChannelKeys() error {
+	var errs ConfigErrors
+	load := func(channels []IRCChannel) {
+		for i := range channels {
+			channel := &channels[i]
+			if channel.PasswordFile == "" {
+				continue
+			}
+			if channel.Password != "" {
+				errs.add("channel %s: password and password_file are mutually exclusive", channel.Name)
+				continue
+			}
+			data, err := ioutil.ReadFile(channel.PasswordFile)
+			if err != nil {
+				errs.add("channel %s: could not read password_file: %s", channel.Name, err)
+				continue
+			}
+			channel.Password = strings.TrimSpace(string(data))
+			if channel.Password == "" {
+				errs.add("channel %s: password_file %s is empty", channel.Name, channel.PasswordFile)
+			}
+		}
+	}
+	load(c.IRCChannels)
+	for _, connection := range c.IRCConnections {
+		load(connection.IRCChannels)
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// ConfigErrors lists all the problems found in a config, so that they can
+// be fixed at once instead of one per restart.
+type ConfigErrors []string
+
+func (e ConfigErrors) Error() string {
+	return "invalid config:\n  " + strings.Join(e, "\n  ")
+}
+
+func (e *ConfigErrors) add(format string, a ...interface{}) {
+	*e = append(*e, fmt.Sprintf(format, a...))
+}
+
+func (c *Config) validate() error {
+	var errs ConfigErrors
+
+	if c.HTTPPort < 0 || c.HTTPPort > 65535 {
+		errs.add("http_port %d is not a valid port", c.HTTPPort)
+	}
+	if c.InternalHTTPPort < 0 || c.InternalHTTPPort > 65535 {
+		errs.add("internal_http_port %d is not a valid port", c.InternalHTTPPort)
+	}
+	if c.InternalHTTPPort != 0 && c.InternalHTTPPort == c.HTTPPort && c.InternalHTTPHost == c.HTTPHost {
+		errs.add("internal_http_port must differ from http_port on the same host")
+	}
+	if c.IRCPort <= 0 || c.IRCPort > 65535 {
+		errs.add("irc_port %d is not a valid port", c.IRCPort)
+	}
+	if c.IRCNick == "" {
+		errs.add("irc_nickname must not be empty")
+	}
+	if strings.ContainsAny(c.IRCNick+c.IRCIdent, " \t") {
+		errs.add("irc_nickname and irc_ident must not contain spaces")
+	}
+	if _, err := newCharsetEncoder(c.IRCCharset); err != nil {
+		errs.add("irc_charset: %s", err)
+	}
+	if c.IRCIdleTimeout < 0 {
+		errs.add("irc_idle_timeout must not be negative")
+	}
+	if c.IRCRegistrationTimeout < 0 {
+		errs.add("irc_registration_timeout must not be negative")
+	}
+	for _, pattern := range c.IRCReconnectNotices {
+		if _, err := regexp.Compile(pattern); err != nil {
+			errs.add("irc_reconnect_notices: %s", err)
+		}
+	}
+	if c.IRCMOTDTimeout < 0 {
+		errs.add("irc_motd_timeout must not be negative")
+	}
+	if c.IRCWriteTimeout < 0 {
+		errs.add("irc_write_timeout must not be negative")
+	}
+	if c.IRCTCPKeepAlive.Interval < 0 || c.IRCTCPKeepAlive.Count < 0 {
+		errs.add("irc_tcp_keepalive interval and count must not be negative")
+	}
+	if c.IRCMaxConnectAttempts < 0 {
+		errs.add("irc_max_reconnect_attempts must not be negative")
+	}
+	if c.IRCMaxConnectAttempts > 0 {
+		if c.IRCGiveUpAction != giveUpActionExit && c.IRCGiveUpAction != giveUpActionRetrySlowly {
+			errs.add("irc_give_up_action must be '%s' or '%s', not '%s'",
+				giveUpActionExit, giveUpActionRetrySlowly, c.IRCGiveUpAction)
+		}
+		if c.IRCGiveUpAction == giveUpActionRetrySlowly && c.IRCGiveUpRetryInterval <= 0 {
+			errs.add("irc_give_up_retry_interval must be positive")
+		}
+	}
+	if c.IRCBannedAction != "" &&
+		c.IRCBannedAction != bannedActionBackoff && c.IRCBannedAction != bannedActionExit {
+		errs.add("irc_banned_action must be '%s' or '%s', not '%s'",
+			bannedActionBackoff, bannedActionExit, c.IRCBannedAction)
+	}
+	if c.IRCBannedRetryInterval < 0 {
+		errs.add("irc_banned_retry_interval must not be negative")
+	}
+	if c.IRCInterruptedMessages != "" &&
+		c.IRCInterruptedMessages != interruptedMessagesResend &&
+		c.IRCInterruptedMessages != interruptedMessagesDrop {
+		errs.add("irc_interrupted_messages must be '%s' or '%s', not '%s'",
+			interruptedMessagesResend, interruptedMessagesDrop, c.IRCInterruptedMessages)
+	}
+	if c.IRCBacklogTTL < 0 {
+		errs.add("irc_backlog_ttl must not be negative")
+	}
+	if c.BackoffJitter != "" &&
+		c.BackoffJitter != backoffJitterFull &&
+		c.BackoffJitter != backoffJitterDecorrelated &&
+		c.BackoffJitter != backoffJitterNone {
+		errs.add("backoff_jitter must be '%s', '%s' or '%s', not '%s'",
+			backoffJitterFull, backoffJitterDecorrelated, backoffJitterNone, c.BackoffJitter)
+	}
+	for _, cidr := range c.WebhookAllowedCIDRs {
+		if _, err := parseCIDROrIP(cidr); err != nil {
+			errs.add("webhook_allowed_cidrs: %s", err)
+		}
+	}
+	for _, cidr := range c.WebhookTrustedProxies {
+		if _, err := parseCIDROrIP(cidr); err != nil {
+			errs.add("webhook_trusted_proxies: %s", err)
+		}
+	}
+	for _, cidr := range c.HTTPProxyProtocolUpstreams {
+		if _, err := parseCIDROrIP(cidr); err != nil {
+			errs.add("http_proxy_protocol_upstreams: %s", err)
+		}
+	}
+	if c.WebhookDedupTTL < 0 {
+		errs.add("webhook_dedup_ttl must not be negative")
+	}
+	if c.WebhookRetryDedupTTL < 0 {
+		errs.add("webhook_retry_dedup_ttl must not be negative")
+	}
+	if c.WebhookRetryDedupTTL > 0 && c.WebhookRetryDedupMaxEntries <= 0 {
+		errs.add("webhook_retry_dedup_max_entries must be positive")
+	}
+	if c.WebhookHMACSecret != "" && c.WebhookSignatureMaxSkew <= 0 {
+		errs.add("webhook_signature_max_skew must be positive")
+	}
+	if strings.ContainsAny(c.WebhookChannelLabelSeparator, "#&") {
+		errs.add("webhook_channel_label_separator must not contain '#' or '&'")
+	}
+	for _, channel := range c.WebhookChannelAllowlist {
+		if !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel, "&") {
+			errs.add("webhook_channel_allowlist: %q is not a channel name", channel)
+		}
+	}
+	if c.NotificationJoinFailureThreshold < 0 {
+		errs.add("notification_join_failure_threshold must not be negative")
+	}
+	if c.IRCNoSuchChannelAttempts < 0 || c.IRCNoSuchChannelAttemptsDynamic < 0 {
+		errs.add("irc_no_such_channel_attempts and irc_no_such_channel_attempts_dynamic must not be negative")
+	}
+	if c.IRCJoinPolicy != "" &&
+		c.IRCJoinPolicy != joinPolicyPerChannel &&
+		c.IRCJoinPolicy != joinPolicyShared {
+		errs.add("irc_join_policy must be '%s' or '%s', not '%s'",
+			joinPolicyPerChannel, joinPolicyShared, c.IRCJoinPolicy)
+	}
+	if c.IRCChannelBanRetryInterval < 0 {
+		errs.add("irc_channel_ban_retry_interval must not be negative")
+	}
+	if c.IRCJoinSpacing < 0 {
+		errs.add("irc_join_spacing must not be negative")
+	}
+	if c.IRCJoinWait <= 0 {
+		errs.add("irc_join_wait must be positive")
+	}
+	if c.IRCJoinMaxBackoff <= 0 || c.IRCJoinBackoffReset <= 0 {
+		errs.add("irc_join_max_backoff and irc_join_backoff_reset must be positive")
+	}
+	if c.IRCPresenceCheckInterval < 0 || c.IRCPresenceCheckSpacing < 0 {
+		errs.add("irc_presence_check_interval and irc_presence_check_spacing must not be negative")
+	}
+	if c.StateFile != "" && c.StateSaveInterval <= 0 {
+		errs.add("state_save_interval must be positive")
+	}
+	if c.AlertCooldown < 0 {
+		errs.add("alert_cooldown must not be negative")
+	}
+	if c.FlapThreshold < 0 {
+		errs.add("flap_threshold must not be negative")
+	}
+	if c.FlapThreshold > 0 && (c.FlapWindow <= 0 || c.FlapStablePeriod <= 0) {
+		errs.add("flap_window and flap_stable_period must be positive when flap_threshold is set")
+	}
+	if c.WatchdogAlertName != "" && (c.WatchdogChannel == "" || c.WatchdogTimeout <= 0) {
+		errs.add("watchdog_channel and a positive watchdog_timeout are required when watchdog_alertname is set")
+	}
+	if c.MaxWebhookBytes < 0 {
+		errs.add("max_webhook_bytes must not be negative")
+	}
+	if c.AlertBufferSize < 0 {
+		errs.add("alert_buffer_size must not be negative")
+	}
+	if c.TemplateLeftovers != "" &&
+		c.TemplateLeftovers != templateLeftoversStrip &&
+		c.TemplateLeftovers != templateLeftoversFlag {
+		errs.add("template_leftovers must be '%s' or '%s', not '%s'",
+			templateLeftoversStrip, templateLeftoversFlag, c.TemplateLeftovers)
+	}
+	if c.AnnotationsMarkdown != "" &&
+		c.AnnotationsMarkdown != annotationsMarkdownIRC &&
+		c.AnnotationsMarkdown != annotationsMarkdownStrip {
+		errs.add("annotations_markdown must be '%s' or '%s', not '%s'",
+			annotationsMarkdownIRC, annotationsMarkdownStrip, c.AnnotationsMarkdown)
+	}
+	if c.MessageOrdering != "" &&
+		c.MessageOrdering != messageOrderingAsReceived &&
+		c.MessageOrdering != messageOrderingFiringFirst &&
+		c.MessageOrdering != messageOrderingResolvedFirst {
+		errs.add("message_ordering must be '%s', '%s' or '%s', not '%s'",
+			messageOrderingAsReceived, messageOrderingFiringFirst,
+			messageOrderingResolvedFirst, c.MessageOrdering)
+	}
+	if c.WebhookOrdering != "" &&
+		c.WebhookOrdering != webhookOrderingIndependent &&
+		c.WebhookOrdering != webhookOrderingSequenced {
+		errs.add("webhook_ordering must be '%s' or '%s', not '%s'",
+			webhookOrderingIndependent, webhookOrderingSequenced, c.WebhookOrdering)
+	}
+	for i, route := range c.TemplateRoutes {
+		if route.Template == "" && len(route.IgnoreStatuses) == 0 {
+			errs.add("template_routes entry %d has neither a template nor ignore_statuses", i)
+		} else if _, ok := c.MsgTemplates[route.Template]; route.Template != "" && !ok {
+			errs.add("template_routes entry %d references unknown template '%s'",
+				i, route.Template)
+		}
+		if route.Status != "" && route.Status != "firing" && route.Status != "resolved" {
+			errs.add("template_routes entry %d: status must be 'firing' or 'resolved', not '%s'",
+				i, route.Status)
+		}
+	}
+	if len(c.LabelAllowlist) > 0 && len(c.LabelDenylist) > 0 {
+		errs.add("label_allowlist and label_denylist are mutually exclusive")
+	}
+	for _, pattern := range append(append([]string{}, c.LabelAllowlist...), c.LabelDenylist...) {
+		if _, err := compileLabelPattern(pattern); err != nil {
+			errs.add("label_allowlist or label_denylist: %s", err)
+		}
+	}
+	for receiver, template := range c.TemplatesByReceiver {
+		if _, ok := c.MsgTemplates[template]; !ok {
+			errs.add("templates_by_receiver entry '%s' references unknown template '%s'",
+				receiver, template)
+		}
+	}
+	if c.IRCNickPass != "" && c.NickservName == "" {
+		errs.add("irc_nickname_password is set but nickserv_name is empty")
+	}
+	if c.NickservIdentifyTimeout < 0 {
+		errs.add("nickserv_identify_timeout must not be negative")
+	}
+	if c.NickservRetryInterval < 0 {
+		errs.add("nickserv_retry_interval must not be negative")
+	}
+	for _, command := range c.CTCPReplies {
+		if !ctcpAnswerable[strings.ToUpper(command)] {
+			errs.add("ctcp_replies: cannot answer CTCP %s, only VERSION, PING, TIME and CLIENTINFO",
+				command)
+		}
+	}
+	if c.MaxLinesPerAlert < 0 {
+		errs.add("max_lines_per_alert must not be negative")
+	}
+	if c.MaxAlertsPerWebhook < 0 {
+		errs.add("max_alerts_per_webhook must not be negative")
+	}
+	if c.MaxRenderBytes < 0 {
+		errs.add("max_render_bytes must not be negative")
+	}
+	if c.RenderTimeout < 0 {
+		errs.add("render_timeout must not be negative")
+	}
+	if c.CTCPRateLimit.Interval < 0 {
+		errs.add("ctcp_rate_limit interval must not be negative")
+	}
+	if c.CTCPRateLimit.Interval > 0 && c.CTCPRateLimit.Burst < 1 {
+		errs.add("ctcp_rate_limit burst must be at least 1")
+	}
+	validateSeverityColors(&errs, "", c.SeverityColors)
+	for i := range c.ColorRules {
+		c.ColorRules[i].validate(&errs, i)
+	}
+	for _, channel := range c.IRCChannels {
+		if channel.Name == "" {
+			errs.add("irc_channels entries must have a name")
+		}
+		channel.validate(&errs)
+	}
+
+	if len(c.IRCConnections) > 0 && len(c.IRCChannels) > 0 {
+		errs.add("irc_channels must be set in each of irc_connections instead of at the top level")
+	}
+	names := make(map[string]bool)
+	channels := make(map[string]string)
+	for _, connection := range c.IRCConnections {
+		if connection.Name == "" {
+			errs.add("irc_connections entries must have a name")
+		} else if names[connection.Name] {
+			errs.add("duplicate irc_connections name '%s'", connection.Name)
+		}
+		names[connection.Name] = true
+		if strings.ContainsAny(connection.IRCNick+connection.IRCIdent, " \t") {
+			errs.add("connection '%s': irc_nickname and irc_ident must not contain spaces",
+				connection.Name)
+		}
+		if _, err := newCharsetEncoder(connection.IRCCharset); err != nil {
+			errs.add("connection '%s': irc_charset: %s", connection.Name, err)
+		}
+		if connection.IRCNickPass != "" && connection.IRCNick == "" {
+			errs.add("connection '%s': irc_nickname_password is set without irc_nickname",
+				connection.Name)
+		}
+		for _, channel := range connection.IRCChannels {
+			channel.validate(&errs)
+			if other, ok := channels[channel.Name]; ok {
+				errs.add("channel %s is served by both connections '%s' and '%s'",
+					channel.Name, other, connection.Name)
+			}
+			channels[channel.Name] = connection.Name
+		}
+	}
+	disabled := c.DisabledChannels()
+	escalating := make(map[string]bool)
+	for _, config := range c.ConnectionConfigs() {
+		for _, channel := range config.IRCChannels {
+			escalating[channel.Name] = channel.EscalationChannel != ""
+		}
+	}
+	for _, config := range c.ConnectionConfigs() {
+		for _, channel := range config.IRCChannels {
+			if _, ok := disabled[channel.redirectTo()]; ok && channel.Disabled {
+				errs.add("channel %s: redirect_to %s is disabled too", channel.Name, channel.RedirectTo)
+			}
+			if channel.EscalationChannel != "" && escalating[normalizeChannel(channel.EscalationChannel)] {
+				errs.add("channel %s: escalation_channel %s has an escalation_channel too",
+					channel.Name, channel.EscalationChannel)
+			}
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+var unknownFieldRegexp = regexp.MustCompile(`field (\S+) not found in type (\S+)`)
+
+// withFieldSuggestions decorates strict decoding errors about unknown fields
+// with the closest known field name, if any is close enough to be a typo.
+func withFieldSuggestions(err error) error {
+	typeErr, ok := err.(*yaml.TypeError)
+	if !ok {
+		return err
+	}
+
+	knownFields := make(map[string][]string)
+	collectYAMLFields(reflect.TypeOf(Config{}), knownFields)
+
+	errs := ConfigErrors{}
+	for _, e := range typeErr.Errors {
+		match := unknownFieldRegexp.FindStringSubmatch(e)
+		if match != nil {
+			if suggestion := closestString(match[1], knownFields[match[2]]); suggestion != "" {
+				e = fmt.Sprintf("%s (did you mean '%s'?)", e, suggestion)
+			}
+		}
+		errs = append(errs, e)
+	}
+	return errs
+}
+
+// collectYAMLFields maps the name of each struct type reachable from t to the
+// YAML keys it accepts.
+func collectYAMLFields(t reflect.Type, fields map[string][]string) {
+	for t.Kind() == reflect.Ptr || t.Kind() == reflect.Slice || t.Kind() == reflect.Map {
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return
+	}
+	if _, ok := fields[t.String()]; ok {
+		return
+	}
+	fields[t.String()] = []string{}
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("yaml"), ",")[0]
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[t.String()] = append(fields[t.String()], name)
+		collectYAMLFields(t.Field(i).Type, fields)
+	}
+}
+
+// closestString returns the candidate with the smallest edit distance to s,
+// or an empty string if none is plausibly a misspelling of s.
+func closestString(s string, candidates []string) string {
+	best := ""
+	bestDistance := len(s)/2 + 1
+	for _, candidate := range candidates {
+		if d := editDistance(s, candidate); d < bestDistance {
+			best = candidate
+			bestDistance = d
+		}
+	}
+	return best
+}
+
+func editDistance(a, b string) int {
+	prev := make([]int, len(b)+1)
+	cur := make([]int, len(b)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+	for i := 1; i <= len(a); i++ {
+		cur[0] = i
+		for j := 1; j <= len(b); j++ {
+			cost := 1
+			if a[i-1] == b[j-1] {
+				cost = 0
+			}
+			cur[j] = min3(prev[j]+1, cur[j-1]+1, prev[j-1]+cost)
+		}
+		prev, cur = cur, prev
+	}
+	return prev[len(b)]
+}
+
+func min3(a, b, c int) int {
+	if b < a {
+		a = b
+	}
+	if c < a {
+		a = c
+	}
+	return a
+}
+
+// ConnectionConfigs returns one config per IRC connection to establish. When
+// no irc_connections are configured, this is the config itself. Otherwise each
+// connection gets a copy of the config with its own identity and channels.
+func (c *Config) ConnectionConfigs() []*Config {
+	if len(c.IRCConnections) == 0 {
+		config := *c
+		config.ConnectionName = defaultConnectionName
+		return []*Config{&config}
+	}
+
+	configs := []*Config{}
+	for _, connection := range c.IRCConnections {
+		config := *c
+		config.IRCConnections = nil
+		config.ConnectionName = connection.Name
+		config.IRCChannels = connection.IRCChannels
+		if connection.IRCNick != "" {
+			config.IRCNick = connection.IRCNick
+			// Never reuse the top-level NickServ password for a
+			// different nickname.
+			config.IRCNickPass = connection.IRCNickPass
+		}
+		if connection.IRCIdent != "" {
+			config.IRCIdent = connection.IRCIdent
+		}
+		if connection.IRCRealName != "" {
+			config.IRCRealName = connection.IRCRealName
+		}
+		if connection.IRCCharset != "" {
+			config.IRCCharset = connection.IRCCharset
+		}
+		configs = append(configs, &config)
+	}
+	return configs
+}
+
+// DisabledChannels maps the disabled channels of all connections to the
+// channel their alerts are redirected to, or "" if they are dropped.
+func (c *Config) DisabledChannels() map[string]string {
+	disabled := make(map[string]string)
+	for _, config := range c.ConnectionConfigs() {
+		for _, channel := range config.IRCChannels {
+			if channel.Disabled {
+				disabled[channel.Name] = channel.redirectTo()
+			}
+		}
+	}
+	return disabled
+}
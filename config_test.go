@@ -18,7 +18,11 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
 
 	"gopkg.in/yaml.v2"
 )
@@ -47,6 +51,10 @@ func TestLoadGoodConfig(t *testing.T) {
 		MsgOnce:         false,
 		UsePrivmsg:      false,
 		AlertBufferSize: 666,
+
+		IRCJoinWait:         20 * time.Second,
+		IRCJoinMaxBackoff:   5 * time.Minute,
+		IRCJoinBackoffReset: 30 * time.Minute,
 	}
 	expectedData, err := yaml.Marshal(expectedConfig)
 	if err != nil {
@@ -211,3 +219,759 @@ func TestGivenTemplateNotOverwritten(t *testing.T) {
 		t.Errorf("Template does not match configuration")
 	}
 }
+
+func TestConnectionConfigs(t *testing.T) {
+	config := &Config{
+		IRCNick:     "foo",
+		IRCNickPass: "foopass",
+		IRCRealName: "Foo",
+		IRCChannels: []IRCChannel{IRCChannel{Name: "#foo"}},
+		IRCConnections: []IRCConnection{
+			IRCConnection{
+				Name:        "team-a",
+				IRCNick:     "bot-a",
+				IRCChannels: []IRCChannel{IRCChannel{Name: "#a"}},
+			},
+			IRCConnection{
+				Name:        "team-b",
+				IRCChannels: []IRCChannel{IRCChannel{Name: "#b"}},
+			},
+		},
+	}
+
+	configs := config.ConnectionConfigs()
+	if len(configs) != 2 {
+		t.Fatalf("Expected 2 connection configs, got %d", len(configs))
+	}
+
+	if configs[0].ConnectionName != "team-a" || configs[0].IRCNick != "bot-a" ||
+		configs[0].IRCNickPass != "" || configs[0].IRCRealName != "Foo" ||
+		!reflect.DeepEqual(configs[0].IRCChannels, []IRCChannel{IRCChannel{Name: "#a"}}) {
+		t.Errorf("Unexpected config for team-a: %+v", configs[0])
+	}
+	if configs[1].ConnectionName != "team-b" || configs[1].IRCNick != "foo" ||
+		configs[1].IRCNickPass != "foopass" ||
+		!reflect.DeepEqual(configs[1].IRCChannels, []IRCChannel{IRCChannel{Name: "#b"}}) {
+		t.Errorf("Unexpected config for team-b: %+v", configs[1])
+	}
+	if config.IRCNick != "foo" || config.ConnectionName != "" {
+		t.Errorf("Top-level config was modified: %+v", config)
+	}
+}
+
+func TestDefaultConnectionConfig(t *testing.T) {
+	config := &Config{IRCNick: "foo"}
+
+	configs := config.ConnectionConfigs()
+	if len(configs) != 1 || configs[0].ConnectionName != defaultConnectionName ||
+		configs[0].IRCNick != "foo" {
+		t.Errorf("Unexpected default connection configs: %+v", configs)
+	}
+}
+
+func TestDuplicateConnectionChannel(t *testing.T) {
+	tmpfile, err := ioutil.TempFile("", "airtestduplicateconnectionchannel")
+	if err != nil {
+		t.Errorf("Could not create tmpfile for testing: %s", err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	configData := []byte(`
+irc_connections:
+  - name: a
+    irc_channels:
+      - name: "#foo"
+  - name: b
+    irc_channels:
+      - name: "#foo"
+`)
+	if _, err := tmpfile.Write(configData); err != nil {
+		t.Errorf("Could not write test data in tmpfile: %s", err)
+	}
+	tmpfile.Close()
+
+	config, err := LoadConfig(tmpfile.Name())
+	if err == nil || config != nil {
+		t.Errorf("Expected no config upon duplicate channel. err: %s", err)
+	}
+}
+
+func TestTopLevelChannelsWithConnections(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_channels:
+  - name: "#foo"
+irc_connections:
+  - name: a
+    irc_channels:
+      - name: "#bar"
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon top-level channels with connections")
+	}
+	if !strings.Contains(err.Error(), "irc_channels must be set in each of irc_connections") {
+		t.Errorf("Expected error about top-level irc_channels, got: %s", err)
+	}
+}
+
+func loadTestConfigData(t *testing.T, configData string) (*Config, error) {
+	tmpfile, err := ioutil.TempFile("", "airtestconfigdata")
+	if err != nil {
+		t.Fatalf("Could not create tmpfile for testing: %s", err)
+	}
+	defer os.Remove(tmpfile.Name())
+
+	if _, err := tmpfile.Write([]byte(configData)); err != nil {
+		t.Fatalf("Could not write test data in tmpfile: %s", err)
+	}
+	tmpfile.Close()
+
+	return LoadConfig(tmpfile.Name())
+}
+
+func TestUnknownFieldSuggestion(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+msg_tempalte: "{{ .Status }}"
+irc_channels:
+  - name: "#foo"
+    pasword: secret
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon unknown fields")
+	}
+
+	for _, expected := range []string{
+		"field msg_tempalte not found in type main.Config (did you mean 'msg_template'?)",
+		"field pasword not found in type main.IRCChannel (did you mean 'password'?)",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error to contain %q, got: %s", expected, err)
+		}
+	}
+}
+
+func TestUnknownFieldWithoutSuggestion(t *testing.T) {
+	_, err := loadTestConfigData(t, "completely_unrelated: yes")
+	if err == nil {
+		t.Fatalf("Expected error upon unknown field")
+	}
+	if strings.Contains(err.Error(), "did you mean") {
+		t.Errorf("Unexpected suggestion for unrelated field: %s", err)
+	}
+}
+
+func TestValidationErrorsAggregated(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_port: 0
+irc_nickname: ""
+irc_connections:
+  - irc_nickname_password: secret
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid values")
+	}
+
+	errs, ok := err.(ConfigErrors)
+	if !ok {
+		t.Fatalf("Expected ConfigErrors, got: %s", err)
+	}
+	if len(errs) != 4 {
+		t.Errorf("Expected 4 validation errors, got: %s", err)
+	}
+}
+
+func TestUnknownRouteTemplate(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+msg_templates:
+  concise: "{{ .Labels.alertname }}"
+template_routes:
+  - channel: "#mobile"
+    template: concise
+  - matchers:
+      severity: page
+    template: paging
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon unknown template")
+	}
+	if !strings.Contains(err.Error(), "unknown template 'paging'") {
+		t.Errorf("Expected error about template 'paging', got: %s", err)
+	}
+}
+
+func TestUnknownReceiverTemplate(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+templates_by_receiver:
+  team-irc: team
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon unknown template")
+	}
+	if !strings.Contains(err.Error(), "templates_by_receiver entry 'team-irc' references unknown template 'team'") {
+		t.Errorf("Expected error about template 'team', got: %s", err)
+	}
+}
+
+func TestLabelAllowlistAndDenylist(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+label_allowlist:
+  - alertname
+label_denylist:
+  - "tenant_(id"
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon both label lists")
+	}
+	if !strings.Contains(err.Error(), "label_allowlist and label_denylist are mutually exclusive") {
+		t.Errorf("Expected error about label lists, got: %s", err)
+	}
+	if !strings.Contains(err.Error(), "label_allowlist or label_denylist: error parsing regexp") {
+		t.Errorf("Expected error about the invalid pattern, got: %s", err)
+	}
+}
+
+func TestRouteWithoutTemplate(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+template_routes:
+  - channel: "#mobile"
+    ignore_statuses:
+      - resolved
+  - channel: "#backend"
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon route without template")
+	}
+	if !strings.Contains(err.Error(), "entry 1 has neither a template nor ignore_statuses") {
+		t.Errorf("Expected error about entry 1 only, got: %s", err)
+	}
+	if strings.Contains(err.Error(), "entry 0") {
+		t.Errorf("Expected route ignoring statuses to be valid, got: %s", err)
+	}
+}
+
+func TestInvalidGiveUpAction(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_max_reconnect_attempts: 5
+irc_give_up_action: panic
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid give up action")
+	}
+	if !strings.Contains(err.Error(), "irc_give_up_action") {
+		t.Errorf("Expected error about irc_give_up_action, got: %s", err)
+	}
+}
+
+func TestIdentityPlaceholders(t *testing.T) {
+	os.Setenv("AIR_TEST_REGION", "eu")
+	defer os.Unsetenv("AIR_TEST_REGION")
+	hostname, err := os.Hostname()
+	if err != nil {
+		t.Fatalf("Could not get hostname: %s", err)
+	}
+
+	config, err := loadTestConfigData(t, `
+irc_nickname: air-${env:AIR_TEST_REGION}
+irc_ident: air
+irc_realname: relay on ${hostname} in $AIR_TEST_REGION
+irc_connections:
+  - name: other
+    irc_ident: ${env:AIR_TEST_REGION}
+tracing_service_name: air-${shorthost}
+`)
+	if err != nil {
+		t.Fatalf("Expected a config, got: %s", err)
+	}
+	if config.IRCNick != "air-eu" {
+		t.Errorf("Unexpected nickname: %s", config.IRCNick)
+	}
+	if expected := "relay on " + hostname + " in eu"; config.IRCRealName != expected {
+		t.Errorf("Expected realname %q, got %q", expected, config.IRCRealName)
+	}
+	// Placeholders are expanded in other settings too.
+	if expected := "air-" + strings.SplitN(hostname, ".", 2)[0]; config.TracingServiceName != expected {
+		t.Errorf("Expected service name %q, got %q", expected, config.TracingServiceName)
+	}
+	connectionConfig := config.ConnectionConfigs()[0]
+	if connectionConfig.IRCIdent != "eu" || connectionConfig.IRCNick != "air-eu" {
+		t.Errorf("Unexpected connection identity: %s, %s",
+			connectionConfig.IRCNick, connectionConfig.IRCIdent)
+	}
+}
+
+func TestInvalidSeverityColor(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_channels:
+  - name: "#noc"
+    severity_colors:
+      warning: crimson
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon unknown color")
+	}
+	if !strings.Contains(err.Error(), "channel #noc: unknown color 'crimson'") {
+		t.Errorf("Expected error about unknown color, got: %s", err)
+	}
+}
+
+func TestLoadColorRules(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+color_rules:
+  - matchers:
+      environment: prod
+    color: red
+  - channel: "#noc"
+    color: white
+    background: grey
+`)
+	if err != nil {
+		t.Fatalf("Could not load config: %s", err)
+	}
+	expected := []ColorRule{
+		ColorRule{LabelRule: LabelRule{Matchers: map[string]string{"environment": "prod"}}, Color: "red"},
+		ColorRule{LabelRule: LabelRule{Channel: "#noc"}, Color: "white", Background: "grey"},
+	}
+	if !reflect.DeepEqual(expected, config.ColorRules) {
+		t.Errorf("Unexpected color rules: %+v", config.ColorRules)
+	}
+
+	config, err = loadTestConfigData(t, `
+color_rules:
+  - matchers:
+      environment: staging
+    color: gray
+  - background: grey
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid color rules")
+	}
+	for _, expected := range []string{
+		"color_rules entry 0: unknown color 'gray'",
+		"color_rules entry 1: color is required",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error %q, got: %s", expected, err)
+		}
+	}
+}
+
+func TestInvalidBannedAction(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_banned_action: retry
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid banned action")
+	}
+	if !strings.Contains(err.Error(), "irc_banned_action") {
+		t.Errorf("Expected error about irc_banned_action, got: %s", err)
+	}
+}
+
+func TestInvalidCharset(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_connections:
+  - name: legacy
+    irc_charset: klingon
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid charset")
+	}
+	if !strings.Contains(err.Error(), "connection 'legacy': irc_charset") {
+		t.Errorf("Expected error about irc_charset, got: %s", err)
+	}
+}
+
+func TestNegativeNickservRetryInterval(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+nickserv_retry_interval: -1m
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon negative NickServ retry interval")
+	}
+	if !strings.Contains(err.Error(), "nickserv_retry_interval") {
+		t.Errorf("Expected error about nickserv_retry_interval, got: %s", err)
+	}
+}
+
+func TestNegativeMaxLinesPerAlert(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+max_lines_per_alert: -1
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon negative max lines per alert")
+	}
+	if !strings.Contains(err.Error(), "max_lines_per_alert") {
+		t.Errorf("Expected error about max_lines_per_alert, got: %s", err)
+	}
+}
+
+func TestInvalidStateSaveInterval(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+state_file: /var/lib/alertmanager-irc-relay/state.json
+state_save_interval: 0s
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon state file saved without interval")
+	}
+	if !strings.Contains(err.Error(), "state_save_interval") {
+		t.Errorf("Expected error about state_save_interval, got: %s", err)
+	}
+}
+
+func TestInvalidCTCPReplies(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+ctcp_replies: [VERSION, DCC]
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon CTCP reply we cannot give")
+	}
+	if !strings.Contains(err.Error(), "ctcp_replies") {
+		t.Errorf("Expected error about ctcp_replies, got: %s", err)
+	}
+}
+
+func TestInvalidBackoffJitter(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+backoff_jitter: random
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid backoff jitter")
+	}
+	if !strings.Contains(err.Error(), "backoff_jitter") {
+		t.Errorf("Expected error about backoff_jitter, got: %s", err)
+	}
+}
+
+func TestInvalidTimestampTimezone(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_channels:
+  - name: "#foo"
+    timestamp_format: "15:04"
+    timestamp_timezone: Nowhere/Special
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid timezone")
+	}
+	if !strings.Contains(err.Error(), "channel #foo: invalid timestamp_timezone") {
+		t.Errorf("Expected error about timestamp_timezone, got: %s", err)
+	}
+}
+
+func TestNegativeSendConcurrency(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_channels:
+  - name: "#foo"
+    send_concurrency: -1
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon negative send_concurrency")
+	}
+	if !strings.Contains(err.Error(), "channel #foo: send_concurrency must not be negative") {
+		t.Errorf("Expected error about send_concurrency, got: %s", err)
+	}
+}
+
+func TestInvalidRenderMode(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_channels:
+  - name: "#foo"
+    render_mode: everything
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid render_mode")
+	}
+	if !strings.Contains(err.Error(), "channel #foo: render_mode must be 'first_detailed'") {
+		t.Errorf("Expected error about render_mode, got: %s", err)
+	}
+}
+
+func TestInvalidRedirectTo(t *testing.T) {
+	for _, tc := range []struct {
+		channels string
+		expected string
+	}{
+		{`
+  - name: "#foo"
+    redirect_to: "#bar"
+`, "channel #foo: redirect_to is set but the channel is not disabled"},
+		{`
+  - name: "#foo"
+    disabled: true
+    redirect_to: foo
+`, "channel #foo: redirect_to must be another channel"},
+		{`
+  - name: "#foo"
+    disabled: true
+    redirect_to: "#bar"
+  - name: "#bar"
+    disabled: true
+`, "channel #foo: redirect_to #bar is disabled too"},
+	} {
+		config, err := loadTestConfigData(t, "irc_channels:"+tc.channels)
+		if err == nil || config != nil {
+			t.Fatalf("Expected no config upon invalid redirect_to: %s", tc.channels)
+		}
+		if !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected error '%s', got: %s", tc.expected, err)
+		}
+	}
+}
+
+func TestInvalidEscalation(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_channels:
+  - name: "#oncall"
+    escalation_channel: "#backup"
+  - name: "#backup"
+    escalation_channel: oncall
+    escalation_after: -1m
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid escalation")
+	}
+	for _, expected := range []string{
+		"channel #backup: escalation_after must not be negative",
+		"channel #oncall: escalation_channel #backup has an escalation_channel too",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected error '%s', got: %s", expected, err)
+		}
+	}
+}
+
+func TestInvalidQuietHours(t *testing.T) {
+	for _, tc := range []struct {
+		quietHours string
+		expected   string
+	}{
+		{`
+      ranges:
+        - {start: "18:00", end: "25:00"}
+`, "channel #foo: quiet_hours: range 0: end: invalid time '25:00'"},
+		{`
+      ranges:
+        - {weekdays: [someday], start: "18:00", end: "09:00"}
+`, "channel #foo: quiet_hours: range 0: unknown weekday 'someday'"},
+		{`
+      timezone: Nowhere/Somewhere
+      ranges:
+        - {start: "18:00", end: "09:00"}
+`, "channel #foo: quiet_hours: invalid timezone"},
+		{`
+      ranges: []
+`, "channel #foo: quiet_hours: no ranges"},
+	} {
+		config, err := loadTestConfigData(t, `
+irc_channels:
+  - name: "#foo"
+    quiet_hours:`+tc.quietHours)
+		if err == nil || config != nil {
+			t.Fatalf("Expected no config upon invalid quiet_hours: %s", tc.quietHours)
+		}
+		if !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected error '%s', got: %s", tc.expected, err)
+		}
+	}
+}
+
+func TestInvalidStorm(t *testing.T) {
+	for _, tc := range []struct {
+		storm    string
+		expected string
+	}{
+		{`
+      threshold: 0
+`, "channel #foo: storm threshold must be positive"},
+		{`
+      threshold: 10
+      calm_threshold: 10
+`, "channel #foo: storm calm_threshold must be below threshold"},
+		{`
+      threshold: 10
+      cool_down: -1m
+`, "channel #foo: storm window, cool_down and interval must not be negative"},
+		{`
+      threshold: 10
+      template: "{{ .Firing "
+`, "channel #foo: storm template:"},
+	} {
+		config, err := loadTestConfigData(t, `
+irc_channels:
+  - name: "#foo"
+    storm:`+tc.storm)
+		if err == nil || config != nil {
+			t.Fatalf("Expected no config upon invalid storm: %s", tc.storm)
+		}
+		if !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected error '%s', got: %s", tc.expected, err)
+		}
+	}
+}
+
+func TestInvalidAnnotationsMarkdown(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+annotations_markdown: html
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid annotations_markdown")
+	}
+	if !strings.Contains(err.Error(), "annotations_markdown must be 'irc' or 'strip'") {
+		t.Errorf("Expected error about annotations_markdown, got: %s", err)
+	}
+}
+
+func TestInvalidPresenceCheckInterval(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_presence_check_interval: -1m
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon negative irc_presence_check_interval")
+	}
+}
+
+func TestJoinTimings(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+irc_join_wait: 20s
+`)
+	if err != nil {
+		t.Fatalf("Could not load config: %s", err)
+	}
+	if config.IRCJoinWait != 20*time.Second || config.IRCJoinMaxBackoff != 5*time.Minute ||
+		config.IRCJoinBackoffReset != 30*time.Minute {
+		t.Errorf("Unexpected join timings: %s, %s, %s",
+			config.IRCJoinWait, config.IRCJoinMaxBackoff, config.IRCJoinBackoffReset)
+	}
+
+	config, err = loadTestConfigData(t, `
+irc_join_wait: 0s
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon zero irc_join_wait")
+	}
+	if !strings.Contains(err.Error(), "irc_join_wait must be positive") {
+		t.Errorf("Expected error about irc_join_wait, got: %s", err)
+	}
+}
+
+func TestTemplatePartialsDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "airtestpartials")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir for testing: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "footer.tmpl"), []byte("see {{ .GeneratorURL }}\n"), 0644); err != nil {
+		t.Fatalf("Could not write partial: %s", err)
+	}
+
+	config, err := loadTestConfigData(t, `
+msg_template_partials:
+  badge: "[{{ .Labels.severity }}]"
+msg_template_partials_dir: `+dir+`
+`)
+	if err != nil {
+		t.Fatalf("Expected a config, got: %s", err)
+	}
+	expectedPartials := map[string]string{
+		"badge":  "[{{ .Labels.severity }}]",
+		"footer": "see {{ .GeneratorURL }}",
+	}
+	if !reflect.DeepEqual(expectedPartials, config.MsgTemplatePartials) {
+		t.Errorf("Unexpected partials: %s", config.MsgTemplatePartials)
+	}
+
+	_, err = loadTestConfigData(t, `
+msg_template_partials:
+  footer: "-"
+msg_template_partials_dir: `+dir+`
+`)
+	if err == nil || !strings.Contains(err.Error(), "'footer' defined both") {
+		t.Errorf("Expected error about partial defined twice, got: %v", err)
+	}
+}
+
+func TestChannelPasswordFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "airtestkeys")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir for testing: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	keyFile := filepath.Join(dir, "foo.key")
+	if err := ioutil.WriteFile(keyFile, []byte("sesame\n"), 0600); err != nil {
+		t.Fatalf("Could not write key: %s", err)
+	}
+
+	config, err := loadTestConfigData(t, `
+irc_connections:
+  - name: main
+    irc_channels:
+      - name: "#foo"
+        password_file: `+keyFile+`
+`)
+	if err != nil {
+		t.Fatalf("Expected a config, got: %s", err)
+	}
+	if key := config.IRCConnections[0].IRCChannels[0].Password; key != "sesame" {
+		t.Errorf("Expected key 'sesame', got '%s'", key)
+	}
+
+	_, err = loadTestConfigData(t, `
+irc_channels:
+  - name: "#bar"
+    password_file: `+filepath.Join(dir, "missing.key")+`
+`)
+	if err == nil || !strings.Contains(err.Error(), "channel #bar: could not read password_file") {
+		t.Errorf("Expected error about missing password_file, got: %v", err)
+	}
+
+	_, err = loadTestConfigData(t, `
+irc_channels:
+  - name: "#foo"
+    password: sesame
+    password_file: `+keyFile+`
+`)
+	if err == nil || !strings.Contains(err.Error(), "channel #foo: password and password_file") {
+		t.Errorf("Expected error about password set twice, got: %v", err)
+	}
+}
+
+func TestInvalidMessageOrdering(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+message_ordering: newest_first
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid message ordering")
+	}
+	if !strings.Contains(err.Error(), "message_ordering") {
+		t.Errorf("Expected error about message_ordering, got: %s", err)
+	}
+}
+
+func TestInvalidChannelLabelSettings(t *testing.T) {
+	for _, tc := range []struct {
+		data     string
+		expected string
+	}{
+		{"webhook_channel_label_separator: \"#\"", "webhook_channel_label_separator"},
+		{"webhook_channel_allowlist: [\"#ops\", \"dev\"]", "\"dev\" is not a channel name"},
+	} {
+		config, err := loadTestConfigData(t, tc.data)
+		if err == nil || config != nil {
+			t.Errorf("Expected no config upon %s", tc.data)
+			continue
+		}
+		if !strings.Contains(err.Error(), tc.expected) {
+			t.Errorf("Expected error about %s, got: %s", tc.expected, err)
+		}
+	}
+}
+
+func TestInvalidWebhookOrdering(t *testing.T) {
+	config, err := loadTestConfigData(t, `
+webhook_ordering: strict
+`)
+	if err == nil || config != nil {
+		t.Fatalf("Expected no config upon invalid webhook ordering")
+	}
+	if !strings.Contains(err.Error(), "webhook_ordering") {
+		t.Errorf("Expected error about webhook_ordering, got: %s", err)
+	}
+}
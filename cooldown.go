@@ -0,0 +1,128 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+// AlertCooldown suppresses re-notifications of a firing alert for a period
+// after it was first relayed, regardless of changes to its content. Resolved
+// alerts are always relayed, and end the cooldown.
+type AlertCooldown struct {
+	period     time.Duration
+	timeTeller TimeTeller
+	metrics    *Metrics
+
+	mu           sync.Mutex
+	lastNotified map[string]time.Time
+	lastPruned   time.Time
+}
+
+func NewAlertCooldown(period time.Duration, timeTeller TimeTeller, metrics *Metrics) *AlertCooldown {
+	return &AlertCooldown{
+		period:       period,
+		timeTeller:   timeTeller,
+		metrics:      metrics,
+		lastNotified: make(map[string]time.Time),
+	}
+}
+
+func alertKey(ircChannel string, alert *promtmpl.Alert) string {
+	if alert.Fingerprint != "" {
+		return ircChannel + "/" + alert.Fingerprint
+	}
+	// Older Alertmanager versions do not send fingerprints.
+	key := ircChannel
+	for _, pair := range alert.Labels.SortedPairs() {
+		key += "/" + pair.Name + "=" + pair.Value
+	}
+	return key
+}
+
+// Allow tells whether the alert should be relayed to the channel.
+func (c *AlertCooldown) Allow(ircChannel string, alert *promtmpl.Alert) bool {
+	if c.period <= 0 {
+		return true
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := alertKey(ircChannel, alert)
+	if alert.Status == "resolved" {
+		delete(c.lastNotified, key)
+		return true
+	}
+
+	now := c.timeTeller.Now()
+	c.unsafePrune(now)
+
+	if last, ok := c.lastNotified[key]; ok && now.Sub(last) < c.period {
+		c.metrics.cooldownSuppressedAlerts.WithLabelValues(ircChannel).Inc()
+		return false
+	}
+	c.lastNotified[key] = now
+	return true
+}
+
+// FilterAlerts returns the alerts of the group that should be relayed.
+func (c *AlertCooldown) FilterAlerts(ircChannel string, alerts promtmpl.Alerts) promtmpl.Alerts {
+	filtered := promtmpl.Alerts{}
+	for i := range alerts {
+		if c.Allow(ircChannel, &alerts[i]) {
+			filtered = append(filtered, alerts[i])
+		}
+	}
+	return filtered
+}
+
+func (c *AlertCooldown) unsafePrune(now time.Time) {
+	if now.Sub(c.lastPruned) < c.period {
+		return
+	}
+	for key, last := range c.lastNotified {
+		if now.Sub(last) >= c.period {
+			delete(c.lastNotified, key)
+		}
+	}
+	c.lastPruned = now
+}
+
+// ExportState returns the alerts in cooldown.
+func (c *AlertCooldown) ExportState() []CooldownState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cooldowns := []CooldownState{}
+	for key, last := range c.lastNotified {
+		cooldowns = append(cooldowns, CooldownState{Key: key, LastNotified: last})
+	}
+	return cooldowns
+}
+
+// ImportState puts the alerts in cooldown, in addition to the ones already
+// in cooldown.
+func (c *AlertCooldown) ImportState(cooldowns []CooldownState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, cooldown := range cooldowns {
+		c.lastNotified[cooldown.Key] = cooldown.LastNotified
+	}
+}
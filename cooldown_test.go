@@ -0,0 +1,86 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func makeTestCooldown(elapsedTime []int) *AlertCooldown {
+	fakeTime := &FakeTime{
+		timeseries:   elapsedTime,
+		durationUnit: time.Minute,
+	}
+	return NewAlertCooldown(10*time.Minute, fakeTime, NewMetrics(prometheus.NewRegistry()))
+}
+
+func TestCooldownSuppressesRenotifications(t *testing.T) {
+	cooldown := makeTestCooldown([]int{0, 1, 5, 11})
+	alert := &promtmpl.Alert{Status: "firing", Fingerprint: "abc"}
+
+	expected := []bool{true, false, false, true}
+	for i, allowed := range expected {
+		// Content changes must not matter.
+		alert.Annotations = promtmpl.KV{"value": string(rune('0' + i))}
+		if cooldown.Allow("#foo", alert) != allowed {
+			t.Errorf("Call #%d: expected Allow to return %t", i, allowed)
+		}
+	}
+}
+
+func TestCooldownClearedOnResolve(t *testing.T) {
+	cooldown := makeTestCooldown([]int{0, 1, 2})
+	firing := &promtmpl.Alert{Status: "firing", Fingerprint: "abc"}
+	resolved := &promtmpl.Alert{Status: "resolved", Fingerprint: "abc"}
+
+	if !cooldown.Allow("#foo", firing) {
+		t.Errorf("First firing notification suppressed")
+	}
+	if !cooldown.Allow("#foo", resolved) {
+		t.Errorf("Resolved notification suppressed")
+	}
+	if !cooldown.Allow("#foo", firing) {
+		t.Errorf("Firing notification after resolve suppressed")
+	}
+}
+
+func TestCooldownPerChannelAndFingerprint(t *testing.T) {
+	cooldown := makeTestCooldown([]int{0, 0, 0, 0})
+	alert := &promtmpl.Alert{Status: "firing", Fingerprint: "abc"}
+	otherAlert := &promtmpl.Alert{Status: "firing", Fingerprint: "def"}
+
+	if !cooldown.Allow("#foo", alert) || !cooldown.Allow("#bar", alert) ||
+		!cooldown.Allow("#foo", otherAlert) {
+		t.Errorf("Cooldown applied across channels or fingerprints")
+	}
+	if cooldown.Allow("#foo", alert) {
+		t.Errorf("Cooldown not applied")
+	}
+}
+
+func TestCooldownDisabled(t *testing.T) {
+	cooldown := NewAlertCooldown(0, &FakeTime{}, NewMetrics(prometheus.NewRegistry()))
+	alert := &promtmpl.Alert{Status: "firing", Fingerprint: "abc"}
+
+	for i := 0; i < 3; i++ {
+		if !cooldown.Allow("#foo", alert) {
+			t.Errorf("Alert suppressed with cooldown disabled")
+		}
+	}
+}
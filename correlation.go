@@ -0,0 +1,55 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"regexp"
+)
+
+// Correlation IDs taken from requests are only trusted if they are this
+// short and made of these characters, as they end up in logs and messages.
+var correlationIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,64}$`)
+
+// newCorrelationID returns a short random ID.
+func newCorrelationID() string {
+	b := make([]byte, 4)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// requestCorrelationID returns the correlation ID found in the header of the
+// request, or a new one if there is none or it is not acceptable.
+func requestCorrelationID(r *http.Request, header string) string {
+	if header != "" {
+		if id := r.Header.Get(header); correlationIDRegexp.MatchString(id) {
+			return id
+		}
+	}
+	return newCorrelationID()
+}
+
+// correlationPrefix prefixes the logs about what the correlation ID
+// identifies, if any.
+func correlationPrefix(id string) string {
+	if id == "" {
+		return ""
+	}
+	return "[" + id + "] "
+}
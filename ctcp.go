@@ -0,0 +1,215 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	ctcpResultAnswered    = "answered"
+	ctcpResultIgnored     = "ignored"
+	ctcpResultRateLimited = "rate_limited"
+
+	// Log the first rate limited requests, then one in every few.
+	ctcpLogFirst = 3
+	ctcpLogEvery = 100
+
+	// ctcpMaxLineBytes bounds the lines read from the server: 8191 bytes
+	// of IRCv3 message tags, and 512 bytes of message. Longer lines are
+	// dropped.
+	ctcpMaxLineBytes = 8191 + 512
+	ctcpReadBytes    = 4096
+)
+
+// ctcpAnswerable are the CTCP requests we can answer: goirc answers VERSION
+// and PING itself, and we answer the others. Offers such as DCC are never
+// accepted.
+var ctcpAnswerable = map[string]bool{
+	"VERSION":    true,
+	"PING":       true,
+	"TIME":       true,
+	"CLIENTINFO": true,
+}
+
+// CTCPRateLimit limits the CTCP requests answered, from all requesters: up to
+// Burst at once, then one per Interval. A zero Interval disables the limit.
+type CTCPRateLimit struct {
+	Burst    int           `yaml:"burst"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// ctcpFilter drops the CTCP requests we should not answer before goirc sees
+// them, as goirc answers some of them on its own, and counts them.
+type ctcpFilter struct {
+	name    string
+	answer  map[string]bool
+	limit   CTCPRateLimit
+	metrics *Metrics
+	now     func() time.Time
+	log     *logging.SampledLogger
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+func newCTCPFilter(config *Config, metrics *Metrics) *ctcpFilter {
+	answer := make(map[string]bool)
+	for _, command := range config.CTCPReplies {
+		answer[strings.ToUpper(command)] = true
+	}
+	return &ctcpFilter{
+		name:    config.ConnectionName,
+		answer:  answer,
+		limit:   config.CTCPRateLimit,
+		metrics: metrics,
+		now:     time.Now,
+		log:     logging.NewSampledLogger(ctcpLogFirst, ctcpLogEvery),
+	}
+}
+
+// registerHandlers answers the CTCP requests goirc does not answer itself.
+// Only the requests let through by the filter reach them.
+func (f *ctcpFilter) registerHandlers(client *irc.Conn) {
+	client.HandleFunc(irc.CTCP,
+		func(conn *irc.Conn, line *irc.Line) {
+			switch line.Args[0] {
+			case "TIME":
+				conn.CtcpReply(line.Nick, "TIME", time.Now().Format(time.RFC1123Z))
+			case "CLIENTINFO":
+				commands := []string{}
+				for command := range f.answer {
+					commands = append(commands, command)
+				}
+				sort.Strings(commands)
+				conn.CtcpReply(line.Nick, "CLIENTINFO", strings.Join(commands, " "))
+			}
+		})
+}
+
+// take consumes a token of the rate limit, if there is one left.
+func (f *ctcpFilter) take() bool {
+	if f.limit.Interval <= 0 {
+		return true
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := f.now()
+	if f.last.IsZero() {
+		f.tokens = float64(f.limit.Burst)
+	} else {
+		f.tokens += float64(now.Sub(f.last)) / float64(f.limit.Interval)
+		if f.tokens > float64(f.limit.Burst) {
+			f.tokens = float64(f.limit.Burst)
+		}
+	}
+	f.last = now
+	if f.tokens < 1 {
+		return false
+	}
+	f.tokens--
+	return true
+}
+
+// allow tells whether the line received from the server should be handed to
+// goirc, which is always the case for other lines than CTCP requests.
+func (f *ctcpFilter) allow(raw string) bool {
+	line := irc.ParseLine(strings.TrimRight(raw, "\r\n"))
+	if line == nil || line.Cmd != irc.CTCP || len(line.Args) == 0 {
+		return true
+	}
+	command := line.Args[0]
+	if !f.answer[command] {
+		logging.Debug("Connection %s: ignoring CTCP %s from %s", f.name, command, line.Nick)
+		f.metrics.ircCTCPRequests.WithLabelValues(f.name, ctcpResultIgnored).Inc()
+		return false
+	}
+	if !f.take() {
+		// The nick is not logged by f.log, which would then sample
+		// each nick apart.
+		f.log.Warn("Connection %s: too many CTCP requests, not answering %s", f.name, command)
+		logging.Debug("Connection %s: not answering CTCP %s from %s", f.name, command, line.Nick)
+		f.metrics.ircCTCPRequests.WithLabelValues(f.name, ctcpResultRateLimited).Inc()
+		return false
+	}
+	f.metrics.ircCTCPRequests.WithLabelValues(f.name, ctcpResultAnswered).Inc()
+	return true
+}
+
+// wrap returns the connection to the server with the CTCP requests we do not
+// answer removed from what is read.
+func (f *ctcpFilter) wrap(conn net.Conn) net.Conn {
+	return &ctcpFilterConn{Conn: conn, filter: f, buf: make([]byte, ctcpReadBytes)}
+}
+
+type ctcpFilterConn struct {
+	net.Conn
+	filter *ctcpFilter
+	buf    []byte
+
+	// partial is the last line read, until it is complete, and filtered
+	// the lines not yet returned by Read. The rest of a line too long is
+	// dropped while overlong is set.
+	partial  []byte
+	overlong bool
+	filtered []byte
+	err      error
+}
+
+func (c *ctcpFilterConn) Read(p []byte) (int, error) {
+	for len(c.filtered) == 0 && c.err == nil {
+		n, err := c.Conn.Read(c.buf)
+		c.partial = append(c.partial, c.buf[:n]...)
+		for {
+			end := bytes.IndexByte(c.partial, '\n')
+			if end < 0 {
+				break
+			}
+			line := c.partial[:end+1]
+			if !c.overlong && c.filter.allow(string(line)) {
+				c.filtered = append(c.filtered, line...)
+			}
+			c.overlong = false
+			c.partial = c.partial[end+1:]
+		}
+		if len(c.partial) > ctcpMaxLineBytes {
+			if !c.overlong {
+				logging.Warn("Connection %s: dropping line of more than %d bytes received",
+					c.filter.name, ctcpMaxLineBytes)
+			}
+			c.overlong = true
+			c.partial = c.partial[:0]
+		}
+		c.err = err
+	}
+	if len(c.filtered) == 0 {
+		err := c.err
+		c.err = nil
+		return 0, err
+	}
+	n := copy(p, c.filtered)
+	c.filtered = c.filtered[n:]
+	return n, nil
+}
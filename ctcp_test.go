@@ -0,0 +1,142 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func makeTestCTCPFilter(replies []string, limit CTCPRateLimit) (*ctcpFilter, *time.Time) {
+	config := &Config{
+		ConnectionName: "ctcp",
+		CTCPReplies:    replies,
+		CTCPRateLimit:  limit,
+	}
+	filter := newCTCPFilter(config, NewMetrics(prometheus.NewRegistry()))
+	now := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	filter.now = func() time.Time { return now }
+	return filter, &now
+}
+
+func ctcpCount(filter *ctcpFilter, result string) float64 {
+	return testutil.ToFloat64(filter.metrics.ircCTCPRequests.WithLabelValues("ctcp", result))
+}
+
+func TestCTCPFilterAllow(t *testing.T) {
+	filter, _ := makeTestCTCPFilter([]string{"version", "TIME"}, CTCPRateLimit{})
+
+	for _, tc := range []struct {
+		line     string
+		expected bool
+	}{
+		{":bar!b@h PRIVMSG foo :\001VERSION\001\r\n", true},
+		{":bar!b@h PRIVMSG foo :\001TIME\001\r\n", true},
+		{":bar!b@h PRIVMSG foo :\001PING 123\001\r\n", false},
+		{":bar!b@h PRIVMSG foo :\001DCC SEND file 3232235777 4000 10\001\r\n", false},
+		{":bar!b@h PRIVMSG foo :hello\r\n", true},
+		{":server 001 foo :Welcome\r\n", true},
+	} {
+		if allowed := filter.allow(tc.line); allowed != tc.expected {
+			t.Errorf("Expected %q allowed=%t, got %t", tc.line, tc.expected, allowed)
+		}
+	}
+
+	if v := ctcpCount(filter, ctcpResultAnswered); v != 2 {
+		t.Errorf("Expected 2 answered CTCP requests, got %f", v)
+	}
+	if v := ctcpCount(filter, ctcpResultIgnored); v != 2 {
+		t.Errorf("Expected 2 ignored CTCP requests, got %f", v)
+	}
+}
+
+func TestCTCPFilterRateLimit(t *testing.T) {
+	filter, now := makeTestCTCPFilter([]string{"VERSION"},
+		CTCPRateLimit{Burst: 2, Interval: 10 * time.Second})
+	line := ":bar!b@h PRIVMSG foo :\001VERSION\001\r\n"
+
+	for i, expected := range []bool{true, true, false} {
+		if allowed := filter.allow(line); allowed != expected {
+			t.Errorf("Request %d: expected allowed=%t, got %t", i, expected, allowed)
+		}
+	}
+
+	*now = now.Add(10 * time.Second)
+	for i, expected := range []bool{true, false} {
+		if allowed := filter.allow(line); allowed != expected {
+			t.Errorf("Request %d after interval: expected allowed=%t, got %t", i, expected, allowed)
+		}
+	}
+
+	if v := ctcpCount(filter, ctcpResultAnswered); v != 3 {
+		t.Errorf("Expected 3 answered CTCP requests, got %f", v)
+	}
+	if v := ctcpCount(filter, ctcpResultRateLimited); v != 2 {
+		t.Errorf("Expected 2 rate limited CTCP requests, got %f", v)
+	}
+}
+
+func TestCTCPFilterConn(t *testing.T) {
+	filter, _ := makeTestCTCPFilter([]string{"VERSION"}, CTCPRateLimit{})
+	server, client := net.Pipe()
+	conn := filter.wrap(client)
+
+	go func() {
+		// Lines may be split across reads.
+		server.Write([]byte(":server 001 foo :Welcome\r\n:bar!b@h PRIVMSG foo :\001DC"))
+		server.Write([]byte("C SEND file 3232235777 4000 10\001\r\n:bar!b@h PRIVMSG"))
+		server.Write([]byte(" foo :\001VERSION\001\r\n"))
+		server.Close()
+	}()
+
+	received, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Unexpected error reading: %s", err)
+	}
+	expected := ":server 001 foo :Welcome\r\n:bar!b@h PRIVMSG foo :\001VERSION\001\r\n"
+	if string(received) != expected {
+		t.Errorf("Expected to read %q, got %q", expected, string(received))
+	}
+}
+
+func TestCTCPFilterConnOverlongLine(t *testing.T) {
+	filter, _ := makeTestCTCPFilter([]string{"VERSION"}, CTCPRateLimit{})
+	server, client := net.Pipe()
+	conn := filter.wrap(client)
+
+	go func() {
+		server.Write([]byte(":server 001 foo :Welcome\r\n:bar!b@h PRIVMSG foo :"))
+		for i := 0; i < 4; i++ {
+			server.Write(bytes.Repeat([]byte("x"), ctcpMaxLineBytes/2))
+		}
+		server.Write([]byte("\r\n:server PING :1\r\n"))
+		server.Close()
+	}()
+
+	received, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatalf("Unexpected error reading: %s", err)
+	}
+	expected := ":server 001 foo :Welcome\r\n:server PING :1\r\n"
+	if string(received) != expected {
+		t.Errorf("Expected to read %q, got %q", expected, string(received))
+	}
+}
@@ -14,6 +14,76 @@
 
 package main
 
+import (
+	"fmt"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+// WebhookMessage is the payload of Alertmanager webhooks, and what templates
+// render alert groups with. Fields left out by older Alertmanager versions,
+// such as the receiver, are empty. AllLabels and AllAnnotations are the
+// common labels and annotations before label_allowlist or label_denylist
+// applied.
+type WebhookMessage struct {
+	promtmpl.Data
+	GroupKey string `json:"groupKey"`
+
+	AllLabels      promtmpl.KV `json:"-"`
+	AllAnnotations promtmpl.KV `json:"-"`
+
+	// sequence numbers the webhook, if webhooks are sequenced.
+	sequence uint64
+}
+
+// AlertData is what templates render single alerts with: the alert, and the
+// receiver and group key of the webhook it came with. Raw alerts sent when
+// templates fail are only the alert. AllLabels and AllAnnotations are those
+// of the alert before label_allowlist or label_denylist applied.
+type AlertData struct {
+	promtmpl.Alert
+	Receiver string `json:"-"`
+	GroupKey string `json:"-"`
+
+	AllLabels      promtmpl.KV `json:"-"`
+	AllAnnotations promtmpl.KV `json:"-"`
+
+	// FiringDuration is how long the alert has been firing, or was
+	// firing if resolved.
+	FiringDuration time.Duration `json:"-"`
+}
+
 type AlertMsg struct {
 	Channel, Alert string
+
+	// CorrelationID identifies the webhook delivery the message comes
+	// from, in logs and optionally in the message.
+	CorrelationID string
+
+	// Span measures the time spent queued, nil unless tracing.
+	Span *Span
+
+	// Part is the line number of the message among the Parts lines
+	// rendered for the same alert or alert group, if more than one.
+	Part, Parts int
+
+	// pendingID identifies the message in PendingMessages, if tracked.
+	pendingID uint64
+	// flushID identifies the message in FlushTracker, once handed to
+	// goirc.
+	flushID uint64
+	// sequence numbers the webhook the message comes from, if webhooks
+	// are sequenced, see WebhookSequencer.
+	sequence uint64
+	// keptSince is when the IRC notifier first kept the message for a
+	// later session, if kept messages expire.
+	keptSince time.Time
+	// unbatched lines are sent on their own, rather than collected to be
+	// sent in a multiline batch.
+	unbatched bool
+}
+
+func (a AlertMsg) String() string {
+	return fmt.Sprintf("{%s %s}", a.Channel, a.Alert)
 }
@@ -0,0 +1,124 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// WebhookDeduplicator detects webhooks delivered again, as Alertmanager does
+// when it did not get our response in time, so that they are acknowledged
+// without being relayed twice. Deliveries are identical when their payload
+// is, byte for byte, and they are sent to the same channel within ttl.
+type WebhookDeduplicator struct {
+	ttl        time.Duration
+	timeTeller TimeTeller
+	metrics    *Metrics
+
+	mu         sync.Mutex
+	delivered  map[[sha256.Size]byte]time.Time
+	lastPruned time.Time
+}
+
+func NewWebhookDeduplicator(ttl time.Duration, timeTeller TimeTeller, metrics *Metrics) *WebhookDeduplicator {
+	return &WebhookDeduplicator{
+		ttl:        ttl,
+		timeTeller: timeTeller,
+		metrics:    metrics,
+		delivered:  make(map[[sha256.Size]byte]time.Time),
+	}
+}
+
+// Duplicate records the delivery of the payload to the channel, and tells
+// whether it was already delivered.
+func (d *WebhookDeduplicator) Duplicate(ircChannel string, body []byte) bool {
+	if d.ttl <= 0 {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	key := sha256.Sum256(append([]byte(ircChannel+"\x00"), body...))
+	now := d.timeTeller.Now()
+	d.unsafePrune(now)
+
+	if delivered, ok := d.delivered[key]; ok && now.Sub(delivered) < d.ttl {
+		d.metrics.webhookDuplicateDeliveries.WithLabelValues(ircChannel).Inc()
+		return true
+	}
+	d.delivered[key] = now
+	return false
+}
+
+// Forget forgets the delivery of the payload to the channel, so that it is
+// relayed again if delivered again.
+func (d *WebhookDeduplicator) Forget(ircChannel string, body []byte) {
+	if d.ttl <= 0 {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	delete(d.delivered, sha256.Sum256(append([]byte(ircChannel+"\x00"), body...)))
+}
+
+func (d *WebhookDeduplicator) unsafePrune(now time.Time) {
+	if now.Sub(d.lastPruned) < d.ttl {
+		return
+	}
+	for key, delivered := range d.delivered {
+		if now.Sub(delivered) >= d.ttl {
+			delete(d.delivered, key)
+		}
+	}
+	d.lastPruned = now
+}
+
+// ExportState returns the deliveries remembered.
+func (d *WebhookDeduplicator) ExportState() []DeliveryState {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deliveries := []DeliveryState{}
+	for key, delivered := range d.delivered {
+		deliveries = append(deliveries, DeliveryState{
+			Key:       hex.EncodeToString(key[:]),
+			Delivered: delivered,
+		})
+	}
+	return deliveries
+}
+
+// ImportState remembers the deliveries, in addition to the ones already
+// remembered.
+func (d *WebhookDeduplicator) ImportState(deliveries []DeliveryState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, delivery := range deliveries {
+		var key [sha256.Size]byte
+		decoded, err := hex.DecodeString(delivery.Key)
+		if err != nil || len(decoded) != len(key) {
+			continue
+		}
+		copy(key[:], decoded)
+		d.delivered[key] = delivery.Delivered
+	}
+}
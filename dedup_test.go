@@ -0,0 +1,80 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func makeTestDeduplicator(elapsedTime []int) *WebhookDeduplicator {
+	fakeTime := &FakeTime{
+		timeseries:   elapsedTime,
+		durationUnit: time.Second,
+	}
+	return NewWebhookDeduplicator(time.Minute, fakeTime, NewMetrics(prometheus.NewRegistry()))
+}
+
+func TestDeduplicatorDetectsRedeliveries(t *testing.T) {
+	deduplicator := makeTestDeduplicator([]int{0, 10, 30, 65, 70})
+	body := []byte(`{"status":"firing"}`)
+
+	expected := []bool{false, true, true, false, true}
+	for i, duplicate := range expected {
+		if deduplicator.Duplicate("#foo", body) != duplicate {
+			t.Errorf("Call #%d: expected Duplicate to return %t", i, duplicate)
+		}
+	}
+	if v := testutil.ToFloat64(deduplicator.metrics.webhookDuplicateDeliveries.WithLabelValues("#foo")); v != 3 {
+		t.Errorf("Expected 3 duplicate deliveries, got %f", v)
+	}
+}
+
+func TestDeduplicatorPerChannelAndPayload(t *testing.T) {
+	deduplicator := makeTestDeduplicator([]int{0, 0, 0, 0})
+
+	if deduplicator.Duplicate("#foo", []byte("a")) ||
+		deduplicator.Duplicate("#bar", []byte("a")) ||
+		deduplicator.Duplicate("#foo", []byte("b")) {
+		t.Errorf("Deliveries to other channels or with other payloads detected as duplicates")
+	}
+	if !deduplicator.Duplicate("#foo", []byte("a")) {
+		t.Errorf("Duplicate not detected")
+	}
+}
+
+func TestDeduplicatorForget(t *testing.T) {
+	deduplicator := makeTestDeduplicator([]int{0, 10, 20})
+
+	deduplicator.Duplicate("#foo", []byte("a"))
+	deduplicator.Forget("#foo", []byte("a"))
+	if deduplicator.Duplicate("#foo", []byte("a")) {
+		t.Errorf("Delivery forgotten detected as duplicate")
+	}
+	if !deduplicator.Duplicate("#foo", []byte("a")) {
+		t.Errorf("Duplicate not detected")
+	}
+}
+
+func TestDeduplicatorDisabled(t *testing.T) {
+	deduplicator := NewWebhookDeduplicator(0, &FakeTime{}, NewMetrics(prometheus.NewRegistry()))
+
+	if deduplicator.Duplicate("#foo", []byte("a")) || deduplicator.Duplicate("#foo", []byte("a")) {
+		t.Errorf("Duplicate detected while disabled")
+	}
+}
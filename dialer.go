@@ -0,0 +1,244 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+	"golang.org/x/net/proxy"
+)
+
+// goirc does not let us configure the dialer of its connections, but hands
+// it to the dialer of the proxy set in its config. A pseudo proxy scheme is
+// registered to replace it by the ircDialer the URL names, see
+// ircDialer.register.
+const ircDialerScheme = "air-dialer"
+
+// ircConnectAddressTimeout bounds each connection attempt to one of the
+// addresses of the server, so that the other ones get a chance.
+const ircConnectAddressTimeout = 5 * time.Second
+
+// ircDialers are the dialers registered, by the host of their URL. The
+// registry of x/net/proxy is not safe for concurrent use, so the scheme is
+// only registered once.
+var (
+	ircDialers    = make(map[string]*ircDialer)
+	ircDialersMu  sync.Mutex
+	lastIRCDialer uint64
+)
+
+func init() {
+	proxy.RegisterDialerType(ircDialerScheme, forwardIRCDialer)
+}
+
+// ircDialer sets up the connections of a notifier to the server beyond what
+// goirc can.
+type ircDialer struct {
+	keepAlive TCPKeepAlive
+	// tlsConfig enables TLS. It is handled here rather than by goirc, so
+	// that ctcpFilter sees the lines received.
+	tlsConfig  *tls.Config
+	ctcpFilter *ctcpFilter
+	// writeTimeout, if set, is the deadline of each write, see
+	// deadlineConn, which reports what is written to flushes and calls
+	// writeTimedOut when a write times out.
+	writeTimeout  time.Duration
+	flushes       *FlushTracker
+	writeTimedOut func()
+}
+
+func newIRCDialer(config *Config, tlsConfig *tls.Config, ctcpFilter *ctcpFilter) *ircDialer {
+	return &ircDialer{
+		keepAlive:    config.IRCTCPKeepAlive,
+		tlsConfig:    tlsConfig,
+		ctcpFilter:   ctcpFilter,
+		writeTimeout: config.IRCWriteTimeout,
+	}
+}
+
+// register makes the dialer available to goirc, and returns the proxy URL to
+// set in its config for goirc to use it.
+func (d *ircDialer) register() string {
+	ircDialersMu.Lock()
+	defer ircDialersMu.Unlock()
+	lastIRCDialer++
+	id := strconv.FormatUint(lastIRCDialer, 10)
+	ircDialers[id] = d
+	return (&url.URL{Scheme: ircDialerScheme, Host: id}).String()
+}
+
+// forwardIRCDialer returns the addressDialer of the ircDialer named by the
+// URL, based on the dialer of goirc.
+func forwardIRCDialer(u *url.URL, forward proxy.Dialer) (proxy.Dialer, error) {
+	forwardDialer, ok := forward.(*net.Dialer)
+	if !ok {
+		return nil, fmt.Errorf("cannot wrap a %T", forward)
+	}
+	ircDialersMu.Lock()
+	settings, ok := ircDialers[u.Host]
+	ircDialersMu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("no IRC dialer %s registered", u.Host)
+	}
+
+	// Leave the dialer of goirc untouched.
+	dialer := *forwardDialer
+	settings.keepAlive.apply(&dialer)
+	return &addressDialer{
+		dialer:         &dialer,
+		addressTimeout: ircConnectAddressTimeout,
+		lookup:         net.DefaultResolver.LookupIPAddr,
+		settings:       settings,
+	}, nil
+}
+
+// apply sets up the connection once established: the TLS handshake, which
+// is given up on after timeout if set, or when ctx is done, the CTCP filter
+// and the write deadlines.
+func (d *ircDialer) apply(ctx context.Context, conn net.Conn, timeout time.Duration) (net.Conn, error) {
+	if d.tlsConfig != nil {
+		logging.Info("Performing TLS handshake with %s", conn.RemoteAddr())
+		if timeout > 0 {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, timeout)
+			defer cancel()
+		}
+		tlsConn := tls.Client(conn, d.tlsConfig)
+		if err := tlsHandshake(ctx, tlsConn); err != nil {
+			conn.Close()
+			return nil, err
+		}
+		conn = tlsConn
+	}
+	if d.ctcpFilter != nil {
+		conn = d.ctcpFilter.wrap(conn)
+	}
+	if d.writeTimeout > 0 || d.flushes != nil {
+		conn = &deadlineConn{
+			Conn:     conn,
+			timeout:  d.writeTimeout,
+			flushes:  d.flushes,
+			timedOut: d.writeTimedOut,
+		}
+	}
+	return conn, nil
+}
+
+// preferredAddresses remembers, by server, the last address which could be
+// connected to. It is tried first on the next connection.
+var (
+	preferredAddresses   = make(map[string]string)
+	preferredAddressesMu sync.Mutex
+)
+
+// addressDialer tries in turn all the addresses the server resolves to,
+// alternating IPv6 and IPv4 ones, before failing.
+type addressDialer struct {
+	dialer         *net.Dialer
+	addressTimeout time.Duration
+	lookup         func(context.Context, string) ([]net.IPAddr, error)
+	// settings, if set, sets up the connections once established.
+	settings *ircDialer
+}
+
+// orderAddresses returns the addresses in the order they should be tried:
+// preferred first, then alternating between the family of the first address
+// returned by the resolver and the other one.
+func orderAddresses(addrs []net.IPAddr, preferred string) []net.IPAddr {
+	ordered := []net.IPAddr{}
+	var primary, secondary []net.IPAddr
+	for _, addr := range addrs {
+		if addr.String() == preferred {
+			ordered = append(ordered, addr)
+		} else if len(primary) == 0 || (addr.IP.To4() == nil) == (primary[0].IP.To4() == nil) {
+			primary = append(primary, addr)
+		} else {
+			secondary = append(secondary, addr)
+		}
+	}
+	for i := 0; i < len(primary) || i < len(secondary); i++ {
+		if i < len(primary) {
+			ordered = append(ordered, primary[i])
+		}
+		if i < len(secondary) {
+			ordered = append(ordered, secondary[i])
+		}
+	}
+	return ordered
+}
+
+func (d *addressDialer) Dial(network, address string) (net.Conn, error) {
+	return d.DialContext(context.Background(), network, address)
+}
+
+func (d *addressDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	conn, err := d.dialAddresses(ctx, network, address)
+	if err != nil {
+		return nil, err
+	}
+	if d.settings != nil {
+		return d.settings.apply(ctx, conn, d.dialer.Timeout)
+	}
+	return conn, nil
+}
+
+func (d *addressDialer) dialAddresses(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := d.lookup(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+
+	preferredAddressesMu.Lock()
+	preferred := preferredAddresses[address]
+	preferredAddressesMu.Unlock()
+
+	errs := []string{}
+	for _, addr := range orderAddresses(addrs, preferred) {
+		target := net.JoinHostPort(addr.String(), port)
+		attemptCtx, cancel := context.WithTimeout(ctx, d.addressTimeout)
+		conn, err := d.dialer.DialContext(attemptCtx, network, target)
+		cancel()
+		if err == nil {
+			logging.Info("Connected to %s at %s", address, target)
+			preferredAddressesMu.Lock()
+			preferredAddresses[address] = addr.String()
+			preferredAddressesMu.Unlock()
+			return conn, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		logging.Warn("Could not connect to %s at %s: %s", address, target, err)
+		errs = append(errs, err.Error())
+	}
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("no address found for %s", host)
+	}
+	return nil, errors.New(strings.Join(errs, "; "))
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func makeIPAddrs(ips ...string) []net.IPAddr {
+	addrs := []net.IPAddr{}
+	for _, ip := range ips {
+		addrs = append(addrs, net.IPAddr{IP: net.ParseIP(ip)})
+	}
+	return addrs
+}
+
+func TestOrderAddresses(t *testing.T) {
+	addrs := makeIPAddrs("2001:db8::1", "2001:db8::2", "192.0.2.1", "192.0.2.2", "192.0.2.3")
+
+	for _, tc := range []struct {
+		preferred string
+		expected  []net.IPAddr
+	}{
+		{"", makeIPAddrs("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3")},
+		{"192.0.2.2", makeIPAddrs("192.0.2.2", "2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.3")},
+		{"192.0.2.9", makeIPAddrs("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "192.0.2.3")},
+	} {
+		ordered := orderAddresses(addrs, tc.preferred)
+		if !reflect.DeepEqual(tc.expected, ordered) {
+			t.Errorf("Unexpected order with preferred address '%s'.\nExpected: %s\nActual: %s",
+				tc.preferred, tc.expected, ordered)
+		}
+	}
+}
+
+func TestDialTriesAllAddresses(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer listener.Close()
+	port := strconv.Itoa(listener.Addr().(*net.TCPAddr).Port)
+
+	// The first address, from the TEST-NET-1 range, is unreachable.
+	dialer := &addressDialer{
+		dialer:         &net.Dialer{},
+		addressTimeout: 100 * time.Millisecond,
+		lookup: func(context.Context, string) ([]net.IPAddr, error) {
+			return makeIPAddrs("192.0.2.1", "127.0.0.1"), nil
+		},
+	}
+	address := net.JoinHostPort("irc.example.com", port)
+
+	conn, err := dialer.Dial("tcp", address)
+	if err != nil {
+		t.Fatalf("Could not connect to the second address: %s", err)
+	}
+	conn.Close()
+
+	preferredAddressesMu.Lock()
+	preferred := preferredAddresses[address]
+	preferredAddressesMu.Unlock()
+	if preferred != "127.0.0.1" {
+		t.Errorf("Expected address which worked to be preferred, got '%s'", preferred)
+	}
+
+	listener.Close()
+	if _, err := dialer.Dial("tcp", address); err == nil {
+		t.Errorf("Expected connection to fail when no address is reachable")
+	}
+}
+
+func TestDialTLSHandshakeTimeout(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer listener.Close()
+	go func() {
+		// Accept the connection, but never answer the handshake.
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(5 * time.Second)
+		}
+	}()
+
+	dialer := &addressDialer{
+		dialer:         &net.Dialer{Timeout: 100 * time.Millisecond},
+		addressTimeout: time.Second,
+		lookup:         net.DefaultResolver.LookupIPAddr,
+		settings:       newIRCDialer(&Config{}, &tls.Config{ServerName: "irc.example.com"}, nil),
+	}
+	start := time.Now()
+	if _, err := dialer.Dial("tcp", listener.Addr().String()); err == nil {
+		t.Fatalf("Expected the stalled handshake to fail")
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("Expected the handshake to be given up on after 100ms, took %s", elapsed)
+	}
+}
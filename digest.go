@@ -0,0 +1,216 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+// A digest lists at most this many alerts, and how many more there are.
+const digestMaxAlerts = 20
+
+type digestEntry struct {
+	name    string
+	summary string
+	status  string
+}
+
+// alertSummary keeps the alerts of a channel, in the order they first
+// arrived, with their last status.
+type alertSummary struct {
+	entries map[string]*digestEntry
+	order   []string
+}
+
+func newAlertSummary() alertSummary {
+	return alertSummary{entries: make(map[string]*digestEntry)}
+}
+
+func (s *alertSummary) add(ircChannel string, alerts promtmpl.Alerts) {
+	for i := range alerts {
+		alert := &alerts[i]
+		key := alertKey(ircChannel, alert)
+		entry, ok := s.entries[key]
+		if !ok {
+			entry = &digestEntry{}
+			s.entries[key] = entry
+			s.order = append(s.order, key)
+		}
+		entry.name = alertName(alert)
+		entry.summary = alert.Annotations["summary"]
+		entry.status = alert.Status
+	}
+}
+
+// counts returns how many of the alerts are firing and resolved.
+func (s *alertSummary) counts() (int, int) {
+	counts := make(map[string]int)
+	for _, entry := range s.entries {
+		counts[entry.status]++
+	}
+	return counts["firing"], counts["resolved"]
+}
+
+// lines returns one line per alert with its last status, name and summary
+// annotation, up to digestMaxAlerts.
+func (s *alertSummary) lines() []string {
+	lines := []string{}
+	for i, key := range s.order {
+		if i == digestMaxAlerts {
+			lines = append(lines, fmt.Sprintf("... and %d more", len(s.order)-i))
+			break
+		}
+		entry := s.entries[key]
+		line := fmt.Sprintf("%s: %s", entry.status, entry.name)
+		if entry.summary != "" {
+			line += " - " + entry.summary
+		}
+		lines = append(lines, stripControlCharacters(line))
+	}
+	return lines
+}
+
+type channelDigest struct {
+	interval time.Duration
+	since    time.Time
+	// alerts are those received since the digest was last sent.
+	alerts alertSummary
+}
+
+// Digester accumulates the alerts of the channels in digest mode, and sends
+// them a summary every digest_interval instead of relaying alerts as they
+// arrive. A nil *Digester has no channel in digest mode.
+type Digester struct {
+	alertMsgs  chan AlertMsg
+	timeTeller TimeTeller
+	metrics    *Metrics
+
+	mu       sync.Mutex
+	channels map[string]*channelDigest
+}
+
+func NewDigester(config *Config, alertMsgs chan AlertMsg, timeTeller TimeTeller, metrics *Metrics) *Digester {
+	channels := make(map[string]*channelDigest)
+	for _, connection := range config.ConnectionConfigs() {
+		for _, channel := range connection.IRCChannels {
+			if channel.DigestInterval > 0 {
+				channels[channel.Name] = &channelDigest{
+					interval: channel.DigestInterval,
+					since:    timeTeller.Now(),
+					alerts:   newAlertSummary(),
+				}
+			}
+		}
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+	return &Digester{
+		alertMsgs:  alertMsgs,
+		timeTeller: timeTeller,
+		metrics:    metrics,
+		channels:   channels,
+	}
+}
+
+// Add keeps the alerts for the next digest of the channel, and tells whether
+// the channel is in digest mode, in which case they are not to be relayed.
+func (d *Digester) Add(ircChannel string, alerts promtmpl.Alerts) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	digest, ok := d.channels[ircChannel]
+	if !ok {
+		return false
+	}
+	digest.alerts.add(ircChannel, alerts)
+	d.metrics.digestedAlerts.WithLabelValues(ircChannel).Add(float64(len(alerts)))
+	return true
+}
+
+// unsafeFlush returns the lines of the digest of the channel, and starts the
+// next one.
+func (d *Digester) unsafeFlush(ircChannel string, digest *channelDigest) []string {
+	now := d.timeTeller.Now()
+	period := now.Sub(digest.since).Round(time.Second)
+	digest.since = now
+
+	if len(digest.alerts.order) == 0 {
+		return []string{fmt.Sprintf("Digest of the last %s: no alerts", period)}
+	}
+	firing, resolved := digest.alerts.counts()
+	lines := []string{fmt.Sprintf("Digest of the last %s: %d firing, %d resolved",
+		period, firing, resolved)}
+	lines = append(lines, digest.alerts.lines()...)
+	digest.alerts = newAlertSummary()
+	return lines
+}
+
+// Flush sends the digest of the channel.
+func (d *Digester) Flush(ircChannel string) {
+	d.mu.Lock()
+	lines := d.unsafeFlush(ircChannel, d.channels[ircChannel])
+	d.mu.Unlock()
+
+	logging.Info("Sending digest of %d lines to %s", len(lines), ircChannel)
+	for _, line := range lines {
+		select {
+		case d.alertMsgs <- AlertMsg{Channel: ircChannel, Alert: line}:
+		default:
+			logging.Error("Could not send digest to the IRC routine: %s", line)
+			d.metrics.alertHandlingErrors.WithLabelValues(ircChannel, "internal_comm_channel_full").Inc()
+		}
+	}
+}
+
+func (d *Digester) runChannel(ctx context.Context, ircChannel string, interval time.Duration) {
+	for {
+		select {
+		case <-d.timeTeller.After(interval):
+			d.Flush(ircChannel)
+		case <-ctx.Done():
+			// Alerts received since the last digest are not lost
+			// silently, though they may not make it to IRC.
+			d.Flush(ircChannel)
+			return
+		}
+	}
+}
+
+// Run sends the digests of the channels every interval, and once more when
+// ctx is canceled.
+func (d *Digester) Run(ctx context.Context, stopWg *sync.WaitGroup) {
+	defer stopWg.Done()
+
+	var wg sync.WaitGroup
+	for ircChannel, digest := range d.channels {
+		wg.Add(1)
+		go func(ircChannel string, interval time.Duration) {
+			defer wg.Done()
+			d.runChannel(ctx, ircChannel, interval)
+		}(ircChannel, digest.interval)
+	}
+	wg.Wait()
+}
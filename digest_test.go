@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func makeTestDigester(elapsedTime []int) (*Digester, chan AlertMsg, *FakeTime, *Metrics) {
+	config := &Config{
+		IRCChannels: []IRCChannel{
+			IRCChannel{Name: "#info", DigestInterval: 30 * time.Minute},
+			IRCChannel{Name: "#ops"},
+		},
+	}
+	fakeTime := &FakeTime{
+		timeseries:   elapsedTime,
+		durationUnit: time.Minute,
+		afterChan:    make(chan time.Time, 1),
+	}
+	alertMsgs := make(chan AlertMsg, 10)
+	metrics := NewMetrics(prometheus.NewRegistry())
+	return NewDigester(config, alertMsgs, fakeTime, metrics), alertMsgs, fakeTime, metrics
+}
+
+func digestTestAlert(fingerprint string, name string, status string, summary string) promtmpl.Alert {
+	return promtmpl.Alert{
+		Status:      status,
+		Fingerprint: fingerprint,
+		Labels:      promtmpl.KV{"alertname": name},
+		Annotations: promtmpl.KV{"summary": summary},
+	}
+}
+
+func receiveDigest(alertMsgs chan AlertMsg, lines int) []AlertMsg {
+	digest := []AlertMsg{}
+	for i := 0; i < lines; i++ {
+		digest = append(digest, <-alertMsgs)
+	}
+	return digest
+}
+
+func TestDigest(t *testing.T) {
+	digester, alertMsgs, fakeTime, metrics := makeTestDigester([]int{0, 30, 60})
+
+	if digester.Add("#ops", promtmpl.Alerts{digestTestAlert("a", "airDown", "firing", "")}) {
+		t.Error("Alert to a channel not in digest mode kept for a digest")
+	}
+	if !digester.Add("#info", promtmpl.Alerts{
+		digestTestAlert("a", "airDown", "firing", "Not enough air"),
+		digestTestAlert("b", "diskFull", "firing", "Disk \x07full"),
+	}) {
+		t.Error("Alert to a channel in digest mode not kept for a digest")
+	}
+	digester.Add("#info", promtmpl.Alerts{digestTestAlert("a", "airDown", "resolved", "Not enough air")})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopWg := sync.WaitGroup{}
+	stopWg.Add(1)
+	go digester.Run(ctx, &stopWg)
+
+	fakeTime.afterChan <- time.Now()
+	expectedDigest := []AlertMsg{
+		AlertMsg{Channel: "#info", Alert: "Digest of the last 30m0s: 1 firing, 1 resolved"},
+		AlertMsg{Channel: "#info", Alert: "resolved: airDown - Not enough air"},
+		AlertMsg{Channel: "#info", Alert: "firing: diskFull - Disk full"},
+	}
+	if digest := receiveDigest(alertMsgs, 3); !reflect.DeepEqual(expectedDigest, digest) {
+		t.Errorf("Unexpected digest.\nExpected: %s\nActual: %s", expectedDigest, digest)
+	}
+
+	// The last digest is sent on shutdown.
+	cancel()
+	stopWg.Wait()
+	expectedDigest = []AlertMsg{
+		AlertMsg{Channel: "#info", Alert: "Digest of the last 30m0s: no alerts"},
+	}
+	if digest := receiveDigest(alertMsgs, 1); !reflect.DeepEqual(expectedDigest, digest) {
+		t.Errorf("Unexpected digest.\nExpected: %s\nActual: %s", expectedDigest, digest)
+	}
+
+	if v := testutil.ToFloat64(metrics.digestedAlerts.WithLabelValues("#info")); v != 3 {
+		t.Errorf("Expected 3 digested alerts, got %f", v)
+	}
+}
+
+func TestNoDigest(t *testing.T) {
+	var digester *Digester
+	if digester.Add("#ops", promtmpl.Alerts{digestTestAlert("a", "airDown", "firing", "")}) {
+		t.Error("Alert kept for a digest without channels in digest mode")
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	defaultEscalationAfter = 10 * time.Minute
+
+	// At most that many messages are kept to be replayed in a channel
+	// once it is joined again, the oldest being dropped first.
+	escalationBacklogMax = 100
+)
+
+type channelEscalation struct {
+	target string
+	after  time.Duration
+	replay bool
+
+	// since is when delivering to the channel first failed, zero while
+	// it is delivered to.
+	since      time.Time
+	escalating bool
+	// backlog are the messages which could not be delivered to the
+	// channel since, if they are to be replayed.
+	backlog []AlertMsg
+}
+
+// Escalations relays the messages to channels which could not be delivered
+// to for a while to their escalation channel instead, until they are joined
+// again. A nil *Escalations escalates nothing.
+type Escalations struct {
+	connection string
+	timeTeller TimeTeller
+	metrics    *Metrics
+
+	mu       sync.Mutex
+	channels map[string]*channelEscalation
+}
+
+func NewEscalations(config *Config, timeTeller TimeTeller, metrics *Metrics) *Escalations {
+	channels := make(map[string]*channelEscalation)
+	for _, channel := range config.IRCChannels {
+		if channel.EscalationChannel == "" {
+			continue
+		}
+		escalation := &channelEscalation{
+			target: normalizeChannel(channel.EscalationChannel),
+			after:  channel.EscalationAfter,
+			replay: channel.EscalationReplay,
+		}
+		if escalation.after == 0 {
+			escalation.after = defaultEscalationAfter
+		}
+		channels[channel.Name] = escalation
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+	return &Escalations{
+		connection: config.ConnectionName,
+		timeTeller: timeTeller,
+		metrics:    metrics,
+		channels:   channels,
+	}
+}
+
+// Escalating tells whether the messages to the channel are escalated.
+func (e *Escalations) Escalating(channel string) bool {
+	if e == nil {
+		return false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	escalation, ok := e.channels[channel]
+	return ok && escalation.escalating
+}
+
+// Undeliverable records that the message could not be delivered to its
+// channel, and returns the message to send to the escalation channel of the
+// channel instead, if it is undeliverable for long enough.
+func (e *Escalations) Undeliverable(alertMsg *AlertMsg) (AlertMsg, bool) {
+	if e == nil {
+		return AlertMsg{}, false
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	escalation, ok := e.channels[alertMsg.Channel]
+	if !ok {
+		return AlertMsg{}, false
+	}
+	now := e.timeTeller.Now()
+	if escalation.since.IsZero() {
+		escalation.since = now
+	}
+	if escalation.replay {
+		if len(escalation.backlog) == escalationBacklogMax {
+			logging.Warn("Connection %s: more than %d messages to replay in %s, dropping the oldest",
+				e.connection, escalationBacklogMax, alertMsg.Channel)
+			escalation.backlog = escalation.backlog[1:]
+		}
+		escalation.backlog = append(escalation.backlog, AlertMsg{
+			Channel:       alertMsg.Channel,
+			Alert:         alertMsg.Alert,
+			CorrelationID: alertMsg.CorrelationID,
+		})
+	}
+	if !escalation.escalating {
+		if now.Sub(escalation.since) < escalation.after {
+			return AlertMsg{}, false
+		}
+		logging.Warn("Connection %s: %s undeliverable for %s, escalating its alerts to %s",
+			e.connection, alertMsg.Channel, now.Sub(escalation.since).Round(time.Second), escalation.target)
+		escalation.escalating = true
+		e.metrics.ircChannelEscalated.WithLabelValues(e.connection, alertMsg.Channel).Set(1)
+	}
+	e.metrics.ircEscalatedMsgs.WithLabelValues(e.connection, alertMsg.Channel).Inc()
+	return AlertMsg{
+		Channel:       escalation.target,
+		Alert:         fmt.Sprintf("[%s] %s", alertMsg.Channel, alertMsg.Alert),
+		CorrelationID: alertMsg.CorrelationID,
+	}, true
+}
+
+// Recovered records that the channel was joined, and stops escalating its
+// messages. It returns the messages to replay there, if any.
+func (e *Escalations) Recovered(channel string) []AlertMsg {
+	if e == nil {
+		return nil
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	escalation, ok := e.channels[channel]
+	if !ok || escalation.since.IsZero() {
+		return nil
+	}
+	backlog := escalation.backlog
+	if escalation.escalating {
+		logging.Info("Connection %s: %s joined again, no longer escalating its alerts to %s, replaying %d messages",
+			e.connection, channel, escalation.target, len(backlog))
+		e.metrics.ircChannelEscalated.WithLabelValues(e.connection, channel).Set(0)
+	} else if len(backlog) > 0 {
+		logging.Info("Connection %s: %s joined again before escalating its alerts, replaying %d messages",
+			e.connection, channel, len(backlog))
+	}
+	escalation.since = time.Time{}
+	escalation.escalating = false
+	escalation.backlog = nil
+	return backlog
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestEscalations(t *testing.T) {
+	config := &Config{
+		ConnectionName: "main",
+		IRCChannels: []IRCChannel{
+			IRCChannel{Name: "#oncall", EscalationChannel: "backup", EscalationReplay: true},
+			IRCChannel{Name: "#ops"},
+		},
+	}
+	fakeTime := &FakeTime{
+		timeseries:   []int{0, 5, 10, 12},
+		durationUnit: time.Minute,
+	}
+	metrics := NewMetrics(prometheus.NewRegistry())
+	escalations := NewEscalations(config, fakeTime, metrics)
+
+	if _, ok := escalations.Undeliverable(&AlertMsg{Channel: "#ops", Alert: "lost"}); ok {
+		t.Errorf("Expected a channel without escalation channel not to be escalated")
+	}
+
+	// Messages are escalated once the channel is undeliverable for
+	// escalation_after.
+	for _, alert := range []string{"first", "second"} {
+		if escalated, ok := escalations.Undeliverable(&AlertMsg{Channel: "#oncall", Alert: alert}); ok {
+			t.Errorf("Unexpected escalation before escalation_after: %s", escalated)
+		}
+	}
+	if escalations.Escalating("#oncall") {
+		t.Errorf("Expected #oncall not to be escalated yet")
+	}
+	for _, alert := range []string{"third", "fourth"} {
+		escalated, ok := escalations.Undeliverable(&AlertMsg{Channel: "#oncall", Alert: alert, CorrelationID: "id"})
+		expected := AlertMsg{Channel: "#backup", Alert: "[#oncall] " + alert, CorrelationID: "id"}
+		if !ok || !reflect.DeepEqual(expected, escalated) {
+			t.Errorf("Expected escalated message %s, got %s", expected, escalated)
+		}
+	}
+	if !escalations.Escalating("#oncall") {
+		t.Errorf("Expected #oncall to be escalated")
+	}
+	if v := testutil.ToFloat64(metrics.ircChannelEscalated.WithLabelValues("main", "#oncall")); v != 1 {
+		t.Errorf("Expected #oncall to be reported escalated, got %f", v)
+	}
+	if v := testutil.ToFloat64(metrics.ircEscalatedMsgs.WithLabelValues("main", "#oncall")); v != 2 {
+		t.Errorf("Expected 2 escalated messages, got %f", v)
+	}
+
+	// Once joined again, the messages which could not be delivered are
+	// replayed.
+	backlog := escalations.Recovered("#oncall")
+	expectedBacklog := []AlertMsg{
+		{Channel: "#oncall", Alert: "first"},
+		{Channel: "#oncall", Alert: "second"},
+		{Channel: "#oncall", Alert: "third", CorrelationID: "id"},
+		{Channel: "#oncall", Alert: "fourth", CorrelationID: "id"},
+	}
+	if !reflect.DeepEqual(expectedBacklog, backlog) {
+		t.Errorf("Unexpected backlog.\nExpected: %s\nActual: %s", expectedBacklog, backlog)
+	}
+	if escalations.Escalating("#oncall") {
+		t.Errorf("Expected #oncall to no longer be escalated")
+	}
+	if v := testutil.ToFloat64(metrics.ircChannelEscalated.WithLabelValues("main", "#oncall")); v != 0 {
+		t.Errorf("Expected #oncall to be reported not escalated, got %f", v)
+	}
+	if backlog := escalations.Recovered("#oncall"); backlog != nil {
+		t.Errorf("Expected no backlog once recovered, got %s", backlog)
+	}
+}
+
+func TestNoEscalations(t *testing.T) {
+	escalations := NewEscalations(&Config{IRCChannels: []IRCChannel{IRCChannel{Name: "#ops"}}}, &FakeTime{}, nil)
+	if escalations != nil {
+		t.Fatalf("Expected no escalations without escalation channels")
+	}
+	if _, ok := escalations.Undeliverable(&AlertMsg{Channel: "#ops"}); ok || escalations.Escalating("#ops") {
+		t.Errorf("Expected nothing to be escalated")
+	}
+}
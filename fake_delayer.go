@@ -21,11 +21,15 @@ import (
 	"github.com/google/alertmanager-irc-relay/logging"
 )
 
-type FakeDelayerMaker struct{}
+// FakeDelayerMaker makes FakeDelayers, which wait for StopDelay if
+// DelayOnChan is set.
+type FakeDelayerMaker struct {
+	DelayOnChan bool
+}
 
 func (fdm *FakeDelayerMaker) NewDelayer(_ float64, _ float64, _ time.Duration) Delayer {
 	return &FakeDelayer{
-		DelayOnChan: false,
+		DelayOnChan: fdm.DelayOnChan,
 		StopDelay:   make(chan bool),
 	}
 }
@@ -43,8 +47,13 @@ func (f *FakeDelayer) DelayContext(ctx context.Context) bool {
 	logging.Info("Faking Backoff")
 	if f.DelayOnChan {
 		logging.Info("Waiting StopDelay signal")
-		<-f.StopDelay
-		logging.Info("Received StopDelay signal")
+		select {
+		case <-f.StopDelay:
+			logging.Info("Received StopDelay signal")
+		case <-ctx.Done():
+			logging.Info("Context canceled while waiting StopDelay signal")
+			return false
+		}
 	}
 	return true
 }
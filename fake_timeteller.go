@@ -15,18 +15,33 @@
 package main
 
 import (
+	"sync"
 	"time"
 )
 
+// FakeTime tells the times of timeseries in turn, in durationUnit since the
+// epoch, then the last one again. Without timeseries, it tells the epoch.
 type FakeTime struct {
 	timeseries   []int
 	lastIndex    int
 	durationUnit time.Duration
 	afterChan    chan time.Time
+
+	mu sync.Mutex
 }
 
 func (f *FakeTime) Now() time.Time {
-	timeDelta := time.Duration(f.timeseries[f.lastIndex]) * f.durationUnit
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if len(f.timeseries) == 0 {
+		return time.Unix(0, 0)
+	}
+	index := f.lastIndex
+	if index >= len(f.timeseries) {
+		index = len(f.timeseries) - 1
+	}
+	timeDelta := time.Duration(f.timeseries[index]) * f.durationUnit
 	fakeTime := time.Unix(0, 0).Add(timeDelta)
 	f.lastIndex++
 	return fakeTime
@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/common/model"
+)
+
+const (
+	// Tokens are the first hex digits of the fingerprint Alertmanager
+	// computes from the labels of alerts.
+	fingerprintTokenLength = 7
+
+	// At most that many tokens are remembered, each for that long after
+	// it was last rendered.
+	fingerprintTokensMax = 10000
+	fingerprintTokensTTL = 24 * time.Hour
+)
+
+type fingerprintEntry struct {
+	token       string
+	fingerprint string
+	labels      promtmpl.KV
+	seen        time.Time
+}
+
+// FingerprintTokens remembers the alerts behind the short fingerprint tokens
+// recently rendered in messages, so that they can be looked up later, e.g.
+// from /status. The least recently rendered tokens are forgotten first.
+type FingerprintTokens struct {
+	max        int
+	ttl        time.Duration
+	timeTeller TimeTeller
+
+	mu      sync.Mutex
+	entries map[string]*list.Element
+	// recent lists the entries, most recently rendered first.
+	recent *list.List
+}
+
+func NewFingerprintTokens(max int, ttl time.Duration, timeTeller TimeTeller) *FingerprintTokens {
+	return &FingerprintTokens{
+		max:        max,
+		ttl:        ttl,
+		timeTeller: timeTeller,
+		entries:    make(map[string]*list.Element),
+		recent:     list.New(),
+	}
+}
+
+// fingerprintToken returns the fingerprint of the labels and its token.
+func fingerprintToken(labels promtmpl.KV) (string, string) {
+	set := model.LabelSet{}
+	for name, value := range labels {
+		set[model.LabelName(name)] = model.LabelValue(value)
+	}
+	fingerprint := set.Fingerprint().String()
+	return fingerprint, fingerprint[:fingerprintTokenLength]
+}
+
+// Add remembers the labels and returns their token. Should another alert
+// have the same token, it is forgotten.
+func (t *FingerprintTokens) Add(labels promtmpl.KV) string {
+	fingerprint, token := fingerprintToken(labels)
+	if t == nil {
+		return token
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	now := t.timeTeller.Now()
+	if element, ok := t.entries[token]; ok {
+		entry := element.Value.(*fingerprintEntry)
+		if entry.fingerprint != fingerprint {
+			logging.Warn("Fingerprint token %s of %s now stands for %s instead of %s",
+				token, fingerprint, labels, entry.labels)
+			entry.fingerprint = fingerprint
+			entry.labels = labels
+		}
+		entry.seen = now
+		t.recent.MoveToFront(element)
+		return token
+	}
+	t.entries[token] = t.recent.PushFront(&fingerprintEntry{
+		token:       token,
+		fingerprint: fingerprint,
+		labels:      labels,
+		seen:        now,
+	})
+	for t.recent.Len() > t.max {
+		t.unsafeRemove(t.recent.Back())
+	}
+	return token
+}
+
+func (t *FingerprintTokens) unsafeRemove(element *list.Element) {
+	t.recent.Remove(element)
+	delete(t.entries, element.Value.(*fingerprintEntry).token)
+}
+
+// unsafePrune forgets the tokens not rendered for ttl.
+func (t *FingerprintTokens) unsafePrune(now time.Time) {
+	for element := t.recent.Back(); element != nil; element = t.recent.Back() {
+		if now.Sub(element.Value.(*fingerprintEntry).seen) < t.ttl {
+			return
+		}
+		t.unsafeRemove(element)
+	}
+}
+
+// Lookup returns the labels of the alert behind the token, if it was
+// rendered recently.
+func (t *FingerprintTokens) Lookup(token string) (promtmpl.KV, bool) {
+	if t == nil {
+		return nil, false
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.unsafePrune(t.timeTeller.Now())
+	element, ok := t.entries[token]
+	if !ok {
+		return nil, false
+	}
+	return element.Value.(*fingerprintEntry).labels, true
+}
+
+// Len returns the number of tokens remembered.
+func (t *FingerprintTokens) Len() int {
+	if t == nil {
+		return 0
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	t.unsafePrune(t.timeTeller.Now())
+	return t.recent.Len()
+}
+
+// fingerprintLabels returns the labels the Fingerprint template function
+// derives the token of value from: an alert, or its labels.
+func fingerprintLabels(value interface{}) (promtmpl.KV, error) {
+	switch v := value.(type) {
+	case *AlertData:
+		return v.AllLabels, nil
+	case promtmpl.Alert:
+		return v.Labels, nil
+	case promtmpl.KV:
+		return v, nil
+	case map[string]string:
+		return promtmpl.KV(v), nil
+	}
+	return nil, fmt.Errorf("cannot fingerprint %T, only alerts and labels", value)
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+var instance1Labels = promtmpl.KV{
+	"alertname": "airDown",
+	"instance":  "instance1:3456",
+	"job":       "air",
+	"service":   "prometheus",
+	"severity":  "ticket",
+	"zone":      "global",
+}
+
+func makeTestFingerprintTokens(max int, elapsedTime []int) *FingerprintTokens {
+	fakeTime := &FakeTime{
+		timeseries:   elapsedTime,
+		durationUnit: time.Hour,
+		afterChan:    make(chan time.Time, 1),
+	}
+	return NewFingerprintTokens(max, fingerprintTokensTTL, fakeTime)
+}
+
+func TestFingerprintToken(t *testing.T) {
+	// As computed by Alertmanager, see testdataSimpleAlertJson.
+	fingerprint, token := fingerprintToken(instance1Labels)
+	if fingerprint != "66214a361160fb6f" || token != "66214a3" {
+		t.Errorf("Unexpected fingerprint %s and token %s", fingerprint, token)
+	}
+}
+
+func TestFingerprintTokensLookup(t *testing.T) {
+	tokens := makeTestFingerprintTokens(10, []int{0, 1, 2})
+
+	token := tokens.Add(instance1Labels)
+	if labels, ok := tokens.Lookup(token); !ok || !reflect.DeepEqual(instance1Labels, labels) {
+		t.Errorf("Unexpected lookup of %s: %v, %t", token, labels, ok)
+	}
+	if _, ok := tokens.Lookup("0000000"); ok {
+		t.Error("Unknown token found")
+	}
+}
+
+func TestFingerprintTokensEviction(t *testing.T) {
+	tokens := makeTestFingerprintTokens(2, []int{0, 0, 0, 0, 0, 0, 0})
+
+	first := tokens.Add(promtmpl.KV{"alertname": "a"})
+	second := tokens.Add(promtmpl.KV{"alertname": "b"})
+	// Rendering the first alert again keeps it over the second one.
+	tokens.Add(promtmpl.KV{"alertname": "a"})
+	third := tokens.Add(promtmpl.KV{"alertname": "c"})
+
+	if _, ok := tokens.Lookup(second); ok {
+		t.Error("Least recently rendered token not forgotten")
+	}
+	for _, token := range []string{first, third} {
+		if _, ok := tokens.Lookup(token); !ok {
+			t.Errorf("Token %s forgotten", token)
+		}
+	}
+}
+
+func TestFingerprintTokensExpiry(t *testing.T) {
+	tokens := makeTestFingerprintTokens(10, []int{0, 12, 23, 25, 35})
+
+	old := tokens.Add(promtmpl.KV{"alertname": "a"})
+	recent := tokens.Add(promtmpl.KV{"alertname": "b"})
+	if tokens.Len() != 2 {
+		t.Errorf("Expected 2 tokens, got %d", tokens.Len())
+	}
+	if _, ok := tokens.Lookup(old); ok {
+		t.Error("Token not rendered for a day not forgotten")
+	}
+	if _, ok := tokens.Lookup(recent); !ok {
+		t.Error("Token rendered within a day forgotten")
+	}
+}
+
+func TestFingerprintTokensCollision(t *testing.T) {
+	tokens := makeTestFingerprintTokens(10, []int{0, 0, 0})
+
+	token := tokens.Add(promtmpl.KV{"alertname": "a"})
+	// Pretend another alert had the same token.
+	entry := tokens.entries[token].Value.(*fingerprintEntry)
+	entry.fingerprint = "0000000000000000"
+	entry.labels = promtmpl.KV{"alertname": "other"}
+
+	tokens.Add(promtmpl.KV{"alertname": "a"})
+	if labels, _ := tokens.Lookup(token); labels["alertname"] != "a" {
+		t.Errorf("Expected the most recent alert behind %s, got %v", token, labels)
+	}
+}
+
+func TestNoFingerprintTokens(t *testing.T) {
+	var tokens *FingerprintTokens
+	if token := tokens.Add(instance1Labels); token != "66214a3" {
+		t.Errorf("Unexpected token %s", token)
+	}
+	if _, ok := tokens.Lookup("66214a3"); ok || tokens.Len() != 0 {
+		t.Error("Token remembered without FingerprintTokens")
+	}
+}
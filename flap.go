@@ -0,0 +1,246 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+const (
+	flapSweepInterval = 15 * time.Second
+	// State of firing alerts which are neither flapping nor seen anymore
+	// (e.g. as resolved notifications are not sent) is eventually dropped.
+	flapStateExpiry = 24 * time.Hour
+)
+
+type flapState struct {
+	ircChannel string
+	name       string
+	status     string
+	// transitions holds the times of the status changes within the window.
+	transitions    []time.Time
+	lastTransition time.Time
+	lastSeen       time.Time
+	muted          bool
+}
+
+// FlapDetector mutes alerts changing status too often: once an alert went
+// through threshold status changes within window, a single note is sent to
+// the channel and further notifications are suppressed until the alert kept
+// the same status for stablePeriod. A nil *FlapDetector lets all alerts
+// through.
+type FlapDetector struct {
+	threshold    int
+	window       time.Duration
+	stablePeriod time.Duration
+	alertMsgs    chan AlertMsg
+	timeTeller   TimeTeller
+	metrics      *Metrics
+
+	mu     sync.Mutex
+	states map[string]*flapState
+}
+
+func NewFlapDetector(config *Config, alertMsgs chan AlertMsg, timeTeller TimeTeller, metrics *Metrics) *FlapDetector {
+	if config.FlapThreshold <= 0 {
+		return nil
+	}
+	return &FlapDetector{
+		threshold:    config.FlapThreshold,
+		window:       config.FlapWindow,
+		stablePeriod: config.FlapStablePeriod,
+		alertMsgs:    alertMsgs,
+		timeTeller:   timeTeller,
+		metrics:      metrics,
+		states:       make(map[string]*flapState),
+	}
+}
+
+func alertName(alert *promtmpl.Alert) string {
+	if name, ok := alert.Labels["alertname"]; ok {
+		return name
+	}
+	return alert.Fingerprint
+}
+
+func (d *FlapDetector) sendNote(ircChannel string, note string) {
+	select {
+	case d.alertMsgs <- AlertMsg{Channel: ircChannel, Alert: note}:
+	default:
+		logging.Error("Could not send flapping note to the IRC routine: %s", note)
+		d.metrics.alertHandlingErrors.WithLabelValues(ircChannel, "internal_comm_channel_full").Inc()
+	}
+}
+
+// unsafeAllow records the alert and tells whether it should be relayed.
+func (d *FlapDetector) unsafeAllow(ircChannel string, alert *promtmpl.Alert, now time.Time) bool {
+	key := alertKey(ircChannel, alert)
+	state, ok := d.states[key]
+	if !ok {
+		if alert.Status == "resolved" {
+			return true
+		}
+		// A new firing alert counts as a change from resolved.
+		state = &flapState{
+			ircChannel: ircChannel,
+			name:       alertName(alert),
+			status:     "resolved",
+		}
+		d.states[key] = state
+	}
+	state.lastSeen = now
+
+	if alert.Status != state.status {
+		state.status = alert.Status
+		state.lastTransition = now
+		state.transitions = append(state.transitions, now)
+	}
+	d.unsafePruneTransitions(state, now)
+
+	if !state.muted && len(state.transitions) >= d.threshold {
+		state.muted = true
+		logging.Info("Alert %s in %s is flapping, muting it", state.name, ircChannel)
+		d.sendNote(ircChannel, fmt.Sprintf(
+			"%s is flapping (%d status changes in %s), muting it until it is stable for %s",
+			state.name, len(state.transitions), d.window, d.stablePeriod))
+	}
+	if state.muted {
+		d.metrics.flapSuppressedAlerts.WithLabelValues(ircChannel).Inc()
+		return false
+	}
+	return true
+}
+
+// FilterAlerts returns the alerts of the group that should be relayed.
+func (d *FlapDetector) FilterAlerts(ircChannel string, alerts promtmpl.Alerts) promtmpl.Alerts {
+	if d == nil {
+		return alerts
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.timeTeller.Now()
+	filtered := promtmpl.Alerts{}
+	for i := range alerts {
+		if d.unsafeAllow(ircChannel, &alerts[i], now) {
+			filtered = append(filtered, alerts[i])
+		}
+	}
+	return filtered
+}
+
+func (d *FlapDetector) unsafePruneTransitions(state *flapState, now time.Time) {
+	recent := state.transitions[:0]
+	for _, transition := range state.transitions {
+		if now.Sub(transition) < d.window {
+			recent = append(recent, transition)
+		}
+	}
+	state.transitions = recent
+}
+
+// Sweep unmutes the alerts which became stable, and forgets alerts which
+// are not flapping anymore.
+func (d *FlapDetector) Sweep() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.timeTeller.Now()
+	for key, state := range d.states {
+		d.unsafePruneTransitions(state, now)
+		if state.muted && now.Sub(state.lastTransition) >= d.stablePeriod {
+			state.muted = false
+			logging.Info("Alert %s in %s stabilized, unmuting it", state.name, state.ircChannel)
+			d.sendNote(state.ircChannel, fmt.Sprintf(
+				"%s stabilized, it is currently %s", state.name, state.status))
+		}
+		if !state.muted && len(state.transitions) == 0 &&
+			(state.status == "resolved" || now.Sub(state.lastSeen) >= flapStateExpiry) {
+			delete(d.states, key)
+		}
+	}
+}
+
+// Run periodically sweeps the alerts until ctx is canceled.
+func (d *FlapDetector) Run(ctx context.Context, stopWg *sync.WaitGroup) {
+	defer stopWg.Done()
+
+	ticker := time.NewTicker(flapSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			d.Sweep()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// ExportState returns the alerts followed, none if d is nil.
+func (d *FlapDetector) ExportState() []FlapState {
+	flaps := []FlapState{}
+	if d == nil {
+		return flaps
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key, state := range d.states {
+		flaps = append(flaps, FlapState{
+			Key:            key,
+			IRCChannel:     state.ircChannel,
+			Name:           state.name,
+			Status:         state.status,
+			Transitions:    append([]time.Time{}, state.transitions...),
+			LastTransition: state.lastTransition,
+			LastSeen:       state.lastSeen,
+			Muted:          state.muted,
+		})
+	}
+	return flaps
+}
+
+// ImportState follows the alerts, replacing what is known about them. It
+// does nothing if d is nil.
+func (d *FlapDetector) ImportState(flaps []FlapState) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for _, flap := range flaps {
+		d.states[flap.Key] = &flapState{
+			ircChannel:     flap.IRCChannel,
+			name:           flap.Name,
+			status:         flap.Status,
+			transitions:    flap.Transitions,
+			lastTransition: flap.LastTransition,
+			lastSeen:       flap.LastSeen,
+			muted:          flap.Muted,
+		}
+	}
+}
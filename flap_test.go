@@ -0,0 +1,129 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func makeTestFlapDetector(elapsedTime []int) (*FlapDetector, chan AlertMsg, *Metrics) {
+	config := &Config{
+		FlapThreshold:    3,
+		FlapWindow:       2 * time.Minute,
+		FlapStablePeriod: 5 * time.Minute,
+	}
+	fakeTime := &FakeTime{
+		timeseries:   elapsedTime,
+		durationUnit: time.Minute,
+	}
+	alertMsgs := make(chan AlertMsg, 10)
+	metrics := NewMetrics(prometheus.NewRegistry())
+	return NewFlapDetector(config, alertMsgs, fakeTime, metrics), alertMsgs, metrics
+}
+
+func flapTestAlert(status string) promtmpl.Alerts {
+	return promtmpl.Alerts{promtmpl.Alert{
+		Status:      status,
+		Fingerprint: "abc",
+		Labels:      promtmpl.KV{"alertname": "airDown"},
+	}}
+}
+
+func TestFlappingAlertMuted(t *testing.T) {
+	detector, alertMsgs, metrics := makeTestFlapDetector(
+		[]int{0, 0, 1, 1, 3, 4, 8, 9, 10})
+
+	for i, step := range []struct {
+		status  string
+		relayed bool
+	}{
+		{"firing", true},
+		{"resolved", true},
+		{"firing", false},
+		{"resolved", false},
+	} {
+		relayed := len(detector.FilterAlerts("#foo", flapTestAlert(step.status))) == 1
+		if relayed != step.relayed {
+			t.Errorf("Step #%d: expected relayed=%t", i, step.relayed)
+		}
+	}
+
+	detector.Sweep()
+	if len(detector.FilterAlerts("#foo", flapTestAlert("firing"))) != 0 {
+		t.Errorf("Alert unmuted before it stabilized")
+	}
+	detector.Sweep()
+	detector.Sweep()
+	if len(detector.FilterAlerts("#foo", flapTestAlert("firing"))) != 1 {
+		t.Errorf("Alert still muted after it stabilized")
+	}
+
+	expectedNotes := []AlertMsg{
+		AlertMsg{Channel: "#foo", Alert: "airDown is flapping (3 status changes in 2m0s), muting it until it is stable for 5m0s"},
+		AlertMsg{Channel: "#foo", Alert: "airDown stabilized, it is currently firing"},
+	}
+	if len(alertMsgs) != len(expectedNotes) {
+		t.Fatalf("Expected %d notes, got %d", len(expectedNotes), len(alertMsgs))
+	}
+	for _, expectedNote := range expectedNotes {
+		if note := <-alertMsgs; note.Channel != expectedNote.Channel || note.Alert != expectedNote.Alert {
+			t.Errorf("Unexpected note.\nExpected: %s\nActual: %s", expectedNote, note)
+		}
+	}
+
+	if v := testutil.ToFloat64(metrics.flapSuppressedAlerts.WithLabelValues("#foo")); v != 3 {
+		t.Errorf("Expected 3 suppressed notifications, got %f", v)
+	}
+}
+
+func TestSlowTransitionsNotMuted(t *testing.T) {
+	detector, alertMsgs, _ := makeTestFlapDetector([]int{0, 1, 3, 5, 7})
+
+	for i, status := range []string{"firing", "resolved", "firing", "resolved", "firing"} {
+		if len(detector.FilterAlerts("#foo", flapTestAlert(status))) != 1 {
+			t.Errorf("Step #%d: alert not relayed", i)
+		}
+	}
+	if len(alertMsgs) != 0 {
+		t.Errorf("Expected no note, got %d", len(alertMsgs))
+	}
+}
+
+func TestFlapStateForgotten(t *testing.T) {
+	detector, _, _ := makeTestFlapDetector([]int{0, 0, 3})
+
+	detector.FilterAlerts("#foo", flapTestAlert("firing"))
+	detector.FilterAlerts("#foo", flapTestAlert("resolved"))
+	detector.Sweep()
+	if len(detector.states) != 0 {
+		t.Errorf("Expected state of resolved alert to be dropped, got %d states",
+			len(detector.states))
+	}
+}
+
+func TestFlapDetectionDisabled(t *testing.T) {
+	detector := NewFlapDetector(&Config{}, nil, &FakeTime{}, NewMetrics(prometheus.NewRegistry()))
+	if detector != nil {
+		t.Fatalf("Expected no flap detector without threshold")
+	}
+	if len(detector.FilterAlerts("#foo", flapTestAlert("firing"))) != 1 {
+		t.Errorf("Alert not relayed with flap detection disabled")
+	}
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// FlushTracker keeps the messages handed to goirc until their lines are
+// written to the socket. goirc queues lines before writing them, and drops
+// those left when the connection breaks, so a message handed to it is only
+// sent once written. A nil *FlushTracker tracks nothing.
+type FlushTracker struct {
+	// flushed is called once all the lines of a message are written.
+	flushed func(AlertMsg)
+
+	mu      sync.Mutex
+	lastID  uint64
+	waiting []*flushWait
+	// partial is the last line written, until it is complete.
+	partial []byte
+}
+
+// flushWait is a message whose lines are not all written yet.
+type flushWait struct {
+	lines    []string
+	alertMsg AlertMsg
+}
+
+func NewFlushTracker(flushed func(AlertMsg)) *FlushTracker {
+	return &FlushTracker{flushed: flushed}
+}
+
+// rawLine returns the line goirc writes to send the text, see Conn.Raw.
+func rawLine(command string, target string, text string) string {
+	line := command + " " + target + " :" + text
+	if end := strings.IndexAny(line, "\r\n"); end >= 0 {
+		line = line[:end]
+	}
+	return line
+}
+
+// Add tracks the message, whose lines are about to be handed to goirc, and
+// records its flush ID in it.
+func (f *FlushTracker) Add(lines []string, alertMsg *AlertMsg) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.lastID++
+	alertMsg.flushID = f.lastID
+	f.waiting = append(f.waiting, &flushWait{lines: lines, alertMsg: *alertMsg})
+}
+
+// Remove stops tracking the message, e.g. when it could not be handed to
+// goirc.
+func (f *FlushTracker) Remove(alertMsg *AlertMsg) {
+	if f == nil {
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	for i, wait := range f.waiting {
+		if wait.alertMsg.flushID == alertMsg.flushID {
+			f.waiting = append(f.waiting[:i:i], f.waiting[i+1:]...)
+			return
+		}
+	}
+}
+
+// Written records the data written to the socket. Lines of messages handed
+// concurrently may be written in any order, and other lines in between.
+func (f *FlushTracker) Written(p []byte) {
+	if f == nil || len(p) == 0 {
+		return
+	}
+
+	flushed := []AlertMsg{}
+	f.mu.Lock()
+	f.partial = append(f.partial, p...)
+	for {
+		end := bytes.IndexByte(f.partial, '\n')
+		if end < 0 {
+			break
+		}
+		line := string(bytes.TrimRight(f.partial[:end], "\r"))
+		f.partial = f.partial[end+1:]
+		for i, wait := range f.waiting {
+			if wait.lines[0] != line {
+				continue
+			}
+			wait.lines = wait.lines[1:]
+			if len(wait.lines) == 0 {
+				flushed = append(flushed, wait.alertMsg)
+				f.waiting = append(f.waiting[:i:i], f.waiting[i+1:]...)
+			}
+			break
+		}
+	}
+	f.mu.Unlock()
+
+	for _, alertMsg := range flushed {
+		f.flushed(alertMsg)
+	}
+}
+
+// Reset returns the messages not written yet, in the order they were handed
+// to goirc, and forgets them, once the connection is closed.
+func (f *FlushTracker) Reset() []AlertMsg {
+	if f == nil {
+		return nil
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	alertMsgs := []AlertMsg{}
+	for _, wait := range f.waiting {
+		alertMsgs = append(alertMsgs, wait.alertMsg)
+	}
+	f.waiting = nil
+	f.partial = nil
+	return alertMsgs
+}
+
+// deadlineConn sets a deadline on each write to the server, so that a write
+// stalled e.g. because the server stopped reading during a netsplit fails,
+// and goirc closes the connection, instead of blocking forever. It reports
+// the data written to flushes.
+type deadlineConn struct {
+	net.Conn
+	timeout time.Duration
+	flushes *FlushTracker
+	// timedOut is called when a write times out.
+	timedOut func()
+}
+
+func (c *deadlineConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.timeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Write(p)
+	c.flushes.Written(p[:n])
+	if netErr, ok := err.(net.Error); ok && netErr.Timeout() && c.timedOut != nil {
+		c.timedOut()
+	}
+	return n, err
+}
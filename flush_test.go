@@ -0,0 +1,97 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFlushTracker(t *testing.T) {
+	flushed := []string{}
+	tracker := NewFlushTracker(func(alertMsg AlertMsg) {
+		flushed = append(flushed, alertMsg.Alert)
+	})
+	one := AlertMsg{Channel: "#a", Alert: "one"}
+	two := AlertMsg{Channel: "#b", Alert: "two"}
+	three := AlertMsg{Channel: "#a", Alert: "three"}
+	tracker.Add([]string{rawLine("NOTICE", "#a", "one 1"), rawLine("NOTICE", "#a", "one 2")}, &one)
+	tracker.Add([]string{rawLine("NOTICE", "#b", "two")}, &two)
+	tracker.Add([]string{rawLine("NOTICE", "#a", "three")}, &three)
+
+	// Lines may be split across writes, come in any order, and other
+	// lines in between.
+	tracker.Written([]byte("NOTICE #b :two\r\nPONG :1\r\nNOTICE #a :o"))
+	tracker.Written([]byte("ne 1\r\nNOTICE #a :one 2\r"))
+	if expected := []string{"two"}; !reflect.DeepEqual(expected, flushed) {
+		t.Errorf("Expected %q flushed, got %q", expected, flushed)
+	}
+	tracker.Written([]byte("\n"))
+	if expected := []string{"two", "one"}; !reflect.DeepEqual(expected, flushed) {
+		t.Errorf("Expected %q flushed, got %q", expected, flushed)
+	}
+
+	unflushed := tracker.Reset()
+	if len(unflushed) != 1 || unflushed[0].Alert != "three" || unflushed[0].flushID != three.flushID {
+		t.Errorf("Expected three not to be flushed, got %v", unflushed)
+	}
+	if unflushed := tracker.Reset(); len(unflushed) != 0 {
+		t.Errorf("Expected nothing left after a reset, got %v", unflushed)
+	}
+}
+
+func TestDeadlineConnStalled(t *testing.T) {
+	flushed := []string{}
+	tracker := NewFlushTracker(func(alertMsg AlertMsg) {
+		flushed = append(flushed, alertMsg.Alert)
+	})
+	server, client := net.Pipe()
+	defer server.Close()
+	timedOut := false
+	conn := &deadlineConn{
+		Conn:     client,
+		timeout:  50 * time.Millisecond,
+		flushes:  tracker,
+		timedOut: func() { timedOut = true },
+	}
+	one := AlertMsg{Channel: "#a", Alert: "one"}
+	two := AlertMsg{Channel: "#a", Alert: "two"}
+	tracker.Add([]string{rawLine("NOTICE", "#a", "one")}, &one)
+	tracker.Add([]string{rawLine("NOTICE", "#a", "two")}, &two)
+
+	// The server reads the first line, then stops reading.
+	go func() {
+		buf := make([]byte, len("NOTICE #a :one\r\n"))
+		server.Read(buf)
+	}()
+	if _, err := conn.Write([]byte("NOTICE #a :one\r\n")); err != nil {
+		t.Fatalf("Unexpected error writing the first line: %s", err)
+	}
+	_, err := conn.Write([]byte("NOTICE #a :two\r\n"))
+	if netErr, ok := err.(net.Error); !ok || !netErr.Timeout() {
+		t.Fatalf("Expected the stalled write to time out, got %v", err)
+	}
+	if !timedOut {
+		t.Errorf("Expected the write timeout to be reported")
+	}
+	if expected := []string{"one"}; !reflect.DeepEqual(expected, flushed) {
+		t.Errorf("Expected %q flushed, got %q", expected, flushed)
+	}
+	if unflushed := tracker.Reset(); len(unflushed) != 1 || unflushed[0].Alert != "two" {
+		t.Errorf("Expected two to be sent again, got %v", unflushed)
+	}
+}
@@ -15,77 +15,969 @@
 package main
 
 import (
-	"bytes"
 	"encoding/json"
+	"fmt"
 	"net/url"
+	"regexp"
+	"sort"
 	"strings"
 	"text/template"
+	"text/template/parse"
+	"time"
+	"unicode/utf8"
 
 	"github.com/google/alertmanager-irc-relay/logging"
 	promtmpl "github.com/prometheus/alertmanager/template"
 )
 
+// isIRCFormatting tells whether a control character is used by IRC clients
+// for text formatting (bold, colors, italics, ...) and should be kept.
+func isIRCFormatting(r rune) bool {
+	switch r {
+	case '\x02', '\x03', '\x0f', '\x11', '\x16', '\x1d', '\x1e', '\x1f':
+		return true
+	}
+	return false
+}
+
+// sanitizeLine removes control characters that are not IRC formatting
+// codes, as they could confuse clients or the server.
+func (f *Formatter) sanitizeLine(line string) string {
+	sanitized := stripControlCharacters(line)
+	if sanitized != line {
+		f.metrics.formatSanitized.WithLabelValues("control_characters").Inc()
+	}
+	return sanitized
+}
+
+// stripControlCharacters removes the control characters of line, except IRC
+// formatting codes. Tabs become spaces so that the words they separate stay
+// apart.
+func stripControlCharacters(line string) string {
+	return strings.Map(func(r rune) rune {
+		if r == '\t' {
+			return ' '
+		}
+		if (r < 0x20 || r == 0x7f) && !isIRCFormatting(r) {
+			return -1
+		}
+		return r
+	}, line)
+}
+
+// Actions on template syntax left unrendered by Alertmanager in alert fields.
+const (
+	templateLeftoversStrip = "strip"
+	templateLeftoversFlag  = "flag"
+
+	templateLeftoversMarker = "[unrendered template]"
+)
+
+// Orders in which the messages of an alert group are emitted.
+const (
+	messageOrderingAsReceived    = "as_received"
+	messageOrderingFiringFirst   = "firing_first"
+	messageOrderingResolvedFirst = "resolved_first"
+)
+
+// Render modes of channels for alert groups.
+const (
+	renderModeFirstDetailed = "first_detailed"
+)
+
+// defaultSeverityOrder ranks the usual severities, most severe first.
+var defaultSeverityOrder = []string{"critical", "error", "warning", "info"}
+
+// truncatedMarker ends the last line sent of messages cut short by
+// MaxLinesPerAlert.
+const truncatedMarker = "(truncated)"
+
+// templateLeftoverRegexp matches template actions, which may span lines.
+var templateLeftoverRegexp = regexp.MustCompile(`(?s)\{\{.*?\}\}`)
+
 type Formatter struct {
 	MsgTemplate *template.Template
 	MsgOnce     bool
+
+	// TemplateRoutes select one of namedTemplates instead of MsgTemplate
+	// for some channels or alerts.
+	TemplateRoutes []TemplateRoute
+	namedTemplates map[string]*template.Template
+	// TemplatesByReceiver select one of namedTemplates by the receiver
+	// of the webhook, before TemplateRoutes.
+	TemplatesByReceiver map[string]string
+
+	// TemplateLeftovers tells what to do with "{{ ... }}" found in labels
+	// and annotations: strip it, flag it, or keep it if empty.
+	TemplateLeftovers string
+
+	// AnnotationsMarkdown tells whether to convert the Markdown of
+	// annotations for IRC, and what to do with its emphasis.
+	AnnotationsMarkdown string
+	// labelFilter, if set, hides some labels and annotations from
+	// templates.
+	labelFilter *labelFilter
+
+	// Channels whose render mode is first_detailed in channelRenderModes
+	// get the most severe alert of a group after SeverityOrder rendered
+	// as usual, and the others with RestTemplate, or only counted if
+	// unset.
+	RestTemplate       *template.Template
+	SeverityOrder      []string
+	channelRenderModes map[string]string
+	// MessageOrdering tells which of firing and resolved alerts of a group
+	// are emitted first, if any.
+	MessageOrdering string
+
+	// RunbookAnnotation names the annotation holding a runbook link, to be
+	// appended to the message after RunbookPrefix, shortened with
+	// shortenURL if RunbookShorten.
+	RunbookAnnotation string
+	RunbookPrefix     string
+	RunbookShorten    bool
+
+	// MaxLinesPerAlert, if set, caps the number of lines sent for an alert
+	// or alert group, the last one being marked as truncated.
+	MaxLinesPerAlert int
+
+	// MaxAlertsPerWebhook, if set, caps the number of alerts of a webhook
+	// rendered one by one, the others being only counted.
+	MaxAlertsPerWebhook int
+
+	// Renders writing more than MaxRenderBytes or taking longer than
+	// RenderTimeout, if set, fail.
+	MaxRenderBytes int
+	RenderTimeout  time.Duration
+
+	// CorrelationIDInMessages appends the correlation ID of the webhook
+	// delivery to the message.
+	CorrelationIDInMessages bool
+
+	// ChannelDisplayNames map channel names to the names rendered by
+	// channelDisplayName, which passes the others through.
+	ChannelDisplayNames map[string]string
+
+	// Topics, if set, returns the topic of a channel for Topic, empty if
+	// unknown.
+	Topics func(ircChannel string) string
+	// Fingerprints, if set, remembers the alerts behind the tokens
+	// rendered by Fingerprint.
+	Fingerprints *FingerprintTokens
+
+	// Now tells the time Since, Until and FiringDuration are relative to.
+	Now func() time.Time
+
+	// ColorRules color the messages of the firing alerts they match, else
+	// SeverityColors map the severity of firing alerts to the code of the
+	// color of their messages. channelSeverityColors override them for
+	// some channels.
+	ColorRules            []ColorRule
+	SeverityColors        map[string]string
+	channelSeverityColors map[string]map[string]string
+
+	metrics *Metrics
+}
+
+var templateFuncMap = template.FuncMap{
+	"ToUpper": strings.ToUpper,
+	"ToLower": strings.ToLower,
+	"Join":    strings.Join,
+
+	"QueryEscape": url.QueryEscape,
+	"PathEscape":  url.PathEscape,
+
+	"TrimPrefix": func(prefix string, s string) string { return strings.TrimPrefix(s, prefix) },
+	"Title":      strings.Title,
+
+	"MarkdownToIRC": func(s string) string { return markdownToIRC(s, true) },
+
+	"HumanizeDuration": func(value interface{}) (string, error) {
+		d, err := toDuration(value)
+		if err != nil {
+			return "", err
+		}
+		return humanizeDuration(d), nil
+	},
+
+	// amGroupURL, channelDisplayName and Topic are bound to the alert
+	// group and channel being formatted, Since and Until to the time of
+	// formatting and Fingerprint to the tokens remembered, see
+	// bindTemplate.
+	"amGroupURL":         func() string { return "" },
+	"channelDisplayName": func(...string) string { return "" },
+	"Topic":              func(...string) string { return "" },
+	"Since":              func(time.Time) string { return "" },
+	"Until":              func(time.Time) string { return "" },
+	"Fingerprint":        func(interface{}) (string, error) { return "", nil },
+}
+
+// amGroupURL returns the link to the alert group in the Alertmanager UI,
+// filtered on its group labels, or "" if the Alertmanager did not tell its
+// external URL.
+func amGroupURL(data *promtmpl.Data) string {
+	if data.ExternalURL == "" {
+		return ""
+	}
+	// The UI does not decode '+' as a space.
+	escape := func(s string) string {
+		return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+	}
+	params := []string{}
+	if len(data.GroupLabels) > 0 {
+		matchers := []string{}
+		for _, pair := range data.GroupLabels.SortedPairs() {
+			matchers = append(matchers, fmt.Sprintf("%s=%q", pair.Name, pair.Value))
+		}
+		params = append(params, "filter="+escape("{"+strings.Join(matchers, ",")+"}"))
+	}
+	if data.Receiver != "" {
+		params = append(params, "receiver="+escape(data.Receiver))
+	}
+	return strings.TrimSuffix(data.ExternalURL, "/") + "/#/alerts?" + strings.Join(params, "&")
+}
+
+// channelDisplayName returns the display name of the channel, or the channel
+// name itself if it has none.
+func (f *Formatter) channelDisplayName(ircChannel string) string {
+	if name, ok := f.ChannelDisplayNames[ircChannel]; ok {
+		return name
+	}
+	return ircChannel
+}
+
+// topic returns the topic of the channel, empty if unknown.
+func (f *Formatter) topic(ircChannel string) string {
+	if f.Topics == nil {
+		return ""
+	}
+	return f.Topics(ircChannel)
+}
+
+// bindTemplate returns a copy of tmpl whose amGroupURL returns groupURL, whose
+// channelDisplayName and Topic default to ircChannel, and whose Since and
+// Until are relative to now.
+func (f *Formatter) bindTemplate(tmpl *template.Template, ircChannel string, groupURL string) *template.Template {
+	bound, err := tmpl.Clone()
+	if err != nil {
+		logging.Error("Could not bind functions in template %s: %s", tmpl.Name(), err)
+		return tmpl
+	}
+	return bound.Funcs(template.FuncMap{
+		"amGroupURL": func() string { return groupURL },
+		"channelDisplayName": func(channels ...string) string {
+			if len(channels) == 0 {
+				return f.channelDisplayName(ircChannel)
+			}
+			return f.channelDisplayName(channels[0])
+		},
+		"Topic": func(channels ...string) string {
+			if len(channels) == 0 {
+				return f.topic(ircChannel)
+			}
+			return f.topic(channels[0])
+		},
+		"Since": func(t time.Time) string { return humanizeDuration(f.Now().Sub(t)) },
+		"Until": func(t time.Time) string { return humanizeDuration(t.Sub(f.Now())) },
+		"Fingerprint": func(value interface{}) (string, error) {
+			labels, err := fingerprintLabels(value)
+			if err != nil {
+				return "", err
+			}
+			return f.Fingerprints.Add(labels), nil
+		},
+	})
+}
+
+// walkTemplateIncludes calls visit for each {{ template }} action under node.
+func walkTemplateIncludes(node parse.Node, visit func(*parse.TemplateNode)) {
+	switch n := node.(type) {
+	case *parse.ListNode:
+		if n == nil {
+			return
+		}
+		for _, child := range n.Nodes {
+			walkTemplateIncludes(child, visit)
+		}
+	case *parse.IfNode:
+		walkTemplateIncludes(&n.BranchNode, visit)
+	case *parse.RangeNode:
+		walkTemplateIncludes(&n.BranchNode, visit)
+	case *parse.WithNode:
+		walkTemplateIncludes(&n.BranchNode, visit)
+	case *parse.BranchNode:
+		walkTemplateIncludes(n.List, visit)
+		walkTemplateIncludes(n.ElseList, visit)
+	case *parse.TemplateNode:
+		visit(n)
+	}
+}
+
+// parseMsgTemplate parses a message template, which may include the partials.
+// Including undefined templates is an error, rather than failing each time
+// the template is executed.
+func parseMsgTemplate(partials *template.Template, name string, text string) (*template.Template, error) {
+	set, err := partials.Clone()
+	if err != nil {
+		return nil, err
+	}
+	tmpl, err := set.New(name).Parse(text)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range tmpl.Templates() {
+		if t.Tree == nil {
+			continue
+		}
+		walkTemplateIncludes(t.Tree.Root, func(include *parse.TemplateNode) {
+			if err == nil && tmpl.Lookup(include.Name) == nil {
+				err = fmt.Errorf("template %s includes undefined template %q", t.Name(), include.Name)
+			}
+		})
+	}
+	return tmpl, err
 }
 
-func NewFormatter(config *Config) (*Formatter, error) {
-	funcMap := template.FuncMap{
-		"ToUpper": strings.ToUpper,
-		"ToLower": strings.ToLower,
-		"Join":    strings.Join,
+func NewFormatter(config *Config, metrics *Metrics) (*Formatter, error) {
+	partials := template.New("").Funcs(templateFuncMap)
+	for name, text := range config.MsgTemplatePartials {
+		if _, err := partials.New(name).Parse(text); err != nil {
+			return nil, err
+		}
+	}
 
-		"QueryEscape": url.QueryEscape,
-		"PathEscape":  url.PathEscape,
+	tmpl, err := parseMsgTemplate(partials, "msg", config.MsgTemplate)
+	if err != nil {
+		return nil, err
 	}
 
-	tmpl, err := template.New("msg").Funcs(funcMap).Parse(config.MsgTemplate)
+	namedTemplates := make(map[string]*template.Template)
+	for name, text := range config.MsgTemplates {
+		namedTmpl, err := parseMsgTemplate(partials, name, text)
+		if err != nil {
+			return nil, err
+		}
+		namedTemplates[name] = namedTmpl
+	}
+
+	labelFilter, err := newLabelFilter(config.LabelAllowlist, config.LabelDenylist)
 	if err != nil {
 		return nil, err
 	}
+
+	var restTmpl *template.Template
+	if config.MsgTemplateRest != "" {
+		restTmpl, err = parseMsgTemplate(partials, "msg_rest", config.MsgTemplateRest)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	severityOrder := config.SeverityOrder
+	if len(severityOrder) == 0 {
+		severityOrder = defaultSeverityOrder
+	}
+
+	channelSeverityColors := make(map[string]map[string]string)
+	channelRenderModes := make(map[string]string)
+	channels := config.IRCChannels
+	for _, connection := range config.IRCConnections {
+		channels = append(channels, connection.IRCChannels...)
+	}
+	for _, channel := range channels {
+		if len(channel.SeverityColors) > 0 {
+			channelSeverityColors[channel.Name] = severityColorCodes(channel.SeverityColors)
+		}
+		if channel.RenderMode != "" {
+			channelRenderModes[channel.Name] = channel.RenderMode
+		}
+	}
+
 	return &Formatter{
-		MsgTemplate: tmpl,
-		MsgOnce:     config.MsgOnce,
+		MsgTemplate:         tmpl,
+		MsgOnce:             config.MsgOnce,
+		TemplateRoutes:      config.TemplateRoutes,
+		namedTemplates:      namedTemplates,
+		TemplateLeftovers:   config.TemplateLeftovers,
+		AnnotationsMarkdown: config.AnnotationsMarkdown,
+		labelFilter:         labelFilter,
+		Now:                 time.Now,
+
+		RestTemplate:        restTmpl,
+		SeverityOrder:       severityOrder,
+		channelRenderModes:  channelRenderModes,
+		MessageOrdering:     config.MessageOrdering,
+		RunbookAnnotation:   config.RunbookAnnotation,
+		RunbookPrefix:       config.RunbookPrefix,
+		RunbookShorten:      config.RunbookShorten,
+		MaxLinesPerAlert:    config.MaxLinesPerAlert,
+		MaxAlertsPerWebhook: config.MaxAlertsPerWebhook,
+		MaxRenderBytes:      config.MaxRenderBytes,
+		RenderTimeout:       config.RenderTimeout,
+		metrics:             metrics,
+
+		TemplatesByReceiver:     config.TemplatesByReceiver,
+		CorrelationIDInMessages: config.CorrelationIDInMessages,
+		ChannelDisplayNames:     config.ChannelDisplayNames,
+
+		ColorRules:            config.ColorRules,
+		SeverityColors:        severityColorCodes(config.SeverityColors),
+		channelSeverityColors: channelSeverityColors,
 	}, nil
 }
 
+func severityColorCodes(colors map[string]string) map[string]string {
+	codes := make(map[string]string)
+	for severity, color := range colors {
+		codes[severity] = ircColors[color]
+	}
+	return codes
+}
+
+// colorCode returns the code of the color of the messages of an alert, or
+// alert group, with the labels: that of the first color rule matching, else
+// that of its severity for the channel, else the global one.
+func (f *Formatter) colorCode(ircChannel string, labels promtmpl.KV) (string, bool) {
+	for i := range f.ColorRules {
+		if f.ColorRules[i].Matches(ircChannel, labels) {
+			return f.ColorRules[i].code(), true
+		}
+	}
+	severity, ok := labels[severityLabel]
+	if !ok {
+		return "", false
+	}
+	if code, ok := f.channelSeverityColors[ircChannel][severity]; ok {
+		return code, true
+	}
+	code, ok := f.SeverityColors[severity]
+	return code, ok
+}
+
+// colorize colors the lines of a firing alert, or alert group, see
+// colorCode.
+func (f *Formatter) colorize(lines []string, ircChannel string, status string, labels promtmpl.KV) []string {
+	if status != "firing" {
+		return lines
+	}
+	code, ok := f.colorCode(ircChannel, labels)
+	if !ok {
+		return lines
+	}
+	for i := range lines {
+		lines[i] = colorLine(lines[i], code)
+	}
+	return lines
+}
+
+// routeFor returns the first route matching the channel, alert and webhook,
+// if any.
+func (f *Formatter) routeFor(ircChannel string, status string, labels promtmpl.KV, message *WebhookMessage) *TemplateRoute {
+	for i := range f.TemplateRoutes {
+		if f.TemplateRoutes[i].Matches(ircChannel, status, labels, message.Receiver, message.GroupKey) {
+			return &f.TemplateRoutes[i]
+		}
+	}
+	return nil
+}
+
+// templateFor returns the template of the receiver if it has one, else that
+// of the route, or MsgTemplate if there is none or it does not name one.
+func (f *Formatter) templateFor(receiver string, route *TemplateRoute) *template.Template {
+	if name, ok := f.TemplatesByReceiver[receiver]; ok && receiver != "" {
+		return f.namedTemplates[name]
+	}
+	if route == nil || route.Template == "" {
+		return f.MsgTemplate
+	}
+	return f.namedTemplates[route.Template]
+}
+
+// ignored tells whether the route drops alerts in this status, and counts
+// them if so.
+func (f *Formatter) ignored(route *TemplateRoute, ircChannel string, status string) bool {
+	if route == nil || !route.Ignores(status) {
+		return false
+	}
+	logging.Debug("Ignoring %s alert for %s", status, ircChannel)
+	f.metrics.formatIgnored.WithLabelValues(ircChannel, status).Inc()
+	return true
+}
+
 func (f *Formatter) FormatMsg(ircChannel string, data interface{}) []string {
-	output := bytes.Buffer{}
-	var msg string
-	if err := f.MsgTemplate.Execute(&output, data); err != nil {
+	return f.formatMsgWithTemplate(f.bindTemplate(f.MsgTemplate, ircChannel, ""), ircChannel, data, "")
+}
+
+func (f *Formatter) formatMsgWithTemplate(tmpl *template.Template, ircChannel string, data interface{}, correlationID string) []string {
+	msg, err := f.executeTemplate(tmpl, data)
+	if err != nil {
 		msg_bytes, _ := json.Marshal(data)
 		msg = string(msg_bytes)
-		logging.Error("Could not apply msg template on alert (%s): %s",
-			err, msg)
-		logging.Warn("Sending raw alert")
-		alertHandlingErrors.WithLabelValues(ircChannel, "format_msg").Inc()
-	} else {
-		msg = output.String()
+		logging.Error("%sCould not apply msg template on alert (%s): %s",
+			correlationPrefix(correlationID), err, msg)
+		logging.Warn("%sSending raw alert", correlationPrefix(correlationID))
+		f.metrics.alertHandlingErrors.WithLabelValues(ircChannel, "format_msg").Inc()
+		f.metrics.formatRenderErrors.WithLabelValues(tmpl.Name()).Inc()
+		if limitErr, ok := err.(*renderLimitError); ok {
+			f.metrics.formatRenderLimits.WithLabelValues(tmpl.Name(), limitErr.limit).Inc()
+		}
+		// The raw alert is no smaller than what the template would
+		// render.
+		if f.MaxRenderBytes > 0 && len(msg) > f.MaxRenderBytes {
+			cut := f.MaxRenderBytes
+			for cut > 0 && !utf8.RuneStart(msg[cut]) {
+				cut--
+			}
+			msg = msg[:cut] + " " + truncatedMarker
+		}
 	}
 
 	// Do not send to IRC messages with newlines, split in multiple messages instead.
 	newLinesSplit := func(r rune) bool {
 		return r == '\n' || r == '\r'
 	}
-	return strings.FieldsFunc(msg, newLinesSplit)
+	// Blank lines are dropped, a message with nothing but whitespace is
+	// not sent at all.
+	lines := []string{}
+	for _, line := range strings.FieldsFunc(msg, newLinesSplit) {
+		if line = f.sanitizeLine(line); strings.TrimSpace(line) != "" {
+			lines = append(lines, line)
+		}
+	}
+	if len(lines) == 0 {
+		logging.Debug("%sTemplate %s rendered an empty message for %s%s, skipping",
+			correlationPrefix(correlationID), tmpl.Name(), describeRendered(data), ircChannel)
+		f.metrics.formatEmptyOutput.WithLabelValues(ircChannel, tmpl.Name()).Inc()
+	}
+	return lines
+}
+
+// describeRendered tells which alert or alert group data is, if known, to
+// prefix the channel with in logs.
+func describeRendered(data interface{}) string {
+	switch d := data.(type) {
+	case *AlertData:
+		return fmt.Sprintf("alert %s in ", d.Fingerprint)
+	case *WebhookMessage:
+		if d.GroupKey != "" {
+			return fmt.Sprintf("alert group %s in ", d.GroupKey)
+		}
+		return "alert group in "
+	}
+	return ""
+}
+
+// cleanKV returns a copy of kv without template leftovers. field labels the
+// metrics, to tell where leftovers were found. Keys are left out, so that
+// arbitrary label names do not make series.
+func (f *Formatter) cleanKV(field string, kv promtmpl.KV) promtmpl.KV {
+	cleaned := promtmpl.KV{}
+	for key, value := range kv {
+		if templateLeftoverRegexp.MatchString(value) {
+			f.metrics.formatTemplateLeftovers.WithLabelValues(field).Inc()
+			replacement := ""
+			if f.TemplateLeftovers == templateLeftoversFlag {
+				replacement = templateLeftoversMarker
+			}
+			value = strings.TrimSpace(
+				templateLeftoverRegexp.ReplaceAllLiteralString(value, replacement))
+		}
+		cleaned[key] = value
+	}
+	return cleaned
+}
+
+// cleanTemplateLeftovers returns a copy of data where template syntax left
+// over by Alertmanager was handled according to TemplateLeftovers.
+func (f *Formatter) cleanTemplateLeftovers(data *promtmpl.Data) *promtmpl.Data {
+	if f.TemplateLeftovers == "" {
+		return data
+	}
+	cleaned := *data
+	cleaned.GroupLabels = f.cleanKV("GroupLabels", data.GroupLabels)
+	cleaned.CommonLabels = f.cleanKV("CommonLabels", data.CommonLabels)
+	cleaned.CommonAnnotations = f.cleanKV("CommonAnnotations", data.CommonAnnotations)
+	cleaned.Alerts = make(promtmpl.Alerts, len(data.Alerts))
+	for i, alert := range data.Alerts {
+		alert.Labels = f.cleanKV("Labels", alert.Labels)
+		alert.Annotations = f.cleanKV("Annotations", alert.Annotations)
+		cleaned.Alerts[i] = alert
+	}
+	return &cleaned
+}
+
+// compileLabelPattern compiles a label_allowlist or label_denylist entry,
+// which matches whole label names.
+func compileLabelPattern(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile("^(?:" + pattern + ")$")
+}
+
+// labelFilter keeps the labels and annotations whose name matches one of
+// patterns if allow is set, or else those matching none of them.
+type labelFilter struct {
+	allow    bool
+	patterns []*regexp.Regexp
+}
+
+// newLabelFilter returns nil if both lists are empty.
+func newLabelFilter(allowlist []string, denylist []string) (*labelFilter, error) {
+	filter := &labelFilter{allow: len(allowlist) > 0}
+	for _, pattern := range append(append([]string{}, allowlist...), denylist...) {
+		re, err := compileLabelPattern(pattern)
+		if err != nil {
+			return nil, err
+		}
+		filter.patterns = append(filter.patterns, re)
+	}
+	if len(filter.patterns) == 0 {
+		return nil, nil
+	}
+	return filter, nil
+}
+
+func (l *labelFilter) keeps(name string) bool {
+	for _, pattern := range l.patterns {
+		if pattern.MatchString(name) {
+			return l.allow
+		}
+	}
+	return !l.allow
+}
+
+// filter returns a copy of kv without the names not kept, kv itself if l is
+// nil.
+func (l *labelFilter) filter(kv promtmpl.KV) promtmpl.KV {
+	if l == nil || kv == nil {
+		return kv
+	}
+	filtered := promtmpl.KV{}
+	for name, value := range kv {
+		if l.keeps(name) {
+			filtered[name] = value
+		}
+	}
+	return filtered
+}
+
+// filterAlert returns a copy of the alert with the labels and annotations
+// exposed to templates.
+func (f *Formatter) filterAlert(alert promtmpl.Alert) promtmpl.Alert {
+	alert.Labels = f.labelFilter.filter(alert.Labels)
+	alert.Annotations = f.labelFilter.filter(alert.Annotations)
+	return alert
+}
+
+// filterGroup returns a copy of the alert group with the labels and
+// annotations exposed to templates, keeping the full common ones in
+// AllLabels and AllAnnotations.
+func (f *Formatter) filterGroup(message *WebhookMessage) *WebhookMessage {
+	filtered := *message
+	filtered.AllLabels = message.CommonLabels
+	filtered.AllAnnotations = message.CommonAnnotations
+	if f.labelFilter == nil {
+		return &filtered
+	}
+	filtered.GroupLabels = f.labelFilter.filter(message.GroupLabels)
+	filtered.CommonLabels = f.labelFilter.filter(message.CommonLabels)
+	filtered.CommonAnnotations = f.labelFilter.filter(message.CommonAnnotations)
+	filtered.Alerts = make(promtmpl.Alerts, len(message.Alerts))
+	for i, alert := range message.Alerts {
+		filtered.Alerts[i] = f.filterAlert(alert)
+	}
+	return &filtered
+}
+
+// truncate drops the lines beyond MaxLinesPerAlert, and marks the last line
+// kept so that readers know the message is incomplete.
+func (f *Formatter) truncate(lines []string, ircChannel string) []string {
+	if f.MaxLinesPerAlert == 0 || len(lines) <= f.MaxLinesPerAlert {
+		return lines
+	}
+	logging.Debug("Truncating message of %d lines for %s to %d lines",
+		len(lines), ircChannel, f.MaxLinesPerAlert)
+	f.metrics.formatTruncated.WithLabelValues(ircChannel).Inc()
+	lines = lines[:f.MaxLinesPerAlert]
+	lines[len(lines)-1] += " " + truncatedMarker
+	return lines
+}
+
+// appendRunbook adds the runbook link, if any, at the end of the message.
+func (f *Formatter) appendRunbook(lines []string, annotations promtmpl.KV) []string {
+	if f.RunbookAnnotation == "" || len(lines) == 0 {
+		return lines
+	}
+	runbook := f.sanitizeLine(strings.TrimSpace(annotations[f.RunbookAnnotation]))
+	if runbook == "" {
+		return lines
+	}
+	if f.RunbookShorten {
+		runbook = shortenURL(runbook)
+	}
+	lines[len(lines)-1] += " " + f.RunbookPrefix + runbook
+	return lines
+}
+
+// maxShortenedPathLength is the number of runes of a link path above which
+// shortenURL elides its middle.
+const maxShortenedPathLength = 40
+
+// shortenURL trims the trailing slash of an HTTP(S) link and elides the middle
+// of an overlong path with "...", keeping the scheme, host, query and fragment
+// as they are. Other links are kept as is.
+func shortenURL(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.User != nil {
+		return link
+	}
+	// The scheme is lowercased when parsed but keeps its length.
+	origin := link[:len(u.Scheme)+len("://")+len(u.Host)]
+	path, rest := link[len(origin):], ""
+	if i := strings.IndexAny(path, "?#"); i >= 0 {
+		path, rest = path[:i], path[i:]
+	}
+	if rest == "" {
+		path = strings.TrimSuffix(path, "/")
+	}
+	if runes := []rune(path); len(runes) > maxShortenedPathLength {
+		keep := (maxShortenedPathLength - len("...")) / 2
+		path = string(runes[:keep]) + "..." + string(runes[len(runes)-keep:])
+	}
+	return origin + path + rest
+}
+
+// appendCorrelationID adds the correlation ID, if enabled, at the end of the
+// message.
+func (f *Formatter) appendCorrelationID(lines []string, correlationID string) []string {
+	if !f.CorrelationIDInMessages || correlationID == "" || len(lines) == 0 {
+		return lines
+	}
+	lines[len(lines)-1] += " [" + correlationID + "]"
+	return lines
+}
+
+// orderAlerts returns the alerts in the order their messages should be
+// emitted. Alerts with the same status keep their relative order.
+func (f *Formatter) orderAlerts(alerts promtmpl.Alerts) promtmpl.Alerts {
+	var first string
+	switch f.MessageOrdering {
+	case messageOrderingFiringFirst:
+		first = "firing"
+	case messageOrderingResolvedFirst:
+		first = "resolved"
+	default:
+		return alerts
+	}
+	ordered := append(promtmpl.Alerts{}, alerts...)
+	sort.SliceStable(ordered, func(i, j int) bool {
+		return ordered[i].Status == first && ordered[j].Status != first
+	})
+	return ordered
 }
 
 func (f *Formatter) GetMsgsFromAlertMessage(ircChannel string,
 	data *promtmpl.Data) []AlertMsg {
+	return f.GetCorrelatedMsgsFromAlertMessage(ircChannel, &WebhookMessage{Data: *data}, "")
+}
+
+// linesToAlertMsgs returns the messages of the lines rendered for an alert or
+// alert group, numbered if there are several.
+func linesToAlertMsgs(ircChannel string, lines []string, correlationID string) []AlertMsg {
+	msgs := []AlertMsg{}
+	for i, line := range lines {
+		msg := AlertMsg{Channel: ircChannel, Alert: line, CorrelationID: correlationID}
+		if len(lines) > 1 {
+			msg.Part = i + 1
+			msg.Parts = len(lines)
+		}
+		msgs = append(msgs, msg)
+	}
+	return msgs
+}
+
+// GetCorrelatedMsgsFromAlertMessage formats the messages of a webhook
+// delivery, tagged with its correlation ID.
+func (f *Formatter) GetCorrelatedMsgsFromAlertMessage(ircChannel string,
+	message *WebhookMessage, correlationID string) []AlertMsg {
+	msgs, _ := f.GetAlertFingerprintedMsgs(ircChannel, message, correlationID)
+	return msgs
+}
+
+// GetAlertFingerprintedMsgs formats the messages of a webhook delivery like
+// GetCorrelatedMsgsFromAlertMessage, and returns for each message the
+// fingerprint of the alert it was rendered from, empty for messages about
+// the whole group.
+func (f *Formatter) GetAlertFingerprintedMsgs(ircChannel string,
+	message *WebhookMessage, correlationID string) ([]AlertMsg, []string) {
 	msgs := []AlertMsg{}
+	fingerprints := []string{}
+	data := f.convertAnnotationsMarkdown(f.cleanTemplateLeftovers(&message.Data))
+	message = &WebhookMessage{Data: *data, GroupKey: message.GroupKey}
+	groupURL := amGroupURL(data)
 	if f.MsgOnce {
-		for _, msg := range f.FormatMsg(ircChannel, data) {
-			msgs = append(msgs,
-				AlertMsg{Channel: ircChannel, Alert: msg})
+		route := f.routeFor(ircChannel, data.Status, data.CommonLabels, message)
+		if f.ignored(route, ircChannel, data.Status) {
+			return msgs, fingerprints
 		}
+		tmpl := f.bindTemplate(f.templateFor(data.Receiver, route), ircChannel, groupURL)
+		lines := f.appendRunbook(
+			f.truncate(f.formatMsgWithTemplate(tmpl, ircChannel, f.filterGroup(message), correlationID), ircChannel),
+			data.CommonAnnotations)
+		lines = f.appendCorrelationID(lines, correlationID)
+		lines = f.colorize(lines, ircChannel, data.Status, data.CommonLabels)
+		msgs = append(msgs, linesToAlertMsgs(ircChannel, lines, correlationID)...)
 	} else {
-		for _, alert := range data.Alerts {
-			for _, msg := range f.FormatMsg(ircChannel, alert) {
-				msgs = append(msgs,
-					AlertMsg{Channel: ircChannel, Alert: msg})
+		routed := []routedAlert{}
+		for _, alert := range f.orderAlerts(data.Alerts) {
+			route := f.routeFor(ircChannel, alert.Status, alert.Labels, message)
+			if f.ignored(route, ircChannel, alert.Status) {
+				continue
+			}
+			routed = append(routed, routedAlert{alert, route})
+		}
+		routed, omitted := f.limitAlerts(routed)
+		if f.channelRenderModes[ircChannel] == renderModeFirstDetailed && len(routed) > 1 {
+			msgs = f.formatFirstDetailed(ircChannel, f.detailedFirst(routed), message, groupURL, correlationID)
+		} else {
+			// Templates are bound once for the whole delivery, not for
+			// each alert.
+			bound := map[*template.Template]*template.Template{}
+			for _, r := range routed {
+				unbound := f.templateFor(data.Receiver, r.route)
+				tmpl, ok := bound[unbound]
+				if !ok {
+					tmpl = f.bindTemplate(unbound, ircChannel, groupURL)
+					bound[unbound] = tmpl
+				}
+				alertMsgs := linesToAlertMsgs(ircChannel,
+					f.formatAlert(tmpl, ircChannel, r.alert, message, correlationID), correlationID)
+				msgs = append(msgs, alertMsgs...)
+				for range alertMsgs {
+					fingerprints = append(fingerprints, alertFingerprint(&r.alert))
+				}
+			}
+		}
+		if omitted > 0 {
+			logging.Warn("Omitted %d alerts of group %s for %s beyond max_alerts_per_webhook",
+				omitted, message.GroupKey, ircChannel)
+			f.metrics.formatOmitted.WithLabelValues(ircChannel).Add(float64(omitted))
+			line := fmt.Sprintf("... %d additional alerts omitted", omitted)
+			if message.GroupKey != "" {
+				line += fmt.Sprintf(" (group %s)", message.GroupKey)
 			}
+			msgs = append(msgs, AlertMsg{Channel: ircChannel, Alert: f.sanitizeLine(line), CorrelationID: correlationID})
+		}
+	}
+	for len(fingerprints) < len(msgs) {
+		fingerprints = append(fingerprints, "")
+	}
+	return msgs, fingerprints
+}
+
+// limitAlerts keeps the MaxAlertsPerWebhook most important of the alerts,
+// in their order, and tells how many were left out. Firing alerts are more
+// important than resolved ones, then alerts rank after SeverityOrder, ties
+// going to the earliest.
+func (f *Formatter) limitAlerts(routed []routedAlert) ([]routedAlert, int) {
+	if f.MaxAlertsPerWebhook == 0 || len(routed) <= f.MaxAlertsPerWebhook {
+		return routed, 0
+	}
+	ranked := make([]int, len(routed))
+	for i := range ranked {
+		ranked[i] = i
+	}
+	sort.SliceStable(ranked, func(i, j int) bool {
+		a, b := routed[ranked[i]].alert, routed[ranked[j]].alert
+		if (a.Status == "firing") != (b.Status == "firing") {
+			return a.Status == "firing"
+		}
+		return f.severityRank(a) < f.severityRank(b)
+	})
+	kept := ranked[:f.MaxAlertsPerWebhook]
+	sort.Ints(kept)
+	limited := make([]routedAlert, 0, len(kept))
+	for _, i := range kept {
+		limited = append(limited, routed[i])
+	}
+	return limited, len(routed) - len(kept)
+}
+
+type routedAlert struct {
+	alert promtmpl.Alert
+	route *TemplateRoute
+}
+
+// alertData returns what templates render the alert of the webhook with.
+func (f *Formatter) alertData(alert promtmpl.Alert, message *WebhookMessage) *AlertData {
+	return &AlertData{
+		Alert:          f.filterAlert(alert),
+		Receiver:       message.Receiver,
+		GroupKey:       message.GroupKey,
+		AllLabels:      alert.Labels,
+		AllAnnotations: alert.Annotations,
+		FiringDuration: firingDuration(alert.Status, alert.StartsAt, alert.EndsAt, f.Now()),
+	}
+}
+
+// formatAlert renders the lines of a single alert.
+func (f *Formatter) formatAlert(tmpl *template.Template, ircChannel string, alert promtmpl.Alert, message *WebhookMessage, correlationID string) []string {
+	alertData := f.alertData(alert, message)
+	lines := f.appendRunbook(
+		f.truncate(f.formatMsgWithTemplate(tmpl, ircChannel, alertData, correlationID), ircChannel),
+		alert.Annotations)
+	lines = f.appendCorrelationID(lines, correlationID)
+	return f.colorize(lines, ircChannel, alert.Status, alert.Labels)
+}
+
+// severityRank tells how severe an alert is after SeverityOrder, lower being
+// more severe. Alerts with other severities come last.
+func (f *Formatter) severityRank(alert promtmpl.Alert) int {
+	severity := alert.Labels[severityLabel]
+	for i, s := range f.SeverityOrder {
+		if s == severity {
+			return i
+		}
+	}
+	return len(f.SeverityOrder)
+}
+
+// detailedFirst moves the alert to render in detail first: the most severe
+// of the alerts with the status of the first one, after ordering. Ties go
+// to the earliest.
+func (f *Formatter) detailedFirst(routed []routedAlert) []routedAlert {
+	first := 0
+	for i, r := range routed {
+		if r.alert.Status == routed[0].alert.Status &&
+			f.severityRank(r.alert) < f.severityRank(routed[first].alert) {
+			first = i
+		}
+	}
+	ordered := []routedAlert{routed[first]}
+	ordered = append(ordered, routed[:first]...)
+	return append(ordered, routed[first+1:]...)
+}
+
+// formatFirstDetailed renders the first alert with its usual template, and
+// the others with RestTemplate, or only counts them if there is none.
+func (f *Formatter) formatFirstDetailed(ircChannel string, routed []routedAlert, message *WebhookMessage, groupURL string, correlationID string) []AlertMsg {
+	first := routed[0]
+	tmpl := f.bindTemplate(f.templateFor(message.Receiver, first.route), ircChannel, groupURL)
+	lines := f.formatAlert(tmpl, ircChannel, first.alert, message, correlationID)
+	rest := routed[1:]
+	if f.RestTemplate == nil {
+		if len(lines) > 0 {
+			lines[len(lines)-1] += fmt.Sprintf(" (+%d more)", len(rest))
+		}
+		return linesToAlertMsgs(ircChannel, lines, correlationID)
+	}
+	msgs := linesToAlertMsgs(ircChannel, lines, correlationID)
+	restTmpl := f.bindTemplate(f.RestTemplate, ircChannel, groupURL)
+	for _, r := range rest {
+		// A one-liner each.
+		lines := f.formatMsgWithTemplate(restTmpl, ircChannel, f.alertData(r.alert, message), correlationID)
+		if len(lines) > 1 {
+			lines = lines[:1]
 		}
+		lines = f.colorize(lines, ircChannel, r.alert.Status, r.alert.Labels)
+		msgs = append(msgs, linesToAlertMsgs(ircChannel, lines, correlationID)...)
 	}
 	return msgs
 }
@@ -15,122 +15,1182 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
-	"io"
+	"errors"
+	"fmt"
 	"io/ioutil"
+	"mime"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 
 	"github.com/google/alertmanager-irc-relay/logging"
 	"github.com/gorilla/mux"
 	promtmpl "github.com/prometheus/alertmanager/template"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-var (
-	handledAlertGroups = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "webhook_handled_alert_groups",
-		Help: "Number of alert groups received"},
-		[]string{"ircchannel"},
-	)
-	handledAlerts = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "webhook_handled_alerts",
-		Help: "Number of single alert messages relayed"},
-		[]string{"ircchannel"},
-	)
-	alertHandlingErrors = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "webhook_alert_handling_errors",
-		Help: "Errors while processing webhook requests"},
-		[]string{"ircchannel", "error"},
-	)
-)
-
 type HTTPListener func(string, http.Handler) error
 
 type HTTPServer struct {
-	Addr         string
-	Port         int
+	Addr string
+	Port int
+	// InternalAddr and InternalPort, if set, are where the operational
+	// endpoints are served, apart from webhooks.
+	InternalAddr string
+	InternalPort int
 	formatter    *Formatter
+	cooldown     *AlertCooldown
+	deduplicator *WebhookDeduplicator
+	fingerprints *FingerprintTokens
+	formatterMu  sync.Mutex
 	AlertMsgs    chan AlertMsg
 	httpListener HTTPListener
+	metrics      *Metrics
+
+	maxBodyBytes int64
+
+	// retries, if set, skips the alerts already delivered in retried
+	// webhooks.
+	retries *RetryDeduplicator
+
+	// logEmptyWebhooks logs webhooks without any alert at debug level,
+	// e.g. health checks, which are otherwise only counted.
+	logEmptyWebhooks bool
+
+	// staticLabels are added to every alert received, replacing labels
+	// with the same name only if overrideLabels is set.
+	staticLabels   map[string]string
+	overrideLabels bool
+
+	// correlationIDHeader, if set, is the request header carrying the
+	// correlation ID of the delivery.
+	correlationIDHeader string
+
+	// sourceAllowlist, if set, restricts the clients allowed to send
+	// webhooks.
+	sourceAllowlist *SourceAllowlist
+	// clients tells who sent webhooks, for logs.
+	clients *ClientResolver
+
+	// channelField and channelLabel tell where webhooks posted to
+	// /api/webhook name their channel. The channelLabel label of alerts
+	// also names channels they are relayed to on top of the channels of
+	// their webhook, separated by channelLabelSeparator.
+	channelField          string
+	channelLabel          string
+	channelLabelSeparator string
+
+	// Tracer, if set, traces alerts from their reception to IRC.
+	Tracer *Tracer
+	// FlapDetector, if set, mutes flapping alerts.
+	FlapDetector *FlapDetector
+	// Watchdog, if set, consumes the watchdog alerts.
+	Watchdog *Watchdog
+	// Digester, if set, keeps the alerts of channels in digest mode.
+	Digester *Digester
+	// QuietHours, if set, holds the alerts of channels during their quiet
+	// hours.
+	QuietHours *QuietHours
+	// Storms, if set, summarizes the alerts of channels in storm mode.
+	Storms *StormDetector
+	// Notifiers report the state of their connection in /status.
+	Notifiers []*IRCNotifier
+	// Pending, if set, tracks the messages queued, listed on /queue.
+	Pending *PendingMessages
+	// Sequencer, if set, numbers the webhooks for their messages to be
+	// sent in order.
+	Sequencer *WebhookSequencer
+	// queueAPIToken is required to access /queue.
+	queueAPIToken string
+	// legacyRoutes serves the endpoints on their unversioned paths too.
+	legacyRoutes bool
+	// verifier, if set, checks the signature of webhooks.
+	verifier *WebhookVerifier
+	// allowMissingContentType accepts webhooks without a Content-Type.
+	allowMissingContentType bool
+
+	// disabled maps the disabled channels to the channel their alerts are
+	// redirected to, or "" if they are dropped.
+	disabled   map[string]string
+	disabledMu sync.Mutex
+
+	// channelAllowlist tells the channels webhooks may be relayed to.
+	channelAllowlist   *ChannelAllowlist
+	channelAllowlistMu sync.Mutex
 }
 
-func NewHTTPServer(config *Config, alertMsgs chan AlertMsg) (
+func NewHTTPServer(config *Config, alertMsgs chan AlertMsg, metrics *Metrics) (
 	*HTTPServer, error) {
-	return NewHTTPServerForTesting(config, alertMsgs, http.ListenAndServe)
+	listener := HTTPListener(http.ListenAndServe)
+	if len(config.HTTPProxyProtocolUpstreams) > 0 {
+		upstreams, err := parseCIDRs(config.HTTPProxyProtocolUpstreams)
+		if err != nil {
+			return nil, err
+		}
+		listener = ProxyProtocolListener(upstreams)
+	}
+	return NewHTTPServerForTesting(config, alertMsgs, listener, metrics)
 }
 
 func NewHTTPServerForTesting(config *Config, alertMsgs chan AlertMsg,
-	httpListener HTTPListener) (*HTTPServer, error) {
-	formatter, err := NewFormatter(config)
+	httpListener HTTPListener, metrics *Metrics) (*HTTPServer, error) {
+	formatter, err := NewFormatter(config, metrics)
+	if err != nil {
+		return nil, err
+	}
+	sourceAllowlist, err := NewSourceAllowlist(config.WebhookAllowedCIDRs, config.WebhookTrustedProxies)
+	if err != nil {
+		return nil, err
+	}
+	clients, err := NewClientResolver(config.WebhookTrustedProxies)
 	if err != nil {
 		return nil, err
 	}
 	server := &HTTPServer{
-		Addr:         config.HTTPHost,
-		Port:         config.HTTPPort,
-		formatter:    formatter,
-		AlertMsgs:    alertMsgs,
-		httpListener: httpListener,
+		Addr:           config.HTTPHost,
+		Port:           config.HTTPPort,
+		InternalAddr:   config.InternalHTTPHost,
+		InternalPort:   config.InternalHTTPPort,
+		formatter:      formatter,
+		cooldown:       NewAlertCooldown(config.AlertCooldown, &RealTime{}, metrics),
+		deduplicator:   NewWebhookDeduplicator(config.WebhookDedupTTL, &RealTime{}, metrics),
+		fingerprints:   NewFingerprintTokens(fingerprintTokensMax, fingerprintTokensTTL, &RealTime{}),
+		AlertMsgs:      alertMsgs,
+		httpListener:   httpListener,
+		metrics:        metrics,
+		maxBodyBytes:   config.MaxWebhookBytes,
+		staticLabels:   config.StaticLabels,
+		overrideLabels: config.StaticLabelsOverride,
+
+		logEmptyWebhooks:        config.LogEmptyWebhooks,
+		correlationIDHeader:     config.CorrelationIDHeader,
+		sourceAllowlist:         sourceAllowlist,
+		clients:                 clients,
+		channelField:            config.WebhookChannelField,
+		channelLabel:            config.WebhookChannelLabel,
+		channelLabelSeparator:   config.WebhookChannelLabelSeparator,
+		queueAPIToken:           config.QueueAPIToken,
+		legacyRoutes:            config.HTTPLegacyRoutes,
+		allowMissingContentType: config.WebhookAllowMissingContentType,
+		verifier: NewWebhookVerifier(config.WebhookHMACSecret, config.WebhookSignatureMaxSkew,
+			&RealTime{}, metrics),
+		disabled:         config.DisabledChannels(),
+		channelAllowlist: NewChannelAllowlist(config),
+		retries: NewRetryDeduplicator(config.WebhookRetryDedupTTL, config.WebhookRetryDedupMaxEntries,
+			&RealTime{}, metrics),
 	}
+	if server.maxBodyBytes == 0 {
+		server.maxBodyBytes = defaultMaxWebhookBytes
+	}
+	if server.channelLabelSeparator == "" {
+		server.channelLabelSeparator = defaultChannelLabelSeparator
+	}
+	formatter.Topics = server.channelTopic
+	formatter.Fingerprints = server.fingerprints
 
 	return server, nil
 }
 
+// SetFormatter replaces the formatter, e.g. when the config is reloaded.
+// Webhooks being handled keep the previous one.
+func (s *HTTPServer) SetFormatter(formatter *Formatter) {
+	formatter.Topics = s.channelTopic
+	formatter.Fingerprints = s.fingerprints
+	s.formatterMu.Lock()
+	defer s.formatterMu.Unlock()
+	s.formatter = formatter
+}
+
+func (s *HTTPServer) getFormatter() *Formatter {
+	s.formatterMu.Lock()
+	defer s.formatterMu.Unlock()
+	return s.formatter
+}
+
+// SetDisabledChannels replaces the disabled channels, e.g. when the config
+// is reloaded, see Config.DisabledChannels.
+func (s *HTTPServer) SetDisabledChannels(disabled map[string]string) {
+	s.disabledMu.Lock()
+	defer s.disabledMu.Unlock()
+	s.disabled = disabled
+}
+
+// SetChannelAllowlist replaces the channels webhooks may be relayed to, e.g.
+// when the config is reloaded.
+func (s *HTTPServer) SetChannelAllowlist(allowlist *ChannelAllowlist) {
+	s.channelAllowlistMu.Lock()
+	defer s.channelAllowlistMu.Unlock()
+	s.channelAllowlist = allowlist
+}
+
+// channelAllowed tells whether webhooks may be relayed to the channel, see
+// ChannelAllowlist.Allowed.
+func (s *HTTPServer) channelAllowed(ircChannel string, fromPayload bool) bool {
+	s.channelAllowlistMu.Lock()
+	defer s.channelAllowlistMu.Unlock()
+	return s.channelAllowlist.Allowed(ircChannel, fromPayload)
+}
+
+// allowedChannels returns the channels webhooks may be relayed to among
+// those given, and the results for the others, which are logged and counted.
+func (s *HTTPServer) allowedChannels(ircChannels []string, fromPayload bool, logPrefix string) ([]string, []TargetResult) {
+	allowed := []string{}
+	rejected := []TargetResult{}
+	for _, ircChannel := range ircChannels {
+		if s.channelAllowed(ircChannel, fromPayload) {
+			allowed = append(allowed, ircChannel)
+			continue
+		}
+		logging.Warn("%sNot relaying webhook to %s: the channel is not allowed", logPrefix, ircChannel)
+		s.metrics.webhookChannelsNotAllowed.Inc()
+		rejected = append(rejected,
+			TargetResult{Channel: ircChannel, Status: targetIgnored, Reason: "not_allowed"})
+	}
+	return allowed, rejected
+}
+
+// redirectDisabled replaces the disabled channels among ircChannels by those
+// their alerts are redirected to. It returns the channels to relay to, the
+// disabled channels the redirected ones come from, and the results for the
+// disabled channels whose alerts are dropped.
+func (s *HTTPServer) redirectDisabled(ircChannels []string, logPrefix string) ([]string, map[string]string, []TargetResult) {
+	s.disabledMu.Lock()
+	defer s.disabledMu.Unlock()
+
+	targets := []string{}
+	redirectedFrom := make(map[string]string)
+	dropped := []TargetResult{}
+	for _, ircChannel := range ircChannels {
+		redirectTo, disabled := s.disabled[ircChannel]
+		if !disabled {
+			targets = append(targets, ircChannel)
+			continue
+		}
+		if redirectTo == "" {
+			logging.Info("%sNot relaying webhook to %s: the channel is disabled", logPrefix, ircChannel)
+			s.metrics.webhookDisabledChannelDrops.WithLabelValues(ircChannel).Inc()
+			dropped = append(dropped,
+				TargetResult{Channel: ircChannel, Status: targetIgnored, Reason: "disabled"})
+			continue
+		}
+		logging.Debug("%sRelaying webhook for disabled channel %s to %s", logPrefix, ircChannel, redirectTo)
+		targets = append(targets, redirectTo)
+		if _, ok := redirectedFrom[redirectTo]; !ok {
+			redirectedFrom[redirectTo] = ircChannel
+		}
+	}
+	targets = uniqueChannels(targets)
+	// A channel the webhook is sent to directly is not redirected to.
+	for _, ircChannel := range ircChannels {
+		delete(redirectedFrom, ircChannel)
+	}
+	return targets, redirectedFrom, dropped
+}
+
+// channelTopic returns the topic of the channel, as seen by the first
+// connection in it, or "" if none is.
+func (s *HTTPServer) channelTopic(ircChannel string) string {
+	for _, notifier := range s.Notifiers {
+		if topic, ok := notifier.ChannelTopic(ircChannel); ok {
+			return topic
+		}
+	}
+	return ""
+}
+
+// channelJoined tells whether a connection is in the channel. It is assumed
+// to be when no connection reports its state, e.g. in tests.
+func (s *HTTPServer) channelJoined(ircChannel string) bool {
+	for _, notifier := range s.Notifiers {
+		if _, ok := notifier.ChannelTopic(ircChannel); ok {
+			return true
+		}
+	}
+	return len(s.Notifiers) == 0
+}
+
+func (s *HTTPServer) addStaticLabels(labels promtmpl.KV) promtmpl.KV {
+	if labels == nil {
+		labels = promtmpl.KV{}
+	}
+	for name, value := range s.staticLabels {
+		if _, ok := labels[name]; !ok || s.overrideLabels {
+			labels[name] = value
+		}
+	}
+	return labels
+}
+
+// enrichAlerts adds the static labels to the alerts. The common labels are
+// those the enriched alerts share, as alerts which had their own value of a
+// static label keep it unless overridden.
+func (s *HTTPServer) enrichAlerts(data *promtmpl.Data) {
+	if len(s.staticLabels) == 0 {
+		return
+	}
+	for i := range data.Alerts {
+		data.Alerts[i].Labels = s.addStaticLabels(data.Alerts[i].Labels)
+	}
+	if len(data.Alerts) == 0 {
+		data.CommonLabels = s.addStaticLabels(data.CommonLabels)
+		return
+	}
+	common := promtmpl.KV{}
+	for name, value := range data.Alerts[0].Labels {
+		common[name] = value
+	}
+	for _, alert := range data.Alerts[1:] {
+		for name, value := range common {
+			if other, ok := alert.Labels[name]; !ok || other != value {
+				delete(common, name)
+			}
+		}
+	}
+	data.CommonLabels = common
+}
+
+// RelayAlert relays a webhook to the channels named in the URL path,
+// separated by commas.
 func (s *HTTPServer) RelayAlert(w http.ResponseWriter, r *http.Request) {
-	vars := mux.Vars(r)
-	ircChannel := "#" + vars["IRCChannel"]
+	ircChannels := []string{}
+	for _, name := range strings.Split(mux.Vars(r)["IRCChannel"], ",") {
+		if name != "" {
+			ircChannels = append(ircChannels, "#"+name)
+		}
+	}
+	if len(ircChannels) == 0 {
+		http.Error(w, "no channel given in the URL path", http.StatusBadRequest)
+		return
+	}
+	s.relayAlert(w, r, uniqueChannels(ircChannels))
+}
+
+// RelayAlertFromBody relays a webhook to the channels named in its payload,
+// see channelsFromBody.
+func (s *HTTPServer) RelayAlertFromBody(w http.ResponseWriter, r *http.Request) {
+	s.relayAlert(w, r, nil)
+}
+
+// normalizeChannel prefixes channel names given without their "#".
+func normalizeChannel(channel string) string {
+	channel = strings.TrimSpace(channel)
+	if !strings.HasPrefix(channel, "#") && !strings.HasPrefix(channel, "&") {
+		channel = "#" + channel
+	}
+	return channel
+}
+
+// uniqueChannels returns the channels without duplicates, in order.
+func uniqueChannels(channels []string) []string {
+	seen := map[string]bool{}
+	unique := []string{}
+	for _, channel := range channels {
+		if !seen[channel] {
+			seen[channel] = true
+			unique = append(unique, channel)
+		}
+	}
+	return unique
+}
+
+// parseChannelNames normalizes the channel names given in a payload,
+// skipping empty ones.
+func parseChannelNames(names []string) ([]string, error) {
+	channels := []string{}
+	for _, name := range names {
+		if name = strings.TrimSpace(name); name == "" {
+			continue
+		}
+		if strings.ContainsAny(name, " ,\x07") {
+			return nil, fmt.Errorf("invalid channel name %q", name)
+		}
+		channels = append(channels, normalizeChannel(name))
+	}
+	return uniqueChannels(channels), nil
+}
+
+// channelFieldNames returns the channel names of the channel field of a
+// payload: a string, possibly separated by commas, or an array of strings.
+func channelFieldNames(raw json.RawMessage) ([]string, error) {
+	var name string
+	if err := json.Unmarshal(raw, &name); err == nil {
+		return strings.Split(name, ","), nil
+	}
+	names := []string{}
+	err := json.Unmarshal(raw, &names)
+	return names, err
+}
+
+// channelsFromBody returns the channels named by the channelField field of
+// the payload, which may name several, separated by commas. It returns none
+// if the alerts name their channels in their channelLabel label instead, or
+// those of the common label if there is no alert.
+func (s *HTTPServer) channelsFromBody(body []byte, message *WebhookMessage) ([]string, error) {
+	channels := []string{}
+	if s.channelField != "" {
+		fields := map[string]json.RawMessage{}
+		if err := json.Unmarshal(body, &fields); err == nil {
+			if raw, ok := fields[s.channelField]; ok {
+				names, err := channelFieldNames(raw)
+				if err != nil {
+					return nil, fmt.Errorf("field \"%s\" of the payload must be a string or an array of strings", s.channelField)
+				}
+				if channels, err = parseChannelNames(names); err != nil {
+					return nil, err
+				}
+			}
+		}
+	}
+	if len(channels) == 0 && len(message.Alerts) == 0 && s.channelLabel != "" {
+		channels, _ = s.parseLabelChannels(message.CommonLabels[s.channelLabel])
+	}
+	if len(channels) == 0 && !s.labelNamesChannels(message) {
+		expected := []string{}
+		if s.channelField != "" {
+			expected = append(expected, fmt.Sprintf("the \"%s\" field of the payload", s.channelField))
+		}
+		if s.channelLabel != "" {
+			expected = append(expected, fmt.Sprintf("the \"%s\" label of the alerts", s.channelLabel))
+		}
+		return nil, fmt.Errorf("no channel given, expected in %s", strings.Join(expected, " or "))
+	}
+	return channels, nil
+}
+
+// labelValue returns the channelLabel label of the alert, or else the one
+// common to the alerts of the message.
+func (s *HTTPServer) labelValue(alert *promtmpl.Alert, message *WebhookMessage) string {
+	if value := alert.Labels[s.channelLabel]; value != "" {
+		return value
+	}
+	return message.CommonLabels[s.channelLabel]
+}
+
+// parseLabelChannels splits the value of the channelLabel label of an alert
+// into the channels it names. Unlike in the field, names must have their
+// "#". The entries skipped are returned too, by reason: "empty",
+// "missing_prefix", "invalid" or "not_allowed".
+func (s *HTTPServer) parseLabelChannels(value string) ([]string, []string) {
+	channels := []string{}
+	skipped := []string{}
+	if strings.TrimSpace(value) == "" {
+		return channels, skipped
+	}
+	for _, name := range strings.Split(value, s.channelLabelSeparator) {
+		name = strings.TrimSpace(name)
+		switch {
+		case name == "":
+			skipped = append(skipped, "empty")
+		case !strings.HasPrefix(name, "#") && !strings.HasPrefix(name, "&"):
+			skipped = append(skipped, "missing_prefix")
+		case strings.ContainsAny(name, " ,\x07"):
+			skipped = append(skipped, "invalid")
+		case !s.channelAllowed(name, true):
+			skipped = append(skipped, "not_allowed")
+		default:
+			channels = append(channels, name)
+		}
+	}
+	return uniqueChannels(channels), skipped
+}
+
+// labelNamesChannels tells whether the channelLabel label of an alert of the
+// message names a channel.
+func (s *HTTPServer) labelNamesChannels(message *WebhookMessage) bool {
+	if s.channelLabel == "" {
+		return false
+	}
+	for i := range message.Alerts {
+		if channels, _ := s.parseLabelChannels(s.labelValue(&message.Alerts[i], message)); len(channels) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// labelTargets returns the channels named by the channelLabel label of the
+// alerts of the message, in order, with the indexes of the alerts naming
+// each. The entries skipped are logged and counted.
+func (s *HTTPServer) labelTargets(message *WebhookMessage, logPrefix string) ([]string, map[string][]int) {
+	channels := []string{}
+	alerts := make(map[string][]int)
+	if s.channelLabel == "" {
+		return channels, alerts
+	}
+	for i := range message.Alerts {
+		value := s.labelValue(&message.Alerts[i], message)
+		named, skipped := s.parseLabelChannels(value)
+		if len(skipped) > 0 {
+			logging.Warn("%sSkipping %d of the channels named by %s=%q (%s)",
+				logPrefix, len(skipped), s.channelLabel, value, strings.Join(skipped, ", "))
+		}
+		for _, reason := range skipped {
+			s.metrics.webhookChannelLabelSkipped.WithLabelValues(reason).Inc()
+		}
+		for _, channel := range named {
+			if _, ok := alerts[channel]; !ok {
+				channels = append(channels, channel)
+			}
+			alerts[channel] = append(alerts[channel], i)
+		}
+	}
+	return channels, alerts
+}
+
+// What became of a webhook for one of its channels, when answering it.
+// Messages are sent asynchronously, so "sent" is never known by then.
+const (
+	// Messages were queued for the channel, which we are in.
+	targetQueued = "queued"
+	// Messages were queued for the channel, which no connection is in
+	// yet, e.g. while joining it.
+	targetAwaitingJoin = "awaiting_join"
+	// The alerts are kept for the digest of the channel, or until its
+	// quiet hours are over.
+	targetBuffered = "buffered"
+	// Nothing is to be relayed, as Reason tells.
+	targetIgnored = "ignored"
+	// Some messages were dropped, as Reason tells.
+	targetDropped = "dropped"
+	// The alert was delivered already, when a webhook is retried.
+	targetAlreadyDelivered = "already_delivered"
+)
+
+// WebhookResponse is the document answering webhooks that were relayed.
+type WebhookResponse struct {
+	// RequestID is the correlation ID of the webhook.
+	RequestID string `json:"request_id"`
+	// Alerts is the number of alerts received.
+	Alerts int `json:"alerts"`
+	// Rendered is the number of messages rendered, for all channels.
+	Rendered int            `json:"rendered"`
+	Targets  []TargetResult `json:"targets"`
+}
+
+// TargetResult tells what became of a webhook for one of its channels.
+type TargetResult struct {
+	Channel string `json:"channel"`
+	Status  string `json:"status"`
+	// Messages is the number of messages queued for the channel.
+	Messages int `json:"messages"`
+	// Reason tells why the webhook was ignored or dropped, e.g.
+	// "duplicate" or "queue_full".
+	Reason string `json:"reason,omitempty"`
+	// RedirectedFrom is the disabled channel the webhook was sent to, if
+	// it was redirected to this one.
+	RedirectedFrom string `json:"redirected_from,omitempty"`
+	// Alerts tells what became of each alert, with retry deduplication.
+	Alerts []AlertResult `json:"alerts,omitempty"`
+	// rendered is the number of messages rendered for the channel.
+	rendered int
+}
+
+// AlertResult tells what became of an alert of a webhook for a channel: the
+// status of the channel, or already_delivered, or dropped if some of its
+// messages were.
+type AlertResult struct {
+	Fingerprint string `json:"fingerprint"`
+	Status      string `json:"status"`
+}
+
+func writeWebhookResponse(w http.ResponseWriter, status int, response *WebhookResponse) {
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(response); err != nil {
+		logging.Error("Could not write webhook response: %s", err)
+	}
+}
+
+// jsonContentType tells whether the request announces a JSON body, or none
+// if allowMissing is set.
+func jsonContentType(r *http.Request, allowMissing bool) bool {
+	contentType := r.Header.Get("Content-Type")
+	if contentType == "" {
+		return allowMissing
+	}
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	return err == nil && (mediaType == "application/json" || strings.HasSuffix(mediaType, "+json"))
+}
+
+// DecodeError is the document answering webhooks which could not be
+// decoded, telling where the decoder gave up, when it tells.
+type DecodeError struct {
+	Error  string `json:"error"`
+	Offset int64  `json:"offset,omitempty"`
+	Field  string `json:"field,omitempty"`
+}
+
+func newDecodeError(err error) DecodeError {
+	var syntaxErr *json.SyntaxError
+	var typeErr *json.UnmarshalTypeError
+	switch {
+	case errors.As(err, &syntaxErr):
+		return DecodeError{
+			Error:  fmt.Sprintf("invalid JSON at offset %d: %s", syntaxErr.Offset, syntaxErr),
+			Offset: syntaxErr.Offset,
+		}
+	case errors.As(err, &typeErr):
+		return DecodeError{
+			Error: fmt.Sprintf("field %s at offset %d must be a %s, not a %s",
+				typeErr.Field, typeErr.Offset, typeErr.Type, typeErr.Value),
+			Offset: typeErr.Offset,
+			Field:  typeErr.Field,
+		}
+	}
+	return DecodeError{Error: err.Error()}
+}
 
-	body, err := ioutil.ReadAll(io.LimitReader(r.Body, 1024*1024*1024))
+// relayAlert relays a webhook to the channels given, or to those named in
+// its payload if nil.
+func (s *HTTPServer) relayAlert(w http.ResponseWriter, r *http.Request, ircChannels []string) {
+	if allowed, ip := s.sourceAllowlist.Allowed(r); !allowed {
+		logging.Warn("Rejecting webhook from %s (connected from %s): not in webhook_allowed_cidrs",
+			ip, r.RemoteAddr)
+		s.metrics.webhookForbiddenRequests.Inc()
+		w.WriteHeader(http.StatusForbidden)
+		return
+	}
+
+	s.metrics.webhookLastReceivedTimestamp.SetToCurrentTime()
+
+	if !jsonContentType(r, s.allowMissingContentType) {
+		logging.Warn("Rejecting webhook from %s: unsupported Content-Type %q",
+			s.clients.ClientIP(r), r.Header.Get("Content-Type"))
+		s.metrics.httpRejectedRequests.WithLabelValues("unsupported_media_type").Inc()
+		http.Error(w, "webhooks must have Content-Type application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	correlationID := requestCorrelationID(r, s.correlationIDHeader)
+	logPrefix := correlationPrefix(correlationID)
+	if s.correlationIDHeader != "" {
+		w.Header().Set(s.correlationIDHeader, correlationID)
+	}
+
+	// Until the webhook is decoded, errors are reported for all of its
+	// channels at once.
+	ircChannel := strings.Join(ircChannels, ",")
+
+	span := s.Tracer.StartSpanFromRequest(r, "webhook")
+	if ircChannel != "" {
+		span.SetAttribute("ircchannel", ircChannel)
+	}
+	span.SetAttribute("correlation_id", correlationID)
+	defer span.End()
+
+	decodeSpan := span.StartChild("decode")
+	encoding := r.Header.Get("Content-Encoding")
+	bodyReader, err := decompressedBody(http.MaxBytesReader(w, r.Body, s.maxBodyBytes), encoding)
+	if err == errUnsupportedEncoding {
+		logging.Warn("%sRejecting webhook for %s: unsupported Content-Encoding %q", logPrefix, ircChannel, encoding)
+		s.metrics.httpRejectedRequests.WithLabelValues("unsupported_encoding").Inc()
+		decodeSpan.SetError(err)
+		decodeSpan.End()
+		http.Error(w, "webhooks may only be compressed with gzip or deflate", http.StatusUnsupportedMediaType)
+		return
+	}
+	var body []byte
+	if err == nil {
+		// The limit applies to the decompressed body too, against
+		// zip bombs, with the same error, see isBodyTooLarge.
+		body, err = ioutil.ReadAll(http.MaxBytesReader(w, ioutil.NopCloser(bodyReader), s.maxBodyBytes))
+	}
+	if err != nil && isBodyTooLarge(err) {
+		logging.Error("%sRequest body for %s exceeds %d bytes, rejecting", logPrefix, ircChannel, s.maxBodyBytes)
+		s.metrics.alertHandlingErrors.WithLabelValues(ircChannel, "body_too_large").Inc()
+		decodeSpan.SetError(err)
+		decodeSpan.End()
+		w.WriteHeader(http.StatusRequestEntityTooLarge)
+		return
+	}
+	if err != nil && encoding != "" {
+		logging.Error("%sCould not decompress %s body: %s", logPrefix, encoding, err)
+		s.metrics.httpRejectedRequests.WithLabelValues("invalid_encoding").Inc()
+		decodeSpan.SetError(err)
+		decodeSpan.End()
+		http.Error(w, fmt.Sprintf("invalid %s body: %s", encoding, err), http.StatusBadRequest)
+		return
+	}
 	if err != nil {
-		logging.Error("Could not get body: %s", err)
-		alertHandlingErrors.WithLabelValues(ircChannel, "read_body").Inc()
+		logging.Error("%sCould not get body: %s", logPrefix, err)
+		s.metrics.alertHandlingErrors.WithLabelValues(ircChannel, "read_body").Inc()
+		decodeSpan.SetError(err)
+		decodeSpan.End()
+		return
+	}
+	if status, reason := s.verifier.Verify(r, body); status != 0 {
+		logging.Warn("%sRejecting webhook for %s from %s: %s signature",
+			logPrefix, ircChannel, s.clients.ClientIP(r), reason)
+		decodeSpan.SetError(errors.New(reason + " signature"))
+		decodeSpan.End()
+		http.Error(w, reason+" signature", status)
 		return
 	}
 
-	var alertMessage = promtmpl.Data{}
+	var alertMessage = WebhookMessage{}
 	if err := json.Unmarshal(body, &alertMessage); err != nil {
-		logging.Error("Could not decode request body (%s): %s", err, body)
-		alertHandlingErrors.WithLabelValues(ircChannel, "decode_body").Inc()
+		logging.Error("%sCould not decode request body (%s): %s", logPrefix, err, body)
+		s.metrics.alertHandlingErrors.WithLabelValues(ircChannel, "decode_body").Inc()
+		s.metrics.httpRejectedRequests.WithLabelValues("invalid_json").Inc()
+		decodeSpan.SetError(err)
+		decodeSpan.End()
 		w.Header().Set("Content-Type", "application/json; charset=UTF-8")
-		w.WriteHeader(422) // Unprocessable entity
-		if err := json.NewEncoder(w).Encode(err); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		if err := json.NewEncoder(w).Encode(newDecodeError(err)); err != nil {
 			logging.Error("Could not write decoding error: %s", err)
+		}
+		return
+	}
+	decodeSpan.End()
+	fromPayload := ircChannels == nil
+	if fromPayload {
+		ircChannels, err = s.channelsFromBody(body, &alertMessage)
+		if err != nil {
+			logging.Error("%sRejecting webhook: %s", logPrefix, err)
+			s.metrics.alertHandlingErrors.WithLabelValues("", "no_channel").Inc()
+			http.Error(w, err.Error(), http.StatusBadRequest)
 			return
 		}
+		span.SetAttribute("ircchannel", strings.Join(ircChannels, ","))
+	}
+	ircChannels, rejected := s.allowedChannels(ircChannels, fromPayload, logPrefix)
+	ircChannels, redirectedFrom, dropped := s.redirectDisabled(ircChannels, logPrefix)
+
+	response := &WebhookResponse{
+		RequestID: correlationID,
+		Alerts:    len(alertMessage.Alerts),
+		Targets:   append(rejected, dropped...),
+	}
+	if len(ircChannels) == 0 && len(rejected) > 0 && !s.labelNamesChannels(&alertMessage) {
+		// None of the channels named may be relayed to.
+		writeWebhookResponse(w, http.StatusForbidden, response)
 		return
 	}
-	handledAlertGroups.WithLabelValues(ircChannel).Inc()
-	for _, alertMsg := range s.formatter.GetMsgsFromAlertMessage(
-		ircChannel, &alertMessage) {
+	if len(alertMessage.Alerts) == 0 {
+		for _, ircChannel := range ircChannels {
+			s.metrics.webhookEmptyPayloads.WithLabelValues(ircChannel).Inc()
+			if s.logEmptyWebhooks {
+				logging.Debug("%sWebhook for %s has no alert, ignoring it", logPrefix, ircChannel)
+			}
+			response.Targets = append(response.Targets, TargetResult{
+				Channel: ircChannel, Status: targetIgnored, Reason: "empty",
+				RedirectedFrom: redirectedFrom[ircChannel]})
+		}
+		writeWebhookResponse(w, http.StatusOK, response)
+		return
+	}
+	s.enrichAlerts(&alertMessage.Data)
+	alertMessage.Alerts = s.Watchdog.FilterAlerts(alertMessage.Alerts)
+	var channelAlerts map[string][]int
+	ircChannels, channelAlerts, response.Targets = s.addLabelTargets(&alertMessage,
+		ircChannels, redirectedFrom, response.Targets, logPrefix)
+
+	retries := s.retries
+	if r.URL.Query().Get(retryDedupParam) == "false" {
+		retries = nil
+	}
+	status := http.StatusOK
+	alertMessage.sequence = s.Sequencer.Begin()
+	queued := make(map[string]int)
+	for _, ircChannel := range ircChannels {
+		channelMessage := alertMessage
+		if indexes, ok := channelAlerts[ircChannel]; ok {
+			channelMessage.Alerts = alertsAt(alertMessage.Alerts, indexes)
+		}
+		result := s.relayToChannel(r, ircChannel, channelMessage, body, span, correlationID, retries)
+		queued[ircChannel] += result.Messages
+		result.RedirectedFrom = redirectedFrom[ircChannel]
+		response.Rendered += result.rendered
+		response.Targets = append(response.Targets, result)
+		if result.Status == targetDropped && retries != nil {
+			// Alertmanager retries the webhook, the alerts already
+			// delivered being skipped then.
+			status = http.StatusServiceUnavailable
+		}
+	}
+	s.Sequencer.End(alertMessage.sequence, queued)
+	writeWebhookResponse(w, status, response)
+}
+
+// addLabelTargets adds the channels named by the channelLabel label of the
+// alerts of the message to the targets of the webhook, after redirecting or
+// dropping those disabled, the latter being added to dropped. The channels
+// the webhook was not relayed to already only get the alerts naming them,
+// returned by index.
+func (s *HTTPServer) addLabelTargets(message *WebhookMessage, targets []string, redirectedFrom map[string]string, dropped []TargetResult, logPrefix string) ([]string, map[string][]int, []TargetResult) {
+	labelChannels, labelAlerts := s.labelTargets(message, logPrefix)
+	isTarget := make(map[string]bool)
+	for _, target := range targets {
+		isTarget[target] = true
+	}
+	isDropped := make(map[string]bool)
+	for _, result := range dropped {
+		isDropped[result.Channel] = true
+	}
+
+	channelAlerts := make(map[string][]int)
+	for _, labelChannel := range labelChannels {
+		redirected, from, labelDropped := s.redirectDisabled([]string{labelChannel}, logPrefix)
+		for _, result := range labelDropped {
+			if !isDropped[result.Channel] {
+				isDropped[result.Channel] = true
+				dropped = append(dropped, result)
+			}
+		}
+		for _, target := range redirected {
+			if isTarget[target] && channelAlerts[target] == nil {
+				// The webhook is relayed there in full already.
+				continue
+			}
+			if !isTarget[target] {
+				isTarget[target] = true
+				targets = append(targets, target)
+				if source, ok := from[target]; ok {
+					redirectedFrom[target] = source
+				}
+			}
+			channelAlerts[target] = append(channelAlerts[target], labelAlerts[labelChannel]...)
+		}
+	}
+	return targets, channelAlerts, dropped
+}
+
+// alertsAt returns the alerts at the indexes, once each and in order.
+func alertsAt(alerts promtmpl.Alerts, indexes []int) promtmpl.Alerts {
+	picked := make(map[int]bool)
+	for _, i := range indexes {
+		picked[i] = true
+	}
+	subset := promtmpl.Alerts{}
+	for i := range alerts {
+		if picked[i] {
+			subset = append(subset, alerts[i])
+		}
+	}
+	return subset
+}
+
+// relayToChannel relays the decoded webhook to one of its channels. Each
+// channel has its own deduplication, filters and digest. With retries, the
+// alerts already delivered to the channel are skipped, and the fate of each
+// alert is told.
+func (s *HTTPServer) relayToChannel(r *http.Request, ircChannel string, alertMessage WebhookMessage, body []byte, span *Span, correlationID string, retries *RetryDeduplicator) TargetResult {
+	logPrefix := correlationPrefix(correlationID)
+	result := TargetResult{Channel: ircChannel, Status: targetIgnored}
+
+	if s.deduplicator.Duplicate(ircChannel, body) {
+		logging.Info("%sWebhook for %s already delivered, not relaying it again", logPrefix, ircChannel)
+		result.Reason = "duplicate"
+		return result
+	}
+	alerts := alertMessage.Alerts
+	remaining, skipped := retries.Filter(ircChannel, alertMessage.GroupKey, alerts)
+	if len(skipped) > 0 {
+		logging.Info("%sSkipping %d alerts of %s already delivered to %s",
+			logPrefix, len(skipped), alertMessage.GroupKey, ircChannel)
+	}
+	var dropped map[string]bool
+	if len(remaining) == 0 && len(skipped) > 0 {
+		result.Reason = "duplicate"
+	} else {
+		alertMessage.Alerts = remaining
+		result, dropped = s.relayAlerts(r, ircChannel, alertMessage, span, correlationID)
+	}
+	if retries == nil {
+		return result
+	}
+	if result.Status == targetDropped {
+		// Not to ignore the retry of the webhook as a duplicate.
+		s.deduplicator.Forget(ircChannel, body)
+	}
+
+	isSkipped := make(map[string]bool)
+	for i := range skipped {
+		isSkipped[alertFingerprint(&skipped[i])] = true
+	}
+	// The alerts none of the messages of which were dropped were queued.
+	deliveredStatus := result.Status
+	if deliveredStatus == targetDropped {
+		deliveredStatus = targetQueued
+		if !s.channelJoined(ircChannel) {
+			deliveredStatus = targetAwaitingJoin
+		}
+	}
+	delivered := promtmpl.Alerts{}
+	result.Alerts = []AlertResult{}
+	for i := range alerts {
+		fingerprint := alertFingerprint(&alerts[i])
+		status := deliveredStatus
+		if isSkipped[fingerprint] {
+			status = targetAlreadyDelivered
+		} else if dropped[fingerprint] || dropped[""] {
+			status = targetDropped
+		} else {
+			delivered = append(delivered, alerts[i])
+		}
+		result.Alerts = append(result.Alerts, AlertResult{Fingerprint: fingerprint, Status: status})
+	}
+	retries.Record(ircChannel, alertMessage.GroupKey, delivered)
+	return result
+}
+
+// relayAlerts relays the alerts of the webhook to the channel, after its
+// filters and digest. It returns the fingerprints of the alerts some messages
+// of which were dropped, the empty one standing for messages about the whole
+// group.
+func (s *HTTPServer) relayAlerts(r *http.Request, ircChannel string, alertMessage WebhookMessage, span *Span, correlationID string) (TargetResult, map[string]bool) {
+	logPrefix := correlationPrefix(correlationID)
+	result := TargetResult{Channel: ircChannel, Status: targetIgnored}
+	dropped := make(map[string]bool)
+
+	s.metrics.handledAlertGroups.WithLabelValues(ircChannel).Inc()
+	alertMessage.Alerts = s.FlapDetector.FilterAlerts(ircChannel, alertMessage.Alerts)
+	alertMessage.Alerts = s.cooldown.FilterAlerts(ircChannel, alertMessage.Alerts)
+	if len(alertMessage.Alerts) == 0 {
+		logging.Debug("%sNo alert for %s left to relay after filtering", logPrefix, ircChannel)
+		result.Reason = "filtered"
+		return result, dropped
+	}
+	if s.Digester.Add(ircChannel, alertMessage.Alerts) {
+		logging.Debug("%sKeeping %d alerts for the digest of %s", logPrefix, len(alertMessage.Alerts), ircChannel)
+		result.Status = targetBuffered
+		return result, dropped
+	}
+
+	alertMessage.Alerts = s.QuietHours.Hold(ircChannel, alertMessage.Alerts, func(held promtmpl.Alerts) []AlertMsg {
+		heldMessage := alertMessage
+		heldMessage.Alerts = held
+		return s.getFormatter().GetCorrelatedMsgsFromAlertMessage(ircChannel, &heldMessage, correlationID)
+	})
+	if len(alertMessage.Alerts) == 0 {
+		logging.Debug("%sHolding the alerts to %s during its quiet hours", logPrefix, ircChannel)
+		result.Status = targetBuffered
+		result.Reason = "quiet_hours"
+		return result, dropped
+	}
+	if s.Storms.Add(ircChannel, alertMessage.Alerts) {
+		logging.Debug("%sKeeping %d alerts for the storm summary of %s", logPrefix, len(alertMessage.Alerts), ircChannel)
+		result.Status = targetBuffered
+		result.Reason = "storm"
+		return result, dropped
+	}
+
+	renderSpan := span.StartChild("render")
+	renderSpan.SetAttribute("ircchannel", ircChannel)
+	alertMsgs, msgFingerprints := s.getFormatter().GetAlertFingerprintedMsgs(ircChannel, &alertMessage, correlationID)
+	renderSpan.End()
+	result.rendered = len(alertMsgs)
+	result.Status = targetQueued
+	if !s.channelJoined(ircChannel) {
+		result.Status = targetAwaitingJoin
+	}
+	logging.Info("%sRelaying %d messages to %s from webhook sent by %s",
+		logPrefix, len(alertMsgs), ircChannel, s.clients.ClientIP(r))
+
+	var fingerprints []string
+	if s.Pending != nil {
+		fingerprints = alertFingerprints(alertMessage.Alerts)
+	}
+	for i, alertMsg := range alertMsgs {
+		alertMsg.sequence = alertMessage.sequence
+		alertMsg.Span = span.StartChild("queue_wait")
+		// Tracked before being queued, so that it cannot be sent
+		// before.
+		s.Pending.Add(&alertMsg, fingerprints)
 		select {
 		case s.AlertMsgs <- alertMsg:
-			handledAlerts.WithLabelValues(ircChannel).Inc()
+			s.metrics.handledAlerts.WithLabelValues(ircChannel).Inc()
+			result.Messages++
 		default:
-			logging.Error("Could not send this alert to the IRC routine: %s",
-				alertMsg)
-			alertHandlingErrors.WithLabelValues(ircChannel, "internal_comm_channel_full").Inc()
+			logging.Error("%sCould not send this alert to the IRC routine: %s",
+				logPrefix, alertMsg)
+			s.metrics.alertHandlingErrors.WithLabelValues(ircChannel, "internal_comm_channel_full").Inc()
+			alertMsg.Span.SetError(errors.New("internal channel full"))
+			alertMsg.Span.End()
+			s.Pending.Done(&alertMsg)
+			result.Status = targetDropped
+			result.Reason = "queue_full"
+			dropped[msgFingerprints[i]] = true
 		}
 	}
+	return result, dropped
 }
 
-func (s *HTTPServer) Run() {
-	router := mux.NewRouter().StrictSlash(true)
+// Status is the document served on /status.
+type Status struct {
+	Build       BuildInfo          `json:"build"`
+	Connections []ConnectionStatus `json:"connections"`
+	// FingerprintTokens is the number of fingerprint tokens remembered.
+	FingerprintTokens int `json:"fingerprint_tokens"`
+	// Fingerprint describes the alert behind the token given with
+	// ?fingerprint=.
+	Fingerprint *FingerprintStatus `json:"fingerprint,omitempty"`
+}
 
-	router.Path("/metrics").Handler(promhttp.Handler())
+// FingerprintStatus tells the labels of the alert behind a fingerprint
+// token, if it was rendered recently.
+type FingerprintStatus struct {
+	Token  string            `json:"token"`
+	Found  bool              `json:"found"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func (s *HTTPServer) ServeStatus(w http.ResponseWriter, r *http.Request) {
+	status := Status{
+		Build:             GetBuildInfo(),
+		Connections:       []ConnectionStatus{},
+		FingerprintTokens: s.fingerprints.Len(),
+	}
+	for _, notifier := range s.Notifiers {
+		status.Connections = append(status.Connections, notifier.Status())
+	}
+	if token := r.URL.Query().Get("fingerprint"); token != "" {
+		labels, found := s.fingerprints.Lookup(token)
+		status.Fingerprint = &FingerprintStatus{Token: token, Found: found, Labels: labels}
+	}
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logging.Error("Could not write status: %s", err)
+	}
+}
 
-	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		s.RelayAlert(w, r)
+// ServeQueue lists the messages waiting to be sent, to all channels or to the
+// one in the path. It requires the queue_api_token as bearer token.
+func (s *HTTPServer) ServeQueue(w http.ResponseWriter, r *http.Request) {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Bearer ") ||
+		subtle.ConstantTimeCompare([]byte(strings.TrimPrefix(token, "Bearer ")), []byte(s.queueAPIToken)) != 1 {
+		w.Header().Set("WWW-Authenticate", "Bearer")
+		http.Error(w, "invalid or missing bearer token", http.StatusUnauthorized)
+		return
+	}
+	entries := defaultQueueEntries
+	if value := r.URL.Query().Get("entries"); value != "" {
+		var err error
+		if entries, err = strconv.Atoi(value); err != nil || entries < 0 || entries > maxQueueEntries {
+			http.Error(w, fmt.Sprintf("entries must be a number from 0 to %d", maxQueueEntries), http.StatusBadRequest)
+			return
+		}
+	}
+	channel := ""
+	if name := mux.Vars(r)["channel"]; name != "" {
+		channel = normalizeChannel(name)
+	}
+
+	status := s.Pending.Snapshot(channel, entries)
+	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
+	if err := json.NewEncoder(w).Encode(status); err != nil {
+		logging.Error("Could not write queue: %s", err)
+	}
+}
+
+// instrumentHandler is a middleware exporting request metrics. Requests are
+// labelled with the name of the route they matched rather than their path,
+// which contains channel names.
+func (s *HTTPServer) instrumentHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		handlerName := "unknown"
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() != "" {
+			handlerName = route.GetName()
+		}
+		labels := prometheus.Labels{"handler": handlerName}
+
+		promhttp.InstrumentHandlerInFlight(s.metrics.httpRequestsInFlight,
+			promhttp.InstrumentHandlerDuration(
+				s.metrics.httpRequestDuration.MustCurryWith(labels),
+				promhttp.InstrumentHandlerCounter(
+					s.metrics.httpRequests.MustCurryWith(labels),
+					next))).ServeHTTP(w, r)
+	})
+}
+
+// allowedMethods returns the methods the router serves the path of the
+// request with.
+func allowedMethods(router *mux.Router, r *http.Request) []string {
+	allowed := []string{}
+	for _, method := range []string{"GET", "POST"} {
+		probe := r.Clone(r.Context())
+		probe.Method = method
+		match := mux.RouteMatch{}
+		if router.Match(probe, &match) && match.MatchErr == nil {
+			allowed = append(allowed, method)
+		}
+	}
+	return allowed
+}
+
+func (s *HTTPServer) newRouter() *mux.Router {
+	router := mux.NewRouter().StrictSlash(true)
+	router.Use(s.instrumentHandler)
+	router.MethodNotAllowedHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		allowed := strings.Join(allowedMethods(router, r), ", ")
+		s.metrics.httpRejectedRequests.WithLabelValues("method_not_allowed").Inc()
+		w.Header().Set("Allow", allowed)
+		http.Error(w, fmt.Sprintf("%s is not allowed, only %s", r.Method, allowed), http.StatusMethodNotAllowed)
 	})
-	router.Path("/{IRCChannel}").Handler(handler).Methods("POST")
+	return router
+}
 
+func (s *HTTPServer) listen(name string, addr string, port int, router http.Handler) {
 	listenAddr := strings.Join(
-		[]string{s.Addr, strconv.Itoa(s.Port)}, ":")
-	logging.Info("Starting HTTP server")
+		[]string{addr, strconv.Itoa(port)}, ":")
+	logging.Info("Starting %s on %s", name, listenAddr)
 	if err := s.httpListener(listenAddr, router); err != nil {
-		logging.Error("Could not start http server: %s", err)
+		logging.Error("Could not start %s: %s", name, err)
+	}
+}
+
+// apiPrefix prefixes the paths of the API, which are kept stable within a
+// version.
+const apiPrefix = "/api/v1"
+
+// setupRoutes registers the webhook endpoints on router, and the operational
+// ones on internalRouter, which may be the same. Endpoints are served under
+// apiPrefix, and under their legacy unversioned paths unless legacyRoutes is
+// unset. Legacy routes have the same names, for metrics. /metrics is where
+// Prometheus expects it.
+func (s *HTTPServer) setupRoutes(router *mux.Router, internalRouter *mux.Router) {
+	internalRouter.Path("/metrics").Name("metrics").Handler(
+		promhttp.HandlerFor(s.metrics.registry, promhttp.HandlerOpts{}))
+
+	prefixes := []string{apiPrefix}
+	if s.legacyRoutes {
+		prefixes = append(prefixes, "")
+	}
+	for _, prefix := range prefixes {
+		internalRouter.Path(prefix + "/status").Name("status").HandlerFunc(s.ServeStatus).Methods("GET")
+		if s.queueAPIToken != "" {
+			internalRouter.Path(prefix + "/queue").Name("queue").HandlerFunc(s.ServeQueue).Methods("GET")
+			internalRouter.Path(prefix + "/queue/{channel}").Name("queue_channel").HandlerFunc(s.ServeQueue).Methods("GET")
+		}
+	}
+
+	router.Path(apiPrefix + "/webhook").Name("webhook_body").HandlerFunc(s.RelayAlertFromBody).Methods("POST")
+	router.Path(apiPrefix + "/webhook/{IRCChannel}").Name("webhook").HandlerFunc(s.RelayAlert).Methods("POST")
+	if s.legacyRoutes {
+		router.Path("/api/webhook").Name("webhook_body").HandlerFunc(s.RelayAlertFromBody).Methods("POST")
+		// Registered last, as it matches any other path.
+		router.Path("/{IRCChannel}").Name("webhook").HandlerFunc(s.RelayAlert).Methods("POST")
+	}
+}
+
+// Run serves webhooks, and the operational endpoints on the same listener
+// unless InternalPort is set.
+func (s *HTTPServer) Run() {
+	router := s.newRouter()
+	internalRouter := router
+	if s.InternalPort != 0 {
+		internalRouter = s.newRouter()
+	}
+
+	s.setupRoutes(router, internalRouter)
+
+	if s.InternalPort != 0 {
+		go s.listen("internal HTTP server", s.InternalAddr, s.InternalPort, internalRouter)
 	}
+	s.listen("HTTP server", s.Addr, s.Port, router)
 }
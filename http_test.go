@@ -15,12 +15,26 @@
 package main
 
 import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/json"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 type FakeHTTPListener struct {
@@ -48,17 +62,42 @@ func NewFakeHTTPListener() *FakeHTTPListener {
 
 func MakeHTTPTestingConfig() *Config {
 	return &Config{
-		HTTPHost:    "test.web",
-		HTTPPort:    8888,
-		MsgTemplate: "Alert {{ .Labels.alertname }} on {{ .Labels.instance }} is {{ .Status }}",
+		HTTPHost:         "test.web",
+		HTTPPort:         8888,
+		MsgTemplate:      "Alert {{ .Labels.alertname }} on {{ .Labels.instance }} is {{ .Status }}",
+		HTTPLegacyRoutes: true,
 	}
 }
 
 func RunHTTPTest(t *testing.T,
 	alertData string, url string,
 	testingConfig *Config, listener *FakeHTTPListener) *http.Response {
+	return RunHTTPTestWithMetrics(t, alertData, url, testingConfig, listener,
+		NewMetrics(prometheus.NewRegistry()))
+}
+
+func RunHTTPTestWithMetrics(t *testing.T,
+	alertData string, url string,
+	testingConfig *Config, listener *FakeHTTPListener,
+	metrics *Metrics) *http.Response {
+	return RunHTTPRequest(t, "POST", alertData, url, testingConfig, listener,
+		metrics)
+}
+
+func RunHTTPRequest(t *testing.T,
+	method string, body string, url string,
+	testingConfig *Config, listener *FakeHTTPListener,
+	metrics *Metrics) *http.Response {
+	return RunHTTPRequestWithHeaders(t, method, body, url, nil,
+		testingConfig, listener, metrics)
+}
+
+func RunHTTPRequestWithHeaders(t *testing.T,
+	method string, body string, url string, headers map[string]string,
+	testingConfig *Config, listener *FakeHTTPListener,
+	metrics *Metrics) *http.Response {
 	httpServer, err := NewHTTPServerForTesting(testingConfig,
-		listener.AlertMsgs, listener.Serve)
+		listener.AlertMsgs, listener.Serve, metrics)
 	if err != nil {
 		t.Fatal(fmt.Sprintf("Could not create HTTP server: %s", err))
 	}
@@ -67,11 +106,17 @@ func RunHTTPTest(t *testing.T,
 
 	<-listener.StartedServing
 
-	alertDataReader := strings.NewReader(alertData)
-	request, err := http.NewRequest("POST", url, alertDataReader)
+	bodyReader := strings.NewReader(body)
+	request, err := http.NewRequest(method, url, bodyReader)
 	if err != nil {
 		t.Fatal(fmt.Sprintf("Could not create HTTP request: %s", err))
 	}
+	if method == "POST" {
+		request.Header.Set("Content-Type", "application/json")
+	}
+	for name, value := range headers {
+		request.Header.Set(name, value)
+	}
 	responseRecorder := httptest.NewRecorder()
 
 	listener.router.ServeHTTP(responseRecorder, request)
@@ -105,8 +150,18 @@ func TestAlertsDispatched(t *testing.T) {
 			expectedStatusCode, response.StatusCode))
 	}
 
+	correlationID := ""
 	for _, expectedAlertMsg := range expectedAlertMsgs {
 		alertMsg := <-listener.AlertMsgs
+		// Messages of a delivery share its generated correlation ID.
+		if alertMsg.CorrelationID == "" {
+			t.Error("Expected a correlation ID")
+		}
+		if correlationID != "" && alertMsg.CorrelationID != correlationID {
+			t.Errorf("Expected correlation ID %s, got %s", correlationID, alertMsg.CorrelationID)
+		}
+		correlationID = alertMsg.CorrelationID
+		expectedAlertMsg.CorrelationID = correlationID
 		if !reflect.DeepEqual(expectedAlertMsg, alertMsg) {
 			t.Error(fmt.Sprintf(
 				"Unexpected alert msg.\nExpected: %s\nActual: %s",
@@ -135,7 +190,7 @@ func TestInvalidDataReturnsError(t *testing.T) {
 	listener := NewFakeHTTPListener()
 	testingConfig := MakeHTTPTestingConfig()
 
-	expectedStatusCode := 422
+	expectedStatusCode := 400
 
 	response := RunHTTPTest(
 		t, testdataBogusAlertJson, "/somechannel",
@@ -145,4 +200,953 @@ func TestInvalidDataReturnsError(t *testing.T) {
 		t.Error(fmt.Sprintf("Expected %d status in response, got %d",
 			expectedStatusCode, response.StatusCode))
 	}
+	decodeError := DecodeError{}
+	if err := json.NewDecoder(response.Body).Decode(&decodeError); err != nil {
+		t.Fatalf("Could not decode error: %s", err)
+	}
+	if decodeError.Offset != 33 || !strings.Contains(decodeError.Error, "offset 33") {
+		t.Errorf("Expected the error to tell the offset, got %+v", decodeError)
+	}
+}
+
+func TestWrongFieldTypeReturnsError(t *testing.T) {
+	response := RunHTTPTest(
+		t, `{"status": "firing", "alerts": "none"}`, "/somechannel",
+		MakeHTTPTestingConfig(), NewFakeHTTPListener())
+
+	if response.StatusCode != 400 {
+		t.Errorf("Expected 400 status in response, got %d", response.StatusCode)
+	}
+	decodeError := DecodeError{}
+	if err := json.NewDecoder(response.Body).Decode(&decodeError); err != nil {
+		t.Fatalf("Could not decode error: %s", err)
+	}
+	if decodeError.Field != "alerts" {
+		t.Errorf("Expected the error to tell the field, got %+v", decodeError)
+	}
+}
+
+func compress(t *testing.T, encoding string, data string) string {
+	var b bytes.Buffer
+	var writer io.WriteCloser
+	switch encoding {
+	case "gzip":
+		writer = gzip.NewWriter(&b)
+	case "zlib":
+		writer = zlib.NewWriter(&b)
+	case "flate":
+		var err error
+		if writer, err = flate.NewWriter(&b, flate.DefaultCompression); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := writer.Write([]byte(data)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return b.String()
+}
+
+func TestCompressedBodies(t *testing.T) {
+	// Compresses to a few hundred bytes, well within the limit, but
+	// exceeds it once decompressed.
+	bomb := `{"status": "firing", "alerts": [], "padding": "` + strings.Repeat("0", 1<<20) + `"}`
+	for _, tc := range []struct {
+		name     string
+		encoding string
+		body     string
+		expected int
+		alerts   int
+		rejected string
+	}{
+		{"gzip", "gzip", compress(t, "gzip", testdataSimpleAlertJson), 200, 2, ""},
+		{"deflate", "deflate", compress(t, "zlib", testdataSimpleAlertJson), 200, 2, ""},
+		{"raw deflate", "deflate", compress(t, "flate", testdataSimpleAlertJson), 200, 2, ""},
+		{"identity", "identity", testdataSimpleAlertJson, 200, 2, ""},
+		{"bomb", "gzip", compress(t, "gzip", bomb), 413, 0, ""},
+		{"mislabeled", "gzip", testdataSimpleAlertJson, 400, 0, "invalid_encoding"},
+		{"unknown encoding", "br", testdataSimpleAlertJson, 415, 0, "unsupported_encoding"},
+	} {
+		listener := NewFakeHTTPListener()
+		testingConfig := MakeHTTPTestingConfig()
+		testingConfig.MaxWebhookBytes = 64 << 10
+		metrics := NewMetrics(prometheus.NewRegistry())
+
+		response := RunHTTPRequestWithHeaders(t, "POST", tc.body, "/somechannel",
+			map[string]string{"Content-Encoding": tc.encoding}, testingConfig, listener, metrics)
+
+		if response.StatusCode != tc.expected {
+			t.Errorf("%s: expected %d status, got %d", tc.name, tc.expected, response.StatusCode)
+		}
+		if len(listener.AlertMsgs) != tc.alerts {
+			t.Errorf("%s: expected %d alerts relayed, got %d", tc.name, tc.alerts, len(listener.AlertMsgs))
+		}
+		if tc.rejected != "" {
+			if v := testutil.ToFloat64(metrics.httpRejectedRequests.WithLabelValues(tc.rejected)); v != 1 {
+				t.Errorf("%s: expected 1 request rejected as %s, got %f", tc.name, tc.rejected, v)
+			}
+		}
+	}
+}
+
+func TestContentTypeEnforced(t *testing.T) {
+	for _, tc := range []struct {
+		contentType  string
+		allowMissing bool
+		expected     int
+	}{
+		{"application/json", false, 200},
+		{"application/json; charset=utf-8", false, 200},
+		{"application/vnd.api+json", false, 200},
+		{"application/x-www-form-urlencoded", false, 415},
+		{"application/x-www-form-urlencoded", true, 415},
+		{"", false, 415},
+		{"", true, 200},
+	} {
+		testingConfig := MakeHTTPTestingConfig()
+		testingConfig.WebhookAllowMissingContentType = tc.allowMissing
+		metrics := NewMetrics(prometheus.NewRegistry())
+
+		response := RunHTTPRequestWithHeaders(t, "POST", testdataSimpleAlertJson, "/somechannel",
+			map[string]string{"Content-Type": tc.contentType}, testingConfig, NewFakeHTTPListener(), metrics)
+
+		if response.StatusCode != tc.expected {
+			t.Errorf("Content-Type %q (allowing missing: %t): expected %d status, got %d",
+				tc.contentType, tc.allowMissing, tc.expected, response.StatusCode)
+		}
+		rejected := testutil.ToFloat64(metrics.httpRejectedRequests.WithLabelValues("unsupported_media_type"))
+		if (tc.expected == 415) != (rejected == 1) {
+			t.Errorf("Content-Type %q: unexpected rejection count %f", tc.contentType, rejected)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		method string
+		url    string
+		allow  string
+	}{
+		{"GET", "/somechannel", "POST"},
+		{"PUT", "/api/v1/webhook/somechannel", "POST"},
+		{"POST", "/api/v1/status", "GET"},
+	} {
+		metrics := NewMetrics(prometheus.NewRegistry())
+		response := RunHTTPRequest(t, tc.method, "", tc.url,
+			MakeHTTPTestingConfig(), NewFakeHTTPListener(), metrics)
+
+		if response.StatusCode != 405 {
+			t.Errorf("%s %s: expected 405 status, got %d", tc.method, tc.url, response.StatusCode)
+		}
+		if allow := response.Header.Get("Allow"); allow != tc.allow {
+			t.Errorf("%s %s: expected Allow %q, got %q", tc.method, tc.url, tc.allow, allow)
+		}
+		if v := testutil.ToFloat64(metrics.httpRejectedRequests.WithLabelValues("method_not_allowed")); v != 1 {
+			t.Errorf("%s %s: expected 1 rejection, got %f", tc.method, tc.url, v)
+		}
+	}
+}
+
+func TestWebhookReceptionTimestamp(t *testing.T) {
+	listener := NewFakeHTTPListener()
+	testingConfig := MakeHTTPTestingConfig()
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	RunHTTPTestWithMetrics(
+		t, testdataSimpleAlertJson, "/somechannel",
+		testingConfig, listener, metrics)
+
+	if testutil.ToFloat64(metrics.webhookLastReceivedTimestamp) == 0 {
+		t.Error("Webhook reception timestamp not set")
+	}
+}
+
+func TestEmptyWebhookIgnored(t *testing.T) {
+	listener := NewFakeHTTPListener()
+	testingConfig := MakeHTTPTestingConfig()
+	testingConfig.MsgOnce = true
+	testingConfig.LogEmptyWebhooks = true
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	response := RunHTTPTestWithMetrics(
+		t, `{"status": "firing", "alerts": []}`, "/somechannel",
+		testingConfig, listener, metrics)
+
+	if response.StatusCode != 200 {
+		t.Errorf("Expected 200 status in response, got %d", response.StatusCode)
+	}
+	webhookResponse := WebhookResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&webhookResponse); err != nil {
+		t.Fatalf("Could not decode response: %s", err)
+	}
+	expectedTargets := []TargetResult{{Channel: "#somechannel", Status: "ignored", Reason: "empty"}}
+	if webhookResponse.Alerts != 0 || webhookResponse.Rendered != 0 || !reflect.DeepEqual(expectedTargets, webhookResponse.Targets) {
+		t.Errorf("Unexpected response: %+v", webhookResponse)
+	}
+	select {
+	case alertMsg := <-listener.AlertMsgs:
+		t.Errorf("Unexpected alert msg for empty webhook: %s", alertMsg)
+	default:
+	}
+	if v := testutil.ToFloat64(metrics.webhookEmptyPayloads.WithLabelValues("#somechannel")); v != 1 {
+		t.Errorf("Expected 1 empty webhook, got %f", v)
+	}
+	if v := testutil.ToFloat64(metrics.handledAlertGroups.WithLabelValues("#somechannel")); v != 0 {
+		t.Errorf("Expected no handled alert group, got %f", v)
+	}
+}
+
+func TestChannelFromBody(t *testing.T) {
+	alerts := `"alerts": [
+		{"status": "firing", "labels": {"alertname": "airDown", "instance": "instance1:3456", "room": "%[1]s"}},
+		{"status": "firing", "labels": {"alertname": "airDown", "instance": "instance2:7890", "room": "%[1]s"}}
+	]`
+	for _, tc := range []struct {
+		name            string
+		body            string
+		expectedStatus  string
+		expectedChannel string
+	}{
+		{"field", `{"channel": "#somechannel", ` + fmt.Sprintf(alerts, "") + `}`, "200 OK", "#somechannel"},
+		{"field without #", `{"channel": "somechannel", ` + fmt.Sprintf(alerts, "") + `}`, "200 OK", "#somechannel"},
+		{"local channel", `{"channel": "&local", ` + fmt.Sprintf(alerts, "") + `}`, "200 OK", "&local"},
+		{"common label", `{"commonLabels": {"room": "#ops"}, ` + fmt.Sprintf(alerts, "") + `}`, "200 OK", "#ops"},
+		{"label of all alerts", `{` + fmt.Sprintf(alerts, "#ops") + `}`, "200 OK", "#ops"},
+		{"label without #", `{` + fmt.Sprintf(alerts, "ops") + `}`, "400 Bad Request", ""},
+		{"no channel", `{"status": "firing", "alerts": []}`, "400 Bad Request", ""},
+		{"not a string", `{"channel": 3, ` + fmt.Sprintf(alerts, "") + `}`, "400 Bad Request", ""},
+		{"invalid channel", `{"channel": "#a b", ` + fmt.Sprintf(alerts, "") + `}`, "400 Bad Request", ""},
+		{"channel not allowed", `{"channel": "#elsewhere", ` + fmt.Sprintf(alerts, "") + `}`, "403 Forbidden", ""},
+	} {
+		listener := NewFakeHTTPListener()
+		testingConfig := MakeHTTPTestingConfig()
+		testingConfig.WebhookChannelField = "channel"
+		testingConfig.WebhookChannelLabel = "room"
+		testingConfig.IRCChannels = []IRCChannel{{Name: "#somechannel"}, {Name: "&local"}, {Name: "#ops"}}
+
+		response := RunHTTPTest(t, tc.body, "/api/webhook", testingConfig, listener)
+
+		if response.Status != tc.expectedStatus {
+			t.Errorf("%s: expected status %s, got %s", tc.name, tc.expectedStatus, response.Status)
+			continue
+		}
+		if tc.expectedChannel == "" {
+			body, _ := ioutil.ReadAll(response.Body)
+			if tc.name == "no channel" && !strings.Contains(string(body), `"channel" field`) {
+				t.Errorf("%s: expected the error to name the field, got %q", tc.name, body)
+			}
+			continue
+		}
+		for i := 0; i < 2; i++ {
+			alertMsg := <-listener.AlertMsgs
+			if alertMsg.Channel != tc.expectedChannel {
+				t.Errorf("%s: expected channel %s, got %s", tc.name, tc.expectedChannel, alertMsg.Channel)
+			}
+		}
+	}
+}
+
+func TestChannelsFromAlertLabels(t *testing.T) {
+	body := `{"status": "firing", "alerts": [
+		{"status": "firing", "labels": {"alertname": "airDown", "instance": "one", "irc_channels": "#a, #b, ,ops,#somechannel"}},
+		{"status": "firing", "labels": {"alertname": "airDown", "instance": "two", "irc_channels": "#b,#forbidden"}}
+	]}`
+	listener := NewFakeHTTPListener()
+	testingConfig := MakeHTTPTestingConfig()
+	testingConfig.WebhookChannelLabel = "irc_channels"
+	testingConfig.WebhookChannelAllowlist = []string{"#a", "#b", "#somechannel"}
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	response := RunHTTPTestWithMetrics(t, body, "/somechannel", testingConfig, listener, metrics)
+
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected 200 status in response, got %d", response.StatusCode)
+	}
+	webhookResponse := WebhookResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&webhookResponse); err != nil {
+		t.Fatalf("Could not decode response: %s", err)
+	}
+	// The channel of the URL gets all the alerts, the others those naming
+	// them.
+	expectedTargets := []TargetResult{
+		{Channel: "#somechannel", Status: "queued", Messages: 2},
+		{Channel: "#a", Status: "queued", Messages: 1},
+		{Channel: "#b", Status: "queued", Messages: 2},
+	}
+	if !reflect.DeepEqual(expectedTargets, webhookResponse.Targets) {
+		t.Errorf("Unexpected targets.\nExpected: %+v\nActual: %+v", expectedTargets, webhookResponse.Targets)
+	}
+	expectedMsgs := []string{
+		"#somechannel Alert airDown on one is firing",
+		"#somechannel Alert airDown on two is firing",
+		"#a Alert airDown on one is firing",
+		"#b Alert airDown on one is firing",
+		"#b Alert airDown on two is firing",
+	}
+	for _, expected := range expectedMsgs {
+		alertMsg := <-listener.AlertMsgs
+		if msg := alertMsg.Channel + " " + alertMsg.Alert; msg != expected {
+			t.Errorf("Expected %q, got %q", expected, msg)
+		}
+	}
+	select {
+	case alertMsg := <-listener.AlertMsgs:
+		t.Errorf("Unexpected alert msg: %s", alertMsg)
+	default:
+	}
+
+	for _, reason := range []string{"empty", "missing_prefix", "not_allowed"} {
+		if v := testutil.ToFloat64(metrics.webhookChannelLabelSkipped.WithLabelValues(reason)); v != 1 {
+			t.Errorf("Expected 1 entry skipped as %s, got %f", reason, v)
+		}
+	}
+}
+
+func TestParseLabelChannels(t *testing.T) {
+	server := &HTTPServer{
+		channelLabelSeparator: ";",
+		channelAllowlist: NewChannelAllowlist(&Config{
+			IRCChannels:             []IRCChannel{{Name: "#a"}},
+			WebhookChannelAllowlist: []string{"&b"},
+		}),
+	}
+	channels, skipped := server.parseLabelChannels("#a; &b;#a;;c;#d e;#other")
+	if expected := []string{"#a", "&b"}; !reflect.DeepEqual(expected, channels) {
+		t.Errorf("Expected channels %q, got %q", expected, channels)
+	}
+	if expected := []string{"empty", "missing_prefix", "invalid", "not_allowed"}; !reflect.DeepEqual(expected, skipped) {
+		t.Errorf("Expected entries skipped as %q, got %q", expected, skipped)
+	}
+}
+
+func TestMultipleTargets(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		body string
+		url  string
+	}{
+		{"path", testdataSimpleAlertJson, "/somechannel,otherchannel,somechannel"},
+		{"string field", `{"channel": "somechannel, #otherchannel", ` + testdataSimpleAlertJson[strings.Index(testdataSimpleAlertJson, "{")+1:], "/api/webhook"},
+		{"array field", `{"channel": ["#somechannel", "otherchannel", "#somechannel"], ` + testdataSimpleAlertJson[strings.Index(testdataSimpleAlertJson, "{")+1:], "/api/webhook"},
+	} {
+		listener := NewFakeHTTPListener()
+		testingConfig := MakeHTTPTestingConfig()
+		testingConfig.WebhookChannelField = "channel"
+		testingConfig.WebhookChannelAllowlist = []string{"#somechannel", "#otherchannel"}
+
+		response := RunHTTPTest(t, tc.body, tc.url, testingConfig, listener)
+
+		if response.StatusCode != 200 {
+			t.Errorf("%s: expected 200 status in response, got %d", tc.name, response.StatusCode)
+			continue
+		}
+		webhookResponse := WebhookResponse{}
+		if err := json.NewDecoder(response.Body).Decode(&webhookResponse); err != nil {
+			t.Fatalf("%s: could not decode response: %s", tc.name, err)
+		}
+		expectedResponse := WebhookResponse{
+			RequestID: webhookResponse.RequestID,
+			Alerts:    2,
+			Rendered:  4,
+			Targets: []TargetResult{
+				{Channel: "#somechannel", Status: "queued", Messages: 2},
+				{Channel: "#otherchannel", Status: "queued", Messages: 2},
+			},
+		}
+		if webhookResponse.RequestID == "" {
+			t.Errorf("%s: expected a request ID", tc.name)
+		}
+		if !reflect.DeepEqual(expectedResponse, webhookResponse) {
+			t.Errorf("%s: unexpected response.\nExpected: %+v\nActual: %+v", tc.name, expectedResponse, webhookResponse)
+		}
+		for _, expectedChannel := range []string{"#somechannel", "#somechannel", "#otherchannel", "#otherchannel"} {
+			if alertMsg := <-listener.AlertMsgs; alertMsg.Channel != expectedChannel {
+				t.Errorf("%s: expected a message for %s, got %s", tc.name, expectedChannel, alertMsg)
+			}
+		}
+		select {
+		case alertMsg := <-listener.AlertMsgs:
+			t.Errorf("%s: unexpected alert msg: %s", tc.name, alertMsg)
+		default:
+		}
+	}
+}
+
+func TestChannelsNotAllowed(t *testing.T) {
+	for _, tc := range []struct {
+		name            string
+		url             string
+		expectedStatus  int
+		expectedTargets []TargetResult
+	}{
+		{"some allowed", "/somechannel,forbidden", 200, []TargetResult{
+			{Channel: "#forbidden", Status: "ignored", Reason: "not_allowed"},
+			{Channel: "#somechannel", Status: "queued", Messages: 2},
+		}},
+		{"none allowed", "/forbidden", 403, []TargetResult{
+			{Channel: "#forbidden", Status: "ignored", Reason: "not_allowed"},
+		}},
+	} {
+		listener := NewFakeHTTPListener()
+		testingConfig := MakeHTTPTestingConfig()
+		testingConfig.WebhookChannelAllowlist = []string{"#somechannel"}
+		metrics := NewMetrics(prometheus.NewRegistry())
+
+		response := RunHTTPTestWithMetrics(t, testdataSimpleAlertJson, tc.url, testingConfig, listener, metrics)
+
+		if response.StatusCode != tc.expectedStatus {
+			t.Errorf("%s: expected %d status in response, got %d", tc.name, tc.expectedStatus, response.StatusCode)
+			continue
+		}
+		webhookResponse := WebhookResponse{}
+		if err := json.NewDecoder(response.Body).Decode(&webhookResponse); err != nil {
+			t.Fatalf("%s: could not decode response: %s", tc.name, err)
+		}
+		if !reflect.DeepEqual(tc.expectedTargets, webhookResponse.Targets) {
+			t.Errorf("%s: unexpected targets.\nExpected: %+v\nActual: %+v", tc.name, tc.expectedTargets, webhookResponse.Targets)
+		}
+		if v := testutil.ToFloat64(metrics.webhookChannelsNotAllowed); v != 1 {
+			t.Errorf("%s: expected 1 channel not allowed, got %f", tc.name, v)
+		}
+	}
+}
+
+func TestSequencedWebhooks(t *testing.T) {
+	testingConfig := MakeHTTPTestingConfig()
+	testingConfig.WebhookOrdering = webhookOrderingSequenced
+	listener := NewFakeHTTPListener()
+	httpServer, err := NewHTTPServerForTesting(testingConfig,
+		listener.AlertMsgs, listener.Serve, NewMetrics(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Could not create HTTP server: %s", err)
+	}
+	sequencer := NewWebhookSequencer(testingConfig)
+	httpServer.Sequencer = sequencer
+	go httpServer.Run()
+	<-listener.StartedServing
+	defer func() { listener.StopServing <- true }()
+
+	for i := 0; i < 2; i++ {
+		request := httptest.NewRequest("POST", "/somechannel,otherchannel", strings.NewReader(testdataSimpleAlertJson))
+		request.Header.Set("Content-Type", "application/json")
+		listener.router.ServeHTTP(httptest.NewRecorder(), request)
+	}
+
+	// The messages of each webhook are numbered, and released once
+	// received as the webhooks were relayed.
+	for i := 0; i < 8; i++ {
+		alertMsg := <-listener.AlertMsgs
+		expected := uint64(1 + i/4)
+		if alertMsg.sequence != expected {
+			t.Errorf("Expected message %d to be numbered %d, got %d", i, expected, alertMsg.sequence)
+		}
+		if !sequencer.Add("conn", alertMsg) {
+			t.Errorf("Expected message %d to be held", i)
+		}
+	}
+	if released := sequencer.Released("conn"); len(released) != 8 {
+		t.Errorf("Expected the 8 messages released, got %d", len(released))
+	}
+}
+
+func TestDisabledChannelsRelay(t *testing.T) {
+	listener := NewFakeHTTPListener()
+	testingConfig := MakeHTTPTestingConfig()
+	testingConfig.IRCChannels = []IRCChannel{
+		{Name: "#dropped", Disabled: true},
+		{Name: "#moved", Disabled: true, RedirectTo: "otherchannel"},
+	}
+
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	response := RunHTTPTestWithMetrics(t, testdataSimpleAlertJson, "/api/v1/webhook/dropped,moved,somechannel",
+		testingConfig, listener, metrics)
+
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected 200 status in response, got %d", response.StatusCode)
+	}
+	webhookResponse := WebhookResponse{}
+	if err := json.NewDecoder(response.Body).Decode(&webhookResponse); err != nil {
+		t.Fatalf("Could not decode response: %s", err)
+	}
+	expectedTargets := []TargetResult{
+		{Channel: "#dropped", Status: "ignored", Reason: "disabled"},
+		{Channel: "#otherchannel", Status: "queued", Messages: 2, RedirectedFrom: "#moved"},
+		{Channel: "#somechannel", Status: "queued", Messages: 2},
+	}
+	if !reflect.DeepEqual(expectedTargets, webhookResponse.Targets) {
+		t.Errorf("Unexpected targets.\nExpected: %+v\nActual: %+v", expectedTargets, webhookResponse.Targets)
+	}
+	for _, expectedChannel := range []string{"#otherchannel", "#otherchannel", "#somechannel", "#somechannel"} {
+		if alertMsg := <-listener.AlertMsgs; alertMsg.Channel != expectedChannel {
+			t.Errorf("Expected a message for %s, got %s", expectedChannel, alertMsg)
+		}
+	}
+	if v := testutil.ToFloat64(metrics.webhookDisabledChannelDrops.WithLabelValues("#dropped")); v != 1 {
+		t.Errorf("Expected 1 drop for #dropped, got %f", v)
+	}
+}
+
+func TestRetryDedup(t *testing.T) {
+	listener := NewFakeHTTPListener()
+	// Room for one message only.
+	listener.AlertMsgs = make(chan AlertMsg, 1)
+	testingConfig := MakeHTTPTestingConfig()
+	testingConfig.WebhookRetryDedupTTL = time.Hour
+	testingConfig.WebhookRetryDedupMaxEntries = 10
+	httpServer, err := NewHTTPServerForTesting(testingConfig,
+		listener.AlertMsgs, listener.Serve, NewMetrics(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Could not create HTTP server: %s", err)
+	}
+	go httpServer.Run()
+	<-listener.StartedServing
+	defer func() { listener.StopServing <- true }()
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		status   int
+		expected []AlertResult
+	}{
+		{"partial delivery", "/somechannel", 503, []AlertResult{
+			{Fingerprint: "66214a361160fb6f", Status: "queued"},
+			{Fingerprint: "25a874c99325d1ce", Status: "dropped"},
+		}},
+		{"retry", "/somechannel", 200, []AlertResult{
+			{Fingerprint: "66214a361160fb6f", Status: "already_delivered"},
+			{Fingerprint: "25a874c99325d1ce", Status: "queued"},
+		}},
+		// Nothing is skipped, and dropping is not retried.
+		{"bypassed", "/somechannel?retry_dedup=false", 200, nil},
+	} {
+		responseRecorder := httptest.NewRecorder()
+		request := httptest.NewRequest("POST", tc.url, strings.NewReader(testdataSimpleAlertJson))
+		request.Header.Set("Content-Type", "application/json")
+		listener.router.ServeHTTP(responseRecorder, request)
+		if responseRecorder.Code != tc.status {
+			t.Errorf("%s: expected %d status, got %d", tc.name, tc.status, responseRecorder.Code)
+		}
+		webhookResponse := WebhookResponse{}
+		if err := json.NewDecoder(responseRecorder.Result().Body).Decode(&webhookResponse); err != nil {
+			t.Fatalf("%s: could not decode response: %s", tc.name, err)
+		}
+		if actual := webhookResponse.Targets[0].Alerts; !reflect.DeepEqual(tc.expected, actual) {
+			t.Errorf("%s: unexpected alert statuses.\nExpected: %+v\nActual: %+v", tc.name, tc.expected, actual)
+		}
+		expectedAlert := "Alert airDown on instance1:3456 is resolved"
+		if tc.name == "retry" {
+			expectedAlert = "Alert airDown on instance2:7890 is resolved"
+		}
+		if alertMsg := <-listener.AlertMsgs; alertMsg.Alert != expectedAlert {
+			t.Errorf("%s: expected message %q, got %s", tc.name, expectedAlert, alertMsg)
+		}
+	}
+}
+
+func TestStatusReportsBuildInfo(t *testing.T) {
+	listener := NewFakeHTTPListener()
+	testingConfig := MakeHTTPTestingConfig()
+
+	response := RunHTTPRequest(
+		t, "GET", "", "/status",
+		testingConfig, listener, NewMetrics(prometheus.NewRegistry()))
+
+	if response.StatusCode != 200 {
+		t.Fatalf("Expected 200 status in response, got %d", response.StatusCode)
+	}
+
+	status := Status{}
+	if err := json.NewDecoder(response.Body).Decode(&status); err != nil {
+		t.Fatalf("Could not decode status: %s", err)
+	}
+	if !reflect.DeepEqual(GetBuildInfo(), status.Build) {
+		t.Errorf("Expected build info %+v, got %+v", GetBuildInfo(), status.Build)
+	}
+}
+
+func TestStatusLooksUpFingerprint(t *testing.T) {
+	httpServer, err := NewHTTPServerForTesting(MakeHTTPTestingConfig(),
+		make(chan AlertMsg, 10), NewFakeHTTPListener().Serve, NewMetrics(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Could not create HTTP server: %s", err)
+	}
+	token := httpServer.fingerprints.Add(instance1Labels)
+
+	for _, tc := range []struct {
+		token  string
+		found  bool
+		labels map[string]string
+	}{
+		{token, true, instance1Labels},
+		{"0000000", false, nil},
+	} {
+		responseRecorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", "/status?fingerprint="+tc.token, nil)
+		httpServer.ServeStatus(responseRecorder, request)
+
+		status := Status{}
+		if err := json.NewDecoder(responseRecorder.Result().Body).Decode(&status); err != nil {
+			t.Fatalf("Could not decode status: %s", err)
+		}
+		expected := &FingerprintStatus{Token: tc.token, Found: tc.found, Labels: tc.labels}
+		if !reflect.DeepEqual(expected, status.Fingerprint) {
+			t.Errorf("Expected fingerprint status %+v, got %+v", expected, status.Fingerprint)
+		}
+		if status.FingerprintTokens != 1 {
+			t.Errorf("Expected 1 fingerprint token, got %d", status.FingerprintTokens)
+		}
+	}
+}
+
+func TestInternalListener(t *testing.T) {
+	testingConfig := MakeHTTPTestingConfig()
+	testingConfig.InternalHTTPHost = "127.0.0.1"
+	testingConfig.InternalHTTPPort = 9999
+
+	routers := make(chan http.Handler, 2)
+	addrs := make(chan string, 2)
+	stop := make(chan bool)
+	defer close(stop)
+	listener := func(addr string, router http.Handler) error {
+		addrs <- addr
+		routers <- router
+		<-stop
+		return nil
+	}
+	httpServer, err := NewHTTPServerForTesting(testingConfig,
+		make(chan AlertMsg, 10), listener, NewMetrics(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Could not create HTTP server: %s", err)
+	}
+	go httpServer.Run()
+
+	byAddr := make(map[string]http.Handler)
+	for i := 0; i < 2; i++ {
+		byAddr[<-addrs] = <-routers
+	}
+	public, internal := byAddr["test.web:8888"], byAddr["127.0.0.1:9999"]
+	if public == nil || internal == nil {
+		t.Fatalf("Unexpected listeners: %v", byAddr)
+	}
+
+	for _, tc := range []struct {
+		name     string
+		router   http.Handler
+		method   string
+		url      string
+		expected int
+	}{
+		{"public webhook", public, "POST", "/somechannel", 200},
+		{"public status", public, "GET", "/status", 405},
+		{"public metrics", public, "GET", "/metrics", 405},
+		{"internal status", internal, "GET", "/status", 200},
+		{"internal metrics", internal, "GET", "/metrics", 200},
+		{"internal webhook", internal, "POST", "/somechannel", 404},
+	} {
+		responseRecorder := httptest.NewRecorder()
+		request := httptest.NewRequest(tc.method, tc.url, strings.NewReader(testdataSimpleAlertJson))
+		request.Header.Set("Content-Type", "application/json")
+		tc.router.ServeHTTP(responseRecorder, request)
+		if responseRecorder.Code != tc.expected {
+			t.Errorf("%s: expected %d status, got %d", tc.name, tc.expected, responseRecorder.Code)
+		}
+	}
+}
+
+func TestQueueEndpoint(t *testing.T) {
+	testingConfig := MakeHTTPTestingConfig()
+	testingConfig.QueueAPIToken = "secret"
+	listener := NewFakeHTTPListener()
+	httpServer, err := NewHTTPServerForTesting(testingConfig,
+		listener.AlertMsgs, listener.Serve, NewMetrics(prometheus.NewRegistry()))
+	if err != nil {
+		t.Fatalf("Could not create HTTP server: %s", err)
+	}
+	httpServer.Pending = NewPendingMessages(&RealTime{})
+	go httpServer.Run()
+	<-listener.StartedServing
+	defer func() { listener.StopServing <- true }()
+
+	request := httptest.NewRequest("POST", "/somechannel", strings.NewReader(testdataSimpleAlertJson))
+	request.Header.Set("Content-Type", "application/json")
+	listener.router.ServeHTTP(httptest.NewRecorder(), request)
+
+	for _, tc := range []struct {
+		name     string
+		url      string
+		token    string
+		expected int
+		depth    int
+	}{
+		{"no token", "/queue", "", 401, 0},
+		{"wrong token", "/queue", "Bearer wrong", 401, 0},
+		{"not bearer", "/queue", "secret", 401, 0},
+		{"all channels", "/queue", "Bearer secret", 200, 2},
+		{"channel", "/queue/somechannel", "Bearer secret", 200, 2},
+		{"other channel", "/queue/otherchannel", "Bearer secret", 200, 0},
+		{"invalid entries", "/queue?entries=-1", "Bearer secret", 400, 0},
+	} {
+		responseRecorder := httptest.NewRecorder()
+		request := httptest.NewRequest("GET", tc.url, nil)
+		if tc.token != "" {
+			request.Header.Set("Authorization", tc.token)
+		}
+		listener.router.ServeHTTP(responseRecorder, request)
+		if responseRecorder.Code != tc.expected {
+			t.Errorf("%s: expected %d status, got %d", tc.name, tc.expected, responseRecorder.Code)
+			continue
+		}
+		if tc.expected != 200 {
+			continue
+		}
+		status := QueueStatus{}
+		if err := json.NewDecoder(responseRecorder.Result().Body).Decode(&status); err != nil {
+			t.Fatalf("%s: could not decode queue: %s", tc.name, err)
+		}
+		depth := 0
+		for _, channel := range status.Channels {
+			depth += channel.Depth
+		}
+		if depth != tc.depth {
+			t.Errorf("%s: expected %d messages queued, got %+v", tc.name, tc.depth, status)
+		}
+	}
+}
+
+func TestRoutes(t *testing.T) {
+	for _, legacyRoutes := range []bool{true, false} {
+		testingConfig := MakeHTTPTestingConfig()
+		testingConfig.QueueAPIToken = "secret"
+		testingConfig.HTTPLegacyRoutes = legacyRoutes
+		httpServer, err := NewHTTPServerForTesting(testingConfig,
+			make(chan AlertMsg, 10), NewFakeHTTPListener().Serve, NewMetrics(prometheus.NewRegistry()))
+		if err != nil {
+			t.Fatalf("Could not create HTTP server: %s", err)
+		}
+		router := httpServer.newRouter()
+		httpServer.setupRoutes(router, router)
+
+		for _, tc := range []struct {
+			method string
+			path   string
+			legacy string
+			name   string
+		}{
+			{"POST", "/api/v1/webhook/somechannel", "/somechannel", "webhook"},
+			{"POST", "/api/v1/webhook", "/api/webhook", "webhook_body"},
+			{"GET", "/api/v1/status", "/status", "status"},
+			{"GET", "/api/v1/queue", "/queue", "queue"},
+			{"GET", "/api/v1/queue/somechannel", "/queue/somechannel", "queue_channel"},
+		} {
+			for _, path := range []string{tc.path, tc.legacy} {
+				expected := tc.name
+				if path == tc.legacy && !legacyRoutes {
+					expected = ""
+				}
+				match := mux.RouteMatch{}
+				name := ""
+				if router.Match(httptest.NewRequest(tc.method, path, nil), &match) && match.Route != nil {
+					name = match.Route.GetName()
+				}
+				if name != expected {
+					t.Errorf("%s %s with legacy routes %t: expected route %q, got %q",
+						tc.method, path, legacyRoutes, expected, name)
+				}
+			}
+		}
+		match := mux.RouteMatch{}
+		if !router.Match(httptest.NewRequest("GET", "/metrics", nil), &match) || match.Route.GetName() != "metrics" {
+			t.Errorf("/metrics not served with legacy routes %t", legacyRoutes)
+		}
+	}
+}
+
+func TestSignedWebhooks(t *testing.T) {
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	signature := NewWebhookVerifier("secret", time.Minute, &RealTime{}, nil).sign(
+		timestamp, []byte(testdataSimpleAlertJson))
+	for _, tc := range []struct {
+		name     string
+		headers  map[string]string
+		expected int
+	}{
+		{"unsigned", nil, 401},
+		{"signed", map[string]string{"X-Signature": signature, "X-Signature-Timestamp": timestamp}, 200},
+	} {
+		listener := NewFakeHTTPListener()
+		testingConfig := MakeHTTPTestingConfig()
+		testingConfig.WebhookHMACSecret = "secret"
+		testingConfig.WebhookSignatureMaxSkew = time.Minute
+
+		response := RunHTTPRequestWithHeaders(t, "POST", testdataSimpleAlertJson, "/somechannel",
+			tc.headers, testingConfig, listener, NewMetrics(prometheus.NewRegistry()))
+		if response.StatusCode != tc.expected {
+			t.Errorf("%s: expected %d status, got %d", tc.name, tc.expected, response.StatusCode)
+		}
+	}
+}
+
+func TestHTTPRequestMetrics(t *testing.T) {
+	listener := NewFakeHTTPListener()
+	testingConfig := MakeHTTPTestingConfig()
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	RunHTTPTestWithMetrics(
+		t, testdataBogusAlertJson, "/somechannel",
+		testingConfig, listener, metrics)
+
+	if v := testutil.ToFloat64(metrics.httpRequests.WithLabelValues("webhook", "post", "400")); v != 1 {
+		t.Errorf("Expected 1 webhook request with code 400, got %f", v)
+	}
+	if v := testutil.ToFloat64(metrics.httpRejectedRequests.WithLabelValues("invalid_json")); v != 1 {
+		t.Errorf("Expected 1 request rejected as invalid JSON, got %f", v)
+	}
+	if v := testutil.ToFloat64(metrics.httpRequestsInFlight); v != 0 {
+		t.Errorf("Expected no request in flight, got %f", v)
+	}
+}
+
+func TestOversizedBodyRejected(t *testing.T) {
+	listener := NewFakeHTTPListener()
+	testingConfig := MakeHTTPTestingConfig()
+	testingConfig.MaxWebhookBytes = 64
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	response := RunHTTPTestWithMetrics(
+		t, testdataSimpleAlertJson, "/somechannel",
+		testingConfig, listener, metrics)
+
+	if response.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("Expected %d status in response, got %d",
+			http.StatusRequestEntityTooLarge, response.StatusCode)
+	}
+	if len(listener.AlertMsgs) != 0 {
+		t.Errorf("Expected no alert to be relayed, got %d", len(listener.AlertMsgs))
+	}
+	if v := testutil.ToFloat64(metrics.alertHandlingErrors.WithLabelValues("#somechannel", "body_too_large")); v != 1 {
+		t.Errorf("Expected oversized body to be counted once, got %f", v)
+	}
+}
+
+func TestStaticLabels(t *testing.T) {
+	for _, tc := range []struct {
+		override bool
+		expected string
+	}{
+		{false, "Alert airDown in global for prod is resolved"},
+		{true, "Alert airDown in eu for prod is resolved"},
+	} {
+		listener := NewFakeHTTPListener()
+		testingConfig := MakeHTTPTestingConfig()
+		testingConfig.MsgTemplate = "Alert {{ .Labels.alertname }} in {{ .Labels.zone }} for {{ .Labels.environment }} is {{ .Status }}"
+		testingConfig.StaticLabels = map[string]string{
+			"environment": "prod",
+			"zone":        "eu",
+		}
+		testingConfig.StaticLabelsOverride = tc.override
+
+		RunHTTPTest(
+			t, testdataSimpleAlertJson, "/somechannel",
+			testingConfig, listener)
+
+		alertMsg := <-listener.AlertMsgs
+		if alertMsg.Alert != tc.expected {
+			t.Errorf("Expected '%s' with override=%t, got '%s'",
+				tc.expected, tc.override, alertMsg.Alert)
+		}
+	}
+}
+
+func TestStaticLabelsCommonLabels(t *testing.T) {
+	server := &HTTPServer{staticLabels: map[string]string{
+		"environment": "prod",
+		"zone":        "eu",
+	}}
+	data := &promtmpl.Data{
+		Alerts: promtmpl.Alerts{
+			promtmpl.Alert{Labels: promtmpl.KV{"alertname": "airDown", "zone": "global"}},
+			promtmpl.Alert{Labels: promtmpl.KV{"alertname": "airDown"}},
+		},
+		CommonLabels: promtmpl.KV{"alertname": "airDown"},
+	}
+
+	server.enrichAlerts(data)
+
+	// The alerts do not share the zone, which one of them had already.
+	expected := promtmpl.KV{"alertname": "airDown", "environment": "prod"}
+	if !reflect.DeepEqual(expected, data.CommonLabels) {
+		t.Errorf("Unexpected common labels.\nExpected: %v\nActual: %v",
+			expected, data.CommonLabels)
+	}
+}
+
+func TestCorrelationID(t *testing.T) {
+	for _, tc := range []struct {
+		header     string
+		expectedID string
+	}{
+		{"abc-123", "abc-123"},
+		// Unacceptable IDs are replaced.
+		{"not an id", ""},
+		{"", ""},
+	} {
+		listener := NewFakeHTTPListener()
+		testingConfig := MakeHTTPTestingConfig()
+		testingConfig.CorrelationIDHeader = "X-Correlation-ID"
+		testingConfig.CorrelationIDInMessages = true
+
+		headers := map[string]string{}
+		if tc.header != "" {
+			headers["X-Correlation-ID"] = tc.header
+		}
+		response := RunHTTPRequestWithHeaders(t, "POST", testdataSimpleAlertJson,
+			"/somechannel", headers, testingConfig, listener,
+			NewMetrics(prometheus.NewRegistry()))
+
+		id := response.Header.Get("X-Correlation-ID")
+		if tc.expectedID != "" && id != tc.expectedID {
+			t.Errorf("Expected correlation ID %s for header '%s', got %s", tc.expectedID, tc.header, id)
+		}
+		if tc.expectedID == "" && (id == "" || id == tc.header) {
+			t.Errorf("Expected a new correlation ID for header '%s', got '%s'", tc.header, id)
+		}
+
+		alertMsg := <-listener.AlertMsgs
+		if alertMsg.CorrelationID != id {
+			t.Errorf("Expected message with correlation ID %s, got %s", id, alertMsg.CorrelationID)
+		}
+		expectedAlert := "Alert airDown on instance1:3456 is resolved [" + id + "]"
+		if alertMsg.Alert != expectedAlert {
+			t.Errorf("Expected '%s', got '%s'", expectedAlert, alertMsg.Alert)
+		}
+	}
+}
+
+func TestForbiddenSource(t *testing.T) {
+	listener := NewFakeHTTPListener()
+	testingConfig := MakeHTTPTestingConfig()
+	testingConfig.WebhookAllowedCIDRs = []string{"192.0.2.0/24"}
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	// Requests from untrusted clients cannot claim to be forwarded.
+	response := RunHTTPRequestWithHeaders(t, "POST", testdataSimpleAlertJson,
+		"/somechannel", map[string]string{"X-Forwarded-For": "192.0.2.10"},
+		testingConfig, listener, metrics)
+
+	if response.StatusCode != http.StatusForbidden {
+		t.Errorf("Expected status 403, got %d", response.StatusCode)
+	}
+	if v := testutil.ToFloat64(metrics.webhookForbiddenRequests); v != 1 {
+		t.Errorf("Expected 1 forbidden request, got %f", v)
+	}
+	select {
+	case alertMsg := <-listener.AlertMsgs:
+		t.Errorf("Unexpected alert relayed: %s", alertMsg)
+	default:
+	}
 }
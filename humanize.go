@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var humanizeUnits = []struct {
+	suffix string
+	length time.Duration
+}{
+	{"d", 24 * time.Hour},
+	{"h", time.Hour},
+	{"m", time.Minute},
+	{"s", time.Second},
+}
+
+// humanizeDuration renders d with at most its two largest units, e.g.
+// "2h10m" or "45s", truncating the rest. Negative durations, e.g. due to
+// clock skew, are rendered as "0s".
+func humanizeDuration(d time.Duration) string {
+	if d < time.Second {
+		return "0s"
+	}
+	rendered := ""
+	units := 0
+	for _, unit := range humanizeUnits {
+		if units == 2 {
+			break
+		}
+		count := d / unit.length
+		if count == 0 {
+			if units > 0 {
+				// The next unit would not be adjacent.
+				break
+			}
+			continue
+		}
+		rendered += fmt.Sprintf("%d%s", count, unit.suffix)
+		d -= count * unit.length
+		units++
+	}
+	return rendered
+}
+
+// toDuration converts the argument of HumanizeDuration, a time.Duration or a
+// number of seconds.
+func toDuration(value interface{}) (time.Duration, error) {
+	switch v := value.(type) {
+	case time.Duration:
+		return v, nil
+	case int:
+		return time.Duration(v) * time.Second, nil
+	case int64:
+		return time.Duration(v) * time.Second, nil
+	case float64:
+		return time.Duration(v * float64(time.Second)), nil
+	}
+	return 0, fmt.Errorf("cannot humanize %T as a duration", value)
+}
+
+// firingDuration tells for how long the alert has been firing at now, or was
+// firing if it is resolved, 0 if it is unknown or negative.
+func firingDuration(status string, startsAt time.Time, endsAt time.Time, now time.Time) time.Duration {
+	if startsAt.IsZero() {
+		return 0
+	}
+	end := now
+	if status == "resolved" && !endsAt.IsZero() {
+		end = endsAt
+	}
+	if d := end.Sub(startsAt); d > 0 {
+		return d
+	}
+	return 0
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestHumanizeDuration(t *testing.T) {
+	for d, expected := range map[time.Duration]string{
+		-3 * time.Second:       "0s",
+		0:                      "0s",
+		500 * time.Millisecond: "0s",
+		time.Second:            "1s",
+		45 * time.Second:       "45s",
+		90 * time.Second:       "1m30s",
+		23 * time.Minute:       "23m",
+		23*time.Minute + 10*time.Second + time.Millisecond: "23m10s",
+		time.Hour + 59*time.Minute + 59*time.Second:        "1h59m",
+		2*time.Hour + 10*time.Minute:                       "2h10m",
+		2*time.Hour + 5*time.Second:                        "2h",
+		24 * time.Hour:                                     "1d",
+		3*24*time.Hour + 4*time.Hour + 5*time.Minute:       "3d4h",
+		400 * 24 * time.Hour:                               "400d",
+	} {
+		if actual := humanizeDuration(d); actual != expected {
+			t.Errorf("Unexpected rendering of %s: expected %s, got %s", d, expected, actual)
+		}
+	}
+}
+
+func TestToDuration(t *testing.T) {
+	for _, tc := range []struct {
+		value    interface{}
+		expected time.Duration
+	}{
+		{time.Minute, time.Minute},
+		{90, 90 * time.Second},
+		{int64(90), 90 * time.Second},
+		{1.5, 1500 * time.Millisecond},
+	} {
+		if actual, err := toDuration(tc.value); err != nil || actual != tc.expected {
+			t.Errorf("Unexpected conversion of %v: expected %s, got %s (%v)", tc.value, tc.expected, actual, err)
+		}
+	}
+	if _, err := toDuration("1m"); err == nil {
+		t.Error("Expected an error converting a string")
+	}
+}
+
+func TestFiringDuration(t *testing.T) {
+	now := time.Date(2021, 6, 1, 12, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		name     string
+		status   string
+		startsAt time.Time
+		endsAt   time.Time
+		expected time.Duration
+	}{
+		{"firing", "firing", now.Add(-23 * time.Minute), time.Time{}, 23 * time.Minute},
+		{"firing with future end", "firing", now.Add(-time.Hour), now.Add(4 * time.Minute), time.Hour},
+		{"resolved", "resolved", now.Add(-3 * time.Hour), now.Add(-50 * time.Minute), 2*time.Hour + 10*time.Minute},
+		{"resolved without end", "resolved", now.Add(-time.Minute), time.Time{}, time.Minute},
+		{"clock skew", "firing", now.Add(2 * time.Second), time.Time{}, 0},
+		{"no start", "firing", time.Time{}, time.Time{}, 0},
+	} {
+		if actual := firingDuration(tc.status, tc.startsAt, tc.endsAt, now); actual != tc.expected {
+			t.Errorf("%s: expected %s, got %s", tc.name, tc.expected, actual)
+		}
+	}
+}
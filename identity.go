@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// identityPlaceholder matches the placeholders which the config file may
+// contain, so that instances sharing a config describe themselves, e.g. in
+// irc_nickname, irc_ident and irc_realname: ${hostname}, ${shorthost},
+// ${version} and ${env:VAR}.
+var identityPlaceholder = regexp.MustCompile(`\$\{(hostname|shorthost|version|env:[^}]*)\}`)
+
+// identityExpander expands the identity placeholders.
+type identityExpander struct {
+	hostname string
+	version  string
+}
+
+func newIdentityExpander() (*identityExpander, error) {
+	hostname, err := os.Hostname()
+	if err != nil {
+		return nil, err
+	}
+	return &identityExpander{
+		hostname: hostname,
+		version:  GetBuildInfo().Version,
+	}, nil
+}
+
+func (e *identityExpander) expand(value string) string {
+	return identityPlaceholder.ReplaceAllStringFunc(value, func(placeholder string) string {
+		name := placeholder[2 : len(placeholder)-1]
+		switch {
+		case name == "hostname":
+			return e.hostname
+		case name == "shorthost":
+			return strings.SplitN(e.hostname, ".", 2)[0]
+		case name == "version":
+			return e.version
+		default:
+			return os.Getenv(strings.TrimPrefix(name, "env:"))
+		}
+	})
+}
+
+// expandVariable expands the variable ${name} of the config file, an identity
+// placeholder or else an environment variable.
+func (e *identityExpander) expandVariable(name string) string {
+	placeholder := "${" + name + "}"
+	if identityPlaceholder.FindString(placeholder) == placeholder {
+		return e.expand(placeholder)
+	}
+	return os.Getenv(name)
+}
+
+// truncateNick shortens nick to the length allowed by the server, as
+// advertised with NICKLEN in RPL_ISUPPORT, without splitting a character.
+func truncateNick(nick string, nickLen int) string {
+	if nickLen <= 0 || len(nick) <= nickLen {
+		return nick
+	}
+	cut := nickLen
+	for cut > 0 && !utf8.RuneStart(nick[cut]) {
+		cut--
+	}
+	return nick[:cut]
+}
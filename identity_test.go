@@ -0,0 +1,70 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestExpandIdentity(t *testing.T) {
+	os.Setenv("AIR_TEST_REGION", "eu")
+	defer os.Unsetenv("AIR_TEST_REGION")
+
+	expander := &identityExpander{hostname: "relay-1.example.com", version: "v1.2"}
+	for value, expected := range map[string]string{
+		"alertmanager-irc-relay ${version} on ${shorthost}": "alertmanager-irc-relay v1.2 on relay-1",
+		"relay on ${hostname}":                              "relay on relay-1.example.com",
+		"air-${env:AIR_TEST_REGION}":                        "air-eu",
+		"air-${env:AIR_TEST_UNSET}":                         "air-",
+		"${unknown}":                                        "${unknown}",
+	} {
+		if actual := expander.expand(value); actual != expected {
+			t.Errorf("Expected %q to expand to %q, got %q", value, expected, actual)
+		}
+	}
+
+	for name, expected := range map[string]string{
+		"shorthost":           "relay-1",
+		"env:AIR_TEST_REGION": "eu",
+		"AIR_TEST_REGION":     "eu",
+		"x${hostname":         "",
+	} {
+		if actual := expander.expandVariable(name); actual != expected {
+			t.Errorf("Expected variable %q to expand to %q, got %q", name, expected, actual)
+		}
+	}
+}
+
+func TestTruncateNick(t *testing.T) {
+	for _, tc := range []struct {
+		nick     string
+		nickLen  int
+		expected string
+	}{
+		{"alertbot", 0, "alertbot"},
+		{"alertbot", 9, "alertbot"},
+		{"alertbot", 8, "alertbot"},
+		{"alertbot", 5, "alert"},
+		// Multi-byte characters are not split.
+		{"bötbot", 2, "b"},
+		{"bötbot", 3, "bö"},
+	} {
+		if actual := truncateNick(tc.nick, tc.nickLen); actual != tc.expected {
+			t.Errorf("Expected %s truncated to %d to be %s, got %s",
+				tc.nick, tc.nickLen, tc.expected, actual)
+		}
+	}
+}
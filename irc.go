@@ -17,6 +17,11 @@ package main
 import (
 	"context"
 	"crypto/tls"
+	"errors"
+	"fmt"
+	"math"
+	"os"
+	"regexp"
 	"strconv"
 	"strings"
 	"sync"
@@ -24,8 +29,7 @@ import (
 
 	irc "github.com/fluffle/goirc/client"
 	"github.com/google/alertmanager-irc-relay/logging"
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/text/encoding"
 )
 
 const (
@@ -34,25 +38,104 @@ const (
 	nickservWaitSecs           = 10
 	ircConnectMaxBackoffSecs   = 300
 	ircConnectBackoffResetSecs = 1800
+	// Servers throttling or banning us get longer backoffs.
+	ircThrottledMaxBackoffMins   = 30
+	ircThrottledBackoffResetMins = 120
+	ircBannedMaxBackoffMins      = 240
+	ircBannedBackoffResetMins    = 1440
 )
 
-var (
-	ircConnectedGauge = promauto.NewGauge(prometheus.GaugeOpts{
-		Name: "irc_connected",
-		Help: "Whether the IRC connection is established",
-	})
-	ircSentMsgs = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "irc_sent_msgs",
-		Help: "Number of IRC messages sent"},
-		[]string{"ircchannel"},
-	)
-	ircSendMsgErrors = promauto.NewCounterVec(prometheus.CounterOpts{
-		Name: "irc_send_msg_errors",
-		Help: "Errors while sending IRC messages"},
-		[]string{"ircchannel", "error"},
-	)
+// defaultIRCRegistrationTimeout bounds the wait for the server to welcome us
+// once connected.
+const defaultIRCRegistrationTimeout = 2 * time.Minute
+
+// defaultIRCWriteTimeout bounds the time taken to hand a message to the
+// connection.
+const defaultIRCWriteTimeout = time.Minute
+
+// Actions taken once irc_max_reconnect_attempts consecutive attempts to
+// establish a session failed: exit non-zero, so that a supervisor notices,
+// or keep trying every irc_give_up_retry_interval.
+const (
+	giveUpActionExit        = "exit"
+	giveUpActionRetrySlowly = "retry_slowly"
+)
+
+const defaultIRCGiveUpRetryInterval = 30 * time.Minute
+
+// Actions taken when the server closes the link because we are banned
+// (e.g. K-lined): back off, for irc_banned_retry_interval if set, or exit
+// non-zero rather than keep knocking at the door.
+const (
+	bannedActionBackoff = "backoff"
+	bannedActionExit    = "exit"
 )
 
+// Policies for messages split over several lines whose sending is interrupted
+// by a disconnection: send them again in whole once reconnected, or drop the
+// lines not sent yet.
+const (
+	interruptedMessagesResend = "resend"
+	interruptedMessagesDrop   = "drop"
+)
+
+// Classes of ERROR lines sent by servers closing the link.
+const (
+	serverErrorClassThrottled = "throttled"
+	serverErrorClassBanned    = "banned"
+	serverErrorClassOther     = "other"
+)
+
+// serverErrorPatterns are matched, lowercased, against ERROR messages in
+// order. Messages matching none are classified as other.
+var serverErrorPatterns = []struct {
+	class    string
+	patterns []string
+}{
+	{serverErrorClassBanned, []string{"banned", "k-lined", "g-lined", "z-lined"}},
+	{serverErrorClassThrottled, []string{"too many connections", "throttled", "too fast", "connection limit"}},
+}
+
+func classifyServerError(msg string) string {
+	msg = strings.ToLower(msg)
+	for _, classPatterns := range serverErrorPatterns {
+		for _, pattern := range classPatterns.patterns {
+			if strings.Contains(msg, pattern) {
+				return classPatterns.class
+			}
+		}
+	}
+	return serverErrorClassOther
+}
+
+// ircErrYoureBannedCreep is sent by servers before closing the link of
+// banned clients.
+const ircErrYoureBannedCreep = "465"
+
+// Reasons for a connection teardown, used to classify reconnections.
+const (
+	disconnectReasonServerError         = "server_error"
+	disconnectReasonPingTimeout         = "ping_timeout"
+	disconnectReasonRegistrationTimeout = "registration_timeout"
+	disconnectReasonConnectionLost      = "connection_lost"
+	disconnectReasonKilled              = "killed"
+	// disconnectReasonLocalRestart is for connections we close on purpose
+	// to establish a new one, e.g. when idle, upon a server NOTICE, or when
+	// writing blocks.
+	disconnectReasonLocalRestart = "local_restart"
+)
+
+// isKillMessage tells whether an ERROR message is about us being KILLed by
+// an operator, for servers which do not send us the KILL itself.
+func isKillMessage(msg string) bool {
+	msg = strings.ToLower(msg)
+	return strings.Contains(msg, "(killed ") || strings.Contains(msg, "[killed ")
+}
+
+// attemptFailureConnectError classifies attempts to establish a session which
+// failed before even connecting, along with the disconnection reasons.
+const attemptFailureConnectError = "connect_error"
+
 func loggerHandler(_ *irc.Conn, line *irc.Line) {
 	logging.Info("Received: '%s'", line.Raw)
 }
@@ -60,33 +143,56 @@ func loggerHandler(_ *irc.Conn, line *irc.Line) {
 func makeGOIRCConfig(config *Config) *irc.Config {
 	ircConfig := irc.NewConfig(config.IRCNick)
 	ircConfig.Me.Ident = config.IRCNick
+	if config.IRCIdent != "" {
+		ircConfig.Me.Ident = config.IRCIdent
+	}
 	ircConfig.Me.Name = config.IRCRealName
 	ircConfig.Server = strings.Join(
 		[]string{config.IRCHost, strconv.Itoa(config.IRCPort)}, ":")
 	ircConfig.Pass = config.IRCHostPass
-	ircConfig.SSL = config.IRCUseSSL
-	ircConfig.SSLConfig = &tls.Config{
-		ServerName:         config.IRCHost,
-		InsecureSkipVerify: !config.IRCVerifySSL,
-	}
-	ircConfig.PingFreq = pingFrequencySecs * time.Second
+	// TLS is handled by our dialer, below the CTCP filter, see ircDialer.
+	ircConfig.SSL = false
+	// Pings are sent by our PingMonitor instead.
+	ircConfig.PingFreq = 0
 	ircConfig.Timeout = connectionTimeoutSecs * time.Second
 	ircConfig.NewNick = func(n string) string { return n + "^" }
+	// Used by goirc to answer CTCP VERSION requests.
+	ircConfig.Version = GetBuildInfo().String()
+	// Alerts are split by splitMessage instead, following the line length
+	// advertised by the server.
+	ircConfig.SplitLen = math.MaxInt32
 
 	return ircConfig
 }
 
 type IRCNotifier struct {
+	// Name identifies the connection in logs and metrics.
+	Name string
+
 	// Nick stores the nickname specified in the config, because irc.Client
-	// might change its copy.
+	// might change its copy. It is shortened if the server advertises a
+	// shorter NICKLEN, nickMu guards it.
 	Nick         string
+	nickMu       sync.Mutex
 	NickPassword string
+	// Ident and RealName are reported in /status.
+	Ident    string
+	RealName string
 
-	NickservName string
+	NickservName             string
 	NickservIdentifyPatterns []string
+	NickservConfirmPatterns  []string
+
+	// ReconnectNotices are patterns of server NOTICEs upon which we
+	// reconnect, e.g. announcing the server is going down.
+	ReconnectNotices []*regexp.Regexp
 
 	Client    *irc.Conn
 	AlertMsgs chan AlertMsg
+	// NotificationMsgs receives notes about channels we were kicked from
+	// or cannot join, AlertMsgs by default. With several connections,
+	// the notification channel may be served by another one.
+	NotificationMsgs chan AlertMsg
 
 	// irc.Conn has a Connected() method that can tell us wether the TCP
 	// connection is up, and thus if we should trigger connect/disconnect.
@@ -98,64 +204,382 @@ type IRCNotifier struct {
 	sessionDownSignal chan bool
 	sessionWg         sync.WaitGroup
 
+	// MOTDTimeout, if set, delays joining channels until the end of the
+	// MOTD, signaled on motdDoneSignal, or until it elapsed.
+	MOTDTimeout    time.Duration
+	motdDoneSignal chan struct{}
+
+	// JoinWait is how long alerts wait for their channel to be joined.
+	JoinWait time.Duration
+
+	// disconnectReason classifies the next session teardown, it is set
+	// by whatever notices or triggers the teardown. serverErrorClass is
+	// set when the server closed the link with an ERROR, and selects the
+	// backoff applied before connecting again. banMessage is the reason
+	// given by the server for banning us, until a session is up again.
+	disconnectReason   string
+	serverErrorClass   string
+	serverErrorText    string
+	banMessage         string
+	disconnectReasonMu sync.Mutex
+
 	channelReconciler *ChannelReconciler
+	isupport          *ISupport
+	pingMonitor       *PingMonitor
+	presenceChecker   *PresenceChecker
+	nickReclaimer     *NickReclaimer
+	nickserv          *NickservIdentifier
+	membership        *ChannelMembership
+	// dialer sets up the connections to the server, e.g. TLS.
+	dialer *ircDialer
+	// flushes keeps the messages handed to goirc until written to the
+	// socket.
+	flushes *FlushTracker
+	// escalations relay the messages to channels undeliverable for a
+	// while to their escalation channel.
+	escalations *Escalations
+	// multiline sends the lines of a message in multiline batches, if the
+	// server supports them, once batchParts collected them all.
+	multiline  *MultilineBatcher
+	batchParts []AlertMsg
 
 	UsePrivmsg bool
+	// timestamps prefix the messages sent to some channels with the time.
+	timestamps map[string]channelTimestamp
+	// charsetEncoder transcodes the messages from UTF-8, if the network
+	// expects another charset. It is not safe for concurrent use, hence
+	// charsetMu.
+	charsetEncoder *encoding.Encoder
+	charsetMu      sync.Mutex
+
+	// sendSlots bound the alerts sent at once to the channels whose
+	// delivery need not be ordered, see IRCChannel.SendConcurrency. The
+	// alerts to other channels are sent one after the other.
+	sendSlots map[string]chan struct{}
+	// sendCtx is canceled when the session ends, to interrupt the
+	// concurrent sends tracked by sendWg. unsentAlertMsgs are those which
+	// could not complete, to be sent again on the next session.
+	sendCtx         context.Context
+	cancelSend      context.CancelFunc
+	sendWg          sync.WaitGroup
+	unsentAlertMsgs []AlertMsg
+	unsentMu        sync.Mutex
+
+	// IdleTimeout, if set, closes the session after that long without
+	// alerts. The next alert opens it again.
+	IdleTimeout time.Duration
+	idle        bool
+
+	// pendingAlertMsgs are the alerts kept for the next session, and those
+	// released by Sequencer, sent in order before any other once it is up.
+	// They outlive the sessions, and the channel joins tracked by the
+	// reconciler for each of them.
+	// BacklogTTL, if set, drops those kept for longer than that.
+	pendingAlertMsgs []AlertMsg
+	BacklogTTL       time.Duration
+
+	// RegistrationTimeout, if set, restarts connections on which the
+	// server did not welcome us within that long.
+	RegistrationTimeout time.Duration
+	// WriteTimeout, if set, restarts connections on which sending a
+	// message blocks for that long.
+	WriteTimeout time.Duration
+
+	// InterruptedMessages is the policy for messages split over several
+	// lines whose sending is interrupted. sentParts are the lines of the
+	// message being sent already handed to goirc, and skipParts drops the
+	// lines left of an interrupted message.
+	InterruptedMessages string
+	sentParts           []AlertMsg
+	skipParts           bool
+
+	// MaxReconnectAttempts, if set, is the number of consecutive failed
+	// attempts to establish a session after which GiveUpAction is taken.
+	MaxReconnectAttempts int
+	GiveUpAction         string
+	GiveUpRetryInterval  time.Duration
+	failedAttempts       int
+	// failedAttemptReasons are summarized when giving up, one entry per
+	// reason so that they do not grow without a cap on attempts.
+	failedAttemptReasons []attemptFailures
+	gaveUp               bool
+	// exit is called to exit the process when giving up.
+	exit func(int)
+
+	// BannedAction is taken when the server closes the link because we
+	// are banned. BannedRetryInterval, if set, replaces the backoffs then.
+	BannedAction        string
+	BannedRetryInterval time.Duration
 
 	NickservDelayWait time.Duration
 	BackoffCounter    Delayer
-	timeTeller        TimeTeller
+	// serverErrorBackoffs are applied, by ERROR class, instead of
+	// BackoffCounter.
+	serverErrorBackoffs map[string]Delayer
+	timeTeller          TimeTeller
+	metrics             *Metrics
+
+	// Pending, if set, tracks the messages queued, until they are sent or
+	// dropped.
+	Pending *PendingMessages
+	// Sequencer, if set, holds the messages of webhooks until they can be
+	// sent in order.
+	Sequencer *WebhookSequencer
 }
 
-func NewIRCNotifier(config *Config, alertMsgs chan AlertMsg, delayerMaker DelayerMaker, timeTeller TimeTeller) (*IRCNotifier, error) {
+// channelTimestamp is the format of the time prefixed to the messages sent to
+// a channel.
+type channelTimestamp struct {
+	format   string
+	location *time.Location
+}
+
+func makeChannelTimestamps(channels []IRCChannel) (map[string]channelTimestamp, error) {
+	timestamps := make(map[string]channelTimestamp)
+	for _, channel := range channels {
+		if channel.TimestampFormat == "" {
+			continue
+		}
+		location, err := time.LoadLocation(channel.TimestampTimezone)
+		if err != nil {
+			return nil, err
+		}
+		timestamps[channel.Name] = channelTimestamp{channel.TimestampFormat, location}
+	}
+	return timestamps, nil
+}
+
+func makeSendSlots(channels []IRCChannel) map[string]chan struct{} {
+	sendSlots := make(map[string]chan struct{})
+	for _, channel := range channels {
+		if channel.SendConcurrency > 1 {
+			sendSlots[channel.Name] = make(chan struct{}, channel.SendConcurrency)
+		}
+	}
+	return sendSlots
+}
+
+func NewIRCNotifier(config *Config, alertMsgs chan AlertMsg, delayerMaker DelayerMaker, timeTeller TimeTeller, metrics *Metrics) (*IRCNotifier, error) {
 
 	ircConfig := makeGOIRCConfig(config)
 
 	client := irc.Client(ircConfig)
+	isupport := NewISupport(config.ConnectionName, client)
 
 	backoffCounter := delayerMaker.NewDelayer(
 		ircConnectMaxBackoffSecs, ircConnectBackoffResetSecs,
 		time.Second)
 
-	channelReconciler := NewChannelReconciler(config, client, delayerMaker, timeTeller)
+	serverErrorBackoffs := map[string]Delayer{
+		serverErrorClassThrottled: delayerMaker.NewDelayer(
+			ircThrottledMaxBackoffMins, ircThrottledBackoffResetMins,
+			time.Minute),
+		serverErrorClassBanned: delayerMaker.NewDelayer(
+			ircBannedMaxBackoffMins, ircBannedBackoffResetMins,
+			time.Minute),
+		serverErrorClassOther: delayerMaker.NewDelayer(
+			ircConnectMaxBackoffSecs, ircConnectBackoffResetSecs,
+			time.Second),
+	}
+
+	timestamps, err := makeChannelTimestamps(config.IRCChannels)
+	if err != nil {
+		return nil, err
+	}
+
+	reconnectNotices := []*regexp.Regexp{}
+	for _, pattern := range config.IRCReconnectNotices {
+		reconnectNotice, err := regexp.Compile(pattern)
+		if err != nil {
+			return nil, err
+		}
+		reconnectNotices = append(reconnectNotices, reconnectNotice)
+	}
+
+	charsetEncoder, err := newCharsetEncoder(config.IRCCharset)
+	if err != nil {
+		return nil, err
+	}
+
+	channelReconciler := NewChannelReconciler(config, client, delayerMaker, timeTeller, metrics)
 
 	notifier := &IRCNotifier{
+		Name:                     config.ConnectionName,
 		Nick:                     config.IRCNick,
+		Ident:                    ircConfig.Me.Ident,
+		RealName:                 config.IRCRealName,
 		NickPassword:             config.IRCNickPass,
 		NickservName:             config.NickservName,
 		NickservIdentifyPatterns: config.NickservIdentifyPatterns,
+		ReconnectNotices:         reconnectNotices,
+		NickservConfirmPatterns:  config.NickservConfirmPatterns,
 		Client:                   client,
 		AlertMsgs:                alertMsgs,
+		NotificationMsgs:         alertMsgs,
 		sessionUpSignal:          make(chan bool),
+		motdDoneSignal:           make(chan struct{}, 1),
+		MOTDTimeout:              config.IRCMOTDTimeout,
+		JoinWait:                 config.IRCJoinWait,
 		sessionDownSignal:        make(chan bool),
 		channelReconciler:        channelReconciler,
+		escalations:              NewEscalations(config, timeTeller, metrics),
 		UsePrivmsg:               config.UsePrivmsg,
+		timestamps:               timestamps,
+		charsetEncoder:           charsetEncoder,
+		sendSlots:                makeSendSlots(config.IRCChannels),
+		IdleTimeout:              config.IRCIdleTimeout,
+		RegistrationTimeout:      config.IRCRegistrationTimeout,
+		WriteTimeout:             config.IRCWriteTimeout,
+		InterruptedMessages:      config.IRCInterruptedMessages,
+		BacklogTTL:               config.IRCBacklogTTL,
+		MaxReconnectAttempts:     config.IRCMaxConnectAttempts,
+		GiveUpAction:             config.IRCGiveUpAction,
+		GiveUpRetryInterval:      config.IRCGiveUpRetryInterval,
+		BannedAction:             config.IRCBannedAction,
+		BannedRetryInterval:      config.IRCBannedRetryInterval,
+		exit:                     os.Exit,
 		NickservDelayWait:        nickservWaitSecs * time.Second,
 		BackoffCounter:           backoffCounter,
+		serverErrorBackoffs:      serverErrorBackoffs,
 		timeTeller:               timeTeller,
+		metrics:                  metrics,
+		isupport:                 isupport,
+	}
+
+	notifier.pingMonitor = NewPingMonitor(notifier.Name, client,
+		pingFrequencySecs*time.Second, metrics, func() {
+			notifier.setDisconnectReason(disconnectReasonPingTimeout)
+			client.Close()
+		})
+	notifier.presenceChecker = NewPresenceChecker(notifier.Name, client, channelReconciler,
+		config.IRCPresenceCheckInterval, config.IRCPresenceCheckSpacing, metrics)
+	notifier.nickReclaimer = NewNickReclaimer(notifier.Name, client, notifier.nick,
+		channelReconciler)
+	notifier.multiline = NewMultilineBatcher(config, client, metrics)
+	// Channels requiring it may be joined once identified.
+	notifier.nickserv = NewNickservIdentifier(config, client, metrics,
+		channelReconciler)
+
+	channelReconciler.notify = notifier.sendNotification
+	channelReconciler.joined = notifier.channelJoined
+
+	notifier.membership = NewChannelMembership(client, metrics, config.ChannelMembershipMetrics)
+	notifier.membership.SetConfiguredChannels(config.IRCChannels)
+
+	ctcpFilter := newCTCPFilter(config, metrics)
+	ctcpFilter.registerHandlers(client)
+	var tlsConfig *tls.Config
+	if config.IRCUseSSL {
+		tlsConfig = &tls.Config{
+			ServerName:         config.IRCHost,
+			InsecureSkipVerify: !config.IRCVerifySSL,
+		}
+	}
+	notifier.flushes = NewFlushTracker(notifier.alertMsgFlushed)
+	notifier.dialer = newIRCDialer(config, tlsConfig, ctcpFilter)
+	notifier.dialer.flushes = notifier.flushes
+	notifier.dialer.writeTimedOut = func() {
+		logging.Error("Connection %s: writing to the server blocked for %s, reconnecting",
+			notifier.Name, notifier.WriteTimeout)
+		notifier.metrics.ircWriteTimeouts.WithLabelValues(notifier.Name).Inc()
+		// goirc closes the connection when the write fails.
+		notifier.setDisconnectReason(disconnectReasonLocalRestart)
 	}
+	// Not an actual proxy, see ircDialerScheme.
+	client.Config().Proxy = notifier.dialer.register()
 
 	notifier.registerHandlers()
 
+	logging.Info("Connection %s: nickname=%s ident=%s realname=%q",
+		notifier.Name, notifier.Nick, notifier.Ident, notifier.RealName)
+
 	return notifier, nil
 }
 
 func (n *IRCNotifier) registerHandlers() {
 	n.Client.HandleFunc(irc.CONNECTED,
 		func(*irc.Conn, *irc.Line) {
-			logging.Info("Session established")
+			logging.Info("Connection %s: session established", n.Name)
 			n.sessionUpSignal <- true
 		})
 
 	n.Client.HandleFunc(irc.DISCONNECTED,
 		func(*irc.Conn, *irc.Line) {
-			logging.Info("Disconnected from IRC")
+			logging.Info("Connection %s: disconnected from IRC", n.Name)
+			n.channelReconciler.HandleDisconnect()
 			n.sessionDownSignal <- false
 		})
 
+	n.Client.HandleFunc(irc.ERROR,
+		func(_ *irc.Conn, line *irc.Line) {
+			class := classifyServerError(line.Text())
+			logging.Warn("Connection %s: received ERROR from server (%s): %s",
+				n.Name, class, line.Text())
+			n.metrics.ircServerErrors.WithLabelValues(n.Name, class).Inc()
+			if isKillMessage(line.Text()) {
+				n.setDisconnectReason(disconnectReasonKilled)
+			} else {
+				n.setDisconnectReason(disconnectReasonServerError)
+			}
+			n.setServerError(class, line.Text())
+		})
+
+	n.Client.HandleFunc(ircErrYoureBannedCreep,
+		func(_ *irc.Conn, line *irc.Line) {
+			logging.Warn("Connection %s: banned by the server: %s", n.Name, line.Text())
+			n.metrics.ircServerErrors.WithLabelValues(n.Name, serverErrorClassBanned).Inc()
+			n.setDisconnectReason(disconnectReasonServerError)
+			n.setServerError(serverErrorClassBanned, line.Text())
+		})
+
+	n.Client.HandleFunc("KILL",
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) == 0 || line.Args[0] != n.Client.Me().Nick {
+				return
+			}
+			logging.Warn("Connection %s: killed by %s: %s", n.Name, line.Nick, line.Text())
+			n.setDisconnectReason(disconnectReasonKilled)
+		})
+
+	// End of the MOTD, or no MOTD at all.
+	for _, event := range []string{"376", "422"} {
+		n.Client.HandleFunc(event,
+			func(*irc.Conn, *irc.Line) {
+				select {
+				case n.motdDoneSignal <- struct{}{}:
+				default:
+				}
+			})
+	}
+
+	n.Client.HandleFunc("005",
+		func(_ *irc.Conn, line *irc.Line) {
+			// The nick comes first, and the text last.
+			if len(line.Args) < 3 {
+				return
+			}
+			n.isupport.Handle(line.Args[1 : len(line.Args)-1])
+			for _, token := range line.Args {
+				switch {
+				case strings.HasPrefix(token, "NICKLEN="):
+					if nickLen := n.isupport.NickLen(); nickLen > 0 {
+						n.SetNickLen(nickLen)
+					}
+				case strings.HasPrefix(token, "CASEMAPPING="):
+					n.membership.SetCasemapping(n.isupport.Casemapping())
+				case strings.HasPrefix(token, "CHANNELLEN="):
+					n.checkChannelLen(n.isupport.ChannelLen())
+				}
+			}
+		})
+
 	n.Client.HandleFunc(irc.NOTICE,
 		func(_ *irc.Conn, line *irc.Line) {
 			n.HandleNotice(line.Nick, line.Text())
+			// Users, including services, have a nick!ident@host source.
+			if !strings.Contains(line.Src, "!") {
+				n.HandleServerNotice(line.Text())
+			}
 		})
 
 	for _, event := range []string{"433"} {
@@ -163,6 +587,106 @@ func (n *IRCNotifier) registerHandlers() {
 	}
 }
 
+func (n *IRCNotifier) setDisconnectReason(reason string) {
+	n.disconnectReasonMu.Lock()
+	defer n.disconnectReasonMu.Unlock()
+	// Keep the first reason, later ones are usually consequences of it.
+	if n.disconnectReason == "" {
+		n.disconnectReason = reason
+	}
+}
+
+func (n *IRCNotifier) popDisconnectReason() string {
+	n.disconnectReasonMu.Lock()
+	defer n.disconnectReasonMu.Unlock()
+	reason := n.disconnectReason
+	n.disconnectReason = ""
+	if reason == "" {
+		reason = disconnectReasonConnectionLost
+	}
+	return reason
+}
+
+func (n *IRCNotifier) setServerError(class string, text string) {
+	n.disconnectReasonMu.Lock()
+	defer n.disconnectReasonMu.Unlock()
+	// Keep a ban, the ERROR which follows ERR_YOUREBANNEDCREEP does not
+	// necessarily tell about it.
+	if n.serverErrorClass == serverErrorClassBanned && class != serverErrorClassBanned {
+		return
+	}
+	n.serverErrorClass = class
+	n.serverErrorText = text
+}
+
+// setBanMessage records why we are banned, or that we no longer are, and
+// tells whether we just got banned.
+func (n *IRCNotifier) setBanMessage(text string) bool {
+	n.disconnectReasonMu.Lock()
+	defer n.disconnectReasonMu.Unlock()
+	newlyBanned := n.banMessage == "" && text != ""
+	n.banMessage = text
+	return newlyBanned
+}
+
+func (n *IRCNotifier) popServerError() (string, string) {
+	n.disconnectReasonMu.Lock()
+	defer n.disconnectReasonMu.Unlock()
+	class := n.serverErrorClass
+	n.serverErrorClass = ""
+	return class, n.serverErrorText
+}
+
+// attemptFailures counts the attempts to establish a session which failed for
+// a reason, detail being that of the last one, e.g. the error message.
+type attemptFailures struct {
+	reason string
+	count  int
+	detail string
+}
+
+func (n *IRCNotifier) attemptFailed(reason string, detail string) {
+	for i := range n.failedAttemptReasons {
+		if n.failedAttemptReasons[i].reason == reason {
+			n.failedAttemptReasons[i].count++
+			n.failedAttemptReasons[i].detail = detail
+			return
+		}
+	}
+	n.failedAttemptReasons = append(n.failedAttemptReasons, attemptFailures{reason, 1, detail})
+}
+
+// failureSummary tells how many attempts failed for each reason, in the order
+// reasons first occurred, with the last detail of each.
+func (n *IRCNotifier) failureSummary() string {
+	summary := []string{}
+	for _, failures := range n.failedAttemptReasons {
+		item := fmt.Sprintf("%dx %s", failures.count, failures.reason)
+		if failures.detail != "" {
+			item += fmt.Sprintf(" (last: %s)", failures.detail)
+		}
+		summary = append(summary, item)
+	}
+	return strings.Join(summary, ", ")
+}
+
+func (n *IRCNotifier) sendNotification(alertMsg AlertMsg) {
+	select {
+	case n.NotificationMsgs <- alertMsg:
+	default:
+		logging.Error("Could not send notification to the IRC routine: %s", alertMsg.Alert)
+		n.metrics.alertHandlingErrors.WithLabelValues(alertMsg.Channel, "internal_comm_channel_full").Inc()
+	}
+}
+
+// channelJoined stops escalating the messages to the channel once joined,
+// and replays those which could not be delivered meanwhile.
+func (n *IRCNotifier) channelJoined(channel string) {
+	for _, alertMsg := range n.escalations.Recovered(channel) {
+		n.sendNotification(alertMsg)
+	}
+}
+
 func (n *IRCNotifier) HandleNotice(nick string, msg string) {
 	logging.Info("Received NOTICE from %s: %s", nick, msg)
 	if strings.ToLower(nick) == "nickserv" {
@@ -170,6 +694,24 @@ func (n *IRCNotifier) HandleNotice(nick string, msg string) {
 	}
 }
 
+// HandleServerNotice reconnects if the NOTICE from the server matches one of
+// ReconnectNotices. We quit gracefully, and reconnect with the usual backoff.
+func (n *IRCNotifier) HandleServerNotice(msg string) {
+	for _, pattern := range n.ReconnectNotices {
+		if !pattern.MatchString(msg) {
+			continue
+		}
+		logging.Warn("Connection %s: server notice matches '%s', reconnecting: %s",
+			n.Name, pattern, msg)
+		n.metrics.ircReconnectNotices.WithLabelValues(n.Name, pattern.String()).Inc()
+		n.setDisconnectReason(disconnectReasonLocalRestart)
+		if !n.writeWithTimeout(func() { n.Client.Quit("reconnecting") }) {
+			n.Client.Close()
+		}
+		return
+	}
+}
+
 func (n *IRCNotifier) HandleNickservMsg(msg string) {
 	if n.NickPassword == "" {
 		logging.Debug("Skip processing NickServ request, no password configured")
@@ -189,10 +731,48 @@ func (n *IRCNotifier) HandleNickservMsg(msg string) {
 		logging.Debug("Checking if NickServ message matches identify request '%s'", identifyPattern)
 		if strings.Contains(cleanedMsg, identifyPattern) {
 			logging.Info("Handling NickServ request to IDENTIFY")
-			n.Client.Privmsgf(n.NickservName, "IDENTIFY %s", n.NickPassword)
+			n.nickserv.Identify()
 			return
 		}
 	}
+	for _, confirmPattern := range n.NickservConfirmPatterns {
+		if strings.Contains(cleanedMsg, confirmPattern) {
+			n.nickserv.SetIdentified()
+			return
+		}
+	}
+}
+
+// checkChannelLen warns about the channels of the config longer than the
+// server allows, which cannot be joined.
+func (n *IRCNotifier) checkChannelLen(channelLen int) {
+	if channelLen <= 0 {
+		return
+	}
+	for _, channel := range n.channelReconciler.ConfiguredChannels() {
+		if len(channel) > channelLen {
+			logging.Warn("Connection %s: channel %s is longer than the %d characters allowed by the server (CHANNELLEN), it cannot be joined",
+				n.Name, channel, channelLen)
+		}
+	}
+}
+
+// SetNickLen shortens the nickname to the length allowed by the server.
+func (n *IRCNotifier) SetNickLen(nickLen int) {
+	n.nickMu.Lock()
+	defer n.nickMu.Unlock()
+
+	if nick := truncateNick(n.Nick, nickLen); nick != n.Nick {
+		logging.Warn("Connection %s: nickname '%s' is longer than the %d characters allowed by the server, using '%s'",
+			n.Name, n.Nick, nickLen, nick)
+		n.Nick = nick
+	}
+}
+
+func (n *IRCNotifier) nick() string {
+	n.nickMu.Lock()
+	defer n.nickMu.Unlock()
+	return n.Nick
 }
 
 func (n *IRCNotifier) MaybeGhostNick() {
@@ -202,15 +782,15 @@ func (n *IRCNotifier) MaybeGhostNick() {
 	}
 
 	currentNick := n.Client.Me().Nick
-	if currentNick != n.Nick {
+	if nick := n.nick(); currentNick != nick {
 		logging.Info("My nick is '%s', sending GHOST to NickServ to get '%s'",
-			currentNick, n.Nick)
-		n.Client.Privmsgf(n.NickservName, "GHOST %s %s", n.Nick,
+			currentNick, nick)
+		n.Client.Privmsgf(n.NickservName, "GHOST %s %s", nick,
 			n.NickPassword)
 		time.Sleep(n.NickservDelayWait)
 
-		logging.Info("Changing nick to '%s'", n.Nick)
-		n.Client.Nick(n.Nick)
+		logging.Info("Changing nick to '%s'", nick)
+		n.Client.Nick(nick)
 		time.Sleep(n.NickservDelayWait)
 	}
 }
@@ -227,47 +807,658 @@ func (n *IRCNotifier) MaybeWaitForNickserv() {
 	time.Sleep(n.NickservDelayWait)
 }
 
-func (n *IRCNotifier) ChannelJoined(ctx context.Context, channel string) bool {
+// MaybeWaitForMOTD waits for the end of the MOTD, as some servers reject
+// joins until then.
+func (n *IRCNotifier) MaybeWaitForMOTD(ctx context.Context) {
+	if n.MOTDTimeout <= 0 {
+		return
+	}
+
+	motdTimer := time.NewTimer(n.MOTDTimeout)
+	defer motdTimer.Stop()
+
+	select {
+	case <-n.motdDoneSignal:
+		logging.Debug("Connection %s: end of MOTD received", n.Name)
+	case <-motdTimer.C:
+		logging.Warn("Connection %s: no end of MOTD after %s, joining channels anyway",
+			n.Name, n.MOTDTimeout)
+	case <-ctx.Done():
+	}
+}
+
+// ChannelJoined waits for the channel to be joined, and tells whether it is.
+// It returns errSessionDown if a signal is received on sessionDown meanwhile,
+// which may be nil.
+func (n *IRCNotifier) ChannelJoined(ctx context.Context, channel string, sessionDown <-chan bool) (bool, error) {
 
 	isJoined, waitJoined := n.channelReconciler.JoinChannel(channel)
 	if isJoined {
-		return true
+		return true, nil
+	}
+	if waitJoined == nil {
+		// We gave up joining it.
+		return false, nil
 	}
+	n.channelReconciler.CountQueued(channel)
 
 	select {
 	case <-waitJoined:
-		return true
-	case <-n.timeTeller.After(ircJoinWaitSecs * time.Second):
-		logging.Warn("Channel %s not joined after %d seconds, giving bad news to caller", channel, ircJoinWaitSecs)
-		return false
+		return true, nil
+	case <-n.timeTeller.After(n.JoinWait):
+		logging.Warn("Channel %s not joined after %s, giving bad news to caller", channel, n.JoinWait)
+		return false, nil
+	case <-sessionDown:
+		logging.Info("Session lost while waiting for join on channel %s", channel)
+		return false, errSessionDown
 	case <-ctx.Done():
 		logging.Info("Context canceled while waiting for join on channel %s", channel)
-		return false
+		return false, nil
 	}
 }
 
+var (
+	errWriteTimeout    = errors.New("write timeout")
+	errSendInterrupted = errors.New("interrupted")
+	errSessionDown     = errors.New("session down")
+)
+
+// SendAlertMsg sends an alert, and restarts the connection if sending blocked.
+// The lines of a message split over several lines are not sent once the
+// connection broke while sending the previous ones, see interruptMessage.
 func (n *IRCNotifier) SendAlertMsg(ctx context.Context, alertMsg *AlertMsg) {
-	if !n.sessionUp {
-		logging.Error("Cannot send alert to %s : IRC not connected", alertMsg.Channel)
-		ircSendMsgErrors.WithLabelValues(alertMsg.Channel, "not_connected").Inc()
+	if n.skipParts {
+		if alertMsg.Part > 1 {
+			logging.Warn("%sConnection %s: dropping line %d of %d of interrupted message to %s",
+				correlationPrefix(alertMsg.CorrelationID), n.Name, alertMsg.Part, alertMsg.Parts, alertMsg.Channel)
+			n.Pending.Done(alertMsg)
+			return
+		}
+		n.skipParts = false
+	}
+	if alertMsg.Part <= 1 {
+		n.sentParts = nil
+	}
+	if n.collectPart(ctx, alertMsg) {
 		return
 	}
-	if !n.ChannelJoined(ctx, alertMsg.Channel) {
-		logging.Error("Cannot send alert to %s : cannot join channel", alertMsg.Channel)
-		ircSendMsgErrors.WithLabelValues(alertMsg.Channel, "not_joined").Inc()
+	// goirc writes in the background, and closes the connection if that
+	// fails: lines handed to it since may be lost.
+	if n.sessionUp && !n.Client.Connected() {
+		if alertMsg.Part > 1 {
+			n.interruptMessage(alertMsg)
+		} else {
+			n.keepAlertMsgs(true, *alertMsg)
+		}
+		<-n.sessionDownSignal
+		n.sessionLost()
 		return
 	}
 
-	if n.UsePrivmsg {
-		n.Client.Privmsg(alertMsg.Channel, alertMsg.Alert)
+	err := n.deliverAlertMsg(ctx, alertMsg, n.sessionUp, n.sessionDownSignal)
+	if err == errSessionDown {
+		// The session was lost while waiting for the channel to be
+		// joined, the signal is consumed already.
+		n.interruptMessage(alertMsg)
+		n.sessionLost()
+		return
+	}
+	if err != errWriteTimeout {
+		if alertMsg.Parts > 1 {
+			n.sentParts = append(n.sentParts, *alertMsg)
+		}
+		if alertMsg.Part < alertMsg.Parts && n.sessionUp && !n.Client.Connected() {
+			n.interruptMessage(nil)
+			<-n.sessionDownSignal
+			n.sessionLost()
+		} else if alertMsg.Part == alertMsg.Parts {
+			n.sentParts = nil
+		}
+		return
+	}
+	// Send it again once reconnected.
+	n.interruptMessage(alertMsg)
+	n.setDisconnectReason(disconnectReasonLocalRestart)
+	// Close dispatches the disconnection and waits for its handlers, which
+	// signal us.
+	go n.Client.Close()
+	<-n.sessionDownSignal
+	n.sessionLost()
+}
+
+// interruptMessage handles the disconnection interrupting the sending of a
+// message, alertMsg being the line not sent, if any. Single lines are sent
+// again once reconnected. The lines of a message split over several lines
+// are all sent again first, or those left dropped, as InterruptedMessages
+// says, rather than sending the message truncated or in pieces.
+func (n *IRCNotifier) interruptMessage(alertMsg *AlertMsg) {
+	parts := n.sentParts
+	n.sentParts = nil
+	if alertMsg != nil {
+		if alertMsg.Parts <= 1 {
+			n.keepAlertMsgs(true, *alertMsg)
+			return
+		}
+		parts = append(parts, *alertMsg)
+	}
+	if len(parts) == 0 {
+		return
+	}
+	last := parts[len(parts)-1]
+	logPrefix := correlationPrefix(last.CorrelationID)
+	n.metrics.ircSendMsgErrors.WithLabelValues(n.Name, last.Channel, "interrupted").Inc()
+	if n.InterruptedMessages == interruptedMessagesDrop {
+		logging.Warn("%sConnection %s: sending message to %s interrupted at line %d of %d, dropping the rest",
+			logPrefix, n.Name, last.Channel, last.Part, last.Parts)
+		n.skipParts = last.Part < last.Parts
+		if alertMsg != nil {
+			n.Pending.Done(alertMsg)
+		}
+		return
+	}
+	logging.Warn("%sConnection %s: sending message to %s interrupted at line %d of %d, sending it again once reconnected",
+		logPrefix, n.Name, last.Channel, last.Part, last.Parts)
+	n.keepAlertMsgs(true, parts...)
+}
+
+// keepUnflushed keeps the alerts handed to goirc but not written to the
+// socket when the connection broke for the next session, before the others,
+// as they were to be sent first. Those kept already, as lines of a message
+// interrupted, are not kept twice.
+func (n *IRCNotifier) keepUnflushed() {
+	kept := make(map[uint64]bool)
+	for _, alertMsg := range n.pendingAlertMsgs {
+		if alertMsg.flushID != 0 {
+			kept[alertMsg.flushID] = true
+		}
+	}
+	unflushed := []AlertMsg{}
+	for _, alertMsg := range n.flushes.Reset() {
+		if !kept[alertMsg.flushID] {
+			unflushed = append(unflushed, alertMsg)
+		}
+	}
+	if len(unflushed) == 0 {
+		return
+	}
+	logging.Warn("Connection %s: %d alerts were not written before the connection broke, sending them again once reconnected",
+		n.Name, len(unflushed))
+	n.keepAlertMsgs(true, unflushed...)
+}
+
+// keepAlertMsgs keeps alerts for the next session, before those kept already
+// if first, or else after them.
+func (n *IRCNotifier) keepAlertMsgs(first bool, alertMsgs ...AlertMsg) {
+	if n.BacklogTTL > 0 {
+		var now time.Time
+		for i := range alertMsgs {
+			if !alertMsgs[i].keptSince.IsZero() {
+				continue
+			}
+			if now.IsZero() {
+				now = n.timeTeller.Now()
+			}
+			alertMsgs[i].keptSince = now
+		}
+	}
+	if first {
+		n.pendingAlertMsgs = append(alertMsgs, n.pendingAlertMsgs...)
 	} else {
-		n.Client.Notice(alertMsg.Channel, alertMsg.Alert)
+		n.pendingAlertMsgs = append(n.pendingAlertMsgs, alertMsgs...)
+	}
+}
+
+// nextPendingAlertMsg pops the next alert kept for the session, dropping
+// those kept for longer than BacklogTTL.
+func (n *IRCNotifier) nextPendingAlertMsg() (AlertMsg, bool) {
+	var now time.Time
+	for len(n.pendingAlertMsgs) > 0 {
+		alertMsg := n.pendingAlertMsgs[0]
+		n.pendingAlertMsgs = n.pendingAlertMsgs[1:]
+		if alertMsg.keptSince.IsZero() {
+			return alertMsg, true
+		}
+		if now.IsZero() {
+			now = n.timeTeller.Now()
+		}
+		if now.Sub(alertMsg.keptSince) < n.BacklogTTL {
+			return alertMsg, true
+		}
+		logging.Warn("%sConnection %s: dropping alert to %s kept for more than %s",
+			correlationPrefix(alertMsg.CorrelationID), n.Name, alertMsg.Channel, n.BacklogTTL)
+		n.metrics.ircSendMsgErrors.WithLabelValues(n.Name, alertMsg.Channel, "expired").Inc()
+		// The rest of a message is not sent without its start.
+		n.skipParts = alertMsg.Part < alertMsg.Parts
+		n.Pending.Done(&alertMsg)
+	}
+	return AlertMsg{}, false
+}
+
+// deliverAlertMsg sends an alert, once its channel is joined. Alerts which
+// cannot be sent are dropped, and errors returned only for those which should
+// be sent again on the next session: errWriteTimeout if sending blocked,
+// errSendInterrupted if ctx was canceled while waiting for the join, and
+// errSessionDown if the session was lost meanwhile, as signaled on
+// sessionDown.
+func (n *IRCNotifier) deliverAlertMsg(ctx context.Context, alertMsg *AlertMsg, sessionUp bool, sessionDown <-chan bool) error {
+	alertMsg.Span.End()
+	sendSpan := alertMsg.Span.StartSibling("irc_write")
+	sendSpan.SetAttribute("connection", n.Name)
+	defer sendSpan.End()
+
+	logPrefix := correlationPrefix(alertMsg.CorrelationID)
+	if !sessionUp {
+		logging.Error("%sCannot send alert to %s : IRC connection %s not connected", logPrefix, alertMsg.Channel, n.Name)
+		n.metrics.ircSendMsgErrors.WithLabelValues(n.Name, alertMsg.Channel, "not_connected").Inc()
+		sendSpan.SetError(errors.New("not connected"))
+		n.Pending.Done(alertMsg)
+		return nil
+	}
+	if n.channelReconciler.Disabled(alertMsg.Channel) {
+		logging.Warn("%sNot sending alert to %s : channel disabled", logPrefix, alertMsg.Channel)
+		n.metrics.ircSendMsgErrors.WithLabelValues(n.Name, alertMsg.Channel, "disabled").Inc()
+		sendSpan.SetError(errors.New("channel disabled"))
+		n.Pending.Done(alertMsg)
+		return nil
+	}
+	// Messages escalated do not wait for their channel to be joined.
+	var joined bool
+	var err error
+	if n.escalations.Escalating(alertMsg.Channel) {
+		joined, _ = n.channelReconciler.JoinChannel(alertMsg.Channel)
+	} else {
+		joined, err = n.ChannelJoined(ctx, alertMsg.Channel, sessionDown)
+	}
+	if err != nil {
+		sendSpan.SetError(err)
+		return err
+	}
+	if !joined {
+		if ctx.Err() != nil {
+			sendSpan.SetError(errSendInterrupted)
+			return errSendInterrupted
+		}
+		if escalated, ok := n.escalations.Undeliverable(alertMsg); ok {
+			logging.Warn("%sCannot send alert to %s : cannot join channel, escalating it to %s",
+				logPrefix, alertMsg.Channel, escalated.Channel)
+			sendSpan.SetAttribute("escalated_to", escalated.Channel)
+			n.Pending.Done(alertMsg)
+			n.sendNotification(escalated)
+			return nil
+		}
+		logging.Error("%sCannot send alert to %s : cannot join channel", logPrefix, alertMsg.Channel)
+		n.metrics.ircSendMsgErrors.WithLabelValues(n.Name, alertMsg.Channel, "not_joined").Inc()
+		sendSpan.SetError(errors.New("cannot join channel"))
+		n.Pending.Done(alertMsg)
+		return nil
+	}
+
+	// The timestamp is part of the message split if too long.
+	msg := alertMsg.Alert
+	if timestamp, ok := n.timestamps[alertMsg.Channel]; ok {
+		msg = n.timeTeller.Now().In(timestamp.location).Format(timestamp.format) + " " + msg
+	}
+	n.charsetMu.Lock()
+	msg = encodeMessage(n.charsetEncoder, msg)
+	n.charsetMu.Unlock()
+
+	command := irc.NOTICE
+	if n.UsePrivmsg {
+		command = irc.PRIVMSG
+	}
+	lines := splitMessage(msg, n.isupport.SplitLen())
+	rawLines := []string{}
+	for _, line := range lines {
+		rawLines = append(rawLines, rawLine(command, alertMsg.Channel, line))
+	}
+	// The message is sent once its lines are written, see
+	// alertMsgFlushed.
+	n.flushes.Add(rawLines, alertMsg)
+	written := n.writeWithTimeout(func() {
+		for _, line := range lines {
+			if n.UsePrivmsg {
+				n.Client.Privmsg(alertMsg.Channel, line)
+			} else {
+				n.Client.Notice(alertMsg.Channel, line)
+			}
+		}
+	})
+	if !written {
+		n.flushes.Remove(alertMsg)
+		logging.Error("%sConnection %s: sending alert to %s blocked for %s, reconnecting",
+			logPrefix, n.Name, alertMsg.Channel, n.WriteTimeout)
+		n.metrics.ircSendMsgErrors.WithLabelValues(n.Name, alertMsg.Channel, "write_timeout").Inc()
+		sendSpan.SetError(errWriteTimeout)
+		return errWriteTimeout
+	}
+	logging.Debug("%sConnection %s: handed alert to %s over to the connection", logPrefix, n.Name, alertMsg.Channel)
+	return nil
+}
+
+// alertMsgFlushed records an alert as sent, once all its lines are written
+// to the socket.
+func (n *IRCNotifier) alertMsgFlushed(alertMsg AlertMsg) {
+	logging.Debug("%sConnection %s: sent alert to %s",
+		correlationPrefix(alertMsg.CorrelationID), n.Name, alertMsg.Channel)
+	n.metrics.ircSentMsgs.WithLabelValues(n.Name, alertMsg.Channel).Inc()
+	n.metrics.ircLastMsgSentTimestamp.WithLabelValues(alertMsg.Channel).SetToCurrentTime()
+	n.Pending.Done(&alertMsg)
+}
+
+// collectPart collects the lines of a message of several lines, to send them
+// in multiline batches once all collected, and tells whether it took care of
+// alertMsg. The lines collected are sent one by one if the next line received
+// is not the one they miss.
+func (n *IRCNotifier) collectPart(ctx context.Context, alertMsg *AlertMsg) bool {
+	if len(n.batchParts) == 0 {
+		if alertMsg.unbatched || alertMsg.Part != 1 || !n.multiline.Available() {
+			return false
+		}
+		n.batchParts = []AlertMsg{*alertMsg}
+		return true
+	}
+	last := n.batchParts[len(n.batchParts)-1]
+	if alertMsg.Channel != last.Channel || alertMsg.CorrelationID != last.CorrelationID ||
+		alertMsg.Parts != last.Parts || alertMsg.Part != last.Part+1 {
+		n.unbatchParts(n.batchParts, alertMsg)
+		return true
+	}
+	n.batchParts = append(n.batchParts, *alertMsg)
+	if alertMsg.Part == alertMsg.Parts {
+		n.sendBatch(ctx)
+	}
+	return true
+}
+
+// unbatchParts has lines sent one by one, before next if any.
+func (n *IRCNotifier) unbatchParts(parts []AlertMsg, next *AlertMsg) {
+	n.batchParts = nil
+	alertMsgs := []AlertMsg{}
+	for _, part := range parts {
+		part.unbatched = true
+		alertMsgs = append(alertMsgs, part)
+	}
+	if next != nil {
+		alertMsgs = append(alertMsgs, *next)
+	}
+	n.pendingAlertMsgs = append(alertMsgs, n.pendingAlertMsgs...)
+}
+
+// sendBatch sends the lines collected in multiline batches, or one by one if
+// they cannot be.
+func (n *IRCNotifier) sendBatch(ctx context.Context) {
+	parts := n.batchParts
+	n.batchParts = nil
+	sent, err := n.deliverBatch(ctx, parts, n.sessionDownSignal)
+	switch err {
+	case nil:
+	case errSessionDown:
+		// The signal is consumed already.
+		n.keepAlertMsgs(true, parts[sent:]...)
+		n.sessionLost()
+	case errWriteTimeout:
+		n.keepAlertMsgs(true, parts[sent:]...)
+		n.setDisconnectReason(disconnectReasonLocalRestart)
+		go n.Client.Close()
+		<-n.sessionDownSignal
+		n.sessionLost()
+	default:
+		n.unbatchParts(parts[sent:], nil)
+	}
+}
+
+// deliverBatch sends the lines of a message in multiline batches, once their
+// channel is joined, and returns how many were sent. Like deliverAlertMsg, it
+// returns errWriteTimeout, errSendInterrupted or errSessionDown for the lines
+// left to send on the next session, and errBatchUnsuitable or an
+// errBatchRejected error for those to send one by one, which are dropped or
+// escalated that way if their channel cannot be joined.
+func (n *IRCNotifier) deliverBatch(ctx context.Context, parts []AlertMsg, sessionDown <-chan bool) (int, error) {
+	channel := parts[0].Channel
+	logPrefix := correlationPrefix(parts[0].CorrelationID)
+	if n.channelReconciler.Disabled(channel) || n.escalations.Escalating(channel) {
+		return 0, errBatchUnsuitable
+	}
+	joined, err := n.ChannelJoined(ctx, channel, sessionDown)
+	if err != nil {
+		return 0, err
+	}
+	if !joined {
+		if ctx.Err() != nil {
+			return 0, errSendInterrupted
+		}
+		return 0, errBatchUnsuitable
+	}
+
+	lines := []string{}
+	for _, part := range parts {
+		lines = append(lines, part.Alert)
+	}
+	// The timestamp prefixes the message, not each of its lines.
+	if timestamp, ok := n.timestamps[channel]; ok {
+		lines[0] = n.timeTeller.Now().In(timestamp.location).Format(timestamp.format) + " " + lines[0]
+	}
+	n.charsetMu.Lock()
+	for i := range lines {
+		lines[i] = encodeMessage(n.charsetEncoder, lines[i])
+	}
+	n.charsetMu.Unlock()
+	batches := n.multiline.Batches(lines, n.isupport.SplitLen())
+	if batches == nil {
+		logging.Debug("%sConnection %s: message to %s exceeds the multiline limits, sending it line by line",
+			logPrefix, n.Name, channel)
+		return 0, errBatchUnsuitable
+	}
+	command := irc.NOTICE
+	if n.UsePrivmsg {
+		command = irc.PRIVMSG
+	}
+
+	spans := []*Span{}
+	for _, part := range parts {
+		part.Span.End()
+		span := part.Span.StartSibling("irc_write")
+		span.SetAttribute("connection", n.Name)
+		span.SetAttribute("multiline", "true")
+		spans = append(spans, span)
+	}
+	defer func() {
+		for _, span := range spans {
+			span.End()
+		}
+	}()
+
+	sent := 0
+	for _, batch := range batches {
+		var token string
+		written := n.writeWithTimeout(func() {
+			token = n.multiline.Write(channel, command, batch)
+		})
+		if !written {
+			logging.Error("%sConnection %s: sending alert to %s blocked for %s, reconnecting",
+				logPrefix, n.Name, channel, n.WriteTimeout)
+			n.metrics.ircSendMsgErrors.WithLabelValues(n.Name, channel, "write_timeout").Inc()
+			err = errWriteTimeout
+		} else {
+			err = n.multiline.Confirm(token, sessionDown)
+		}
+		if err != nil {
+			for _, span := range spans[sent:] {
+				span.SetError(err)
+			}
+			return sent, err
+		}
+		lineCount := 0
+		for _, line := range batch {
+			if !line.concat {
+				lineCount++
+			}
+		}
+		for i := sent; i < sent+lineCount; i++ {
+			n.metrics.ircSentMsgs.WithLabelValues(n.Name, channel).Inc()
+			n.Pending.Done(&parts[i])
+		}
+		n.metrics.ircLastMsgSentTimestamp.WithLabelValues(channel).SetToCurrentTime()
+		sent += lineCount
+	}
+	logging.Debug("%sConnection %s: sent alert to %s in %d multiline batches", logPrefix, n.Name, channel, len(batches))
+	return sent, nil
+}
+
+// dispatchAlertMsg sends an alert right away if its channel requires ordered
+// delivery, or if it comes from a sequenced webhook, or else in the
+// background once one of the channel's send slots is free.
+func (n *IRCNotifier) dispatchAlertMsg(ctx context.Context, alertMsg *AlertMsg) {
+	slots, ok := n.sendSlots[alertMsg.Channel]
+	if !ok || alertMsg.sequence != 0 {
+		n.SendAlertMsg(ctx, alertMsg)
+		return
+	}
+
+	select {
+	case slots <- struct{}{}:
+	case <-n.sessionDownSignal:
+		n.keepAlertMsgs(false, *alertMsg)
+		n.sessionLost()
+		return
+	case <-ctx.Done():
+		return
+	}
+
+	sendCtx := n.sendCtx
+	msg := *alertMsg
+	n.sendWg.Add(1)
+	go func() {
+		defer n.sendWg.Done()
+		defer func() { <-slots }()
+
+		err := n.deliverAlertMsg(sendCtx, &msg, true, nil)
+		if err == nil {
+			return
+		}
+		n.unsentMu.Lock()
+		n.unsentAlertMsgs = append(n.unsentAlertMsgs, msg)
+		n.unsentMu.Unlock()
+		if err == errWriteTimeout {
+			n.setDisconnectReason(disconnectReasonLocalRestart)
+			// Close dispatches the disconnection to the run loop,
+			// which may be waiting for us.
+			go n.Client.Close()
+		}
+	}()
+}
+
+// stopSending interrupts the alerts being sent in the background, waits for
+// them and keeps those not sent for the next session.
+func (n *IRCNotifier) stopSending() {
+	if n.cancelSend == nil {
+		return
+	}
+	n.cancelSend()
+	n.sendWg.Wait()
+	n.unsentMu.Lock()
+	n.keepAlertMsgs(false, n.unsentAlertMsgs...)
+	n.unsentAlertMsgs = nil
+	n.unsentMu.Unlock()
+}
+
+// writeWithTimeout runs write, which hands lines to goirc. Writes to the
+// socket have a deadline, see deadlineConn, but goirc blocks once its
+// outgoing queue is full and no longer drains it once the connection is
+// closed, so write is given up on after WriteTimeout too. It tells whether
+// write completed in time.
+func (n *IRCNotifier) writeWithTimeout(write func()) bool {
+	if n.WriteTimeout <= 0 {
+		write()
+		return true
+	}
+
+	done := make(chan bool)
+	go func() {
+		// Closing the connection unblocks the write.
+		write()
+		close(done)
+	}()
+
+	timer := time.NewTimer(n.WriteTimeout)
+	defer timer.Stop()
+	select {
+	case <-done:
+		return true
+	case <-timer.C:
+		n.metrics.ircWriteTimeouts.WithLabelValues(n.Name).Inc()
+		return false
+	}
+}
+
+// ConnectionStatus describes an IRC connection in /status.
+type ConnectionStatus struct {
+	Name string `json:"name"`
+	// Nick is the nick we want, and CurrentNick the one we have, which
+	// differ while the former is taken.
+	Nick        string          `json:"nick"`
+	CurrentNick string          `json:"current_nick"`
+	Ident       string          `json:"ident"`
+	RealName    string          `json:"realname"`
+	Channels    []ChannelStatus `json:"channels"`
+	// JoinsPaused is set while joining channels is held back, e.g. while
+	// we change nick.
+	JoinsPaused bool `json:"joins_paused"`
+	// BannedChannels are the channels we are banned from, and when
+	// joining them is tried next.
+	BannedChannels []ChannelBanStatus `json:"banned_channels"`
+	// ChannelEvents are the last reasons why we left or could not join
+	// the channels, e.g. kicks.
+	ChannelEvents []ChannelEvents `json:"channel_events"`
+	// Banned is the reason given by the server for banning us, if it did.
+	Banned string `json:"banned,omitempty"`
+	// DisabledChannels are the channels disabled in the config, which are
+	// not joined.
+	DisabledChannels []DisabledChannelStatus `json:"disabled_channels"`
+	// ISupport are the limits advertised by the server, or the defaults.
+	ISupport ISupportStatus `json:"isupport"`
+}
+
+// ChannelTopic returns the topic of the channel, and whether we are in it.
+func (n *IRCNotifier) ChannelTopic(channel string) (string, bool) {
+	return n.membership.Topic(channel)
+}
+
+// UpdateChannels applies the keys and the disabled flag of channels, e.g. on
+// config reload.
+func (n *IRCNotifier) UpdateChannels(channels []IRCChannel) {
+	n.channelReconciler.UpdateChannelKeys(channels)
+	n.channelReconciler.UpdateDisabledChannels(channels)
+	n.membership.SetConfiguredChannels(channels)
+}
+
+func (n *IRCNotifier) Status() ConnectionStatus {
+	n.disconnectReasonMu.Lock()
+	banned := n.banMessage
+	n.disconnectReasonMu.Unlock()
+	currentNick := n.nickReclaimer.Current()
+	return ConnectionStatus{
+		Name:        n.Name,
+		Nick:        n.nick(),
+		CurrentNick: currentNick,
+		Ident:       n.Ident,
+		RealName:    n.RealName,
+		Channels:    n.membership.ChannelStatuses(currentNick),
+		JoinsPaused: n.channelReconciler.Paused(),
+		Banned:      banned,
+
+		BannedChannels: n.channelReconciler.BannedChannels(),
+		ChannelEvents:  n.channelReconciler.ChannelEvents(),
+
+		DisabledChannels: n.channelReconciler.DisabledChannels(),
+
+		ISupport: n.isupport.Status(),
 	}
-	ircSentMsgs.WithLabelValues(alertMsg.Channel).Inc()
 }
 
 func (n *IRCNotifier) ShutdownPhase() {
 	if n.sessionUp {
+		n.stopSending()
 		logging.Info("IRC client connected, quitting")
 		n.Client.Quit("see ya")
 
@@ -279,46 +1470,264 @@ func (n *IRCNotifier) ShutdownPhase() {
 		}
 		n.sessionWg.Done()
 	}
+	n.pingMonitor.Stop()
+	n.presenceChecker.Stop()
+	n.nickReclaimer.Stop()
+	n.nickserv.Stop()
+	n.membership.Reset()
 	logging.Info("IRC shutdown complete")
 }
 
+func (n *IRCNotifier) disconnectIdle() {
+	logging.Info("Connection %s: no alerts for %s, disconnecting until the next one",
+		n.Name, n.IdleTimeout)
+	n.stopSending()
+	n.metrics.ircReconnects.WithLabelValues(n.Name, disconnectReasonLocalRestart).Inc()
+	n.Client.Quit("idle")
+	select {
+	case <-n.sessionDownSignal:
+	case <-n.timeTeller.After(n.Client.Config().Timeout):
+		logging.Warn("Timeout while waiting for IRC disconnect to complete, closing the connection")
+		go n.Client.Close()
+		<-n.sessionDownSignal
+	}
+	n.sessionUp = false
+	n.sessionWg.Done()
+	n.channelReconciler.Stop()
+	n.pingMonitor.Stop()
+	n.presenceChecker.Stop()
+	n.nickReclaimer.Stop()
+	n.nickserv.Stop()
+	n.membership.Reset()
+	n.metrics.ircConnectedGauge.WithLabelValues(n.Name).Set(0)
+	n.metrics.ircUptime.SetDisconnected(n.Name)
+	// Alerts interrupted by the disconnection are sent again right away.
+	n.idle = len(n.pendingAlertMsgs) == 0
+}
+
+// IdlePhase waits for an alert to arrive while disconnected because of
+// inactivity, and keeps it until the session is back up.
+func (n *IRCNotifier) IdlePhase(ctx context.Context) {
+	select {
+	case alertMsg := <-n.AlertMsgs:
+		if n.Sequencer.Add(n.Name, alertMsg) {
+			return
+		}
+		logging.Info("Connection %s: alert received while idle, reconnecting", n.Name)
+		n.keepAlertMsgs(false, alertMsg)
+		n.idle = false
+	case <-n.Sequencer.Ready(n.Name):
+		logging.Info("Connection %s: alerts released while idle, reconnecting", n.Name)
+		n.keepAlertMsgs(false, n.Sequencer.Released(n.Name)...)
+		n.idle = false
+	case <-ctx.Done():
+		logging.Info("IRC routine asked to terminate")
+	}
+}
+
 func (n *IRCNotifier) ConnectedPhase(ctx context.Context) {
+	if alertMsg, ok := n.nextPendingAlertMsg(); ok {
+		n.dispatchAlertMsg(ctx, &alertMsg)
+		return
+	}
+
+	// The rest of a message being collected is not waited for long.
+	var idleTimeout, collectWait <-chan time.Time
+	if len(n.batchParts) > 0 {
+		collectWait = n.timeTeller.After(multilineCollectWait)
+	} else if n.IdleTimeout > 0 {
+		idleTimeout = n.timeTeller.After(n.IdleTimeout)
+	}
+
 	select {
 	case alertMsg := <-n.AlertMsgs:
-		n.SendAlertMsg(ctx, &alertMsg)
+		if !n.Sequencer.Add(n.Name, alertMsg) {
+			n.dispatchAlertMsg(ctx, &alertMsg)
+		}
+	case <-n.Sequencer.Ready(n.Name):
+		// Sent in order before any other, like those kept.
+		n.pendingAlertMsgs = append(n.pendingAlertMsgs, n.Sequencer.Released(n.Name)...)
+	case <-idleTimeout:
+		n.disconnectIdle()
+	case <-collectWait:
+		n.unbatchParts(n.batchParts, nil)
 	case <-n.sessionDownSignal:
-		n.sessionUp = false
-		n.sessionWg.Done()
-		n.channelReconciler.Stop()
-		n.Client.Quit("see ya")
-		ircConnectedGauge.Set(0)
+		n.sessionLost()
 	case <-ctx.Done():
 		logging.Info("IRC routine asked to terminate")
 	}
 }
 
+// sessionLost tears the session down once disconnected.
+func (n *IRCNotifier) sessionLost() {
+	n.stopSending()
+	// The lines being collected are sent once reconnected, after those
+	// of the message interrupted, if any.
+	n.keepAlertMsgs(true, n.batchParts...)
+	n.batchParts = nil
+	// The session was lost between the lines of a message.
+	n.interruptMessage(nil)
+	n.keepUnflushed()
+	n.sessionUp = false
+	n.sessionWg.Done()
+	n.channelReconciler.Stop()
+	n.pingMonitor.Stop()
+	n.presenceChecker.Stop()
+	n.nickReclaimer.Stop()
+	n.nickserv.Stop()
+	n.membership.Reset()
+	n.Client.Quit("see ya")
+	n.metrics.ircConnectedGauge.WithLabelValues(n.Name).Set(0)
+	n.metrics.ircUptime.SetDisconnected(n.Name)
+	reason := n.popDisconnectReason()
+	logging.Info("Connection %s: session lost (%s)", n.Name, reason)
+	n.metrics.ircReconnects.WithLabelValues(n.Name, reason).Inc()
+}
+
+// delayReconnect waits before the next connection attempt, and tells whether
+// to go ahead with it.
+func (n *IRCNotifier) delayReconnect(ctx context.Context) bool {
+	class, text := n.popServerError()
+	if class == serverErrorClassBanned {
+		n.metrics.ircBanned.WithLabelValues(n.Name).Set(1)
+		if n.BannedAction == bannedActionExit {
+			logging.Error("Connection %s: banned by the server (%s), exiting", n.Name, text)
+			n.exit(1)
+			return false
+		}
+		// Retrying against a ban is expected, only log it loudly once.
+		if n.setBanMessage(text) {
+			logging.Error("Connection %s: banned by the server (%s), alerts are not delivered", n.Name, text)
+		}
+	}
+
+	if n.MaxReconnectAttempts > 0 && n.failedAttempts >= n.MaxReconnectAttempts {
+		if n.GiveUpAction == giveUpActionExit {
+			logging.Error("Connection %s: could not establish a session after %d attempts (%s), giving up and exiting",
+				n.Name, n.failedAttempts, n.failureSummary())
+			n.metrics.ircGaveUp.WithLabelValues(n.Name).Set(1)
+			n.exit(1)
+			return false
+		}
+		if !n.gaveUp {
+			logging.Error("Connection %s: could not establish a session after %d attempts (%s), giving up, will retry every %s",
+				n.Name, n.failedAttempts, n.failureSummary(), n.GiveUpRetryInterval)
+			n.gaveUp = true
+			n.metrics.ircGaveUp.WithLabelValues(n.Name).Set(1)
+		}
+		// The slow retries supersede the backoffs.
+		select {
+		case <-n.timeTeller.After(n.GiveUpRetryInterval):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if class == serverErrorClassBanned && n.BannedRetryInterval > 0 {
+		logging.Info("Connection %s: still banned, retrying in %s",
+			n.Name, n.BannedRetryInterval)
+		select {
+		case <-n.timeTeller.After(n.BannedRetryInterval):
+			return true
+		case <-ctx.Done():
+			return false
+		}
+	}
+
+	if class != "" {
+		logging.Info("Connection %s: backing off after %s server error", n.Name, class)
+		return n.serverErrorBackoffs[class].DelayContext(ctx)
+	}
+	return n.BackoffCounter.DelayContext(ctx)
+}
+
 func (n *IRCNotifier) SetupPhase(ctx context.Context) {
 	if !n.Client.Connected() {
-		logging.Info("Connecting to IRC %s", n.Client.Config().Server)
-		if ok := n.BackoffCounter.DelayContext(ctx); !ok {
+		logging.Info("Connecting to IRC %s as %s (connection %s)",
+			n.Client.Config().Server, n.nick(), n.Name)
+		if ok := n.delayReconnect(ctx); !ok {
 			return
 		}
+		// Reset once the session is up.
+		n.failedAttempts++
+		// Forget the MOTD of the previous connection.
+		select {
+		case <-n.motdDoneSignal:
+		default:
+		}
 		if err := n.Client.ConnectContext(WithWaitGroup(ctx, &n.sessionWg)); err != nil {
 			logging.Error("Could not connect to IRC: %s", err)
+			n.attemptFailed(attemptFailureConnectError, err.Error())
 			return
 		}
-		logging.Info("Connected to IRC server, waiting to establish session")
+		logging.Info("Connection %s: connected to IRC server, waiting to establish session", n.Name)
+	}
+
+	// A real timer is used so that it can be stopped, as the session is
+	// usually up long before the timeout.
+	var registrationTimeout <-chan time.Time
+	if n.RegistrationTimeout > 0 {
+		registrationTimer := time.NewTimer(n.RegistrationTimeout)
+		defer registrationTimer.Stop()
+		registrationTimeout = registrationTimer.C
 	}
+
 	select {
 	case <-n.sessionUpSignal:
 		n.sessionUp = true
 		n.sessionWg.Add(1)
+		n.sendCtx, n.cancelSend = context.WithCancel(ctx)
+		n.MaybeWaitForMOTD(ctx)
 		n.MaybeGhostNick()
 		n.MaybeWaitForNickserv()
+		n.nickserv.Start(ctx)
 		n.channelReconciler.Start(ctx)
-		ircConnectedGauge.Set(1)
+		n.pingMonitor.Start(ctx)
+		n.presenceChecker.Start(ctx)
+		n.nickReclaimer.Start(ctx)
+		n.metrics.ircConnectedGauge.WithLabelValues(n.Name).Set(1)
+		n.failedAttempts = 0
+		n.failedAttemptReasons = nil
+		n.metrics.ircBanned.WithLabelValues(n.Name).Set(0)
+		n.setBanMessage("")
+		if n.gaveUp {
+			logging.Info("Connection %s: session established again", n.Name)
+			n.gaveUp = false
+			n.metrics.ircGaveUp.WithLabelValues(n.Name).Set(0)
+		}
+		// Discard reasons left over from failed connection attempts.
+		n.popDisconnectReason()
+		now := time.Now()
+		n.metrics.ircUptime.SetConnected(n.Name, now)
+		n.metrics.ircLastConnectedTimestamp.WithLabelValues(n.Name).Set(float64(now.Unix()))
 	case <-n.sessionDownSignal:
 		logging.Warn("Receiving a session down before the session is up, this is odd")
+		reason := n.popDisconnectReason()
+		detail := ""
+		if reason == disconnectReasonServerError || reason == disconnectReasonKilled {
+			n.disconnectReasonMu.Lock()
+			detail = n.serverErrorText
+			n.disconnectReasonMu.Unlock()
+		}
+		n.attemptFailed(reason, detail)
+	case <-registrationTimeout:
+		logging.Warn("Connection %s: not registered with the server after %s, reconnecting",
+			n.Name, n.RegistrationTimeout)
+		n.metrics.ircReconnects.WithLabelValues(n.Name, disconnectReasonRegistrationTimeout).Inc()
+		n.attemptFailed(disconnectReasonRegistrationTimeout, "")
+		// Let the server close the link if it still can, closing it
+		// ourselves races with goirc noticing the closed socket.
+		n.Client.Quit("registration timeout")
+		select {
+		case <-n.sessionDownSignal:
+		case <-n.timeTeller.After(n.Client.Config().Timeout):
+			logging.Warn("Timeout while waiting for IRC disconnect to complete, closing the connection")
+			// Close dispatches the disconnection and waits for
+			// its handlers, which signal us.
+			go n.Client.Close()
+			<-n.sessionDownSignal
+		}
 	case <-ctx.Done():
 		logging.Info("IRC routine asked to terminate")
 	}
@@ -328,7 +1737,9 @@ func (n *IRCNotifier) Run(ctx context.Context, stopWg *sync.WaitGroup) {
 	defer stopWg.Done()
 
 	for ctx.Err() != context.Canceled {
-		if !n.sessionUp {
+		if n.idle {
+			n.IdlePhase(ctx)
+		} else if !n.sessionUp {
 			n.SetupPhase(ctx)
 		} else {
 			n.ConnectedPhase(ctx)
@@ -42,6 +42,12 @@ func hUSER(conn *bufio.ReadWriter, line *irc.Line) error {
 	return err
 }
 
+func hPING(conn *bufio.ReadWriter, line *irc.Line) error {
+	r := fmt.Sprintf(":example.com PONG example.com :%s\n", line.Text())
+	_, err := conn.WriteString(r)
+	return err
+}
+
 func hQUIT(conn *bufio.ReadWriter, line *irc.Line) error {
 	return fmt.Errorf("client asked to terminate")
 }
@@ -71,6 +77,7 @@ func (s *testServer) setDefaultHandlers() {
 	s.lineHandlers["JOIN"] = hJOIN
 	s.lineHandlers["USER"] = hUSER
 	s.lineHandlers["QUIT"] = hQUIT
+	s.lineHandlers["PING"] = hPING
 }
 
 func (s *testServer) getHandler(cmd string) LineHandlerFunc {
@@ -17,8 +17,10 @@ package main
 import (
 	"bufio"
 	"context"
+	"errors"
 	"fmt"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
@@ -26,6 +28,8 @@ import (
 
 	irc "github.com/fluffle/goirc/client"
 	"github.com/google/alertmanager-irc-relay/logging"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func makeTestIRCConfig(IRCPort int) *Config {
@@ -42,8 +46,8 @@ func makeTestIRCConfig(IRCPort int) *Config {
 		NickservIdentifyPatterns: []string{
 			"identify yourself ktnxbye",
 		},
-		NickservName:    "NickServ",
-		ChanservName:    "ChanServ",
+		NickservName: "NickServ",
+		ChanservName: "ChanServ",
 	}
 }
 
@@ -56,7 +60,8 @@ func makeTestNotifier(t *testing.T, config *Config) (*IRCNotifier, chan AlertMsg
 	ctx, cancel := context.WithCancel(context.Background())
 	stopWg := sync.WaitGroup{}
 	stopWg.Add(1)
-	notifier, err := NewIRCNotifier(config, alertMsgs, fakeDelayerMaker, fakeTime)
+	notifier, err := NewIRCNotifier(config, alertMsgs, fakeDelayerMaker, fakeTime,
+		NewMetrics(prometheus.NewRegistry()))
 	if err != nil {
 		t.Fatal(fmt.Sprintf("Could not create IRC notifier: %s", err))
 	}
@@ -158,6 +163,72 @@ func TestSendAlertOnPreJoinedChannel(t *testing.T) {
 	if !reflect.DeepEqual(expectedCommands, server.Log) {
 		t.Error("Alert not sent correctly. Received commands:\n", strings.Join(server.Log, "\n"))
 	}
+
+	if testutil.ToFloat64(notifier.metrics.ircLastMsgSentTimestamp.WithLabelValues(testChannel)) == 0 {
+		t.Error("Last message sent timestamp not set")
+	}
+}
+
+func TestSequencedWebhookMessages(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	sequencer := NewWebhookSequencer(&Config{WebhookOrdering: webhookOrderingSequenced})
+	notifier.Sequencer = sequencer
+
+	var testStep sync.WaitGroup
+
+	joinedHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinedHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	server.SetHandler("JOIN", hJOIN)
+
+	noticeHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return nil
+	}
+	server.SetHandler("NOTICE", noticeHandler)
+
+	// The messages of two webhooks relayed at the same time interleave,
+	// the second one being relayed first.
+	first := sequencer.Begin()
+	second := sequencer.Begin()
+	testStep.Add(3)
+	alertMsgs <- AlertMsg{Channel: "#foo", Alert: "second 1", sequence: second}
+	alertMsgs <- AlertMsg{Channel: "#foo", Alert: "first", sequence: first}
+	alertMsgs <- AlertMsg{Channel: "#foo", Alert: "second 2", sequence: second}
+	sequencer.End(second, map[string]int{"#foo": 2})
+	sequencer.End(first, map[string]int{"#foo": 1})
+
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	expectedCommands := []string{
+		"NICK foo",
+		"USER foo 12 * :",
+		"PRIVMSG ChanServ :UNBAN #foo",
+		"JOIN #foo",
+		"NOTICE #foo :first",
+		"NOTICE #foo :second 1",
+		"NOTICE #foo :second 2",
+		"QUIT :see ya",
+	}
+
+	if !reflect.DeepEqual(expectedCommands, server.Log) {
+		t.Error("Alerts not sent in order. Received commands:\n", strings.Join(server.Log, "\n"))
+	}
 }
 
 func TestUsePrivmsgToSendAlertOnPreJoinedChannel(t *testing.T) {
@@ -218,6 +289,108 @@ func TestUsePrivmsgToSendAlertOnPreJoinedChannel(t *testing.T) {
 	}
 }
 
+func TestSendAlertWithTimestamp(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{
+		IRCChannel{Name: "#foo", TimestampFormat: "[15:04 MST]", TimestampTimezone: "UTC"},
+		IRCChannel{Name: "#bar"},
+	}
+	notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	fakeTime := notifier.timeTeller.(*FakeTime)
+	fakeTime.timeseries = []int{3600}
+	fakeTime.durationUnit = time.Second
+
+	var testStep sync.WaitGroup
+
+	joinedHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinedHandler)
+
+	testStep.Add(2)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	server.SetHandler("JOIN", hJOIN)
+
+	noticeHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return nil
+	}
+	server.SetHandler("NOTICE", noticeHandler)
+
+	testStep.Add(2)
+	alertMsgs <- AlertMsg{Channel: "#foo", Alert: "test message"}
+	alertMsgs <- AlertMsg{Channel: "#bar", Alert: "test message"}
+
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	expectedCommands := []string{
+		"NOTICE #foo :[01:00 UTC] test message",
+		"NOTICE #bar :test message",
+		"QUIT :see ya",
+	}
+
+	if !reflect.DeepEqual(expectedCommands, server.Log[len(server.Log)-3:]) {
+		t.Error("Alert not sent correctly. Received commands:\n", strings.Join(server.Log, "\n"))
+	}
+}
+
+func TestSendAlertWithCharset(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCCharset = "ISO-8859-1"
+	notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	var testStep sync.WaitGroup
+
+	joinedHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinedHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	server.SetHandler("JOIN", hJOIN)
+
+	noticeHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return nil
+	}
+	server.SetHandler("NOTICE", noticeHandler)
+
+	testStep.Add(1)
+	alertMsgs <- AlertMsg{Channel: "#foo", Alert: "Température élevée ☢"}
+
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	expectedCommands := []string{
+		"NOTICE #foo :Temp\xe9rature \xe9lev\xe9e ?",
+		"QUIT :see ya",
+	}
+
+	if !reflect.DeepEqual(expectedCommands, server.Log[len(server.Log)-2:]) {
+		t.Error("Alert not encoded correctly. Received commands:\n", strings.Join(server.Log, "\n"))
+	}
+}
+
 func TestSendAlertAndJoinChannel(t *testing.T) {
 	server, port := makeTestServer(t)
 	config := makeTestIRCConfig(port)
@@ -433,7 +606,7 @@ func TestConnectErrorRetry(t *testing.T) {
 	testStep.Wait()
 
 	// We have caused a connection failure, now check for a reconnection
-	notifier.Client.Config().SSL = false
+	notifier.dialer.tlsConfig = nil
 	joinStep.Add(1)
 	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
 		joinStep.Done()
@@ -514,6 +687,104 @@ func TestIdentify(t *testing.T) {
 	}
 }
 
+func TestIdentifyRetryWhenServicesDown(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "services"
+	config.IRCNickPass = "nickpassword"
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	notifier.NickservDelayWait = 0 * time.Second
+	notifier.nickserv.timeout = time.Minute
+	notifier.nickserv.retryInterval = 10 * time.Millisecond
+
+	nickHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		_, err := conn.WriteString(":NickServ!NickServ@services. NOTICE foo :This nickname is registered. Please choose a different nickname, or identify yourself ktnxbye.\n")
+		return err
+	}
+	server.SetHandler("NICK", nickHandler)
+
+	// Services are down for the first IDENTIFY, back for the next one.
+	identifyCount := 0
+	privmsgHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		if line.Args[0] != "NickServ" {
+			return nil
+		}
+		identifyCount++
+		reply := ":example.com 440 foo NickServ :Services are currently down\n"
+		if identifyCount > 1 {
+			reply = ":example.com 900 foo foo!foo@example.com foo :You are now logged in as foo\n"
+		}
+		_, err := conn.WriteString(reply)
+		return err
+	}
+	server.SetHandler("PRIVMSG", privmsgHandler)
+
+	go notifier.Run(ctx, stopWg)
+
+	for notifier.nickserv.State() != identifyStateIdentified {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	expectedTransitions := map[string]float64{
+		identifyStatePending:    2,
+		identifyStateFailed:     1,
+		identifyStateIdentified: 1,
+	}
+	for state, expected := range expectedTransitions {
+		if v := testutil.ToFloat64(notifier.metrics.ircIdentifyTransitions.WithLabelValues("services", state)); v != expected {
+			t.Errorf("Expected %f transitions to %s, got %f", expected, state, v)
+		}
+	}
+}
+
+func TestIdentifyWithoutRequest(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "unasked"
+	config.IRCNickPass = "nickpassword"
+	config.NickservConfirmPatterns = []string{"You are now identified"}
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	notifier.NickservDelayWait = 0 * time.Second
+	notifier.nickserv.timeout = 10 * time.Millisecond
+	notifier.nickserv.retryInterval = 10 * time.Millisecond
+
+	// NickServ never asks us to identify, and only answers the second
+	// IDENTIFY.
+	identifyCount := 0
+	privmsgHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		if line.Args[0] != "NickServ" {
+			return nil
+		}
+		identifyCount++
+		if identifyCount < 2 {
+			return nil
+		}
+		_, err := conn.WriteString(":NickServ!NickServ@services. NOTICE foo :You are now identified for foo.\n")
+		return err
+	}
+	server.SetHandler("PRIVMSG", privmsgHandler)
+
+	go notifier.Run(ctx, stopWg)
+
+	for notifier.nickserv.State() != identifyStateIdentified {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	if v := testutil.ToFloat64(notifier.metrics.ircIdentifyTransitions.WithLabelValues("unasked", identifyStateFailed)); v != 1 {
+		t.Errorf("Expected the unconfirmed IDENTIFY to fail once, got %f", v)
+	}
+}
+
 func TestGhost(t *testing.T) {
 	server, port := makeTestServer(t)
 	config := makeTestIRCConfig(port)
@@ -612,3 +883,1538 @@ func TestStopRunningWhenHalfConnected(t *testing.T) {
 		t.Error("Alert not sent correctly. Received commands:\n", strings.Join(server.Log, "\n"))
 	}
 }
+
+func TestReconnectMetrics(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "metrics"
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	if testutil.ToFloat64(notifier.metrics.ircConnectedGauge.WithLabelValues("metrics")) != 1 {
+		t.Error("Connected gauge not set after session establishment")
+	}
+
+	// Simulate a plain disconnection.
+	testStep.Add(1)
+	server.Client.Close()
+	testStep.Wait()
+
+	// Simulate the server closing the link with an ERROR.
+	testStep.Add(1)
+	server.SendMsg("ERROR :Closing Link: foo (Server shutting down)\n")
+	// Make sure the ERROR is processed before the disconnection.
+	for {
+		notifier.disconnectReasonMu.Lock()
+		reason := notifier.disconnectReason
+		notifier.disconnectReasonMu.Unlock()
+		if reason != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Client.Close()
+	testStep.Wait()
+
+	// Simulate an operator KILLing us, which is followed by an ERROR.
+	testStep.Add(1)
+	server.SendMsg(":oper!oper@example.com KILL foo :irc.example.com!oper (spam)\n")
+	server.SendMsg("ERROR :Closing Link: foo (Killed (oper (spam)))\n")
+	for {
+		notifier.disconnectReasonMu.Lock()
+		class := notifier.serverErrorClass
+		notifier.disconnectReasonMu.Unlock()
+		if class != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Client.Close()
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	if v := testutil.ToFloat64(notifier.metrics.ircReconnects.WithLabelValues("metrics", disconnectReasonKilled)); v != 1 {
+		t.Errorf("Expected 1 killed reconnect, got %f", v)
+	}
+	if v := testutil.ToFloat64(notifier.metrics.ircReconnects.WithLabelValues("metrics", disconnectReasonConnectionLost)); v != 1 {
+		t.Errorf("Expected 1 connection_lost reconnect, got %f", v)
+	}
+	if v := testutil.ToFloat64(notifier.metrics.ircReconnects.WithLabelValues("metrics", disconnectReasonServerError)); v != 1 {
+		t.Errorf("Expected 1 server_error reconnect, got %f", v)
+	}
+}
+
+func TestIsKillMessage(t *testing.T) {
+	for msg, expected := range map[string]bool{
+		"Closing Link: foo (Killed (oper (spam)))":            true,
+		"Closing Link: foo[host] (Killed by oper (spam))":     true,
+		"Closing link: (foo@host) [Killed (oper (spam))]":     true,
+		"Closing Link: foo (Server shutting down)":            false,
+		"Closing Link: foo (You are banned from this server)": false,
+	} {
+		if isKillMessage(msg) != expected {
+			t.Errorf("Expected isKillMessage(%q) to be %t", msg, expected)
+		}
+	}
+}
+
+func TestClassifyServerError(t *testing.T) {
+	for _, tc := range []struct {
+		msg   string
+		class string
+	}{
+		{"Closing Link: foo (Server shutting down)", serverErrorClassOther},
+		{"Closing Link: foo (Too many connections from your IP)", serverErrorClassThrottled},
+		{"Trying to reconnect too fast.", serverErrorClassThrottled},
+		{"Closing Link: foo (You are banned from this server)", serverErrorClassBanned},
+		{"Closing Link: foo (K-Lined)", serverErrorClassBanned},
+	} {
+		if class := classifyServerError(tc.msg); class != tc.class {
+			t.Errorf("Expected '%s' to be classified as %s, got %s", tc.msg, tc.class, class)
+		}
+	}
+}
+
+func TestServerErrorBackoff(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "throttled"
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	// Only the backoff of throttled errors is piloted, reaching it proves
+	// the ERROR was classified and taken into account.
+	delayer := notifier.serverErrorBackoffs[serverErrorClassThrottled].(*FakeDelayer)
+	delayer.DelayOnChan = true
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	testStep.Add(1)
+	server.SendMsg("ERROR :Closing Link: foo (Too many connections from your IP)\n")
+	// Make sure the ERROR is processed before the disconnection.
+	for {
+		notifier.disconnectReasonMu.Lock()
+		class := notifier.serverErrorClass
+		notifier.disconnectReasonMu.Unlock()
+		if class != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Client.Close()
+	delayer.StopDelay <- true
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	if v := testutil.ToFloat64(notifier.metrics.ircServerErrors.WithLabelValues("throttled", serverErrorClassThrottled)); v != 1 {
+		t.Errorf("Expected 1 throttled server error, got %f", v)
+	}
+}
+
+// sendBannedError makes the server close the link because we are banned.
+func sendBannedError(server *testServer, notifier *IRCNotifier) {
+	server.SendMsg("ERROR :Closing Link: foo (K-Lined)\n")
+	// Make sure the ERROR is processed before the disconnection.
+	for {
+		notifier.disconnectReasonMu.Lock()
+		class := notifier.serverErrorClass
+		notifier.disconnectReasonMu.Unlock()
+		if class != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Client.Close()
+}
+
+func TestBannedExit(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "klined"
+	config.IRCBannedAction = bannedActionExit
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	exitCode := 0
+	notifier.exit = func(code int) {
+		exitCode = code
+		cancel()
+	}
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	sendBannedError(server, notifier)
+	stopWg.Wait()
+
+	server.Stop()
+
+	if exitCode != 1 {
+		t.Errorf("Expected to exit with status 1, got %d", exitCode)
+	}
+	if v := testutil.ToFloat64(notifier.metrics.ircBanned.WithLabelValues("klined")); v != 1 {
+		t.Errorf("Expected irc_banned to be 1, got %f", v)
+	}
+}
+
+func TestBannedRetryInterval(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "klined"
+	config.IRCBannedRetryInterval = 12 * time.Hour
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	fakeTime := notifier.timeTeller.(*FakeTime)
+
+	var testStep sync.WaitGroup
+	var joinsMu sync.Mutex
+	joins := 0
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joinsMu.Lock()
+		joins++
+		joinsMu.Unlock()
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	sendBannedError(server, notifier)
+
+	banned := notifier.metrics.ircBanned.WithLabelValues("klined")
+	for testutil.ToFloat64(banned) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The notifier now waits for the retry interval before reconnecting.
+	joinsMu.Lock()
+	if joins != 1 {
+		t.Errorf("Expected no reconnection before the retry interval, got %d joins", joins)
+	}
+	joinsMu.Unlock()
+
+	testStep.Add(1)
+	fakeTime.afterChan <- time.Now()
+	testStep.Wait()
+
+	if v := testutil.ToFloat64(banned); v != 0 {
+		t.Errorf("Expected irc_banned to be reset once connected again, got %f", v)
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+}
+
+func TestBannedNumeric(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "creep"
+	config.IRCBannedRetryInterval = 6 * time.Hour
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	fakeTime := notifier.timeTeller.(*FakeTime)
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	// The ERROR which follows does not tell about the ban.
+	server.SendMsg(":irc.example.com 465 foo :You are banned from this server- spam\n")
+	server.SendMsg("ERROR :Closing Link: foo (Server shutting down)\n")
+	for {
+		notifier.disconnectReasonMu.Lock()
+		text := notifier.serverErrorText
+		notifier.disconnectReasonMu.Unlock()
+		if text != "" {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	server.Client.Close()
+
+	banned := notifier.metrics.ircBanned.WithLabelValues("creep")
+	for testutil.ToFloat64(banned) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if status := notifier.Status(); status.Banned != "You are banned from this server- spam" {
+		t.Errorf("Unexpected ban message in status: %q", status.Banned)
+	}
+
+	testStep.Add(1)
+	fakeTime.afterChan <- time.Now()
+	testStep.Wait()
+
+	if status := notifier.Status(); status.Banned != "" {
+		t.Errorf("Expected no ban message in status once connected again, got %q", status.Banned)
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	if v := testutil.ToFloat64(notifier.metrics.ircServerErrors.WithLabelValues("creep", serverErrorClassBanned)); v != 1 {
+		t.Errorf("Expected 1 banned server error, got %f", v)
+	}
+}
+
+func TestJoinAfterMOTD(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCMOTDTimeout = time.Hour
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	var testStep sync.WaitGroup
+	var joinsMu sync.Mutex
+	joins := 0
+
+	userHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hUSER(conn, line)
+	}
+	server.SetHandler("USER", userHandler)
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joinsMu.Lock()
+		joins++
+		joinsMu.Unlock()
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	// The MOTD is slow to come.
+	time.Sleep(100 * time.Millisecond)
+	joinsMu.Lock()
+	if joins != 0 {
+		t.Errorf("Expected no join before the end of the MOTD, got %d", joins)
+	}
+	joinsMu.Unlock()
+
+	testStep.Add(1)
+	server.SendMsg(":example.com 376 foo :End of /MOTD command.\n")
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+}
+
+func TestJoinWithoutMOTD(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCMOTDTimeout = 100 * time.Millisecond
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	// The server never sends the end of the MOTD, channels are joined
+	// anyway once the timeout elapsed.
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+}
+
+func TestNickLen(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCNick = "foolish"
+	config.IRCIdent = "air"
+	config.IRCRealName = "Alertmanager IRC Relay"
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	server.SendMsg(":example.com 005 foolish CASEMAPPING=ascii NICKLEN=3 :are supported by this server\n")
+	for notifier.Status().Nick != "foo" {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	status := notifier.Status()
+	if status.Ident != "air" || status.RealName != "Alertmanager IRC Relay" {
+		t.Errorf("Unexpected identity in status: %+v", status)
+	}
+}
+
+func waitChannelJoined(notifier *IRCNotifier, channel string) {
+	for {
+		if joined, _ := notifier.channelReconciler.JoinChannel(channel); joined {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestIdleDisconnectAndReconnectOnAlert(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCIdleTimeout = time.Hour
+	notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	fakeTime := notifier.timeTeller.(*FakeTime)
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+	waitChannelJoined(notifier, "#foo")
+
+	// Expire the idle timeout, the bot should quit.
+	testStep.Add(1)
+	quitHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hQUIT(conn, line)
+	}
+	server.SetHandler("QUIT", quitHandler)
+	fakeTime.afterChan <- time.Now()
+	testStep.Wait()
+	server.SetHandler("QUIT", hQUIT)
+
+	// The next alert brings the session back and is delivered once the
+	// channel is joined.
+	testStep.Add(2)
+	noticeHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return nil
+	}
+	server.SetHandler("NOTICE", noticeHandler)
+
+	alertMsgs <- AlertMsg{Channel: "#foo", Alert: "wake up"}
+
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	expectedCommands := []string{
+		"NICK foo",
+		"USER foo 12 * :",
+		"PRIVMSG ChanServ :UNBAN #foo",
+		"JOIN #foo",
+		"QUIT :idle",
+		"NICK foo",
+		"USER foo 12 * :",
+		"PRIVMSG ChanServ :UNBAN #foo",
+		"JOIN #foo",
+		"NOTICE #foo :wake up",
+		"QUIT :see ya",
+	}
+
+	if !reflect.DeepEqual(expectedCommands, server.Log) {
+		t.Error("Idle disconnection did not happen correctly. Received commands:\n", strings.Join(server.Log, "\n"))
+	}
+	if v := testutil.ToFloat64(notifier.metrics.ircReconnects.WithLabelValues(notifier.Name, disconnectReasonLocalRestart)); v != 1 {
+		t.Errorf("Expected the idle disconnection to be counted as a local restart, got %f", v)
+	}
+}
+
+func TestIdleDisconnectClosesUnansweredQuit(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCIdleTimeout = time.Hour
+	notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	fakeTime := notifier.timeTeller.(*FakeTime)
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+	waitChannelJoined(notifier, "#foo")
+
+	// The server never answers the QUIT, the bot should close the
+	// connection itself once the disconnect times out.
+	testStep.Add(1)
+	quitHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return nil
+	}
+	server.SetHandler("QUIT", quitHandler)
+	fakeTime.afterChan <- time.Now()
+	testStep.Wait()
+	server.SetHandler("QUIT", hQUIT)
+	fakeTime.afterChan <- time.Now()
+
+	testStep.Add(2)
+	noticeHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return nil
+	}
+	server.SetHandler("NOTICE", noticeHandler)
+
+	alertMsgs <- AlertMsg{Channel: "#foo", Alert: "wake up"}
+
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	expectedCommands := []string{
+		"NICK foo",
+		"USER foo 12 * :",
+		"PRIVMSG ChanServ :UNBAN #foo",
+		"JOIN #foo",
+		"QUIT :idle",
+		"NICK foo",
+		"USER foo 12 * :",
+		"PRIVMSG ChanServ :UNBAN #foo",
+		"JOIN #foo",
+		"NOTICE #foo :wake up",
+		"QUIT :see ya",
+	}
+
+	if !reflect.DeepEqual(expectedCommands, server.Log) {
+		t.Error("Idle disconnection did not happen correctly. Received commands:\n", strings.Join(server.Log, "\n"))
+	}
+	if notifier.failedAttempts != 0 {
+		t.Errorf("Expected no failed connection attempts, got %d", notifier.failedAttempts)
+	}
+}
+
+func TestServerLagMeasured(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "lag"
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	notifier.pingMonitor.interval = 10 * time.Millisecond
+
+	go notifier.Run(ctx, stopWg)
+
+	// Wait for a PONG to be processed.
+	for {
+		notifier.pingMonitor.mu.Lock()
+		answered := notifier.pingMonitor.seq > 0 && notifier.pingMonitor.pendingToken == ""
+		notifier.pingMonitor.mu.Unlock()
+		if answered {
+			break
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	if v := testutil.ToFloat64(notifier.metrics.ircServerLag.WithLabelValues("lag")); v <= 0 {
+		t.Errorf("Expected a positive lag, got %f", v)
+	}
+
+	// A late answer to an old PING must not be taken into account.
+	notifier.pingMonitor.HandlePong("air-0")
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	families, err := notifier.metrics.registry.Gather()
+	if err != nil {
+		t.Fatalf("Could not gather metrics: %s", err)
+	}
+	for _, family := range families {
+		if family.GetName() == "irc_server_lag_seconds" {
+			t.Errorf("Expected lag to be removed once disconnected, got %s", family)
+		}
+	}
+}
+
+func TestPingTimeoutReconnects(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "pingtimeout"
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	notifier.pingMonitor.interval = 50 * time.Millisecond
+
+	var testStep sync.WaitGroup
+
+	joins := 0
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joins++
+		if joins == 2 {
+			// Reconnected, stop ignoring PINGs.
+			server.SetHandler("PING", hPING)
+		}
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+	server.SetHandler("PING", nil)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	// Wait for the session to be closed and established again.
+	testStep.Add(1)
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	if v := testutil.ToFloat64(notifier.metrics.ircReconnects.WithLabelValues("pingtimeout", disconnectReasonPingTimeout)); v != 1 {
+		t.Errorf("Expected 1 ping_timeout reconnect, got %f", v)
+	}
+	if v := testutil.ToFloat64(notifier.metrics.ircPingsMissed.WithLabelValues("pingtimeout")); v != ircMaxMissedPings {
+		t.Errorf("Expected %d missed pings, got %f", ircMaxMissedPings, v)
+	}
+}
+
+func TestServerNoticeReconnects(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "notice"
+	config.IRCReconnectNotices = []string{"(?i)going down"}
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	// Neither users nor unrelated notices make us reconnect.
+	server.SendMsg(":bar!~bar@example.com NOTICE foo :Server going down, just kidding\n")
+	server.SendMsg(":irc.example.com NOTICE foo :Welcome\n")
+
+	// Wait for the session to be closed and established again.
+	testStep.Add(1)
+	server.SendMsg(":irc.example.com NOTICE foo :Server Going Down for maintenance\n")
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	if v := testutil.ToFloat64(notifier.metrics.ircReconnects.WithLabelValues("notice", disconnectReasonLocalRestart)); v != 1 {
+		t.Errorf("Expected 1 server_notice reconnect, got %f", v)
+	}
+	if v := testutil.ToFloat64(notifier.metrics.ircReconnectNotices.WithLabelValues("notice", "(?i)going down")); v != 1 {
+		t.Errorf("Expected 1 reconnect notice, got %f", v)
+	}
+}
+
+func TestRegistrationTimeoutReconnects(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "stalled"
+	config.IRCRegistrationTimeout = 50 * time.Millisecond
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	var testStep sync.WaitGroup
+
+	// Never welcome the first connection.
+	userCount := 0
+	userHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		userCount++
+		if userCount == 1 {
+			return nil
+		}
+		return hUSER(conn, line)
+	}
+	server.SetHandler("USER", userHandler)
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	// goirc may spuriously drop the following connection attempts, only
+	// check how the stalled one ended.
+	expectedCommands := []string{
+		"NICK foo",
+		"USER foo 12 * :",
+		"QUIT :registration timeout",
+		"NICK foo",
+	}
+
+	if !reflect.DeepEqual(expectedCommands, server.Log[:len(expectedCommands)]) {
+		t.Error("Stalled connection not closed correctly. Received commands:\n", strings.Join(server.Log, "\n"))
+	}
+	if v := testutil.ToFloat64(notifier.metrics.ircReconnects.WithLabelValues("stalled", disconnectReasonRegistrationTimeout)); v != 1 {
+		t.Errorf("Expected 1 registration_timeout reconnect, got %f", v)
+	}
+}
+
+func TestWriteTimeoutReconnects(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "stalled"
+	config.IRCWriteTimeout = 100 * time.Millisecond
+	notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	// Stop reading from the socket, as servers do during netsplits, until
+	// the connection is closed.
+	stalled := make(chan bool)
+	noticeHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		<-stalled
+		return errors.New("stalled")
+	}
+	server.SetHandler("NOTICE", noticeHandler)
+
+	testStep.Add(1)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	// Fill the socket buffers until writing times out.
+	testStep.Add(1)
+	longAlert := strings.Repeat("x", 400)
+	for testutil.ToFloat64(notifier.metrics.ircWriteTimeouts.WithLabelValues("stalled")) == 0 {
+		select {
+		case alertMsgs <- AlertMsg{Channel: "#foo", Alert: longAlert}:
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+	// No alert is sent from now on, those received are the ones not
+	// written before the connection broke.
+	redelivered := make(chan bool)
+	var redeliveredOnce sync.Once
+	server.SetHandler("NOTICE", func(conn *bufio.ReadWriter, line *irc.Line) error {
+		redeliveredOnce.Do(func() { close(redelivered) })
+		return nil
+	})
+	close(stalled)
+	testStep.Wait()
+
+	select {
+	case <-redelivered:
+	case <-time.After(5 * time.Second):
+		t.Errorf("Expected the alerts not written to be sent again once reconnected")
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	if v := testutil.ToFloat64(notifier.metrics.ircReconnects.WithLabelValues("stalled", disconnectReasonLocalRestart)); v != 1 {
+		t.Errorf("Expected 1 write_timeout reconnect, got %f", v)
+	}
+}
+
+func TestGiveUpExit(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "doomed"
+	// The server does not support SSL, every attempt fails.
+	config.IRCUseSSL = true
+	config.IRCMaxConnectAttempts = 2
+	config.IRCGiveUpAction = giveUpActionExit
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	exitCode := 0
+	notifier.exit = func(code int) {
+		exitCode = code
+		cancel()
+	}
+
+	var attemptsMu sync.Mutex
+	attempts := 0
+	server.SetCloseEarly(func() {
+		attemptsMu.Lock()
+		defer attemptsMu.Unlock()
+		attempts++
+	})
+
+	go notifier.Run(ctx, stopWg)
+	stopWg.Wait()
+
+	server.Stop()
+
+	if exitCode != 1 {
+		t.Errorf("Expected to exit with status 1, got %d", exitCode)
+	}
+	attemptsMu.Lock()
+	defer attemptsMu.Unlock()
+	if attempts != 2 {
+		t.Errorf("Expected 2 connection attempts, got %d", attempts)
+	}
+	if summary := notifier.failureSummary(); !strings.HasPrefix(summary, "2x connect_error (last: ") {
+		t.Errorf("Unexpected summary of the failures: %s", summary)
+	}
+}
+
+func TestFailureSummaryCountsReasons(t *testing.T) {
+	notifier := &IRCNotifier{}
+	for i := 0; i < 1000; i++ {
+		notifier.attemptFailed(attemptFailureConnectError, fmt.Sprintf("error %d", i))
+		notifier.attemptFailed(disconnectReasonRegistrationTimeout, "")
+	}
+
+	if len(notifier.failedAttemptReasons) != 2 {
+		t.Errorf("Expected one entry per reason, got %d", len(notifier.failedAttemptReasons))
+	}
+	expected := "1000x connect_error (last: error 999), 1000x registration_timeout"
+	if summary := notifier.failureSummary(); summary != expected {
+		t.Errorf("Unexpected summary of the failures: %s", summary)
+	}
+}
+
+func TestGiveUpRetrySlowly(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "patient"
+	config.IRCUseSSL = true
+	config.IRCMaxConnectAttempts = 1
+	config.IRCGiveUpAction = giveUpActionRetrySlowly
+	config.IRCGiveUpRetryInterval = time.Hour
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	fakeTime := notifier.timeTeller.(*FakeTime)
+
+	var testStep sync.WaitGroup
+
+	server.SetCloseEarly(func() {})
+
+	go notifier.Run(ctx, stopWg)
+
+	gaveUp := notifier.metrics.ircGaveUp.WithLabelValues("patient")
+	for testutil.ToFloat64(gaveUp) == 0 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The notifier now waits for the slow retry, let it succeed.
+	notifier.dialer.tlsConfig = nil
+	server.SetCloseEarly(nil)
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+	fakeTime.afterChan <- time.Now()
+	testStep.Wait()
+
+	if v := testutil.ToFloat64(gaveUp); v != 0 {
+		t.Errorf("Expected irc_gave_up to be reset once connected, got %f", v)
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+}
+
+func TestReclaimNickWithMonitor(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	notifier.nickReclaimer.interval = 10 * time.Millisecond
+
+	// Trigger 433 for first nick when we see the USER command
+	userHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		var err error
+		if line.Args[0] == "foo" {
+			_, err = conn.WriteString(":example.com 433 * foo :nick in use\n")
+		}
+		return err
+	}
+	server.SetHandler("USER", userHandler)
+
+	// Welcome foo^, then let it change back to foo once reclaimed.
+	reclaimed := false
+	pausedWhileReclaiming := false
+	nickHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		var err error
+		switch {
+		case line.Args[0] == "foo^":
+			_, err = conn.WriteString(":example.com 001 foo^ :Welcome\n" +
+				":example.com 005 foo^ MONITOR=100 :are supported by this server\n")
+			reclaimed = true
+		case line.Args[0] == "foo" && reclaimed:
+			pausedWhileReclaiming = notifier.Status().JoinsPaused
+			_, err = conn.WriteString(":foo^!foo@example.com NICK :foo\n")
+		}
+		return err
+	}
+	server.SetHandler("NICK", nickHandler)
+
+	monitorCommands := make(chan string, 10)
+	monitorHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		monitorCommands <- strings.Join(line.Args, " ")
+		return nil
+	}
+	server.SetHandler("MONITOR", monitorHandler)
+
+	go notifier.Run(ctx, stopWg)
+
+	if command := <-monitorCommands; command != "+ foo" {
+		t.Errorf("Expected to monitor foo, got MONITOR %s", command)
+	}
+	if status := notifier.Status(); status.Nick != "foo" || status.CurrentNick != "foo^" {
+		t.Errorf("Unexpected nicks in status: %+v", status)
+	}
+
+	server.SendMsg(":example.com 731 foo^ :foo\n")
+
+	if command := <-monitorCommands; command != "- foo" {
+		t.Errorf("Expected to stop monitoring foo, got MONITOR %s", command)
+	}
+	if status := notifier.Status(); status.CurrentNick != "foo" || status.JoinsPaused {
+		t.Errorf("Nick was not reclaimed, status: %+v", status)
+	}
+	if !pausedWhileReclaiming {
+		t.Errorf("Expected joins to be paused while reclaiming the nick")
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+}
+
+func TestReclaimNickWithIson(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+	notifier.nickReclaimer.interval = 10 * time.Millisecond
+
+	// Trigger 433 for first nick when we see the USER command
+	userHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		var err error
+		if line.Args[0] == "foo" {
+			_, err = conn.WriteString(":example.com 433 * foo :nick in use\n")
+		}
+		return err
+	}
+	server.SetHandler("USER", userHandler)
+
+	reclaimed := false
+	nickHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		var err error
+		switch {
+		case line.Args[0] == "foo^":
+			_, err = conn.WriteString(":example.com 001 foo^ :Welcome\n")
+			reclaimed = true
+		case line.Args[0] == "foo" && reclaimed:
+			_, err = conn.WriteString(":foo^!foo@example.com NICK :foo\n")
+		}
+		return err
+	}
+	server.SetHandler("NICK", nickHandler)
+
+	// foo is online at first, then gone.
+	isonCount := 0
+	isonHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		isonCount++
+		online := ""
+		if isonCount == 1 {
+			online = line.Args[0]
+		}
+		_, err := conn.WriteString(":example.com 303 foo^ :" + online + "\n")
+		return err
+	}
+	server.SetHandler("ISON", isonHandler)
+
+	go notifier.Run(ctx, stopWg)
+
+	for notifier.Status().CurrentNick != "foo" {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	for _, command := range server.Log {
+		if strings.HasPrefix(command, "MONITOR") {
+			t.Errorf("Unexpected %s, server does not support MONITOR", command)
+		}
+	}
+}
+
+func TestCTCPReplies(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "ctcp"
+	config.CTCPReplies = []string{"VERSION"}
+	notifier, _, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	// Offer a file, ask for the time, which is not to be answered, then
+	// the version, which is.
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		_, err := conn.WriteString(
+			":bar!b@example.com PRIVMSG foo :\001DCC SEND file 3232235777 4000 10\001\n" +
+				":bar!b@example.com PRIVMSG foo :\001TIME\001\n" +
+				":bar!b@example.com PRIVMSG foo :\001VERSION\001\n")
+		if err != nil {
+			return err
+		}
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	var testStep sync.WaitGroup
+	testStep.Add(1)
+	noticeHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		return nil
+	}
+	server.SetHandler("NOTICE", noticeHandler)
+
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	replies := 0
+	for _, command := range server.Log {
+		if strings.HasPrefix(command, "NOTICE bar :\001") {
+			replies++
+			if !strings.HasPrefix(command, "NOTICE bar :\001VERSION ") {
+				t.Errorf("Unexpected CTCP reply: %s", command)
+			}
+		}
+	}
+	if replies != 1 {
+		t.Errorf("Expected 1 CTCP reply, got %d", replies)
+	}
+
+	counter := notifier.metrics.ircCTCPRequests
+	if v := testutil.ToFloat64(counter.WithLabelValues("ctcp", ctcpResultAnswered)); v != 1 {
+		t.Errorf("Expected 1 answered CTCP request, got %f", v)
+	}
+	if v := testutil.ToFloat64(counter.WithLabelValues("ctcp", ctcpResultIgnored)); v != 2 {
+		t.Errorf("Expected 2 ignored CTCP requests, got %f", v)
+	}
+}
+
+func TestSendConcurrency(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{
+		IRCChannel{Name: "#foo"},
+		IRCChannel{Name: "#bar", SendConcurrency: 2},
+	}
+	notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	var testStep sync.WaitGroup
+
+	// #bar is only joined once the test says so, alerts to it wait
+	// meanwhile.
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		testStep.Done()
+		if line.Args[0] == "#bar" {
+			return nil
+		}
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	var noticesMu sync.Mutex
+	notices := []string{}
+	noticeHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		noticesMu.Lock()
+		notices = append(notices, line.Args[0]+" "+strings.TrimSpace(line.Args[1]))
+		noticesMu.Unlock()
+		testStep.Done()
+		return nil
+	}
+	server.SetHandler("NOTICE", noticeHandler)
+
+	testStep.Add(2)
+	go notifier.Run(ctx, stopWg)
+
+	testStep.Wait()
+
+	// Alerts to #foo are not held up by those to #bar, and arrive in order.
+	testStep.Add(3)
+	alertMsgs <- AlertMsg{Channel: "#bar", Alert: "bar 1"}
+	alertMsgs <- AlertMsg{Channel: "#bar", Alert: "bar 2"}
+	for i := 1; i <= 3; i++ {
+		alertMsgs <- AlertMsg{Channel: "#foo", Alert: fmt.Sprintf("foo %d", i)}
+	}
+
+	testStep.Wait()
+
+	noticesMu.Lock()
+	expectedNotices := []string{"#foo foo 1", "#foo foo 2", "#foo foo 3"}
+	if !reflect.DeepEqual(expectedNotices, notices) {
+		t.Errorf("Unexpected alerts sent while #bar is not joined: %q", notices)
+	}
+	noticesMu.Unlock()
+
+	testStep.Add(2)
+	server.SendMsg(":foo!foo@example.com JOIN :#bar\n")
+
+	testStep.Wait()
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	// Alerts to #bar may arrive in any order.
+	sort.Strings(notices[3:])
+	expectedNotices = append(expectedNotices, "#bar bar 1", "#bar bar 2")
+	if !reflect.DeepEqual(expectedNotices, notices) {
+		t.Errorf("Unexpected alerts sent: %q", notices)
+	}
+}
+
+func TestInterruptedMessage(t *testing.T) {
+	for _, tc := range []struct {
+		policy   string
+		expected []string
+	}{
+		{interruptedMessagesResend, []string{"line 1", "line 1", "line 2", "line 3", "next"}},
+		{interruptedMessagesDrop, []string{"line 1", "next"}},
+	} {
+		t.Run(tc.policy, func(t *testing.T) {
+			server, port := makeTestServer(t)
+			config := makeTestIRCConfig(port)
+			config.ConnectionName = "flaky"
+			config.IRCInterruptedMessages = tc.policy
+			notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+			joined := make(chan bool, 2)
+			server.SetHandler("JOIN", func(conn *bufio.ReadWriter, line *irc.Line) error {
+				joined <- true
+				return hJOIN(conn, line)
+			})
+
+			// The connection breaks after the first line of the message.
+			notices := make(chan string, 10)
+			var noticesMu sync.Mutex
+			broken := false
+			server.SetHandler("NOTICE", func(conn *bufio.ReadWriter, line *irc.Line) error {
+				notices <- strings.TrimSpace(line.Args[1])
+				noticesMu.Lock()
+				defer noticesMu.Unlock()
+				if !broken {
+					broken = true
+					return errors.New("connection reset")
+				}
+				return nil
+			})
+
+			go notifier.Run(ctx, stopWg)
+			<-joined
+
+			// The rest of the message comes once reconnected.
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: "line 1", Part: 1, Parts: 3}
+			select {
+			case <-joined:
+			case <-time.After(time.Second):
+				t.Fatalf("Expected to reconnect")
+			}
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: "line 2", Part: 2, Parts: 3}
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: "line 3", Part: 3, Parts: 3}
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: "next"}
+
+			received := []string{}
+			for range tc.expected {
+				select {
+				case notice := <-notices:
+					received = append(received, notice)
+				case <-time.After(time.Second):
+					t.Fatalf("Expected notices %q, got %q", tc.expected, received)
+				}
+			}
+			if !reflect.DeepEqual(tc.expected, received) {
+				t.Errorf("Expected notices %q, got %q", tc.expected, received)
+			}
+
+			cancel()
+			stopWg.Wait()
+
+			server.Stop()
+
+			if v := testutil.ToFloat64(notifier.metrics.ircSendMsgErrors.WithLabelValues("flaky", "#foo", "interrupted")); v != 1 {
+				t.Errorf("Expected 1 interrupted message, got %f", v)
+			}
+		})
+	}
+}
+
+func TestPendingMessagesSurviveReconnect(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+	// #bar is not joined before the connection breaks, its messages wait
+	// for the next session.
+	joined := make(chan string, 10)
+	var joinsMu sync.Mutex
+	barJoins := 0
+	server.SetHandler("JOIN", func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joined <- line.Args[0]
+		if line.Args[0] != "#bar" {
+			return hJOIN(conn, line)
+		}
+		joinsMu.Lock()
+		defer joinsMu.Unlock()
+		barJoins++
+		if barJoins == 1 {
+			return nil
+		}
+		return hJOIN(conn, line)
+	})
+	notices := make(chan string, 10)
+	server.SetHandler("NOTICE", func(conn *bufio.ReadWriter, line *irc.Line) error {
+		notices <- line.Args[0] + " " + strings.TrimSpace(line.Args[1])
+		return nil
+	})
+
+	go notifier.Run(ctx, stopWg)
+	waitJoin := func(channel string) {
+		for {
+			select {
+			case c := <-joined:
+				if c == channel {
+					return
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected %s to be joined", channel)
+			}
+		}
+	}
+	waitJoin("#foo")
+
+	alertMsgs <- AlertMsg{Channel: "#bar", Alert: "one"}
+	waitJoin("#bar")
+	server.Client.Close()
+
+	// Messages sent meanwhile are delivered after those kept.
+	alertMsgs <- AlertMsg{Channel: "#bar", Alert: "two"}
+	alertMsgs <- AlertMsg{Channel: "#bar", Alert: "three"}
+
+	expected := []string{"#bar one", "#bar two", "#bar three"}
+	received := []string{}
+	for range expected {
+		select {
+		case notice := <-notices:
+			received = append(received, notice)
+		case <-time.After(time.Second):
+			t.Fatalf("Expected notices %q, got %q", expected, received)
+		}
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	server.Stop()
+
+	select {
+	case notice := <-notices:
+		received = append(received, notice)
+	default:
+	}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("Expected notices %q, got %q", expected, received)
+	}
+	if v := testutil.ToFloat64(notifier.metrics.ircSendMsgErrors.WithLabelValues("", "#bar", "not_joined")); v != 0 {
+		t.Errorf("Expected no message dropped, got %f", v)
+	}
+}
+
+func TestPendingMessagesExpire(t *testing.T) {
+	notifier := &IRCNotifier{
+		Name:       "test",
+		BacklogTTL: time.Hour,
+		timeTeller: &FakeTime{
+			timeseries:   []int{0, 30, 50, 70},
+			durationUnit: time.Minute,
+		},
+		metrics: NewMetrics(prometheus.NewRegistry()),
+	}
+
+	notifier.keepAlertMsgs(false, AlertMsg{Channel: "#foo", Alert: "old"})
+	notifier.keepAlertMsgs(false, AlertMsg{Channel: "#foo", Alert: "new"})
+	// Kept again, a message expires after the TTL since first kept.
+	alertMsg, _ := notifier.nextPendingAlertMsg()
+	notifier.keepAlertMsgs(true, alertMsg)
+
+	alertMsg, ok := notifier.nextPendingAlertMsg()
+	if !ok || alertMsg.Alert != "new" {
+		t.Errorf("Expected the message kept for less than the TTL, got %v", alertMsg)
+	}
+	if _, ok := notifier.nextPendingAlertMsg(); ok {
+		t.Errorf("Expected no message left")
+	}
+	if v := testutil.ToFloat64(notifier.metrics.ircSendMsgErrors.WithLabelValues("test", "#foo", "expired")); v != 1 {
+		t.Errorf("Expected 1 expired message, got %f", v)
+	}
+}
+
+func TestMultilineMessage(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		reject   bool
+		expected []string
+	}{
+		// The limit of 2 lines per batch splits the message.
+		{"accepted", false, []string{"line 1 (batched)", "line 2 (batched)", "line 3 (batched)", "next"}},
+		// Rejected batches are sent line by line.
+		{"rejected", true, []string{"line 1 (batched)", "line 2 (batched)", "line 1", "line 2", "line 3", "next"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, port := makeTestServer(t)
+			config := makeTestIRCConfig(port)
+			config.ConnectionName = "modern"
+			config.IRCMultiline = true
+			notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+			server.SetHandler("CAP", func(conn *bufio.ReadWriter, line *irc.Line) error {
+				var r string
+				switch line.Args[0] {
+				case "LS":
+					r = ":example.com CAP foo LS :multi-prefix draft/multiline=max-bytes=4096,max-lines=2\n"
+				case "REQ":
+					r = fmt.Sprintf(":example.com CAP foo ACK :%s\n", line.Text())
+				}
+				_, err := conn.WriteString(r)
+				return err
+			})
+			server.SetHandler("BATCH", func(conn *bufio.ReadWriter, line *irc.Line) error {
+				if !tc.reject || !strings.HasPrefix(line.Args[0], "-") {
+					return nil
+				}
+				_, err := conn.WriteString(":example.com FAIL BATCH MULTILINE_INVALID :Invalid multiline batch\n")
+				return err
+			})
+			notices := make(chan string, 10)
+			server.SetHandler("NOTICE", func(conn *bufio.ReadWriter, line *irc.Line) error {
+				notice := strings.TrimSpace(line.Args[1])
+				if _, ok := line.Tags["batch"]; ok {
+					notice += " (batched)"
+				}
+				notices <- notice
+				return nil
+			})
+
+			go notifier.Run(ctx, stopWg)
+			deadline := time.Now().Add(time.Second)
+			for !notifier.multiline.Available() {
+				if time.Now().After(deadline) {
+					t.Fatalf("Expected draft/multiline to be negotiated")
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: "line 1", Part: 1, Parts: 3}
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: "line 2", Part: 2, Parts: 3}
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: "line 3", Part: 3, Parts: 3}
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: "next"}
+
+			received := []string{}
+			for range tc.expected {
+				select {
+				case notice := <-notices:
+					received = append(received, notice)
+				case <-time.After(time.Second):
+					t.Fatalf("Expected notices %q, got %q", tc.expected, received)
+				}
+			}
+			if !reflect.DeepEqual(tc.expected, received) {
+				t.Errorf("Expected notices %q, got %q", tc.expected, received)
+			}
+
+			cancel()
+			stopWg.Wait()
+
+			server.Stop()
+
+			result, batches := multilineBatchSent, 2.0
+			if tc.reject {
+				result, batches = multilineBatchRejected, 1
+			}
+			if v := testutil.ToFloat64(notifier.metrics.ircMultilineBatches.WithLabelValues("modern", result)); v != batches {
+				t.Errorf("Expected %f %s batches, got %f", batches, result, v)
+			}
+		})
+	}
+}
+
+func TestISupportLineLength(t *testing.T) {
+	alert := strings.Repeat("word ", 140) + "end"
+	for _, tc := range []struct {
+		name     string
+		isupport string
+		notices  int
+	}{
+		{"modern", "LINELEN=1024 TARGMAX=PRIVMSG:4,NOTICE:4", 1},
+		{"bare-bones", "CHANTYPES=#", 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server, port := makeTestServer(t)
+			config := makeTestIRCConfig(port)
+			notifier, alertMsgs, ctx, cancel, stopWg := makeTestNotifier(t, config)
+
+			server.SetHandler("USER", func(conn *bufio.ReadWriter, line *irc.Line) error {
+				r := fmt.Sprintf(":example.com 001 %s :Welcome\n:example.com 005 %s %s :are supported by this server\n",
+					line.Args[0], line.Args[0], tc.isupport)
+				_, err := conn.WriteString(r)
+				return err
+			})
+			notices := make(chan string, 10)
+			server.SetHandler("NOTICE", func(conn *bufio.ReadWriter, line *irc.Line) error {
+				notices <- strings.TrimSpace(line.Args[1])
+				return nil
+			})
+
+			go notifier.Run(ctx, stopWg)
+
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: alert}
+			alertMsgs <- AlertMsg{Channel: "#foo", Alert: "next"}
+			received := []string{}
+			for {
+				select {
+				case notice := <-notices:
+					received = append(received, notice)
+				case <-time.After(time.Second):
+					t.Fatalf("Expected notices, got %q", received)
+				}
+				if received[len(received)-1] == "next" {
+					break
+				}
+			}
+			received = received[:len(received)-1]
+
+			cancel()
+			stopWg.Wait()
+
+			server.Stop()
+
+			if len(received) != tc.notices {
+				t.Errorf("Expected the alert sent in %d notices, got %q", tc.notices, received)
+			}
+			if joined := strings.Replace(strings.Join(received, ""), "...", "", -1); joined != alert {
+				t.Errorf("Expected the alert to be sent whole, got %q", received)
+			}
+		})
+	}
+}
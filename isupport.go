@@ -0,0 +1,288 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	// Lines are of at most 512 bytes, and commands take a single target,
+	// unless the server advertises otherwise.
+	defaultLineLen    = 512
+	defaultMaxTargets = 1
+
+	// Messages are split at 450 bytes in 512-byte lines, as goirc does,
+	// leaving room for the source the server prepends, the command and
+	// the target.
+	defaultSplitLen = 450
+	lineOverhead    = defaultLineLen - defaultSplitLen
+)
+
+// ISupportStatus describes the limits advertised by the server in /status.
+type ISupportStatus struct {
+	LineLen     int    `json:"linelen"`
+	NickLen     int    `json:"nicklen,omitempty"`
+	ChannelLen  int    `json:"channellen,omitempty"`
+	Casemapping string `json:"casemapping"`
+	// TargMax are the targets allowed per command, 0 for no limit, for
+	// the commands listed by the server.
+	TargMax map[string]int `json:"targmax,omitempty"`
+}
+
+// ISupport keeps the limits the server advertises in RPL_ISUPPORT, and goes
+// back to the defaults on each connection attempt, as the next server may
+// differ.
+type ISupport struct {
+	name string
+
+	mu          sync.Mutex
+	lineLen     int
+	nickLen     int
+	channelLen  int
+	casemapping string
+	targMax     map[string]int
+	// maxTargets applies to PRIVMSG and NOTICE, unless TARGMAX says
+	// otherwise, as advertised by older servers.
+	maxTargets int
+}
+
+func NewISupport(name string, client *irc.Conn) *ISupport {
+	isupport := &ISupport{name: name}
+	isupport.Reset()
+
+	isupport.registerHandlers(client)
+
+	return isupport
+}
+
+// registerHandlers resets the tokens on each connection attempt. They are
+// recorded by the notifier, as goirc runs the handlers of a line in parallel
+// and the components relying on them must see them recorded.
+func (s *ISupport) registerHandlers(client *irc.Conn) {
+	client.HandleFunc(irc.REGISTER,
+		func(*irc.Conn, *irc.Line) {
+			s.Reset()
+		})
+}
+
+// Reset goes back to the defaults.
+func (s *ISupport) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.lineLen = defaultLineLen
+	s.nickLen = 0
+	s.channelLen = 0
+	s.casemapping = casemappingRFC1459
+	s.targMax = nil
+	s.maxTargets = defaultMaxTargets
+}
+
+// Handle records the tokens of an RPL_ISUPPORT reply. Tokens prefixed with
+// "-" go back to the default.
+func (s *ISupport) Handle(tokens []string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, token := range tokens {
+		name, value := token, ""
+		if i := strings.Index(token, "="); i >= 0 {
+			name, value = token[:i], token[i+1:]
+		}
+		negated := strings.HasPrefix(name, "-")
+		name = strings.TrimPrefix(name, "-")
+		switch name {
+		case "LINELEN":
+			s.lineLen = defaultLineLen
+			// Shorter lines than the classic ones are not
+			// expected, and would leave no room for the message.
+			if lineLen := s.parseLimit(name, value); !negated && lineLen > defaultLineLen {
+				s.lineLen = lineLen
+			}
+		case "NICKLEN":
+			s.nickLen = 0
+			if !negated {
+				s.nickLen = s.parseLimit(name, value)
+			}
+		case "CHANNELLEN":
+			s.channelLen = 0
+			if !negated {
+				s.channelLen = s.parseLimit(name, value)
+			}
+		case "CASEMAPPING":
+			s.casemapping = casemappingRFC1459
+			if !negated && value != "" {
+				s.casemapping = value
+			}
+		case "MAXTARGETS":
+			s.maxTargets = defaultMaxTargets
+			if !negated {
+				// No value means no limit.
+				s.maxTargets = s.parseLimit(name, value)
+			}
+		case "TARGMAX":
+			s.targMax = nil
+			if !negated {
+				s.targMax = s.parseTargMax(value)
+			}
+		}
+	}
+}
+
+// parseLimit parses the value of a token, 0 if empty or invalid.
+func (s *ISupport) parseLimit(name string, value string) int {
+	if value == "" {
+		return 0
+	}
+	limit, err := strconv.Atoi(value)
+	if err != nil || limit < 0 {
+		logging.Warn("Connection %s: ignoring invalid %s=%s advertised by the server", s.name, name, value)
+		return 0
+	}
+	return limit
+}
+
+// parseTargMax parses e.g. "PRIVMSG:4,NOTICE:4,JOIN:", an empty limit
+// meaning no limit.
+func (s *ISupport) parseTargMax(value string) map[string]int {
+	targMax := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		i := strings.Index(entry, ":")
+		if i <= 0 {
+			continue
+		}
+		targMax[strings.ToUpper(entry[:i])] = s.parseLimit("TARGMAX", entry[i+1:])
+	}
+	return targMax
+}
+
+// LineLen returns the length of the lines the server accepts, in bytes.
+func (s *ISupport) LineLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lineLen
+}
+
+// SplitLen returns the length in bytes at which messages are split to fit
+// in a line.
+func (s *ISupport) SplitLen() int {
+	return s.LineLen() - lineOverhead
+}
+
+// NickLen returns the maximum length of nicks, 0 if not advertised.
+func (s *ISupport) NickLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.nickLen
+}
+
+// ChannelLen returns the maximum length of channel names, 0 if not
+// advertised.
+func (s *ISupport) ChannelLen() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.channelLen
+}
+
+func (s *ISupport) Casemapping() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.casemapping
+}
+
+// MaxTargets returns how many targets the command takes, 0 for no limit.
+func (s *ISupport) MaxTargets(command string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	command = strings.ToUpper(command)
+	if s.targMax != nil {
+		if limit, ok := s.targMax[command]; ok {
+			return limit
+		}
+		return defaultMaxTargets
+	}
+	if command == irc.PRIVMSG || command == irc.NOTICE {
+		return s.maxTargets
+	}
+	return defaultMaxTargets
+}
+
+func (s *ISupport) Status() ISupportStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	status := ISupportStatus{
+		LineLen:     s.lineLen,
+		NickLen:     s.nickLen,
+		ChannelLen:  s.channelLen,
+		Casemapping: s.casemapping,
+	}
+	if s.targMax != nil {
+		status.TargMax = make(map[string]int)
+		for command, limit := range s.targMax {
+			status.TargMax[command] = limit
+		}
+	}
+	return status
+}
+
+// splitMessage splits a message longer than splitLen bytes like goirc does:
+// at the end of the last sentence fragment or word before splitLen if any,
+// or else between the last runes fitting, marking each cut with "...".
+func splitMessage(msg string, splitLen int) []string {
+	msgs := []string{}
+	for len(msg) > splitLen {
+		i := indexFragment(msg[:splitLen-3])
+		if i < 0 {
+			i = splitLen - 3
+			for i > 0 && !utf8.RuneStart(msg[i]) {
+				i--
+			}
+			if i == 0 {
+				i = splitLen - 3
+			}
+		}
+		msgs = append(msgs, msg[:i]+"...")
+		msg = msg[i:]
+	}
+	return append(msgs, msg)
+}
+
+// indexFragment returns the index after the last sentence fragment in s,
+// ended by punctuation followed by a space, or else after its last space,
+// or -1 if there is none.
+func indexFragment(s string) int {
+	max := -1
+	for _, sep := range []string{". ", ": ", "; ", ", ", "! ", "? ", "\" ", "' "} {
+		if i := strings.LastIndex(s, sep); i > max {
+			max = i
+		}
+	}
+	if max > 0 {
+		return max + 2
+	}
+	if i := strings.LastIndex(s, " "); i > 0 {
+		return i + 1
+	}
+	return -1
+}
@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestISupport(t *testing.T) {
+	defaults := ISupportStatus{LineLen: 512, Casemapping: "rfc1459"}
+	for _, tc := range []struct {
+		name       string
+		tokens     [][]string
+		expected   ISupportStatus
+		splitLen   int
+		maxTargets map[string]int
+	}{
+		{
+			name: "modern",
+			tokens: [][]string{
+				{"LINELEN=1024", "NICKLEN=30", "CHANNELLEN=64", "CASEMAPPING=ascii"},
+				{"TARGMAX=PRIVMSG:4,NOTICE:4,JOIN:", "MAXTARGETS=20"},
+			},
+			expected: ISupportStatus{
+				LineLen:     1024,
+				NickLen:     30,
+				ChannelLen:  64,
+				Casemapping: "ascii",
+				TargMax:     map[string]int{"PRIVMSG": 4, "NOTICE": 4, "JOIN": 0},
+			},
+			splitLen:   962,
+			maxTargets: map[string]int{"PRIVMSG": 4, "notice": 4, "JOIN": 0, "KICK": 1},
+		},
+		{
+			name:       "older",
+			tokens:     [][]string{{"NICKLEN=9", "MAXTARGETS=3"}},
+			expected:   ISupportStatus{LineLen: 512, NickLen: 9, Casemapping: "rfc1459"},
+			splitLen:   450,
+			maxTargets: map[string]int{"PRIVMSG": 3, "NOTICE": 3, "JOIN": 1},
+		},
+		{
+			name:       "bare-bones",
+			tokens:     [][]string{{"PREFIX=(ov)@+", "CHANTYPES=#"}},
+			expected:   defaults,
+			splitLen:   450,
+			maxTargets: map[string]int{"PRIVMSG": 1, "NOTICE": 1},
+		},
+		{
+			name:       "invalid",
+			tokens:     [][]string{{"LINELEN=many", "NICKLEN=-1", "LINELEN=256"}},
+			expected:   defaults,
+			splitLen:   450,
+			maxTargets: map[string]int{"PRIVMSG": 1},
+		},
+		{
+			name: "negated",
+			tokens: [][]string{
+				{"LINELEN=1024", "CASEMAPPING=ascii", "TARGMAX=PRIVMSG:4"},
+				{"-LINELEN", "-CASEMAPPING", "-TARGMAX"},
+			},
+			expected:   defaults,
+			splitLen:   450,
+			maxTargets: map[string]int{"PRIVMSG": 1},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			isupport := &ISupport{name: "test"}
+			isupport.Reset()
+			for _, tokens := range tc.tokens {
+				isupport.Handle(tokens)
+			}
+			if status := isupport.Status(); !reflect.DeepEqual(tc.expected, status) {
+				t.Errorf("Expected %+v, got %+v", tc.expected, status)
+			}
+			if splitLen := isupport.SplitLen(); splitLen != tc.splitLen {
+				t.Errorf("Expected messages split at %d bytes, got %d", tc.splitLen, splitLen)
+			}
+			for command, expected := range tc.maxTargets {
+				if maxTargets := isupport.MaxTargets(command); maxTargets != expected {
+					t.Errorf("Expected %d targets for %s, got %d", expected, command, maxTargets)
+				}
+			}
+
+			// The next server may advertise less.
+			isupport.Reset()
+			if status := isupport.Status(); !reflect.DeepEqual(defaults, status) {
+				t.Errorf("Expected the defaults once reset, got %+v", status)
+			}
+		})
+	}
+}
+
+func TestSplitMessage(t *testing.T) {
+	for _, tc := range []struct {
+		msg      string
+		splitLen int
+		expected []string
+	}{
+		{"short", 20, []string{"short"}},
+		{"first part. second part", 20, []string{"first part. ...", "second part"}},
+		{"several words over the limit", 20, []string{"several words ...", "over the limit"}},
+		{strings.Repeat("x", 15) + "☃☃", 20, []string{strings.Repeat("x", 15) + "...", "☃☃"}},
+	} {
+		if msgs := splitMessage(tc.msg, tc.splitLen); !reflect.DeepEqual(tc.expected, msgs) {
+			t.Errorf("Expected %q split as %q, got %q", tc.msg, tc.expected, msgs)
+		}
+	}
+}
@@ -0,0 +1,44 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+const defaultTCPKeepAliveInterval = 30 * time.Second
+
+// TCPKeepAlive configures TCP keepalive probes on the IRC connection.
+type TCPKeepAlive struct {
+	// Interval between probes, and idle time before the first one. 0
+	// disables keepalive probes.
+	Interval time.Duration `yaml:"interval"`
+	// Count of unanswered probes after which the connection is dead, 0
+	// keeps the system default. Only supported on Linux.
+	Count int `yaml:"count"`
+}
+
+// apply sets the keepalive config on the dialer.
+func (k TCPKeepAlive) apply(dialer *net.Dialer) {
+	if k.Interval > 0 {
+		dialer.KeepAlive = k.Interval
+	} else {
+		dialer.KeepAlive = -1
+	}
+	if k.Interval > 0 && k.Count > 0 {
+		dialer.Control = keepAliveCountControl(k.Count)
+	}
+}
@@ -0,0 +1,35 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"syscall"
+)
+
+// keepAliveCountControl sets the count of keepalive probes on sockets
+// before they connect.
+func keepAliveCountControl(count int) func(string, string, syscall.RawConn) error {
+	return func(_ string, _ string, c syscall.RawConn) error {
+		var sockErr error
+		err := c.Control(func(fd uintptr) {
+			sockErr = syscall.SetsockoptInt(
+				int(fd), syscall.IPPROTO_TCP, syscall.TCP_KEEPCNT, count)
+		})
+		if err != nil {
+			return err
+		}
+		return sockErr
+	}
+}
@@ -0,0 +1,31 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"syscall"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+// keepAliveCountControl leaves the count of keepalive probes to the system,
+// as it cannot be set portably.
+func keepAliveCountControl(count int) func(string, string, syscall.RawConn) error {
+	logging.Warn("Ignoring TCP keepalive count %d, only supported on Linux", count)
+	return nil
+}
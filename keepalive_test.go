@@ -0,0 +1,76 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/net/proxy"
+)
+
+func makeIRCDialer(t *testing.T, config *Config, forward *net.Dialer) *addressDialer {
+	proxyURL, err := url.Parse(newIRCDialer(config, nil, nil).register())
+	if err != nil {
+		t.Fatalf("Could not parse proxy URL: %s", err)
+	}
+	dialer, err := proxy.FromURL(proxyURL, forward)
+	if err != nil {
+		t.Fatalf("Could not create dialer: %s", err)
+	}
+	return dialer.(*addressDialer)
+}
+
+func TestKeepAliveDialer(t *testing.T) {
+	forward := &net.Dialer{Timeout: 5 * time.Second}
+	config := &Config{
+		IRCTCPKeepAlive: TCPKeepAlive{Interval: 30 * time.Second, Count: 4},
+	}
+	dialer := makeIRCDialer(t, config, forward)
+
+	if dialer.dialer.KeepAlive != 30*time.Second {
+		t.Errorf("Expected keepalive interval of 30s, got %s", dialer.dialer.KeepAlive)
+	}
+	if dialer.dialer.Timeout != forward.Timeout {
+		t.Errorf("Dialer settings of goirc not kept")
+	}
+	if forward.KeepAlive != 0 {
+		t.Errorf("Dialer of goirc modified")
+	}
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Could not listen: %s", err)
+	}
+	defer listener.Close()
+	conn, err := dialer.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatalf("Could not connect with keepalive settings: %s", err)
+	}
+	conn.Close()
+}
+
+func TestKeepAliveDisabled(t *testing.T) {
+	dialer := makeIRCDialer(t, &Config{}, &net.Dialer{})
+
+	if dialer.dialer.KeepAlive >= 0 {
+		t.Errorf("Expected keepalive to be disabled, got interval %s", dialer.dialer.KeepAlive)
+	}
+	if dialer.dialer.Control != nil {
+		t.Errorf("Expected keepalive count not to be set")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"fmt"
+	"sync"
+)
+
+// SampledLogger logs the first occurrences of recurring events, then only
+// every Nth one with the number of occurrences so far. Events are identified
+// by their format string and their string and error arguments, e.g. the
+// channel and the error, so that numbers such as attempts or delays do not
+// tell them apart. They are counted until Reset is called.
+type SampledLogger struct {
+	first int
+	every int
+
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+// NewSampledLogger returns a logger logging the first occurrences of each
+// event, then one in every.
+func NewSampledLogger(first int, every int) *SampledLogger {
+	return &SampledLogger{
+		first:  first,
+		every:  every,
+		counts: make(map[string]int),
+	}
+}
+
+// sampleKey identifies the event logged with f and a.
+func sampleKey(f string, a []interface{}) string {
+	key := f
+	for _, arg := range a {
+		switch v := arg.(type) {
+		case string:
+			key += "\x00" + v
+		case error:
+			key += "\x00" + v.Error()
+		}
+	}
+	return key
+}
+
+// sample counts an occurrence of the event, and returns the format to log it
+// with, if it should be logged.
+func (s *SampledLogger) sample(f string, a []interface{}) (string, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	key := sampleKey(f, a)
+	s.counts[key]++
+	count := s.counts[key]
+	if count <= s.first {
+		return f, true
+	}
+	if s.every > 0 && (count-s.first)%s.every == 0 {
+		return f + fmt.Sprintf(" (repeated %d times)", count), true
+	}
+	return f, false
+}
+
+// Reset forgets the occurrences, e.g. when the state the events were
+// reporting on changed.
+func (s *SampledLogger) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.counts = make(map[string]int)
+}
+
+// The methods call logger directly to keep the call depth of the package
+// functions, so that the logged file and line are the caller's.
+
+func (s *SampledLogger) Info(f string, a ...interface{}) {
+	if f, ok := s.sample(f, a); ok {
+		logger.Info(f, a...)
+	}
+}
+
+func (s *SampledLogger) Warn(f string, a ...interface{}) {
+	if f, ok := s.sample(f, a); ok {
+		logger.Warn(f, a...)
+	}
+}
+
+func (s *SampledLogger) Error(f string, a ...interface{}) {
+	if f, ok := s.sample(f, a); ok {
+		logger.Error(f, a...)
+	}
+}
@@ -0,0 +1,84 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package logging
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+func sampleTimes(s *SampledLogger, f string, times int, a ...interface{}) []string {
+	logged := []string{}
+	for i := 0; i < times; i++ {
+		if format, ok := s.sample(f, a); ok {
+			logged = append(logged, format)
+		}
+	}
+	return logged
+}
+
+func TestSampledLoggerCounting(t *testing.T) {
+	s := NewSampledLogger(2, 3)
+
+	expected := []string{
+		"event",
+		"event",
+		"event (repeated 5 times)",
+		"event (repeated 8 times)",
+	}
+	if logged := sampleTimes(s, "event", 9); !reflect.DeepEqual(expected, logged) {
+		t.Errorf("Expected %q, got %q", expected, logged)
+	}
+
+	// Other events are counted separately.
+	expected = []string{"other", "other"}
+	if logged := sampleTimes(s, "other", 2); !reflect.DeepEqual(expected, logged) {
+		t.Errorf("Expected %q, got %q", expected, logged)
+	}
+}
+
+func TestSampledLoggerArguments(t *testing.T) {
+	s := NewSampledLogger(1, 0)
+
+	sampleTimes(s, "channel %s: %s (attempt %d)", 3, "#foo", "banned", 1)
+
+	// Events about other channels or errors are counted separately, not
+	// those differing only by numbers.
+	for _, tc := range []struct {
+		args     []interface{}
+		expected int
+	}{
+		{[]interface{}{"#foo", "banned", 4}, 0},
+		{[]interface{}{"#bar", "banned", 1}, 1},
+		{[]interface{}{"#foo", errors.New("invite only"), 1}, 1},
+	} {
+		if logged := sampleTimes(s, "channel %s: %s (attempt %d)", 1, tc.args...); len(logged) != tc.expected {
+			t.Errorf("Expected %d lines logged for %v, got %q", tc.expected, tc.args, logged)
+		}
+	}
+}
+
+func TestSampledLoggerReset(t *testing.T) {
+	s := NewSampledLogger(1, 0)
+
+	sampleTimes(s, "event", 5)
+	s.Reset()
+
+	expected := []string{"event"}
+	if logged := sampleTimes(s, "event", 3); !reflect.DeepEqual(expected, logged) {
+		t.Errorf("Expected %q, got %q", expected, logged)
+	}
+}
@@ -21,6 +21,7 @@ import (
 	"syscall"
 
 	"github.com/google/alertmanager-irc-relay/logging"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func main() {
@@ -32,27 +33,108 @@ func main() {
 	ctx, _ := WithSignal(context.Background(), syscall.SIGINT, syscall.SIGTERM)
 	stopWg := sync.WaitGroup{}
 
+	configPath := *configFile
+	if configPath == "" {
+		configPath = "(none, using defaults)"
+	}
+	buildInfo := GetBuildInfo()
+	logging.Info("Starting alertmanager-irc-relay version=%s revision=%s go_version=%s config=%s",
+		buildInfo.Version, buildInfo.Revision, buildInfo.GoVersion, configPath)
+
 	config, err := LoadConfig(*configFile)
 	if err != nil {
 		logging.Error("Could not load config: %s", err)
 		return
 	}
 
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}))
+	metrics := NewMetrics(registry)
+
 	alertMsgs := make(chan AlertMsg, config.AlertBufferSize)
 
-	stopWg.Add(1)
-	ircNotifier, err := NewIRCNotifier(config, alertMsgs, &BackoffMaker{}, &RealTime{})
-	if err != nil {
-		logging.Error("Could not create IRC notifier: %s", err)
-		return
+	connectionConfigs := config.ConnectionConfigs()
+	router := NewAlertMsgRouter(connectionConfigs, metrics)
+	pending := NewPendingMessages(&RealTime{})
+	router.Pending = pending
+	sequencer := NewWebhookSequencer(config)
+	router.Sequencer = sequencer
+	notifiers := []*IRCNotifier{}
+	for _, connectionConfig := range connectionConfigs {
+		notifierMsgs := alertMsgs
+		if len(connectionConfigs) > 1 {
+			notifierMsgs = router.AlertMsgs(connectionConfig.ConnectionName)
+		}
+		ircNotifier, err := NewIRCNotifier(connectionConfig, notifierMsgs, &BackoffMaker{Jitter: config.BackoffJitter}, &RealTime{}, metrics)
+		if err != nil {
+			logging.Error("Could not create IRC notifier: %s", err)
+			return
+		}
+		ircNotifier.NotificationMsgs = alertMsgs
+		ircNotifier.Pending = pending
+		ircNotifier.Sequencer = sequencer
+		notifiers = append(notifiers, ircNotifier)
+		stopWg.Add(1)
+		go ircNotifier.Run(ctx, &stopWg)
+	}
+	if len(connectionConfigs) > 1 {
+		stopWg.Add(1)
+		go router.Run(ctx, alertMsgs, &stopWg)
 	}
-	go ircNotifier.Run(ctx, &stopWg)
 
-	httpServer, err := NewHTTPServer(config, alertMsgs)
+	httpServer, err := NewHTTPServer(config, alertMsgs, metrics)
 	if err != nil {
 		logging.Error("Could not create HTTP server: %s", err)
 		return
 	}
+	httpServer.Notifiers = notifiers
+	httpServer.Pending = pending
+	httpServer.Sequencer = sequencer
+	httpServer.Tracer = NewTracer(config, metrics)
+	if httpServer.Tracer != nil {
+		stopWg.Add(1)
+		go httpServer.Tracer.Run(ctx, &stopWg)
+	}
+	httpServer.FlapDetector = NewFlapDetector(config, alertMsgs, &RealTime{}, metrics)
+	if httpServer.FlapDetector != nil {
+		stopWg.Add(1)
+		go httpServer.FlapDetector.Run(ctx, &stopWg)
+	}
+	httpServer.Watchdog = NewWatchdog(config, alertMsgs, &RealTime{}, metrics)
+	if httpServer.Watchdog != nil {
+		stopWg.Add(1)
+		go httpServer.Watchdog.Run(ctx, &stopWg)
+	}
+	httpServer.Digester = NewDigester(config, alertMsgs, &RealTime{}, metrics)
+	if httpServer.Digester != nil {
+		stopWg.Add(1)
+		go httpServer.Digester.Run(ctx, &stopWg)
+	}
+	httpServer.QuietHours = NewQuietHours(config, alertMsgs, &RealTime{}, metrics)
+	if httpServer.QuietHours != nil {
+		stopWg.Add(1)
+		go httpServer.QuietHours.Run(ctx, &stopWg)
+	}
+	httpServer.Storms = NewStormDetector(config, alertMsgs, &RealTime{}, metrics)
+	if httpServer.Storms != nil {
+		stopWg.Add(1)
+		go httpServer.Storms.Run(ctx, &stopWg)
+	}
+	if config.StateFile != "" {
+		stateKeeper := NewStateKeeper(&FileStateStore{Path: config.StateFile},
+			config.StateSaveInterval, httpServer.deduplicator, httpServer.retries, httpServer.cooldown,
+			httpServer.FlapDetector, &RealTime{}, metrics)
+		// Before alerts are received.
+		stateKeeper.Restore()
+		stopWg.Add(1)
+		go stateKeeper.Run(ctx, &stopWg)
+	}
+	if *configFile != "" {
+		stopWg.Add(1)
+		go NewConfigReloader(*configFile, httpServer, metrics).Run(ctx, &stopWg)
+	}
 	go httpServer.Run()
 
 	stopWg.Wait()
@@ -0,0 +1,259 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+// What annotations_markdown does to the Markdown of annotations: convert
+// emphasis to IRC formatting, or strip it. Both turn links, images and code
+// into plain text.
+const (
+	annotationsMarkdownIRC   = "irc"
+	annotationsMarkdownStrip = "strip"
+)
+
+const (
+	ircBold      = "\x02"
+	ircUnderline = "\x1f"
+)
+
+// markdownToIRC converts the Markdown commonly found in annotations to text
+// fit for IRC: links become "text <url>", images their alt text, code spans
+// and fences their content, and emphasis IRC bold and underline, or nothing
+// if formatting is unset. Anything else, including unterminated constructs,
+// is kept as is.
+func markdownToIRC(s string, formatting bool) string {
+	lines := strings.Split(s, "\n")
+	converted := []string{}
+	for i := 0; i < len(lines); i++ {
+		if end := codeFenceEnd(lines, i); end > 0 {
+			code := []string{}
+			for _, line := range lines[i+1 : end] {
+				if line = strings.TrimSpace(line); line != "" {
+					code = append(code, line)
+				}
+			}
+			converted = append(converted, strings.Join(code, " "))
+			i = end
+			continue
+		}
+		converted = append(converted, markdownInline(lines[i], formatting))
+	}
+	return strings.Join(converted, "\n")
+}
+
+// codeFenceEnd returns the index of the line closing the code fence opened
+// at lines[start], or 0 if there is none.
+func codeFenceEnd(lines []string, start int) int {
+	if !strings.HasPrefix(strings.TrimSpace(lines[start]), "```") {
+		return 0
+	}
+	for i := start + 1; i < len(lines); i++ {
+		if strings.TrimSpace(lines[i]) == "```" {
+			return i
+		}
+	}
+	return 0
+}
+
+// markdownInline converts the inline Markdown of a line.
+func markdownInline(s string, formatting bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		switch s[i] {
+		case '`':
+			if content, end, ok := parseCodeSpan(s, i); ok {
+				b.WriteString(content)
+				i = end
+				continue
+			}
+			// Skip the whole run so that its end is not taken for a
+			// code span.
+			run := markerRun(s, i)
+			b.WriteString(s[i : i+run])
+			i += run
+			continue
+		case '!':
+			if text, _, end, ok := parseLink(s, i+1); ok {
+				b.WriteString(text)
+				i = end
+				continue
+			}
+		case '[':
+			if text, url, end, ok := parseLink(s, i); ok {
+				b.WriteString(markdownInline(text, formatting) + " <" + url + ">")
+				i = end
+				continue
+			}
+		case '*', '_':
+			if content, run, end, ok := parseEmphasis(s, i); ok {
+				code := ""
+				if formatting {
+					code = ircUnderline
+					if run == 2 {
+						code = ircBold
+					}
+				}
+				b.WriteString(code + markdownInline(content, formatting) + code)
+				i = end
+				continue
+			}
+			run := markerRun(s, i)
+			b.WriteString(s[i : i+run])
+			i += run
+			continue
+		}
+		b.WriteByte(s[i])
+		i++
+	}
+	return b.String()
+}
+
+// markerRun returns how many times s[i] repeats from i.
+func markerRun(s string, i int) int {
+	run := 1
+	for i+run < len(s) && s[i+run] == s[i] {
+		run++
+	}
+	return run
+}
+
+// parseCodeSpan parses the code span starting at s[i], closed by as many
+// backticks as it is opened with.
+func parseCodeSpan(s string, i int) (content string, end int, ok bool) {
+	run := markerRun(s, i)
+	for j := i + run; j < len(s); {
+		if s[j] != '`' {
+			j++
+			continue
+		}
+		closing := markerRun(s, j)
+		if closing == run && j > i+run {
+			return strings.TrimSpace(s[i+run : j]), j + run, true
+		}
+		j += closing
+	}
+	return "", 0, false
+}
+
+// parseLink parses "[text](url)" starting at s[i]. URLs with spaces or
+// titles are not supported.
+func parseLink(s string, i int) (text string, url string, end int, ok bool) {
+	if i >= len(s) || s[i] != '[' {
+		return "", "", 0, false
+	}
+	closeText := strings.IndexByte(s[i:], ']')
+	if closeText < 0 {
+		return "", "", 0, false
+	}
+	closeText += i
+	if closeText+1 >= len(s) || s[closeText+1] != '(' {
+		return "", "", 0, false
+	}
+	// URLs may have balanced parentheses, as Wikipedia's do.
+	closeURL, depth := -1, 0
+	for j := closeText + 2; j < len(s) && closeURL < 0; j++ {
+		switch s[j] {
+		case '(':
+			depth++
+		case ')':
+			if depth == 0 {
+				closeURL = j
+			}
+			depth--
+		}
+	}
+	if closeURL < 0 {
+		return "", "", 0, false
+	}
+	text = s[i+1 : closeText]
+	url = s[closeText+2 : closeURL]
+	if text == "" || url == "" || strings.ContainsAny(url, " \t") || strings.ContainsAny(text, "[") {
+		return "", "", 0, false
+	}
+	return text, url, closeURL + 1, true
+}
+
+// emphasisCanOpen and emphasisCanClose tell whether what precedes an
+// opening marker and follows a closing one delimits words, so that e.g.
+// snake_case names, paths, __init__.py and products like 2*3*4 are not taken
+// for emphasis.
+func emphasisCanOpen(s string, i int) bool {
+	return i == 0 || strings.IndexByte(" \t([{\"'", s[i-1]) >= 0
+}
+
+func emphasisCanClose(s string, i int) bool {
+	// Punctuation must end the word too.
+	for i < len(s) && strings.IndexByte(".,;:!?)]}\"'", s[i]) >= 0 {
+		i++
+	}
+	return i == len(s) || s[i] == ' ' || s[i] == '\t'
+}
+
+// parseEmphasis parses "*text*", "_text_", "**text**" or "__text__" starting
+// at s[i].
+func parseEmphasis(s string, i int) (content string, run int, end int, ok bool) {
+	marker := s[i]
+	run = markerRun(s, i)
+	start := i + run
+	if run > 2 || !emphasisCanOpen(s, i) || start >= len(s) || s[start] == ' ' {
+		return "", 0, 0, false
+	}
+	for j := start + 1; j < len(s); j++ {
+		if s[j] != marker {
+			continue
+		}
+		closing := markerRun(s, j)
+		if closing == run && s[j-1] != ' ' && emphasisCanClose(s, j+run) {
+			return s[start:j], run, j + run, true
+		}
+		j += closing - 1
+	}
+	return "", 0, 0, false
+}
+
+// convertMarkdownKV returns a copy of kv with the Markdown of its values
+// converted.
+func convertMarkdownKV(kv promtmpl.KV, formatting bool) promtmpl.KV {
+	if kv == nil {
+		return nil
+	}
+	converted := promtmpl.KV{}
+	for key, value := range kv {
+		converted[key] = markdownToIRC(value, formatting)
+	}
+	return converted
+}
+
+// convertAnnotationsMarkdown returns a copy of data where the Markdown of
+// annotations was converted according to AnnotationsMarkdown.
+func (f *Formatter) convertAnnotationsMarkdown(data *promtmpl.Data) *promtmpl.Data {
+	if f.AnnotationsMarkdown == "" {
+		return data
+	}
+	formatting := f.AnnotationsMarkdown == annotationsMarkdownIRC
+	converted := *data
+	converted.CommonAnnotations = convertMarkdownKV(data.CommonAnnotations, formatting)
+	converted.Alerts = make(promtmpl.Alerts, len(data.Alerts))
+	for i, alert := range data.Alerts {
+		alert.Annotations = convertMarkdownKV(alert.Annotations, formatting)
+		converted.Alerts[i] = alert
+	}
+	return &converted
+}
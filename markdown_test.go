@@ -0,0 +1,118 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestMarkdownToIRC(t *testing.T) {
+	for _, tc := range []struct {
+		name     string
+		input    string
+		irc      string
+		stripped string
+	}{
+		{"plain", "Disk is full", "Disk is full", "Disk is full"},
+		{"link", "See [runbook](https://runbooks.example.com/disk).",
+			"See runbook <https://runbooks.example.com/disk>.",
+			"See runbook <https://runbooks.example.com/disk>."},
+		{"link with parentheses", "[Foo](https://en.wikipedia.org/wiki/Foo_(bar))",
+			"Foo <https://en.wikipedia.org/wiki/Foo_(bar)>",
+			"Foo <https://en.wikipedia.org/wiki/Foo_(bar)>"},
+		{"emphasized link", "[**runbook**](https://x)",
+			"\x02runbook\x02 <https://x>", "runbook <https://x>"},
+		{"image", "![disk graph](https://grafana.example.com/d.png) above",
+			"disk graph above", "disk graph above"},
+		{"bold", "**Do not** restart", "\x02Do not\x02 restart", "Do not restart"},
+		{"bold underscores", "__Do not__ restart", "\x02Do not\x02 restart", "Do not restart"},
+		{"italics", "Check *all* (_really_) hosts", "Check \x1fall\x1f (\x1freally\x1f) hosts",
+			"Check all (really) hosts"},
+		{"code span", "Run `df -h` on the host", "Run df -h on the host", "Run df -h on the host"},
+		{"code span with backtick", "Run ``echo `date` `` now", "Run echo `date` now", "Run echo `date` now"},
+		{"code keeps markup", "Set `**x**` and `[a](b)`", "Set **x** and [a](b)", "Set **x** and [a](b)"},
+		{"code fence", "Run:\n```sh\nsystemctl restart foo\n  systemctl status foo\n```\nthen wait",
+			"Run:\nsystemctl restart foo systemctl status foo\nthen wait",
+			"Run:\nsystemctl restart foo systemctl status foo\nthen wait"},
+		{"snake_case", "metric node_filesystem_avail_bytes is low",
+			"metric node_filesystem_avail_bytes is low", "metric node_filesystem_avail_bytes is low"},
+		{"path", "/var/_cache_/x and __init__.py", "/var/_cache_/x and __init__.py",
+			"/var/_cache_/x and __init__.py"},
+		{"arithmetic", "2 * 3 * 4 and 2*3*4", "2 * 3 * 4 and 2*3*4", "2 * 3 * 4 and 2*3*4"},
+		{"unterminated emphasis", "**not closed", "**not closed", "**not closed"},
+		{"unterminated code", "`not closed", "`not closed", "`not closed"},
+		{"unterminated fence", "```\nfoo", "```\nfoo", "```\nfoo"},
+		{"link without url", "[not a link] (x)", "[not a link] (x)", "[not a link] (x)"},
+		{"link with title", "[a](https://x \"title\")", "[a](https://x \"title\")", "[a](https://x \"title\")"},
+		{"unknown construct", "# Heading\n> quote\n- item", "# Heading\n> quote\n- item",
+			"# Heading\n> quote\n- item"},
+		{"triple emphasis", "***very***", "***very***", "***very***"},
+	} {
+		if actual := markdownToIRC(tc.input, true); actual != tc.irc {
+			t.Errorf("%s: expected %q with formatting, got %q", tc.name, tc.irc, actual)
+		}
+		if actual := markdownToIRC(tc.input, false); actual != tc.stripped {
+			t.Errorf("%s: expected %q stripped, got %q", tc.name, tc.stripped, actual)
+		}
+	}
+}
+
+func TestAnnotationsMarkdown(t *testing.T) {
+	data := &promtmpl.Data{
+		Status:            "firing",
+		CommonAnnotations: promtmpl.KV{"summary": "See [runbook](https://x)"},
+		Alerts: promtmpl.Alerts{
+			promtmpl.Alert{
+				Status:      "firing",
+				Labels:      promtmpl.KV{"alertname": "diskFull"},
+				Annotations: promtmpl.KV{"summary": "Disk **full**, run `df`"},
+			},
+		},
+	}
+
+	for _, tc := range []struct {
+		mode     string
+		msgOnce  bool
+		template string
+		expected string
+	}{
+		{"", false, "{{ .Annotations.summary }}", "Disk **full**, run `df`"},
+		{"", false, "{{ MarkdownToIRC .Annotations.summary }}", "Disk \x02full\x02, run df"},
+		{annotationsMarkdownIRC, false, "{{ .Annotations.summary }}", "Disk \x02full\x02, run df"},
+		{annotationsMarkdownStrip, false, "{{ .Annotations.summary }}", "Disk full, run df"},
+		{annotationsMarkdownStrip, true, "{{ .CommonAnnotations.summary }}", "See runbook <https://x>"},
+	} {
+		testingConfig := Config{
+			MsgTemplate:         tc.template,
+			MsgOnce:             tc.msgOnce,
+			AnnotationsMarkdown: tc.mode,
+		}
+		f, _ := NewFormatter(&testingConfig, NewMetrics(prometheus.NewRegistry()))
+
+		expectedAlertMsgs := []AlertMsg{AlertMsg{Channel: "#somechannel", Alert: tc.expected}}
+		alertMsgs := f.GetMsgsFromAlertMessage("#somechannel", data)
+		if !reflect.DeepEqual(expectedAlertMsgs, alertMsgs) {
+			t.Errorf("Mode '%s', template %s: expected %q, got %q",
+				tc.mode, tc.template, expectedAlertMsgs, alertMsgs)
+		}
+	}
+	if data.Alerts[0].Annotations["summary"] != "Disk **full**, run `df`" {
+		t.Errorf("Conversion modified the received alerts")
+	}
+}
@@ -0,0 +1,432 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"strings"
+	"sync"
+
+	irc "github.com/fluffle/goirc/client"
+)
+
+// Casemappings, as advertised by the server in RPL_ISUPPORT.
+const (
+	casemappingASCII         = "ascii"
+	casemappingRFC1459       = "rfc1459"
+	casemappingStrictRFC1459 = "strict-rfc1459"
+)
+
+// Channel membership prefixes in NAMES replies, and the corresponding modes.
+var memberPrefixModes = map[byte]byte{
+	'~': 'q',
+	'&': 'a',
+	'@': 'o',
+	'%': 'h',
+	'+': 'v',
+}
+
+// Channel modes taking a parameter, besides membership modes. 'l' only takes
+// one when set.
+const channelModesWithParam = "beIkfjL"
+
+// foldCase lowercases a nick or channel name following the casemapping, so
+// that names the server considers equal map to the same key.
+func foldCase(casemapping string, name string) string {
+	name = strings.ToLower(name)
+	switch casemapping {
+	case casemappingASCII:
+		return name
+	case casemappingStrictRFC1459:
+		return strings.NewReplacer("[", "{", "]", "}", "\\", "|").Replace(name)
+	default:
+		return strings.NewReplacer("[", "{", "]", "}", "\\", "|", "~", "^").Replace(name)
+	}
+}
+
+type channelMembers struct {
+	name string
+	// members maps folded nicks to their membership modes, e.g. "o".
+	members map[string]string
+	// topic is empty if the channel has none.
+	topic string
+}
+
+// ChannelMembership tracks who is in the channels we joined, with which
+// privileges, and their topics. Only channels we are in are tracked.
+type ChannelMembership struct {
+	client  *irc.Conn
+	metrics *Metrics
+	// exportMetrics enables the per-channel gauges.
+	exportMetrics bool
+
+	mu          sync.Mutex
+	casemapping string
+	channels    map[string]*channelMembers
+	// configured are the names of the channels in the config, as opposed
+	// to those joined on demand.
+	configured []string
+}
+
+func NewChannelMembership(client *irc.Conn, metrics *Metrics, exportMetrics bool) *ChannelMembership {
+	membership := &ChannelMembership{
+		client:        client,
+		metrics:       metrics,
+		exportMetrics: exportMetrics,
+		casemapping:   casemappingRFC1459,
+		channels:      make(map[string]*channelMembers),
+	}
+
+	membership.registerHandlers()
+
+	return membership
+}
+
+func (m *ChannelMembership) registerHandlers() {
+	m.client.HandleFunc(irc.JOIN,
+		func(_ *irc.Conn, line *irc.Line) {
+			m.HandleJoin(line.Nick, line.Args[0])
+		})
+
+	m.client.HandleFunc("PART",
+		func(_ *irc.Conn, line *irc.Line) {
+			m.HandlePart(line.Nick, line.Args[0])
+		})
+
+	m.client.HandleFunc(irc.KICK,
+		func(_ *irc.Conn, line *irc.Line) {
+			m.HandleKick(line.Args[1], line.Args[0])
+		})
+
+	m.client.HandleFunc("QUIT",
+		func(_ *irc.Conn, line *irc.Line) {
+			m.HandleQuit(line.Nick)
+		})
+
+	m.client.HandleFunc("NICK",
+		func(_ *irc.Conn, line *irc.Line) {
+			m.HandleNick(line.Nick, line.Args[0])
+		})
+
+	m.client.HandleFunc("MODE",
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 1 {
+				m.HandleMode(line.Args[0], line.Args[1], line.Args[2:])
+			}
+		})
+
+	m.client.HandleFunc("TOPIC",
+		func(_ *irc.Conn, line *irc.Line) {
+			m.HandleTopic(line.Args[0], line.Text())
+		})
+
+	// RPL_NOTOPIC: "<me> <channel> :No topic is set"
+	m.client.HandleFunc("331",
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 1 {
+				m.HandleTopic(line.Args[1], "")
+			}
+		})
+
+	// RPL_TOPIC: "<me> <channel> :<topic>", sent when joining.
+	m.client.HandleFunc("332",
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 2 {
+				m.HandleTopic(line.Args[1], line.Text())
+			}
+		})
+
+	// RPL_NAMREPLY: "<me> <type> <channel> :<prefixed nicks>"
+	m.client.HandleFunc("353",
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 3 {
+				m.HandleNames(line.Args[2], strings.Fields(line.Args[3]))
+			}
+		})
+}
+
+func (m *ChannelMembership) SetCasemapping(casemapping string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.casemapping = casemapping
+}
+
+// SetConfiguredChannels sets the channels of the config, e.g. on reload.
+func (m *ChannelMembership) SetConfiguredChannels(channels []IRCChannel) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.configured = nil
+	for _, channel := range channels {
+		m.configured = append(m.configured, channel.Name)
+	}
+}
+
+func (m *ChannelMembership) unsafeIsConfigured(key string) bool {
+	for _, name := range m.configured {
+		if foldCase(m.casemapping, name) == key {
+			return true
+		}
+	}
+	return false
+}
+
+func (m *ChannelMembership) unsafeIsMe(nick string) bool {
+	return foldCase(m.casemapping, nick) == foldCase(m.casemapping, m.client.Me().Nick)
+}
+
+func (m *ChannelMembership) unsafeUpdateMetrics(c *channelMembers) {
+	if !m.exportMetrics {
+		return
+	}
+	modes := c.members[foldCase(m.casemapping, m.client.Me().Nick)]
+	boolToFloat := func(b bool) float64 {
+		if b {
+			return 1
+		}
+		return 0
+	}
+	m.metrics.ircChannelMembers.WithLabelValues(c.name).Set(float64(len(c.members)))
+	m.metrics.ircChannelOperator.WithLabelValues(c.name).Set(
+		boolToFloat(strings.ContainsAny(modes, "qao")))
+	m.metrics.ircChannelVoiced.WithLabelValues(c.name).Set(
+		boolToFloat(strings.Contains(modes, "v")))
+}
+
+func (m *ChannelMembership) unsafeDropChannel(key string) {
+	c, ok := m.channels[key]
+	if !ok {
+		return
+	}
+	delete(m.channels, key)
+	if m.exportMetrics {
+		m.metrics.ircChannelMembers.DeleteLabelValues(c.name)
+		m.metrics.ircChannelOperator.DeleteLabelValues(c.name)
+		m.metrics.ircChannelVoiced.DeleteLabelValues(c.name)
+	}
+}
+
+func (m *ChannelMembership) HandleJoin(nick string, channel string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := foldCase(m.casemapping, channel)
+	c, ok := m.channels[key]
+	if !ok {
+		if !m.unsafeIsMe(nick) {
+			return
+		}
+		c = &channelMembers{name: channel, members: make(map[string]string)}
+		m.channels[key] = c
+	}
+	c.members[foldCase(m.casemapping, nick)] = ""
+	m.unsafeUpdateMetrics(c)
+}
+
+// HandlePart handles a nick leaving a channel by PART.
+func (m *ChannelMembership) HandlePart(nick string, channel string) {
+	m.handleLeave(nick, channel, true)
+}
+
+// HandleKick handles a nick kicked from a channel.
+func (m *ChannelMembership) HandleKick(nick string, channel string) {
+	m.handleLeave(nick, channel, false)
+}
+
+func (m *ChannelMembership) handleLeave(nick string, channel string, parted bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := foldCase(m.casemapping, channel)
+	c, ok := m.channels[key]
+	if !ok {
+		return
+	}
+	if m.unsafeIsMe(nick) {
+		m.unsafeDropChannel(key)
+		// A channel joined on demand and parted is left for good unless
+		// joined again. Configured channels, and those we were kicked
+		// from, keep their series, so that alerts on it fire when
+		// nothing is delivered to them.
+		if parted && !m.unsafeIsConfigured(key) {
+			m.metrics.ircLastMsgSentTimestamp.DeleteLabelValues(c.name)
+		}
+		return
+	}
+	delete(c.members, foldCase(m.casemapping, nick))
+	m.unsafeUpdateMetrics(c)
+}
+
+func (m *ChannelMembership) HandleQuit(nick string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	folded := foldCase(m.casemapping, nick)
+	for _, c := range m.channels {
+		if _, ok := c.members[folded]; ok {
+			delete(c.members, folded)
+			m.unsafeUpdateMetrics(c)
+		}
+	}
+}
+
+func (m *ChannelMembership) HandleNick(oldNick string, newNick string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	oldFolded := foldCase(m.casemapping, oldNick)
+	newFolded := foldCase(m.casemapping, newNick)
+	for _, c := range m.channels {
+		if modes, ok := c.members[oldFolded]; ok {
+			delete(c.members, oldFolded)
+			c.members[newFolded] = modes
+		}
+	}
+}
+
+func (m *ChannelMembership) HandleNames(channel string, prefixedNicks []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.channels[foldCase(m.casemapping, channel)]
+	if !ok {
+		return
+	}
+	for _, prefixedNick := range prefixedNicks {
+		modes := ""
+		// With multi-prefix, all prefixes are listed.
+		for len(prefixedNick) > 0 {
+			mode, ok := memberPrefixModes[prefixedNick[0]]
+			if !ok {
+				break
+			}
+			modes += string(mode)
+			prefixedNick = prefixedNick[1:]
+		}
+		if prefixedNick != "" {
+			c.members[foldCase(m.casemapping, prefixedNick)] = modes
+		}
+	}
+	m.unsafeUpdateMetrics(c)
+}
+
+// HandleTopic records the topic of a channel we are in, empty if unset.
+func (m *ChannelMembership) HandleTopic(channel string, topic string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.channels[foldCase(m.casemapping, channel)]
+	if !ok {
+		return
+	}
+	c.topic = topic
+}
+
+// Topic returns the topic of the channel, and whether we are in it.
+func (m *ChannelMembership) Topic(channel string) (string, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.channels[foldCase(m.casemapping, channel)]
+	if !ok {
+		return "", false
+	}
+	return c.topic, true
+}
+
+// HandleMode follows changes of membership modes, e.g. "+ov nick1 nick2".
+func (m *ChannelMembership) HandleMode(channel string, modeChanges string, params []string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	c, ok := m.channels[foldCase(m.casemapping, channel)]
+	if !ok {
+		return
+	}
+	adding := true
+	for i := 0; i < len(modeChanges); i++ {
+		mode := modeChanges[i]
+		switch {
+		case mode == '+' || mode == '-':
+			adding = mode == '+'
+		case strings.IndexByte("qaohv", mode) >= 0:
+			if len(params) == 0 {
+				return
+			}
+			nick := foldCase(m.casemapping, params[0])
+			params = params[1:]
+			modes, ok := c.members[nick]
+			if !ok {
+				continue
+			}
+			modes = strings.Replace(modes, string(mode), "", -1)
+			if adding {
+				modes += string(mode)
+			}
+			c.members[nick] = modes
+		case strings.IndexByte(channelModesWithParam, mode) >= 0 || (mode == 'l' && adding):
+			if len(params) > 0 {
+				params = params[1:]
+			}
+		}
+	}
+	m.unsafeUpdateMetrics(c)
+}
+
+// Reset forgets all channels, e.g. when the session is lost.
+func (m *ChannelMembership) Reset() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for key := range m.channels {
+		m.unsafeDropChannel(key)
+	}
+	m.casemapping = casemappingRFC1459
+}
+
+// ChannelStatus describes a channel we are in. Operator is set for channel
+// owners and admins too.
+type ChannelStatus struct {
+	Name     string `json:"name"`
+	Members  int    `json:"members"`
+	Operator bool   `json:"operator"`
+	Voiced   bool   `json:"voiced"`
+	Topic    string `json:"topic,omitempty"`
+}
+
+// ChannelStatuses returns the state of the channels we are in, sorted by name.
+// Our modes are those of nick, which the caller tracks since goirc's own view
+// of it may only be read from its handlers.
+func (m *ChannelMembership) ChannelStatuses(nick string) []ChannelStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	statuses := []ChannelStatus{}
+	me := foldCase(m.casemapping, nick)
+	for _, c := range m.channels {
+		modes := c.members[me]
+		statuses = append(statuses, ChannelStatus{
+			Name:     c.name,
+			Members:  len(c.members),
+			Operator: strings.ContainsAny(modes, "qao"),
+			Voiced:   strings.Contains(modes, "v"),
+			Topic:    c.topic,
+		})
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
@@ -0,0 +1,147 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func makeTestingMembership(exportMetrics bool) (*ChannelMembership, *Metrics) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	client := irc.Client(irc.NewConfig("foo"))
+	return NewChannelMembership(client, metrics, exportMetrics), metrics
+}
+
+func TestChannelMembership(t *testing.T) {
+	membership, metrics := makeTestingMembership(true)
+
+	membership.HandleJoin("somebody", "#notjoined")
+	membership.HandleJoin("foo", "#foo")
+	membership.HandleNames("#foo", []string{"@foo", "+bar", "@+baz", "qux"})
+	membership.HandleJoin("quux", "#FOO")
+	membership.HandleMode("#foo", "+bv-o", []string{"*!*@spam", "foo", "foo"})
+	membership.HandleMode("#foo", "+kv-o", []string{"key", "quux", "baz"})
+	membership.HandleMode("#foo", "-o", []string{"foo"})
+	membership.HandleNick("bar", "bar2")
+	membership.HandleQuit("qux")
+	membership.HandlePart("BAR2", "#foo")
+
+	expectedStatuses := []ChannelStatus{
+		ChannelStatus{Name: "#foo", Members: 3, Operator: false, Voiced: true},
+	}
+	if statuses := membership.ChannelStatuses("foo"); !reflect.DeepEqual(expectedStatuses, statuses) {
+		t.Errorf("Unexpected channel statuses.\nExpected: %+v\nActual: %+v",
+			expectedStatuses, statuses)
+	}
+
+	if v := testutil.ToFloat64(metrics.ircChannelMembers.WithLabelValues("#foo")); v != 3 {
+		t.Errorf("Expected 3 members, got %f", v)
+	}
+	if v := testutil.ToFloat64(metrics.ircChannelVoiced.WithLabelValues("#foo")); v != 1 {
+		t.Errorf("Expected to be voiced, got %f", v)
+	}
+
+	metrics.ircLastMsgSentTimestamp.WithLabelValues("#foo").SetToCurrentTime()
+	membership.HandlePart("foo", "#foo")
+	if statuses := membership.ChannelStatuses("foo"); len(statuses) != 0 {
+		t.Errorf("Expected no channel after part, got %+v", statuses)
+	}
+	if metrics.ircChannelMembers.DeleteLabelValues("#foo") {
+		t.Error("Expected membership series to be removed after part")
+	}
+	if metrics.ircLastMsgSentTimestamp.DeleteLabelValues("#foo") {
+		t.Error("Expected last message sent series to be removed after part")
+	}
+}
+
+func TestChannelMembershipKeepsConfiguredSeries(t *testing.T) {
+	membership, metrics := makeTestingMembership(false)
+	membership.SetConfiguredChannels([]IRCChannel{IRCChannel{Name: "#oncall"}})
+
+	for _, channel := range []string{"#oncall", "#dynamic"} {
+		membership.HandleJoin("foo", channel)
+		metrics.ircLastMsgSentTimestamp.WithLabelValues(channel).SetToCurrentTime()
+	}
+	membership.HandleKick("foo", "#oncall")
+	membership.HandleKick("foo", "#dynamic")
+	if count := testutil.CollectAndCount(metrics.ircLastMsgSentTimestamp); count != 2 {
+		t.Errorf("Expected the series of both channels to be kept after a kick, got %d", count)
+	}
+
+	// Only the channel joined on demand loses it once parted.
+	membership.HandleJoin("foo", "#oncall")
+	membership.HandleJoin("foo", "#dynamic")
+	membership.HandlePart("foo", "#ONCALL")
+	membership.HandlePart("foo", "#dynamic")
+	if !metrics.ircLastMsgSentTimestamp.DeleteLabelValues("#oncall") {
+		t.Error("Expected the series of the configured channel to be kept after a part")
+	}
+	if metrics.ircLastMsgSentTimestamp.DeleteLabelValues("#dynamic") {
+		t.Error("Expected the series of the dynamic channel to be removed after a part")
+	}
+}
+
+func TestChannelMembershipCasemapping(t *testing.T) {
+	membership, _ := makeTestingMembership(false)
+
+	membership.HandleJoin("foo", "#foo[1]")
+	membership.HandleNames("#FOO{1}", []string{"foo", "@Bar^"})
+	membership.HandlePart("bar~", "#foo{1}")
+	if statuses := membership.ChannelStatuses("foo"); len(statuses) != 1 || statuses[0].Members != 1 {
+		t.Errorf("Expected rfc1459 casemapping by default, got %+v", statuses)
+	}
+
+	membership.Reset()
+	membership.SetCasemapping(casemappingASCII)
+	membership.HandleJoin("foo", "#foo[1]")
+	membership.HandleJoin("bar", "#foo{1}")
+	if statuses := membership.ChannelStatuses("foo"); len(statuses) != 1 || statuses[0].Members != 1 {
+		t.Errorf("Expected ascii casemapping to keep brackets distinct, got %+v", statuses)
+	}
+}
+
+func TestChannelTopic(t *testing.T) {
+	membership, _ := makeTestingMembership(false)
+
+	membership.HandleTopic("#foo", "not joined yet")
+	membership.HandleJoin("foo", "#foo")
+	if topic, ok := membership.Topic("#foo"); !ok || topic != "" {
+		t.Errorf("Expected no topic on join, got '%s' (%t)", topic, ok)
+	}
+	membership.HandleTopic("#foo", "on call: alice")
+	membership.HandleTopic("#FOO", "on call: bob")
+	if topic, _ := membership.Topic("#foo"); topic != "on call: bob" {
+		t.Errorf("Expected topic 'on call: bob', got '%s'", topic)
+	}
+	if statuses := membership.ChannelStatuses("foo"); len(statuses) != 1 || statuses[0].Topic != "on call: bob" {
+		t.Errorf("Expected topic in status, got %+v", statuses)
+	}
+
+	membership.HandleTopic("#foo", "")
+	if topic, _ := membership.Topic("#foo"); topic != "" {
+		t.Errorf("Expected topic to be unset, got '%s'", topic)
+	}
+
+	membership.HandleTopic("#foo", "on call: carol")
+	membership.HandlePart("foo", "#foo")
+	if topic, ok := membership.Topic("#foo"); ok || topic != "" {
+		t.Errorf("Expected topic to be dropped on part, got '%s' (%t)", topic, ok)
+	}
+}
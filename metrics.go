@@ -0,0 +1,492 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+// Metrics holds all the metrics exported by the relay. They are registered on
+// a registry provided by the caller instead of the global one, so that several
+// relays can coexist in the same process (e.g. in tests).
+type Metrics struct {
+	registry *prometheus.Registry
+
+	buildInfo *prometheus.GaugeVec
+
+	// IRC connection
+	ircConnectedGauge         *prometheus.GaugeVec
+	ircReconnects             *prometheus.CounterVec
+	ircReconnectNotices       *prometheus.CounterVec
+	ircLastConnectedTimestamp *prometheus.GaugeVec
+	ircUptime                 *uptimeCollector
+	ircSentMsgs               *prometheus.CounterVec
+	ircLastMsgSentTimestamp   *prometheus.GaugeVec
+	ircSendMsgErrors          *prometheus.CounterVec
+	ircServerLag              *prometheus.GaugeVec
+	ircPingsMissed            *prometheus.CounterVec
+	ircWriteTimeouts          *prometheus.CounterVec
+	ircServerErrors           *prometheus.CounterVec
+	ircGaveUp                 *prometheus.GaugeVec
+	ircChannelGaveUp          *prometheus.GaugeVec
+	ircChannelBanned          *prometheus.GaugeVec
+	ircBanned                 *prometheus.GaugeVec
+	ircIdentifyTransitions    *prometheus.CounterVec
+	ircCTCPRequests           *prometheus.CounterVec
+	ircChannelMembers         *prometheus.GaugeVec
+	ircChannelOperator        *prometheus.GaugeVec
+	ircChannelVoiced          *prometheus.GaugeVec
+	ircChannelPresenceLost    *prometheus.CounterVec
+	ircChannelEscalated       *prometheus.GaugeVec
+	ircEscalatedMsgs          *prometheus.CounterVec
+	ircMultilineBatches       *prometheus.CounterVec
+
+	// Webhook
+	handledAlertGroups            *prometheus.CounterVec
+	handledAlerts                 *prometheus.CounterVec
+	webhookLastReceivedTimestamp  prometheus.Gauge
+	alertHandlingErrors           *prometheus.CounterVec
+	cooldownSuppressedAlerts      *prometheus.CounterVec
+	webhookDuplicateDeliveries    *prometheus.CounterVec
+	webhookEmptyPayloads          *prometheus.CounterVec
+	webhookForbiddenRequests      prometheus.Counter
+	webhookChannelsNotAllowed     prometheus.Counter
+	webhookSignatureFailures      *prometheus.CounterVec
+	webhookDisabledChannelDrops   *prometheus.CounterVec
+	webhookChannelLabelSkipped    *prometheus.CounterVec
+	flapSuppressedAlerts          *prometheus.CounterVec
+	digestedAlerts                *prometheus.CounterVec
+	quietHoursHeldAlerts          *prometheus.CounterVec
+	quietHoursDroppedAlerts       *prometheus.CounterVec
+	stormModeChanges              *prometheus.CounterVec
+	webhookRetryDuplicateAlerts   *prometheus.CounterVec
+	webhookRetryDedupEvictions    prometheus.Counter
+	stormMode                     *prometheus.GaugeVec
+	stormSummarizedAlerts         *prometheus.CounterVec
+	watchdogLastReceivedTimestamp prometheus.Gauge
+	watchdogExpired               prometheus.Gauge
+
+	// HTTP server
+	httpRequests         *prometheus.CounterVec
+	httpRequestDuration  *prometheus.HistogramVec
+	httpRequestsInFlight prometheus.Gauge
+	httpRejectedRequests *prometheus.CounterVec
+
+	// Formatting
+	formatRenderErrors *prometheus.CounterVec
+	formatSanitized    *prometheus.CounterVec
+	formatEmptyOutput  *prometheus.CounterVec
+	formatIgnored      *prometheus.CounterVec
+	formatTruncated    *prometheus.CounterVec
+	formatOmitted      *prometheus.CounterVec
+	formatRenderLimits *prometheus.CounterVec
+
+	formatTemplateLeftovers *prometheus.CounterVec
+
+	// Tracing
+	tracingSpansDropped prometheus.Counter
+
+	// State handover
+	stateErrors             *prometheus.CounterVec
+	stateLastSavedTimestamp prometheus.Gauge
+
+	// Config reloads
+	configReloadFailed prometheus.Counter
+}
+
+func NewMetrics(registry *prometheus.Registry) *Metrics {
+	factory := promauto.With(registry)
+
+	m := &Metrics{
+		registry: registry,
+
+		buildInfo: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "alertmanager_irc_relay_build_info",
+			Help: "Build information of the relay, always 1"},
+			[]string{"version", "revision", "go_version"},
+		),
+
+		ircConnectedGauge: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_connected",
+			Help: "Whether the IRC connection is established"},
+			[]string{"connection"},
+		),
+		ircReconnects: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_reconnects_total",
+			Help: "Number of times an established IRC session was lost"},
+			[]string{"connection", "reason"},
+		),
+		ircReconnectNotices: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_reconnect_notices_total",
+			Help: "Number of server NOTICEs which made us reconnect, by matched pattern"},
+			[]string{"connection", "pattern"},
+		),
+		ircLastConnectedTimestamp: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_last_connected_timestamp_seconds",
+			Help: "When the IRC session was last established"},
+			[]string{"connection"},
+		),
+		ircUptime: newUptimeCollector(),
+		ircSentMsgs: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_sent_msgs",
+			Help: "Number of IRC messages sent"},
+			[]string{"connection", "ircchannel"},
+		),
+		// Channels without any delivery since startup have no series.
+		ircLastMsgSentTimestamp: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_last_message_sent_timestamp_seconds",
+			Help: "When a message was last sent to the IRC channel"},
+			[]string{"ircchannel"},
+		),
+		ircSendMsgErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_send_msg_errors",
+			Help: "Errors while sending IRC messages"},
+			[]string{"connection", "ircchannel", "error"},
+		),
+		// Removed while disconnected, as the lag is unknown.
+		ircServerLag: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_server_lag_seconds",
+			Help: "Round-trip time of the last PING to the IRC server"},
+			[]string{"connection"},
+		),
+		ircPingsMissed: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_pings_missed_total",
+			Help: "Number of PINGs to the IRC server left unanswered"},
+			[]string{"connection"},
+		),
+		ircWriteTimeouts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_write_timeouts_total",
+			Help: "Number of writes to the IRC server given up on after irc_write_timeout"},
+			[]string{"connection"},
+		),
+		ircServerErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_server_errors_total",
+			Help: "Number of ERROR lines received from the IRC server, by class"},
+			[]string{"connection", "class"},
+		),
+		ircGaveUp: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_gave_up",
+			Help: "Whether we gave up establishing a session after too many attempts, and retry slowly"},
+			[]string{"connection"},
+		),
+		ircChannelGaveUp: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_channel_gave_up",
+			Help: "Whether we gave up joining the channel, as the server said it does not exist"},
+			[]string{"connection", "ircchannel"},
+		),
+		ircChannelBanned: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_channel_banned",
+			Help: "Whether we are banned from the channel, joining it being only probed from time to time"},
+			[]string{"connection", "ircchannel"},
+		),
+		ircBanned: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_banned",
+			Help: "Whether the server closed the link because we are banned, until a session is established again"},
+			[]string{"connection"},
+		),
+		ircIdentifyTransitions: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_nickserv_identify_transitions_total",
+			Help: "Number of times the identification to NickServ changed to the state"},
+			[]string{"connection", "state"},
+		),
+		ircCTCPRequests: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_ctcp_requests_total",
+			Help: "Number of CTCP requests received, by whether they were answered, ignored or rate limited"},
+			[]string{"connection", "result"},
+		),
+		// Only exported if enabled, for the channels we are in.
+		ircChannelMembers: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_channel_members",
+			Help: "Number of users in the IRC channel, including us"},
+			[]string{"ircchannel"},
+		),
+		ircChannelOperator: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_channel_operator",
+			Help: "Whether we are operator of the IRC channel"},
+			[]string{"ircchannel"},
+		),
+		ircChannelVoiced: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_channel_voiced",
+			Help: "Whether we are voiced in the IRC channel"},
+			[]string{"ircchannel"},
+		),
+		ircChannelPresenceLost: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_channel_presence_lost_total",
+			Help: "Number of times we were found not to be in a channel we believed joined"},
+			[]string{"connection", "ircchannel"},
+		),
+		ircChannelEscalated: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "irc_channel_escalated",
+			Help: "Whether the alerts to the IRC channel are relayed to its escalation channel, as it is undeliverable"},
+			[]string{"connection", "ircchannel"},
+		),
+		ircEscalatedMsgs: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_escalated_msgs",
+			Help: "Number of messages to the IRC channel relayed to its escalation channel instead"},
+			[]string{"connection", "ircchannel"},
+		),
+		ircMultilineBatches: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "irc_multiline_batches",
+			Help: "Number of multiline batches sent, by whether the server accepted them"},
+			[]string{"connection", "result"},
+		),
+
+		handledAlertGroups: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_handled_alert_groups",
+			Help: "Number of alert groups received"},
+			[]string{"ircchannel"},
+		),
+		handledAlerts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_handled_alerts",
+			Help: "Number of single alert messages relayed"},
+			[]string{"ircchannel"},
+		),
+		webhookLastReceivedTimestamp: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "webhook_last_received_timestamp_seconds",
+			Help: "When a webhook request was last received",
+		}),
+		alertHandlingErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_alert_handling_errors",
+			Help: "Errors while processing webhook requests"},
+			[]string{"ircchannel", "error"},
+		),
+		cooldownSuppressedAlerts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_cooldown_suppressed_alerts",
+			Help: "Number of firing alerts not relayed because of their cooldown"},
+			[]string{"ircchannel"},
+		),
+		webhookDuplicateDeliveries: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_duplicate_deliveries",
+			Help: "Number of webhooks acknowledged but not relayed as they were already delivered"},
+			[]string{"ircchannel"},
+		),
+		webhookEmptyPayloads: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_empty_payloads",
+			Help: "Number of webhooks received without any alert, e.g. health checks"},
+			[]string{"ircchannel"},
+		),
+		webhookForbiddenRequests: factory.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_forbidden_requests",
+			Help: "Number of webhooks rejected as their client is not in webhook_allowed_cidrs"},
+		),
+		webhookChannelsNotAllowed: factory.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_channels_not_allowed",
+			Help: "Number of channels named by webhooks which they may not be relayed to"},
+		),
+		webhookSignatureFailures: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_signature_failures",
+			Help: "Number of webhooks rejected as their signature is missing, invalid, too old or replayed"},
+			[]string{"reason"},
+		),
+		webhookDisabledChannelDrops: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_disabled_channel_drops",
+			Help: "Number of webhooks not relayed to their channel as it is disabled"},
+			[]string{"ircchannel"},
+		),
+		webhookChannelLabelSkipped: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_channel_label_skipped_entries",
+			Help: "Number of channels named by the channel label of alerts skipped as malformed or not allowed"},
+			[]string{"reason"},
+		),
+		flapSuppressedAlerts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_flap_suppressed_alerts",
+			Help: "Number of alert notifications not relayed because the alert is flapping"},
+			[]string{"ircchannel"},
+		),
+		digestedAlerts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_digested_alerts",
+			Help: "Number of alert notifications kept for the digest of their channel instead of being relayed"},
+			[]string{"ircchannel"},
+		),
+		quietHoursHeldAlerts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_quiet_hours_held_alerts",
+			Help: "Number of alert notifications held until the quiet hours of their channel are over"},
+			[]string{"ircchannel"},
+		),
+		quietHoursDroppedAlerts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_quiet_hours_dropped_alerts",
+			Help: "Number of alert notifications held during quiet hours then dropped, by reason"},
+			[]string{"ircchannel", "reason"},
+		),
+		webhookRetryDuplicateAlerts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_retry_duplicate_alerts",
+			Help: "Number of alerts of retried webhooks skipped as already delivered"},
+			[]string{"ircchannel"},
+		),
+		webhookRetryDedupEvictions: factory.NewCounter(prometheus.CounterOpts{
+			Name: "webhook_retry_dedup_evictions",
+			Help: "Number of alert deliveries forgotten before webhook_retry_dedup_ttl, beyond webhook_retry_dedup_max_entries"},
+		),
+		stormModeChanges: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_storm_mode_changes",
+			Help: "Number of times a channel switched to or from storm mode, by the mode switched to"},
+			[]string{"ircchannel", "mode"},
+		),
+		stormMode: factory.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "webhook_storm_mode",
+			Help: "Whether the alerts to a channel are summarized because of an alert storm"},
+			[]string{"ircchannel"},
+		),
+		stormSummarizedAlerts: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "webhook_storm_summarized_alerts",
+			Help: "Number of alert notifications kept for the storm summary of their channel instead of being relayed"},
+			[]string{"ircchannel"},
+		),
+		watchdogLastReceivedTimestamp: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "watchdog_last_received_timestamp_seconds",
+			Help: "Timestamp of the last reception of the watchdog alert"},
+		),
+		watchdogExpired: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "watchdog_expired",
+			Help: "Whether the watchdog alert was not received within its timeout"},
+		),
+
+		httpRequests: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_requests_total",
+			Help: "Number of HTTP requests served"},
+			[]string{"handler", "method", "code"},
+		),
+		httpRequestDuration: factory.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "http_request_duration_seconds",
+			Help:    "Time spent serving HTTP requests",
+			Buckets: prometheus.DefBuckets},
+			[]string{"handler"},
+		),
+		httpRequestsInFlight: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "http_requests_in_flight",
+			Help: "Number of HTTP requests currently being served",
+		}),
+		httpRejectedRequests: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "http_rejected_requests_total",
+			Help: "Number of HTTP requests rejected as malformed, by reason"},
+			[]string{"reason"},
+		),
+
+		formatRenderErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "format_render_errors_total",
+			Help: "Number of times a message template failed to execute"},
+			[]string{"template"},
+		),
+		formatSanitized: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "format_sanitized_total",
+			Help: "Number of rendered messages modified before being sent"},
+			[]string{"kind"},
+		),
+		formatEmptyOutput: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "format_empty_output_total",
+			Help: "Number of renders skipped because they produced no message"},
+			[]string{"ircchannel", "template"},
+		),
+		formatIgnored: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "format_ignored_total",
+			Help: "Number of alerts or alert groups dropped by a template route ignoring their status"},
+			[]string{"ircchannel", "status"},
+		),
+		formatTruncated: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "format_truncated_total",
+			Help: "Number of messages cut short because they had more lines than allowed"},
+			[]string{"ircchannel"},
+		),
+		formatRenderLimits: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "format_render_limits_total",
+			Help: "Number of renders aborted because they exceeded the size or time limit"},
+			[]string{"template", "limit"},
+		),
+		formatOmitted: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "format_omitted_alerts_total",
+			Help: "Number of alerts not rendered because their webhook had more alerts than allowed"},
+			[]string{"ircchannel"},
+		),
+		formatTemplateLeftovers: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "format_template_leftovers_total",
+			Help: "Number of alert fields containing unrendered template syntax"},
+			[]string{"field"},
+		),
+
+		tracingSpansDropped: factory.NewCounter(prometheus.CounterOpts{
+			Name: "tracing_spans_dropped_total",
+			Help: "Number of trace spans that could not be exported",
+		}),
+
+		stateErrors: factory.NewCounterVec(prometheus.CounterOpts{
+			Name: "state_errors_total",
+			Help: "Number of times the relay state could not be loaded or saved"},
+			[]string{"operation"},
+		),
+		stateLastSavedTimestamp: factory.NewGauge(prometheus.GaugeOpts{
+			Name: "state_last_saved_timestamp_seconds",
+			Help: "When the relay state was last saved",
+		}),
+
+		configReloadFailed: factory.NewCounter(prometheus.CounterOpts{
+			Name: "config_reload_failed_total",
+			Help: "Number of config reloads rejected, the previous config being kept",
+		}),
+	}
+	registry.MustRegister(m.ircUptime)
+
+	buildInfo := GetBuildInfo()
+	m.buildInfo.WithLabelValues(
+		buildInfo.Version, buildInfo.Revision, buildInfo.GoVersion).Set(1)
+
+	return m
+}
+
+// uptimeCollector exports for how long each IRC session has been up. The
+// value is computed at scrape time and reset on reconnection.
+type uptimeCollector struct {
+	desc *prometheus.Desc
+
+	mu             sync.Mutex
+	connectedSince map[string]time.Time
+}
+
+func newUptimeCollector() *uptimeCollector {
+	return &uptimeCollector{
+		desc: prometheus.NewDesc("irc_connection_uptime_seconds",
+			"Time since the IRC session was established",
+			[]string{"connection"}, nil),
+		connectedSince: make(map[string]time.Time),
+	}
+}
+
+func (c *uptimeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+func (c *uptimeCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for connection, since := range c.connectedSince {
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue,
+			time.Since(since).Seconds(), connection)
+	}
+}
+
+func (c *uptimeCollector) SetConnected(connection string, since time.Time) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.connectedSince[connection] = since
+}
+
+func (c *uptimeCollector) SetDisconnected(connection string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.connectedSince, connection)
+}
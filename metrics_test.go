@@ -0,0 +1,46 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestMetricsInstancesAreIndependent(t *testing.T) {
+	first := NewMetrics(prometheus.NewRegistry())
+	second := NewMetrics(prometheus.NewRegistry())
+
+	first.handledAlertGroups.WithLabelValues("#somechannel").Inc()
+
+	if v := testutil.ToFloat64(first.handledAlertGroups.WithLabelValues("#somechannel")); v != 1 {
+		t.Errorf("Expected 1 alert group on first instance, got %f", v)
+	}
+	if v := testutil.ToFloat64(second.handledAlertGroups.WithLabelValues("#somechannel")); v != 0 {
+		t.Errorf("Expected no alert group on second instance, got %f", v)
+	}
+}
+
+func TestBuildInfoMetric(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	buildInfo := GetBuildInfo()
+
+	if v := testutil.ToFloat64(metrics.buildInfo.WithLabelValues(
+		buildInfo.Version, buildInfo.Revision, buildInfo.GoVersion)); v != 1 {
+		t.Errorf("Expected build info gauge to be 1, got %f", v)
+	}
+}
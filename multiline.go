@@ -0,0 +1,369 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	multilineCap       = "draft/multiline"
+	multilineConcatTag = "draft/multiline-concat"
+
+	// Each batch is followed by a PING, which the server answers once it
+	// processed the batch. It is deemed sent if not answered within that
+	// long, rather than risking to send it twice.
+	multilineConfirmTimeout = 30 * time.Second
+
+	// How long to wait for the next line of a message being collected,
+	// before sending the lines collected one by one.
+	multilineCollectWait = time.Second
+)
+
+// Outcomes of batches, as labelled in the irc_multiline_batches metric.
+const (
+	multilineBatchSent     = "sent"
+	multilineBatchRejected = "rejected"
+)
+
+var (
+	errBatchRejected = errors.New("batch rejected")
+	// errBatchUnsuitable is returned for messages to send line by line.
+	errBatchUnsuitable = errors.New("batch unsuitable")
+)
+
+// batchLine is a line of a batch, concat if it continues the previous one,
+// which was too long to be sent at once.
+type batchLine struct {
+	text   string
+	concat bool
+}
+
+// MultilineBatcher negotiates the draft/multiline capability once the
+// session is up, and sends messages of several lines as multiline batches
+// while it is available. The server FAILing a batch makes it unavailable for
+// the rest of the session. A nil *MultilineBatcher is never available.
+type MultilineBatcher struct {
+	name    string
+	client  *irc.Conn
+	metrics *Metrics
+
+	mu sync.Mutex
+	// offered accumulates the capabilities listed over several CAP LS
+	// replies.
+	offered   []string
+	available bool
+	maxBytes  int
+	maxLines  int
+	seq       uint64
+	// token is the PING following the batch being confirmed, and
+	// confirmed receives its outcome.
+	token     string
+	confirmed chan error
+}
+
+// NewMultilineBatcher returns nil unless multiline batches are enabled.
+func NewMultilineBatcher(config *Config, client *irc.Conn, metrics *Metrics) *MultilineBatcher {
+	if !config.IRCMultiline {
+		return nil
+	}
+	batcher := &MultilineBatcher{
+		name:    config.ConnectionName,
+		client:  client,
+		metrics: metrics,
+	}
+
+	batcher.registerHandlers()
+
+	return batcher
+}
+
+func (b *MultilineBatcher) registerHandlers() {
+	// Capabilities are negotiated once registered, which servers allow
+	// as well, not to delay the registration.
+	b.client.HandleFunc(irc.CONNECTED,
+		func(conn *irc.Conn, _ *irc.Line) {
+			b.reset()
+			conn.Raw("CAP LS 302")
+		})
+
+	b.client.HandleFunc("CAP",
+		func(conn *irc.Conn, line *irc.Line) {
+			if len(line.Args) < 3 {
+				return
+			}
+			switch line.Args[1] {
+			case "LS":
+				if request := b.HandleLS(line.Args[2:]); request {
+					conn.Raw("CAP REQ :" + multilineCap)
+				}
+			case "ACK":
+				b.HandleAck(strings.Fields(line.Text()), true)
+			case "NAK":
+				b.HandleAck(strings.Fields(line.Text()), false)
+			case "DEL":
+				b.HandleAck(strings.Fields(line.Text()), false)
+			}
+		})
+
+	b.client.HandleFunc("FAIL",
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) < 2 || line.Args[0] != "BATCH" {
+				return
+			}
+			b.HandleFail(line.Args[1], line.Text())
+		})
+
+	b.client.HandleFunc(irc.PONG,
+		func(_ *irc.Conn, line *irc.Line) {
+			b.confirm(line.Text(), nil)
+		})
+}
+
+func (b *MultilineBatcher) reset() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.offered = nil
+	b.available = false
+	b.token = ""
+}
+
+// HandleLS records the capabilities listed in a CAP LS reply, args following
+// the subcommand, and tells whether to request draft/multiline once they are
+// all listed.
+func (b *MultilineBatcher) HandleLS(args []string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Replies listing more to come have a "*" before the capabilities.
+	more := len(args) > 1 && args[0] == "*"
+	b.offered = append(b.offered, strings.Fields(args[len(args)-1])...)
+	if more {
+		return false
+	}
+	offered := b.offered
+	b.offered = nil
+	for _, capability := range offered {
+		name, value := capability, ""
+		if i := strings.Index(capability, "="); i >= 0 {
+			name, value = capability[:i], capability[i+1:]
+		}
+		if name != multilineCap {
+			continue
+		}
+		b.maxBytes, b.maxLines = parseMultilineLimits(value)
+		if b.maxBytes <= 0 {
+			logging.Warn("Connection %s: server offers %s without max-bytes, not using it", b.name, multilineCap)
+			return false
+		}
+		return true
+	}
+	logging.Debug("Connection %s: server does not offer %s", b.name, multilineCap)
+	return false
+}
+
+// parseMultilineLimits parses the value of the draft/multiline capability,
+// e.g. "max-bytes=4096,max-lines=24". A missing limit is 0.
+func parseMultilineLimits(value string) (int, int) {
+	maxBytes, maxLines := 0, 0
+	for _, token := range strings.Split(value, ",") {
+		i := strings.Index(token, "=")
+		if i < 0 {
+			continue
+		}
+		limit, err := strconv.Atoi(token[i+1:])
+		if err != nil {
+			continue
+		}
+		switch token[:i] {
+		case "max-bytes":
+			maxBytes = limit
+		case "max-lines":
+			maxLines = limit
+		}
+	}
+	return maxBytes, maxLines
+}
+
+// HandleAck records whether draft/multiline was granted, or withdrawn, if it
+// is among capabilities.
+func (b *MultilineBatcher) HandleAck(capabilities []string, granted bool) {
+	for _, capability := range capabilities {
+		if strings.TrimPrefix(capability, "-") != multilineCap {
+			continue
+		}
+		granted = granted && !strings.HasPrefix(capability, "-")
+		b.mu.Lock()
+		b.available = granted
+		b.mu.Unlock()
+		if granted {
+			logging.Info("Connection %s: sending messages of several lines as multiline batches", b.name)
+		} else {
+			logging.Info("Connection %s: %s not available, sending messages line by line", b.name, multilineCap)
+		}
+		return
+	}
+}
+
+// HandleFail makes multiline batches unavailable for the session, and fails
+// the batch being confirmed, if any, as the server rejected it.
+func (b *MultilineBatcher) HandleFail(code string, text string) {
+	logging.Warn("Connection %s: multiline batch rejected (%s: %s), sending messages line by line",
+		b.name, code, text)
+	b.mu.Lock()
+	b.available = false
+	token := b.token
+	b.mu.Unlock()
+	b.confirm(token, fmt.Errorf("%w: %s", errBatchRejected, code))
+}
+
+func (b *MultilineBatcher) confirm(token string, err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if token == "" || token != b.token {
+		return
+	}
+	b.token = ""
+	b.confirmed <- err
+}
+
+// Available tells whether messages can be sent as multiline batches.
+func (b *MultilineBatcher) Available() bool {
+	if b == nil {
+		return false
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.available
+}
+
+// Batches splits the lines of a message into batches within the limits of
+// the server, the lines longer than splitLen being sent in several pieces.
+// It returns nil if a single line exceeds the limits.
+func (b *MultilineBatcher) Batches(lines []string, splitLen int) [][]batchLine {
+	b.mu.Lock()
+	maxBytes, maxLines := b.maxBytes, b.maxLines
+	b.mu.Unlock()
+
+	batches := [][]batchLine{}
+	var batch []batchLine
+	size := 0
+	for _, line := range lines {
+		pieces := splitBatchLine(line, splitLen)
+		lineSize := len(line)
+		if lineSize > maxBytes || (maxLines > 0 && len(pieces) > maxLines) {
+			return nil
+		}
+		// Lines are separated by a newline in the message.
+		if batch != nil && (size+1+lineSize > maxBytes ||
+			(maxLines > 0 && len(batch)+len(pieces) > maxLines)) {
+			batches = append(batches, batch)
+			batch, size = nil, 0
+		}
+		if batch != nil {
+			size++
+		}
+		batch = append(batch, pieces...)
+		size += lineSize
+	}
+	if batch != nil {
+		batches = append(batches, batch)
+	}
+	return batches
+}
+
+// splitBatchLine splits a line in pieces of at most splitLen bytes, cutting
+// between runes.
+func splitBatchLine(line string, splitLen int) []batchLine {
+	pieces := []batchLine{}
+	for len(line) > splitLen {
+		i := splitLen
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		if i == 0 {
+			i = splitLen
+		}
+		pieces = append(pieces, batchLine{text: line[:i], concat: len(pieces) > 0})
+		line = line[i:]
+	}
+	return append(pieces, batchLine{text: line, concat: len(pieces) > 0})
+}
+
+// Write sends a batch to target, with command PRIVMSG or NOTICE, followed by
+// the PING confirming it, and returns the token of the PING.
+func (b *MultilineBatcher) Write(target string, command string, batch []batchLine) string {
+	b.mu.Lock()
+	b.seq++
+	// The sequence number is never reset, making references and tokens
+	// unique even across reconnections.
+	ref := fmt.Sprintf("airml%d", b.seq)
+	token := fmt.Sprintf("air-batch-%d", b.seq)
+	b.token = token
+	b.confirmed = make(chan error, 1)
+	b.mu.Unlock()
+
+	b.client.Raw("BATCH +" + ref + " " + multilineCap + " " + target)
+	for _, line := range batch {
+		tags := "@batch=" + ref
+		if line.concat {
+			tags += ";" + multilineConcatTag
+		}
+		b.client.Raw(tags + " " + command + " " + target + " :" + line.text)
+	}
+	b.client.Raw("BATCH -" + ref)
+	b.client.Ping(token)
+	return token
+}
+
+// Confirm waits for the server to process the batch followed by the PING
+// token, and returns an errBatchRejected error if it rejected the batch, or
+// errSessionDown if a signal is received on sessionDown meanwhile.
+func (b *MultilineBatcher) Confirm(token string, sessionDown <-chan bool) error {
+	b.mu.Lock()
+	confirmed := b.confirmed
+	b.mu.Unlock()
+
+	timer := time.NewTimer(multilineConfirmTimeout)
+	defer timer.Stop()
+
+	var err error
+	select {
+	case err = <-confirmed:
+	case <-timer.C:
+		logging.Warn("Connection %s: multiline batch not confirmed after %s, deeming it sent",
+			b.name, multilineConfirmTimeout)
+		b.confirm(token, nil)
+	case <-sessionDown:
+		return errSessionDown
+	}
+	if err != nil {
+		b.metrics.ircMultilineBatches.WithLabelValues(b.name, multilineBatchRejected).Inc()
+	} else {
+		b.metrics.ircMultilineBatches.WithLabelValues(b.name, multilineBatchSent).Inc()
+	}
+	return err
+}
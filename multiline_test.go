@@ -0,0 +1,77 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestMultilineNegotiation(t *testing.T) {
+	batcher := &MultilineBatcher{name: "test"}
+
+	// The capabilities may be listed over several replies.
+	if batcher.HandleLS([]string{"*", "multi-prefix"}) {
+		t.Errorf("Expected to wait for the end of the list")
+	}
+	if !batcher.HandleLS([]string{"batch draft/multiline=max-bytes=4096,max-lines=24"}) {
+		t.Errorf("Expected draft/multiline to be requested")
+	}
+	if batcher.maxBytes != 4096 || batcher.maxLines != 24 {
+		t.Errorf("Expected limits of 4096 bytes and 24 lines, got %d and %d", batcher.maxBytes, batcher.maxLines)
+	}
+	if batcher.Available() {
+		t.Errorf("Expected multiline batches to wait for the ACK")
+	}
+	batcher.HandleAck([]string{"draft/multiline"}, true)
+	if !batcher.Available() {
+		t.Errorf("Expected multiline batches once acknowledged")
+	}
+	batcher.HandleAck([]string{"draft/multiline"}, false)
+	if batcher.Available() {
+		t.Errorf("Expected no multiline batches once withdrawn")
+	}
+
+	if batcher.HandleLS([]string{"draft/multiline=max-lines=24"}) {
+		t.Errorf("Expected draft/multiline without max-bytes not to be requested")
+	}
+	if batcher.HandleLS([]string{"multi-prefix"}) {
+		t.Errorf("Expected draft/multiline not offered not to be requested")
+	}
+
+	var noBatcher *MultilineBatcher
+	if noBatcher.Available() {
+		t.Errorf("Expected no multiline batches when disabled")
+	}
+}
+
+func TestMultilineBatches(t *testing.T) {
+	batcher := &MultilineBatcher{maxBytes: 20, maxLines: 3}
+
+	// Lines are split within the limits, lines longer than the split
+	// length being sent in pieces.
+	batches := batcher.Batches([]string{"first", "second", "a long line ☃", "last"}, 12)
+	expected := [][]batchLine{
+		{{"first", false}, {"second", false}},
+		{{"a long line ", false}, {"☃", true}, {"last", false}},
+	}
+	if !reflect.DeepEqual(expected, batches) {
+		t.Errorf("Expected batches %v, got %v", expected, batches)
+	}
+
+	if batches := batcher.Batches([]string{"short", "a line longer than 20 bytes"}, 100); batches != nil {
+		t.Errorf("Expected no batches with a line exceeding the limits, got %v", batches)
+	}
+}
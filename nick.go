@@ -0,0 +1,273 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	// Interval between checks of whether the desired nick is free, by
+	// ISON when the server does not support MONITOR.
+	nickReclaimInterval = time.Minute
+
+	ircRplIson            = "303"
+	ircErrNicknameInUse   = "433"
+	ircErrUnavailResource = "437"
+	ircRplMonOffline      = "731"
+)
+
+// NickReclaimer takes the desired nick back while the session is up, if we
+// had to use another one because it was taken. It MONITORs the nick if the
+// server supports it, to be told as soon as it is free, and asks with ISON
+// periodically otherwise. Channel joins are paused while taking the nick back.
+type NickReclaimer struct {
+	name       string
+	client     *irc.Conn
+	desired    func() string
+	interval   time.Duration
+	reconciler *ChannelReconciler
+
+	mu sync.Mutex
+	// current is our nick, as told by the server.
+	current string
+	// monitorSupported is set once the server advertised MONITOR, and
+	// monitoring is the nick we asked it to monitor, if any.
+	monitorSupported bool
+	monitoring       string
+	// reclaiming is set from sending NICK until the server answers it.
+	reclaiming bool
+
+	stopCtxCancel context.CancelFunc
+	stopWg        sync.WaitGroup
+}
+
+func NewNickReclaimer(name string, client *irc.Conn, desired func() string, reconciler *ChannelReconciler) *NickReclaimer {
+	reclaimer := &NickReclaimer{
+		name:       name,
+		client:     client,
+		desired:    desired,
+		interval:   nickReclaimInterval,
+		reconciler: reconciler,
+	}
+
+	reclaimer.registerHandlers()
+
+	return reclaimer
+}
+
+func (r *NickReclaimer) registerHandlers() {
+	// Foreground handlers run once goirc updated its own view of our nick,
+	// and before the next line is handled.
+	r.client.HandleFunc(irc.CONNECTED,
+		func(conn *irc.Conn, _ *irc.Line) {
+			r.setCurrent(conn.Me().Nick)
+		})
+
+	r.client.HandleFunc(irc.NICK,
+		func(_ *irc.Conn, line *irc.Line) {
+			r.HandleNick(line.Nick, line.Args[0])
+		})
+
+	r.client.HandleFunc("005",
+		func(_ *irc.Conn, line *irc.Line) {
+			for _, token := range line.Args {
+				if token == "MONITOR" || strings.HasPrefix(token, "MONITOR=") {
+					r.mu.Lock()
+					r.monitorSupported = true
+					r.mu.Unlock()
+				}
+			}
+		})
+
+	// The server refused the nick after all.
+	for _, code := range []string{ircErrNicknameInUse, ircErrUnavailResource} {
+		r.client.HandleFunc(code,
+			func(_ *irc.Conn, _ *irc.Line) {
+				r.mu.Lock()
+				defer r.mu.Unlock()
+				r.unsafeReclaimDone()
+			})
+	}
+
+	r.client.HandleFunc(ircRplMonOffline,
+		func(_ *irc.Conn, line *irc.Line) {
+			r.HandleOffline(strings.Split(line.Text(), ","))
+		})
+
+	r.client.HandleFunc(ircRplIson,
+		func(_ *irc.Conn, line *irc.Line) {
+			r.HandleIson(strings.Fields(line.Text()))
+		})
+}
+
+func (r *NickReclaimer) setCurrent(nick string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = nick
+}
+
+// Current returns our nick, empty while not connected.
+func (r *NickReclaimer) Current() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.current
+}
+
+// HandleNick follows our nick changes, and stops monitoring the desired nick
+// once we have it.
+func (r *NickReclaimer) HandleNick(oldNick string, newNick string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if oldNick != r.current {
+		return
+	}
+	r.current = newNick
+	r.unsafeReclaimDone()
+	if newNick == r.desired() {
+		logging.Info("Connection %s: got back nick '%s'", r.name, newNick)
+		r.unsafeStopMonitoring()
+	}
+}
+
+// HandleOffline reclaims the desired nick if it is among the monitored nicks
+// which went offline.
+func (r *NickReclaimer) HandleOffline(nicks []string) {
+	desired := r.desired()
+	for _, nick := range nicks {
+		if strings.EqualFold(nick, desired) {
+			r.reclaim(desired)
+			return
+		}
+	}
+}
+
+// HandleIson reclaims the desired nick if it is not among the online nicks.
+func (r *NickReclaimer) HandleIson(online []string) {
+	desired := r.desired()
+	for _, nick := range online {
+		if strings.EqualFold(nick, desired) {
+			return
+		}
+	}
+	r.reclaim(desired)
+}
+
+func (r *NickReclaimer) reclaim(desired string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.current == "" || r.current == desired {
+		return
+	}
+	logging.Info("Connection %s: nick '%s' is free, taking it back from '%s'",
+		r.name, desired, r.current)
+	r.reclaiming = true
+	r.reconciler.Pause()
+	r.client.Nick(desired)
+}
+
+func (r *NickReclaimer) unsafeReclaimDone() {
+	if !r.reclaiming {
+		return
+	}
+	r.reclaiming = false
+	r.reconciler.Resume()
+}
+
+func (r *NickReclaimer) unsafeStopMonitoring() {
+	if r.monitoring == "" {
+		return
+	}
+	r.client.Raw("MONITOR - " + r.monitoring)
+	r.monitoring = ""
+}
+
+// check asks the server whether the desired nick is free, if we do not have
+// it, or starts monitoring it.
+func (r *NickReclaimer) check() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	// The server did not answer the last NICK in time.
+	r.unsafeReclaimDone()
+
+	desired := r.desired()
+	if r.current == "" || r.current == desired {
+		r.unsafeStopMonitoring()
+		return
+	}
+	if !r.monitorSupported {
+		r.client.Raw("ISON " + desired)
+		return
+	}
+	if r.monitoring != desired {
+		r.unsafeStopMonitoring()
+		logging.Info("Connection %s: using nick '%s', monitoring '%s' to take it back",
+			r.name, r.current, desired)
+		r.client.Raw("MONITOR + " + desired)
+		r.monitoring = desired
+	}
+}
+
+func (r *NickReclaimer) run(ctx context.Context) {
+	defer r.stopWg.Done()
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			r.check()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *NickReclaimer) Start(ctx context.Context) {
+	r.Stop()
+
+	var stopCtx context.Context
+	stopCtx, r.stopCtxCancel = context.WithCancel(ctx)
+	r.stopWg.Add(1)
+	go r.run(stopCtx)
+}
+
+// Stop ends the reclaiming, the server forgets what we monitored along with
+// the session.
+func (r *NickReclaimer) Stop() {
+	if r.stopCtxCancel == nil {
+		return
+	}
+	r.stopCtxCancel()
+	r.stopWg.Wait()
+	r.stopCtxCancel = nil
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.current = ""
+	r.monitorSupported = false
+	r.monitoring = ""
+	r.unsafeReclaimDone()
+}
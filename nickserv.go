@@ -0,0 +1,252 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	identifyStatePending    = "pending"
+	identifyStateIdentified = "identified"
+	identifyStateFailed     = "failed"
+
+	ircErrNoSuchNick   = "401"
+	ircErrServicesDown = "440"
+	ircRplLoggedIn     = "900"
+)
+
+// NickservIdentifier tracks whether we are identified to NickServ, and sends
+// IDENTIFY again while we are not, e.g. because services were down when we
+// connected. Channel joins are paused while identifying again, and once
+// identified, channels which require it are joined right away.
+type NickservIdentifier struct {
+	name         string
+	client       *irc.Conn
+	nickservName string
+	password     string
+	metrics      *Metrics
+	reconciler   *ChannelReconciler
+
+	// timeout is how long we wait for NickServ to ask us to identify, or
+	// to confirm it, and retryInterval how long before identifying again.
+	timeout       time.Duration
+	retryInterval time.Duration
+
+	mu    sync.Mutex
+	state string
+	// stateSignal wakes run up on state changes.
+	stateSignal chan struct{}
+
+	stopCtxCancel context.CancelFunc
+	stopWg        sync.WaitGroup
+}
+
+func NewNickservIdentifier(config *Config, client *irc.Conn, metrics *Metrics, reconciler *ChannelReconciler) *NickservIdentifier {
+	identifier := &NickservIdentifier{
+		name:          config.ConnectionName,
+		client:        client,
+		nickservName:  config.NickservName,
+		password:      config.IRCNickPass,
+		metrics:       metrics,
+		reconciler:    reconciler,
+		timeout:       config.NickservIdentifyTimeout,
+		retryInterval: config.NickservRetryInterval,
+		stateSignal:   make(chan struct{}, 1),
+	}
+
+	identifier.registerHandlers()
+
+	return identifier
+}
+
+func (i *NickservIdentifier) registerHandlers() {
+	i.client.HandleFunc(ircRplLoggedIn,
+		func(_ *irc.Conn, line *irc.Line) {
+			i.SetIdentified()
+		})
+
+	i.client.HandleFunc(ircErrServicesDown,
+		func(_ *irc.Conn, line *irc.Line) {
+			i.SetFailed(line.Text())
+		})
+
+	i.client.HandleFunc(ircErrNoSuchNick,
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 1 && strings.EqualFold(line.Args[1], i.nickservName) {
+				i.SetFailed(line.Text())
+			}
+		})
+
+	// Servers tell so when we message services while they are gone.
+	i.client.HandleFunc(irc.NOTICE,
+		func(_ *irc.Conn, line *irc.Line) {
+			if strings.Contains(strings.ToLower(line.Text()), "services are currently down") {
+				i.SetFailed(line.Text())
+			}
+		})
+}
+
+// State returns the identification state, empty until we try to identify.
+func (i *NickservIdentifier) State() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.state
+}
+
+func (i *NickservIdentifier) unsafeSetState(state string) {
+	if state == i.state {
+		return
+	}
+	i.state = state
+	i.metrics.ircIdentifyTransitions.WithLabelValues(i.name, state).Inc()
+	select {
+	case i.stateSignal <- struct{}{}:
+	default:
+	}
+}
+
+// Identify sends IDENTIFY to NickServ and waits for its confirmation.
+func (i *NickservIdentifier) Identify() {
+	if i.password == "" {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	i.client.Privmsgf(i.nickservName, "IDENTIFY %s", i.password)
+	i.unsafeSetState(identifyStatePending)
+}
+
+// SetIdentified records NickServ's confirmation.
+func (i *NickservIdentifier) SetIdentified() {
+	i.mu.Lock()
+	if i.state == identifyStateIdentified {
+		i.mu.Unlock()
+		return
+	}
+	logging.Info("Connection %s: identified to %s", i.name, i.nickservName)
+	i.unsafeSetState(identifyStateIdentified)
+	i.mu.Unlock()
+
+	i.reconciler.Resume()
+	i.reconciler.RetryJoins()
+}
+
+// SetFailed records that identifying did not work, if we were trying to.
+func (i *NickservIdentifier) SetFailed(reason string) {
+	if i.password == "" {
+		return
+	}
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	if i.state == identifyStateIdentified || i.state == identifyStateFailed {
+		return
+	}
+	logging.Warn("Connection %s: could not identify to %s: %s", i.name, i.nickservName, reason)
+	i.unsafeSetState(identifyStateFailed)
+	i.reconciler.Resume()
+}
+
+// wait waits for d, or a state change.
+func (i *NickservIdentifier) wait(ctx context.Context, d time.Duration) (expired bool) {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return true
+	case <-i.stateSignal:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (i *NickservIdentifier) run(ctx context.Context) {
+	defer i.stopWg.Done()
+
+	for ctx.Err() == nil {
+		switch i.State() {
+		case identifyStateIdentified:
+			select {
+			case <-i.stateSignal:
+			case <-ctx.Done():
+			}
+		case "":
+			// NickServ did not ask us to identify, it may be gone.
+			if i.wait(ctx, i.timeout) && i.State() == "" {
+				logging.Warn("Connection %s: %s did not ask to identify after %s, identifying anyway",
+					i.name, i.nickservName, i.timeout)
+				i.reconciler.Pause()
+				i.Identify()
+			}
+		case identifyStatePending:
+			if i.wait(ctx, i.timeout) {
+				i.SetFailed("no confirmation after " + i.timeout.String())
+			}
+		case identifyStateFailed:
+			if i.wait(ctx, i.retryInterval) && i.State() == identifyStateFailed {
+				logging.Info("Connection %s: identifying to %s again", i.name, i.nickservName)
+				i.reconciler.Pause()
+				i.Identify()
+			}
+		}
+	}
+}
+
+// Start watches over identification for the session, if identifying and
+// retrying are enabled. We may already have been asked to identify.
+func (i *NickservIdentifier) Start(ctx context.Context) {
+	i.stopRun()
+
+	if i.password == "" || i.timeout <= 0 || i.retryInterval <= 0 {
+		return
+	}
+
+	var stopCtx context.Context
+	stopCtx, i.stopCtxCancel = context.WithCancel(ctx)
+	i.stopWg.Add(1)
+	go i.run(stopCtx)
+}
+
+func (i *NickservIdentifier) stopRun() {
+	if i.stopCtxCancel == nil {
+		return
+	}
+	i.stopCtxCancel()
+	i.stopWg.Wait()
+	i.stopCtxCancel = nil
+}
+
+// Stop ends the watch, and forgets we identified along with the session.
+func (i *NickservIdentifier) Stop() {
+	i.stopRun()
+	i.reconciler.Resume()
+
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.state = ""
+	select {
+	case <-i.stateSignal:
+	default:
+	}
+}
@@ -0,0 +1,164 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	// Consecutive unanswered PINGs after which the session is deemed dead.
+	ircMaxMissedPings = 2
+)
+
+// PingMonitor periodically PINGs the server while the session is up, to
+// measure the lag and detect dead connections that the socket itself would
+// not report.
+type PingMonitor struct {
+	name      string
+	client    *irc.Conn
+	interval  time.Duration
+	metrics   *Metrics
+	onTimeout func()
+
+	mu           sync.Mutex
+	seq          uint64
+	pendingToken string
+	pendingSince time.Time
+	missed       int
+
+	stopCtxCancel context.CancelFunc
+	stopWg        sync.WaitGroup
+}
+
+func NewPingMonitor(name string, client *irc.Conn, interval time.Duration, metrics *Metrics, onTimeout func()) *PingMonitor {
+	monitor := &PingMonitor{
+		name:      name,
+		client:    client,
+		interval:  interval,
+		metrics:   metrics,
+		onTimeout: onTimeout,
+	}
+
+	monitor.registerHandlers()
+
+	return monitor
+}
+
+func (m *PingMonitor) registerHandlers() {
+	m.client.HandleFunc(irc.PONG,
+		func(_ *irc.Conn, line *irc.Line) {
+			m.HandlePong(line.Text())
+		})
+}
+
+// HandlePong records the lag if token answers the last PING sent. Answers
+// to older PINGs arrive late by definition and would give a bogus value.
+func (m *PingMonitor) HandlePong(token string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.pendingToken == "" || token != m.pendingToken {
+		logging.Debug("Connection %s: ignoring PONG with unexpected token '%s'", m.name, token)
+		return
+	}
+	lag := time.Since(m.pendingSince)
+	m.pendingToken = ""
+	m.missed = 0
+	m.metrics.ircServerLag.WithLabelValues(m.name).Set(lag.Seconds())
+}
+
+// ping sends a new PING, or reports a timeout and returns false if too many
+// were left unanswered.
+func (m *PingMonitor) ping() bool {
+	m.mu.Lock()
+	if m.pendingToken != "" {
+		m.missed++
+		logging.Warn("Connection %s: no PONG received for PING '%s' (%d missed)",
+			m.name, m.pendingToken, m.missed)
+		m.metrics.ircPingsMissed.WithLabelValues(m.name).Inc()
+	}
+	if m.missed >= ircMaxMissedPings {
+		m.mu.Unlock()
+		logging.Error("Connection %s: server not answering PINGs, closing session", m.name)
+		// Closing the connection dispatches DISCONNECTED, which waits for
+		// the notifier, which in turn stops us.
+		m.stopWg.Add(1)
+		go func() {
+			defer m.stopWg.Done()
+			m.onTimeout()
+		}()
+		return false
+	}
+	m.seq++
+	// The sequence number is never reset, making tokens unique even
+	// across reconnections.
+	token := fmt.Sprintf("air-%d", m.seq)
+	m.pendingToken = token
+	m.pendingSince = time.Now()
+	m.mu.Unlock()
+
+	m.client.Ping(token)
+	return true
+}
+
+func (m *PingMonitor) run(ctx context.Context) {
+	defer m.stopWg.Done()
+
+	ticker := time.NewTicker(m.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if !m.ping() {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *PingMonitor) Start(ctx context.Context) {
+	m.Stop()
+
+	var stopCtx context.Context
+	stopCtx, m.stopCtxCancel = context.WithCancel(ctx)
+	m.stopWg.Add(1)
+	go m.run(stopCtx)
+}
+
+// Stop ends the monitoring, the lag is unknown until the next Start.
+func (m *PingMonitor) Stop() {
+	if m.stopCtxCancel == nil {
+		return
+	}
+	m.stopCtxCancel()
+	m.stopWg.Wait()
+	m.stopCtxCancel = nil
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.pendingToken = ""
+	m.missed = 0
+	m.metrics.ircServerLag.DeleteLabelValues(m.name)
+}
@@ -0,0 +1,222 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	// RPL_ENDOFNAMES: "<me> <channel> :End of /NAMES list."
+	ircRplEndOfNames = "366"
+
+	// How long to wait for the NAMES of a channel.
+	presenceProbeTimeout = 30 * time.Second
+)
+
+type presenceProbe struct {
+	present bool
+	done    chan struct{}
+}
+
+// PresenceChecker periodically checks, with NAMES, that we are still in the
+// channels we believe joined. Some servers remove clients from channels
+// without telling them, alerts sent there are then lost.
+type PresenceChecker struct {
+	name       string
+	client     *irc.Conn
+	reconciler *ChannelReconciler
+	interval   time.Duration
+	// spacing is the time between two NAMES, so that checking many
+	// channels does not flood the server.
+	spacing time.Duration
+	metrics *Metrics
+
+	mu sync.Mutex
+	// probes are the NAMES in flight, by folded channel name.
+	probes map[string]*presenceProbe
+
+	stopCtxCancel context.CancelFunc
+	stopWg        sync.WaitGroup
+}
+
+func NewPresenceChecker(name string, client *irc.Conn, reconciler *ChannelReconciler, interval time.Duration, spacing time.Duration, metrics *Metrics) *PresenceChecker {
+	checker := &PresenceChecker{
+		name:       name,
+		client:     client,
+		reconciler: reconciler,
+		interval:   interval,
+		spacing:    spacing,
+		metrics:    metrics,
+		probes:     make(map[string]*presenceProbe),
+	}
+
+	checker.registerHandlers()
+
+	return checker
+}
+
+func (p *PresenceChecker) registerHandlers() {
+	// RPL_NAMREPLY: "<me> <type> <channel> :<prefixed nicks>"
+	p.client.HandleFunc("353",
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 3 {
+				p.HandleNames(line.Args[0], line.Args[2], strings.Fields(line.Args[3]))
+			}
+		})
+
+	p.client.HandleFunc(ircRplEndOfNames,
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 1 {
+				p.HandleEndOfNames(line.Args[1])
+			}
+		})
+}
+
+// HandleNames notes whether me, our current nick, is among the nicks listed
+// in a channel being checked.
+func (p *PresenceChecker) HandleNames(me string, channel string, prefixedNicks []string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	probe, ok := p.probes[foldCase(casemappingRFC1459, channel)]
+	if !ok {
+		return
+	}
+	me = foldCase(casemappingRFC1459, me)
+	for _, nick := range prefixedNicks {
+		// With multi-prefix, all prefixes are listed.
+		for len(nick) > 0 {
+			if _, ok := memberPrefixModes[nick[0]]; !ok {
+				break
+			}
+			nick = nick[1:]
+		}
+		if foldCase(casemappingRFC1459, nick) == me {
+			probe.present = true
+		}
+	}
+}
+
+func (p *PresenceChecker) HandleEndOfNames(channel string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	key := foldCase(casemappingRFC1459, channel)
+	if probe, ok := p.probes[key]; ok {
+		close(probe.done)
+		delete(p.probes, key)
+	}
+}
+
+// probe asks for the NAMES of the channel, and tells whether we are in it.
+// ok is false if the server did not answer in time.
+func (p *PresenceChecker) probe(ctx context.Context, channel string) (present bool, ok bool) {
+	key := foldCase(casemappingRFC1459, channel)
+	probe := &presenceProbe{done: make(chan struct{})}
+	p.mu.Lock()
+	p.probes[key] = probe
+	p.mu.Unlock()
+
+	defer func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.probes[key] == probe {
+			delete(p.probes, key)
+		}
+	}()
+
+	p.client.Raw("NAMES " + channel)
+
+	timer := time.NewTimer(presenceProbeTimeout)
+	defer timer.Stop()
+	select {
+	case <-probe.done:
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		return probe.present, true
+	case <-timer.C:
+		logging.Warn("Connection %s: no NAMES received for %s, not checking it", p.name, channel)
+		return false, false
+	case <-ctx.Done():
+		return false, false
+	}
+}
+
+// check probes the channels we believe joined, one every spacing.
+func (p *PresenceChecker) check(ctx context.Context) {
+	for i, channel := range p.reconciler.JoinedChannels() {
+		if i > 0 {
+			select {
+			case <-time.After(p.spacing):
+			case <-ctx.Done():
+				return
+			}
+		}
+		present, ok := p.probe(ctx, channel)
+		if !ok || present {
+			continue
+		}
+		if p.reconciler.HandleNotPresent(channel) {
+			logging.Warn("Connection %s: not in channel %s although it was joined, joining it again",
+				p.name, channel)
+			p.metrics.ircChannelPresenceLost.WithLabelValues(p.name, channel).Inc()
+		}
+	}
+}
+
+func (p *PresenceChecker) run(ctx context.Context) {
+	defer p.stopWg.Done()
+
+	ticker := time.NewTicker(p.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			p.check(ctx)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Start checks the channels every interval, unless it is 0.
+func (p *PresenceChecker) Start(ctx context.Context) {
+	p.Stop()
+
+	if p.interval <= 0 {
+		return
+	}
+	var stopCtx context.Context
+	stopCtx, p.stopCtxCancel = context.WithCancel(ctx)
+	p.stopWg.Add(1)
+	go p.run(stopCtx)
+}
+
+func (p *PresenceChecker) Stop() {
+	if p.stopCtxCancel == nil {
+		return
+	}
+	p.stopCtxCancel()
+	p.stopWg.Wait()
+	p.stopCtxCancel = nil
+}
@@ -0,0 +1,119 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	irc "github.com/fluffle/goirc/client"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestPresenceCheck(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "main"
+	config.IRCChannels = []IRCChannel{
+		IRCChannel{Name: "#foo"},
+		IRCChannel{Name: "#bar"},
+	}
+	reconciler, sessionUp, sessionDown, _ := makeTestReconciler(config)
+	spacing := 50 * time.Millisecond
+	checker := NewPresenceChecker(config.ConnectionName, reconciler.client, reconciler,
+		time.Hour, spacing, reconciler.metrics)
+
+	joins := make(chan string, 10)
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joins <- line.Args[0]
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	// The server silently dropped us from #bar.
+	var namesTimes []time.Time
+	namesHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		namesTimes = append(namesTimes, time.Now())
+		members := "@foo someone"
+		if line.Args[0] == "#bar" {
+			members = "someone"
+		}
+		r := fmt.Sprintf(":example.com 353 foo = %s :%s\n:example.com 366 foo %s :End of /NAMES list.\n",
+			line.Args[0], members, line.Args[0])
+		_, err := conn.WriteString(r)
+		return err
+	}
+	server.SetHandler("NAMES", namesHandler)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	<-joins
+	<-joins
+	for i := 0; len(reconciler.JoinedChannels()) < 2; i++ {
+		if i == 100 {
+			t.Fatalf("Channels not joined: %q", reconciler.JoinedChannels())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	checker.check(context.Background())
+
+	// #bar is joined again.
+	select {
+	case channel := <-joins:
+		if channel != "#bar" {
+			t.Errorf("Expected #bar to be joined again, got %s", channel)
+		}
+	case <-time.After(time.Second):
+		t.Errorf("Expected #bar to be joined again")
+	}
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+
+	expectedCommands := []string{"NAMES #bar", "NAMES #foo"}
+	var namesCommands []string
+	for _, command := range server.Log {
+		if strings.HasPrefix(command, "NAMES ") {
+			namesCommands = append(namesCommands, command)
+		}
+	}
+	if !reflect.DeepEqual(expectedCommands, namesCommands) {
+		t.Errorf("Expected %q, got %q", expectedCommands, namesCommands)
+	}
+	// Allow for some scheduling slack on the server side.
+	if len(namesTimes) == 2 && namesTimes[1].Sub(namesTimes[0]) < spacing/2 {
+		t.Errorf("NAMES only %s apart", namesTimes[1].Sub(namesTimes[0]))
+	}
+
+	lost := reconciler.metrics.ircChannelPresenceLost
+	if v := testutil.ToFloat64(lost.WithLabelValues("main", "#bar")); v != 1 {
+		t.Errorf("Expected presence in #bar lost once, got %f", v)
+	}
+	if v := testutil.ToFloat64(lost.WithLabelValues("main", "#foo")); v != 0 {
+		t.Errorf("Expected presence in #foo not lost, got %f", v)
+	}
+}
@@ -0,0 +1,202 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	// Upstreams must send the PROXY protocol header within that time.
+	proxyProtocolTimeout = 5 * time.Second
+
+	// A v1 header is at most that long, CRLF included.
+	proxyProtocolV1MaxLength = 107
+)
+
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// readProxyHeader reads a PROXY protocol v1 or v2 header, and returns the
+// address of the client it tells, or nil if the upstream connected on its
+// own behalf (e.g. health checks) or did not tell.
+func readProxyHeader(reader *bufio.Reader) (net.Addr, error) {
+	signature, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err == nil && bytes.Equal(signature, proxyProtocolV2Signature) {
+		return readProxyHeaderV2(reader)
+	}
+	prefix, err := reader.Peek(6)
+	if err != nil {
+		return nil, err
+	}
+	if string(prefix) != "PROXY " {
+		return nil, errors.New("no PROXY protocol header")
+	}
+	return readProxyHeaderV1(reader)
+}
+
+// readProxyHeaderV1 reads e.g. "PROXY TCP4 192.0.2.1 198.51.100.1 56324 443\r\n".
+func readProxyHeaderV1(reader *bufio.Reader) (net.Addr, error) {
+	line := []byte{}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyProtocolV1MaxLength {
+			return nil, errors.New("PROXY protocol v1 header too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		line = append(line, b)
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.ParseUint(fields[4], 10, 16)
+	if ip == nil || err != nil || (fields[1] == "TCP4") != (ip.To4() != nil) {
+		return nil, fmt.Errorf("invalid PROXY protocol v1 header %q", line)
+	}
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+func readProxyHeaderV2(reader *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, err
+	}
+	if versionCommand>>4 != 2 {
+		return nil, fmt.Errorf("unsupported PROXY protocol version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0xf {
+	case 0:
+		// LOCAL
+		return nil, nil
+	case 1:
+		// PROXY
+	default:
+		return nil, fmt.Errorf("unsupported PROXY protocol command %d", versionCommand&0xf)
+	}
+	var ipLength int
+	switch family {
+	case 0x11:
+		// TCP over IPv4
+		ipLength = net.IPv4len
+	case 0x21:
+		// TCP over IPv6
+		ipLength = net.IPv6len
+	default:
+		return nil, nil
+	}
+	if len(payload) < 2*ipLength+4 {
+		return nil, errors.New("PROXY protocol v2 addresses too short")
+	}
+	ip := net.IP(payload[:ipLength])
+	port := binary.BigEndian.Uint16(payload[2*ipLength:])
+	return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+}
+
+// proxyProtocolConn is a connection from an upstream, which starts with a
+// PROXY protocol header telling the actual client. The header is read upon
+// first use, by the goroutine serving the connection.
+type proxyProtocolConn struct {
+	net.Conn
+	reader *bufio.Reader
+
+	once       sync.Once
+	remoteAddr net.Addr
+	err        error
+}
+
+func (c *proxyProtocolConn) readHeader() {
+	c.once.Do(func() {
+		c.remoteAddr = c.Conn.RemoteAddr()
+		c.Conn.SetReadDeadline(time.Now().Add(proxyProtocolTimeout))
+		defer c.Conn.SetReadDeadline(time.Time{})
+
+		addr, err := readProxyHeader(c.reader)
+		if err != nil {
+			logging.Warn("Could not read PROXY protocol header from %s: %s", c.remoteAddr, err)
+			c.err = err
+			return
+		}
+		if addr != nil {
+			c.remoteAddr = addr
+		}
+	})
+}
+
+func (c *proxyProtocolConn) Read(b []byte) (int, error) {
+	c.readHeader()
+	if c.err != nil {
+		return 0, c.err
+	}
+	return c.reader.Read(b)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	c.readHeader()
+	return c.remoteAddr
+}
+
+// proxyProtocolListener expects the PROXY protocol from upstreams, and only
+// from them, so that clients cannot pretend to be someone else.
+type proxyProtocolListener struct {
+	net.Listener
+	upstreams []*net.IPNet
+}
+
+func (l *proxyProtocolListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && containsIP(l.upstreams, addr.IP) {
+		return &proxyProtocolConn{Conn: conn, reader: bufio.NewReader(conn)}, nil
+	}
+	return conn, nil
+}
+
+// ProxyProtocolListener returns an HTTPListener expecting the PROXY protocol
+// from the upstreams, e.g. load balancers.
+func ProxyProtocolListener(upstreams []*net.IPNet) HTTPListener {
+	return func(addr string, handler http.Handler) error {
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return err
+		}
+		return http.Serve(&proxyProtocolListener{Listener: listener, upstreams: upstreams}, handler)
+	}
+}
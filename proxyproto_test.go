@@ -0,0 +1,111 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func proxyHeaderV2(command byte, family byte, addresses []byte) []byte {
+	header := append([]byte{}, proxyProtocolV2Signature...)
+	header = append(header, 0x20|command, family, byte(len(addresses)>>8), byte(len(addresses)))
+	return append(header, addresses...)
+}
+
+func TestReadProxyHeader(t *testing.T) {
+	tcp4 := []byte{192, 0, 2, 10, 198, 51, 100, 1, 0xdc, 0x04, 0x01, 0xbb}
+	tcp6 := append(append(net.ParseIP("2001:db8::1").To16(), net.ParseIP("2001:db8::2").To16()...), 0xdc, 0x04, 0x01, 0xbb)
+
+	for _, tc := range []struct {
+		name     string
+		header   []byte
+		expected string
+		err      bool
+	}{
+		{"v1 tcp4", []byte("PROXY TCP4 192.0.2.10 198.51.100.1 56324 443\r\n"), "192.0.2.10:56324", false},
+		{"v1 tcp6", []byte("PROXY TCP6 2001:db8::1 2001:db8::2 56324 443\r\n"), "[2001:db8::1]:56324", false},
+		{"v1 unknown", []byte("PROXY UNKNOWN\r\n"), "", false},
+		{"v1 mismatched family", []byte("PROXY TCP4 2001:db8::1 2001:db8::2 56324 443\r\n"), "", true},
+		{"v1 garbage", []byte("PROXY TCP4 junk\r\n"), "", true},
+		{"v1 too long", []byte("PROXY " + strings.Repeat("x", 200) + "\r\n"), "", true},
+		{"v2 tcp4", proxyHeaderV2(1, 0x11, tcp4), "192.0.2.10:56324", false},
+		{"v2 tcp6", proxyHeaderV2(1, 0x21, tcp6), "[2001:db8::1]:56324", false},
+		{"v2 local", proxyHeaderV2(0, 0x00, nil), "", false},
+		{"v2 short addresses", proxyHeaderV2(1, 0x11, tcp4[:6]), "", true},
+		{"no header", []byte("POST /somechannel HTTP/1.1\r\n"), "", true},
+	} {
+		reader := bufio.NewReader(bytes.NewReader(append(tc.header, []byte("rest")...)))
+		addr, err := readProxyHeader(reader)
+		if tc.err {
+			if err == nil {
+				t.Errorf("%s: expected an error, got %s", tc.name, addr)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tc.name, err)
+			continue
+		}
+		if (tc.expected == "" && addr != nil) || (tc.expected != "" && (addr == nil || addr.String() != tc.expected)) {
+			t.Errorf("%s: expected client %q, got %v", tc.name, tc.expected, addr)
+		}
+		if rest, _ := ioutil.ReadAll(reader); string(rest) != "rest" {
+			t.Errorf("%s: header not consumed exactly, %q left", tc.name, rest)
+		}
+	}
+}
+
+func TestProxyProtocolListener(t *testing.T) {
+	for _, tc := range []struct {
+		name      string
+		upstreams []string
+		preamble  string
+		expected  string
+	}{
+		{"upstream", []string{"127.0.0.1"}, "PROXY TCP4 192.0.2.10 127.0.0.1 56324 8000\r\n", "192.0.2.10"},
+		// Others are not trusted to send the header.
+		{"not upstream", []string{"192.0.2.1"}, "", "127.0.0.1"},
+	} {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("Could not listen: %s", err)
+		}
+		upstreams, _ := parseCIDRs(tc.upstreams)
+		clients := make(chan string, 1)
+		server := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			host, _, _ := net.SplitHostPort(r.RemoteAddr)
+			clients <- host
+		})}
+		go server.Serve(&proxyProtocolListener{Listener: listener, upstreams: upstreams})
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		if err != nil {
+			t.Fatalf("Could not connect: %s", err)
+		}
+		fmt.Fprintf(conn, "%sGET /status HTTP/1.1\r\nHost: test\r\n\r\n", tc.preamble)
+		if client := <-clients; client != tc.expected {
+			t.Errorf("%s: expected client %s, got %s", tc.name, tc.expected, client)
+		}
+		conn.Close()
+		server.Close()
+	}
+}
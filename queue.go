@@ -0,0 +1,204 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+const (
+	// /queue lists that many messages per channel by default, and at most
+	// maxQueueEntries.
+	defaultQueueEntries = 10
+	maxQueueEntries     = 100
+
+	// Messages listed are cut to that many bytes.
+	queueTextMaxBytes = 200
+)
+
+type pendingMessage struct {
+	id           uint64
+	text         string
+	fingerprints []string
+	enqueued     time.Time
+}
+
+// PendingMessages tracks the messages relayed from webhooks which are not
+// sent yet, for /queue. The queues themselves are Go channels and slices
+// owned by the sender loops, which cannot be looked into: the messages are
+// tracked apart, from the time they are queued until they are sent or
+// dropped, so that listing them only holds a lock for as long as copying
+// them takes.
+type PendingMessages struct {
+	timeTeller TimeTeller
+
+	mu     sync.Mutex
+	nextID uint64
+	// channels lists the messages of each channel, in queue order.
+	channels map[string][]*pendingMessage
+}
+
+func NewPendingMessages(timeTeller TimeTeller) *PendingMessages {
+	return &PendingMessages{
+		timeTeller: timeTeller,
+		channels:   make(map[string][]*pendingMessage),
+	}
+}
+
+// alertFingerprint returns the fingerprint of the alert, as given by
+// Alertmanager or else computed from its labels.
+func alertFingerprint(alert *promtmpl.Alert) string {
+	if alert.Fingerprint != "" {
+		return alert.Fingerprint
+	}
+	fingerprint, _ := fingerprintToken(alert.Labels)
+	return fingerprint
+}
+
+// alertFingerprints returns the fingerprints of the alerts.
+func alertFingerprints(alerts promtmpl.Alerts) []string {
+	fingerprints := []string{}
+	for i := range alerts {
+		fingerprints = append(fingerprints, alertFingerprint(&alerts[i]))
+	}
+	return fingerprints
+}
+
+// Add tracks the message, about to be queued, and records its ID in it.
+// fingerprints are those of the alerts it was rendered from.
+func (p *PendingMessages) Add(alertMsg *AlertMsg, fingerprints []string) {
+	if p == nil {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.nextID++
+	alertMsg.pendingID = p.nextID
+	p.channels[alertMsg.Channel] = append(p.channels[alertMsg.Channel], &pendingMessage{
+		id:           p.nextID,
+		text:         alertMsg.Alert,
+		fingerprints: fingerprints,
+		enqueued:     p.timeTeller.Now(),
+	})
+}
+
+// Done stops tracking the message, once sent or dropped. Messages which were
+// not tracked, or no longer are, are ignored.
+func (p *PendingMessages) Done(alertMsg *AlertMsg) {
+	if p == nil || alertMsg.pendingID == 0 {
+		return
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	messages := p.channels[alertMsg.Channel]
+	for i, message := range messages {
+		if message.id != alertMsg.pendingID {
+			continue
+		}
+		if len(messages) == 1 {
+			delete(p.channels, alertMsg.Channel)
+		} else {
+			p.channels[alertMsg.Channel] = append(messages[:i:i], messages[i+1:]...)
+		}
+		return
+	}
+}
+
+// QueueStatus is the document served on /queue.
+type QueueStatus struct {
+	Channels []ChannelQueueStatus `json:"channels"`
+}
+
+// ChannelQueueStatus describes the messages waiting to be sent to a channel.
+type ChannelQueueStatus struct {
+	Channel string `json:"channel"`
+	Depth   int    `json:"depth"`
+	// Oldest is when the first message waiting was queued.
+	Oldest time.Time `json:"oldest"`
+	// Messages are the first messages waiting.
+	Messages []QueuedMessageStatus `json:"messages"`
+}
+
+type QueuedMessageStatus struct {
+	// Text is the message rendered, cut to queueTextMaxBytes.
+	Text string `json:"text"`
+	// Fingerprints are those of the alerts of the webhook the message was
+	// rendered from.
+	Fingerprints []string  `json:"fingerprints"`
+	Enqueued     time.Time `json:"enqueued"`
+}
+
+// truncateText cuts s to max bytes, on a rune boundary.
+func truncateText(s string, max int) string {
+	if len(s) <= max {
+		return s
+	}
+	cut := max
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + " " + truncatedMarker
+}
+
+func (p *PendingMessages) channelStatus(channel string, messages []*pendingMessage, entries int) ChannelQueueStatus {
+	status := ChannelQueueStatus{
+		Channel:  channel,
+		Depth:    len(messages),
+		Oldest:   messages[0].enqueued,
+		Messages: []QueuedMessageStatus{},
+	}
+	for _, message := range messages {
+		if len(status.Messages) == entries {
+			break
+		}
+		status.Messages = append(status.Messages, QueuedMessageStatus{
+			Text:         truncateText(message.text, queueTextMaxBytes),
+			Fingerprints: message.fingerprints,
+			Enqueued:     message.enqueued,
+		})
+	}
+	return status
+}
+
+// Snapshot describes the messages waiting for the channel, or for all
+// channels if empty, listing the first entries of each.
+func (p *PendingMessages) Snapshot(channel string, entries int) QueueStatus {
+	status := QueueStatus{Channels: []ChannelQueueStatus{}}
+	if p == nil {
+		return status
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	for name, messages := range p.channels {
+		if channel == "" || channel == name {
+			status.Channels = append(status.Channels, p.channelStatus(name, messages, entries))
+		}
+	}
+	sort.Slice(status.Channels, func(i, j int) bool {
+		return status.Channels[i].Channel < status.Channels[j].Channel
+	})
+	return status
+}
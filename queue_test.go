@@ -0,0 +1,75 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestPendingMessages(t *testing.T) {
+	fakeTime := &FakeTime{
+		timeseries:   []int{1, 2, 3},
+		durationUnit: time.Minute,
+		afterChan:    make(chan time.Time, 1),
+	}
+	pending := NewPendingMessages(fakeTime)
+
+	first := AlertMsg{Channel: "#somechannel", Alert: "first"}
+	second := AlertMsg{Channel: "#somechannel", Alert: strings.Repeat("é", 150)}
+	other := AlertMsg{Channel: "#otherchannel", Alert: "other"}
+	pending.Add(&first, []string{"66214a361160fb6f"})
+	pending.Add(&second, nil)
+	pending.Add(&other, nil)
+
+	status := pending.Snapshot("", 1)
+	if len(status.Channels) != 2 || status.Channels[0].Channel != "#otherchannel" {
+		t.Fatalf("Unexpected channels: %+v", status.Channels)
+	}
+	expected := ChannelQueueStatus{
+		Channel: "#somechannel",
+		Depth:   2,
+		Oldest:  time.Unix(60, 0),
+		Messages: []QueuedMessageStatus{
+			{Text: "first", Fingerprints: []string{"66214a361160fb6f"}, Enqueued: time.Unix(60, 0)},
+		},
+	}
+	if !reflect.DeepEqual(expected, status.Channels[1]) {
+		t.Errorf("Unexpected queue.\nExpected: %+v\nActual: %+v", expected, status.Channels[1])
+	}
+
+	pending.Done(&first)
+	// Done again, or for messages not tracked, is ignored.
+	pending.Done(&first)
+	pending.Done(&AlertMsg{Channel: "#somechannel", Alert: "note"})
+	pending.Done(&other)
+
+	status = pending.Snapshot("#somechannel", 10)
+	if len(status.Channels) != 1 || status.Channels[0].Depth != 1 {
+		t.Fatalf("Unexpected queue: %+v", status.Channels)
+	}
+	text := status.Channels[0].Messages[0].Text
+	if text != strings.Repeat("é", 100)+" "+truncatedMarker {
+		t.Errorf("Unexpected truncation: %q", text)
+	}
+	if status.Channels[0].Oldest != time.Unix(120, 0) {
+		t.Errorf("Unexpected oldest message: %s", status.Channels[0].Oldest)
+	}
+	if status := pending.Snapshot("#otherchannel", 10); len(status.Channels) != 0 {
+		t.Errorf("Expected no queue for #otherchannel, got %+v", status.Channels)
+	}
+}
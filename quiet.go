@@ -0,0 +1,374 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+const (
+	defaultQuietHoursMaxAlerts = 100
+	defaultQuietHoursTTL       = 24 * time.Hour
+
+	// Whether the quiet hours of the channels are over is checked that
+	// often, rather than waiting until their computed end, which DST
+	// changes could move.
+	quietHoursCheckInterval = time.Minute
+)
+
+// Why alerts held during quiet hours are dropped.
+const (
+	quietHoursDroppedMax      = "max_alerts"
+	quietHoursDroppedTTL      = "ttl"
+	quietHoursDroppedShutdown = "shutdown"
+)
+
+var weekdayNames = map[string]time.Weekday{
+	"sunday":    time.Sunday,
+	"monday":    time.Monday,
+	"tuesday":   time.Tuesday,
+	"wednesday": time.Wednesday,
+	"thursday":  time.Thursday,
+	"friday":    time.Friday,
+	"saturday":  time.Saturday,
+}
+
+// parseClock parses a time of day given as "15:04", "24:00" included, into
+// minutes since midnight.
+func parseClock(clock string) (int, error) {
+	parts := strings.Split(clock, ":")
+	if len(parts) != 2 || len(parts[0]) != 2 || len(parts[1]) != 2 {
+		return 0, fmt.Errorf("invalid time '%s', expected HH:MM", clock)
+	}
+	hours, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', expected HH:MM", clock)
+	}
+	minutes, err := strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, fmt.Errorf("invalid time '%s', expected HH:MM", clock)
+	}
+	if hours < 0 || minutes < 0 || minutes > 59 || hours*60+minutes > 24*60 {
+		return 0, fmt.Errorf("invalid time '%s', expected 00:00 to 24:00", clock)
+	}
+	return hours*60 + minutes, nil
+}
+
+type quietRange struct {
+	days       [7]bool
+	start, end int
+}
+
+// quietSchedule tells when a channel is in its quiet hours. Times are
+// compared on the wall clock of its location, so that a range stays the
+// same hours of the day across DST changes: it is longer or shorter on the
+// day of the change, and hours which do not exist that day are skipped.
+type quietSchedule struct {
+	location *time.Location
+	ranges   []quietRange
+}
+
+func newQuietSchedule(config *QuietHoursConfig) (*quietSchedule, error) {
+	location, err := time.LoadLocation(config.Timezone)
+	if err != nil {
+		return nil, fmt.Errorf("invalid timezone: %s", err)
+	}
+	if len(config.Ranges) == 0 {
+		return nil, fmt.Errorf("no ranges")
+	}
+	schedule := &quietSchedule{location: location}
+	for i, configRange := range config.Ranges {
+		r := quietRange{}
+		if r.start, err = parseClock(configRange.Start); err != nil {
+			return nil, fmt.Errorf("range %d: start: %s", i, err)
+		}
+		if r.end, err = parseClock(configRange.End); err != nil {
+			return nil, fmt.Errorf("range %d: end: %s", i, err)
+		}
+		if r.start == r.end {
+			return nil, fmt.Errorf("range %d: start and end must differ", i)
+		}
+		for _, name := range configRange.Weekdays {
+			day, ok := weekdayNames[strings.ToLower(name)]
+			if !ok {
+				return nil, fmt.Errorf("range %d: unknown weekday '%s'", i, name)
+			}
+			r.days[day] = true
+		}
+		if len(configRange.Weekdays) == 0 {
+			r.days = [7]bool{true, true, true, true, true, true, true}
+		}
+		schedule.ranges = append(schedule.ranges, r)
+	}
+	return schedule, nil
+}
+
+// Quiet tells whether t is within the quiet hours.
+func (s *quietSchedule) Quiet(t time.Time) bool {
+	local := t.In(s.location)
+	day := local.Weekday()
+	previousDay := (day + 6) % 7
+	minute := local.Hour()*60 + local.Minute()
+	for _, r := range s.ranges {
+		if r.start < r.end {
+			if r.days[day] && minute >= r.start && minute < r.end {
+				return true
+			}
+			continue
+		}
+		// The range ends the next day.
+		if (r.days[day] && minute >= r.start) || (r.days[previousDay] && minute < r.end) {
+			return true
+		}
+	}
+	return false
+}
+
+type heldAlerts struct {
+	held   time.Time
+	alerts promtmpl.Alerts
+	// alertMsgs are the messages of the alerts, unless summarized.
+	alertMsgs []AlertMsg
+}
+
+type channelQuietHours struct {
+	schedule  *quietSchedule
+	maxAlerts int
+	ttl       time.Duration
+	summary   bool
+	bypass    map[string]bool
+
+	// held are the alerts held, oldest first, heldAlerts counting them.
+	held       []heldAlerts
+	heldAlerts int
+}
+
+// QuietHours holds the alerts to the channels with quiet hours while they
+// last, and relays them once they are over, or a summary of them. A nil
+// *QuietHours has no channel with quiet hours.
+type QuietHours struct {
+	alertMsgs  chan AlertMsg
+	timeTeller TimeTeller
+	metrics    *Metrics
+
+	mu       sync.Mutex
+	channels map[string]*channelQuietHours
+}
+
+func NewQuietHours(config *Config, alertMsgs chan AlertMsg, timeTeller TimeTeller, metrics *Metrics) *QuietHours {
+	channels := make(map[string]*channelQuietHours)
+	for _, connection := range config.ConnectionConfigs() {
+		for _, channel := range connection.IRCChannels {
+			if channel.QuietHours == nil {
+				continue
+			}
+			// The config was validated.
+			schedule, _ := newQuietSchedule(channel.QuietHours)
+			quietHours := &channelQuietHours{
+				schedule:  schedule,
+				maxAlerts: channel.QuietHours.MaxAlerts,
+				ttl:       channel.QuietHours.TTL,
+				summary:   channel.QuietHours.Summary,
+				bypass:    make(map[string]bool),
+			}
+			if quietHours.maxAlerts == 0 {
+				quietHours.maxAlerts = defaultQuietHoursMaxAlerts
+			}
+			if quietHours.ttl == 0 {
+				quietHours.ttl = defaultQuietHoursTTL
+			}
+			for _, severity := range channel.QuietHours.BypassSeverities {
+				quietHours.bypass[severity] = true
+			}
+			channels[channel.Name] = quietHours
+		}
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+	return &QuietHours{
+		alertMsgs:  alertMsgs,
+		timeTeller: timeTeller,
+		metrics:    metrics,
+		channels:   channels,
+	}
+}
+
+// Hold keeps the alerts to the channel while it is in its quiet hours,
+// except those of a severity bypassing them, and returns the alerts to
+// relay right away. render renders the messages of the alerts held, unless
+// they are to be summarized.
+func (q *QuietHours) Hold(ircChannel string, alerts promtmpl.Alerts, render func(promtmpl.Alerts) []AlertMsg) promtmpl.Alerts {
+	if q == nil {
+		return alerts
+	}
+
+	q.mu.Lock()
+	quietHours, ok := q.channels[ircChannel]
+	if !ok {
+		q.mu.Unlock()
+		return alerts
+	}
+	now := q.timeTeller.Now()
+	if !quietHours.schedule.Quiet(now) {
+		q.mu.Unlock()
+		return alerts
+	}
+	held := promtmpl.Alerts{}
+	relayed := promtmpl.Alerts{}
+	for _, alert := range alerts {
+		if quietHours.bypass[alert.Labels[severityLabel]] {
+			relayed = append(relayed, alert)
+		} else {
+			held = append(held, alert)
+		}
+	}
+	summary := quietHours.summary
+	q.mu.Unlock()
+
+	if len(held) == 0 {
+		return relayed
+	}
+	entry := heldAlerts{held: now, alerts: held}
+	if !summary {
+		entry.alertMsgs = render(held)
+	}
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	quietHours.held = append(quietHours.held, entry)
+	quietHours.heldAlerts += len(held)
+	q.metrics.quietHoursHeldAlerts.WithLabelValues(ircChannel).Add(float64(len(held)))
+	q.unsafePrune(ircChannel, quietHours, now)
+	return relayed
+}
+
+// unsafePrune drops the alerts of the channel held for longer than their
+// TTL, and the oldest ones beyond the maximum, always keeping the last
+// alerts held.
+func (q *QuietHours) unsafePrune(ircChannel string, quietHours *channelQuietHours, now time.Time) {
+	for len(quietHours.held) > 0 {
+		reason := ""
+		oldest := quietHours.held[0]
+		if now.Sub(oldest.held) >= quietHours.ttl {
+			reason = quietHoursDroppedTTL
+		} else if quietHours.heldAlerts > quietHours.maxAlerts && len(quietHours.held) > 1 {
+			reason = quietHoursDroppedMax
+		} else {
+			return
+		}
+		logging.Warn("Dropping %d alerts to %s held during quiet hours: %s", len(oldest.alerts), ircChannel, reason)
+		q.metrics.quietHoursDroppedAlerts.WithLabelValues(ircChannel, reason).Add(float64(len(oldest.alerts)))
+		quietHours.held = quietHours.held[1:]
+		quietHours.heldAlerts -= len(oldest.alerts)
+	}
+}
+
+// unsafeFlush returns the messages to relay for the alerts of the channel
+// held, and forgets them.
+func (q *QuietHours) unsafeFlush(ircChannel string, quietHours *channelQuietHours, now time.Time) []AlertMsg {
+	q.unsafePrune(ircChannel, quietHours, now)
+	if len(quietHours.held) == 0 {
+		return nil
+	}
+	alertMsgs := []AlertMsg{}
+	if quietHours.summary {
+		summary := newAlertSummary()
+		for _, entry := range quietHours.held {
+			summary.add(ircChannel, entry.alerts)
+		}
+		firing, resolved := summary.counts()
+		since := quietHours.held[0].held.In(quietHours.schedule.location).Format("Mon 15:04 MST")
+		alertMsgs = append(alertMsgs, AlertMsg{Channel: ircChannel,
+			Alert: fmt.Sprintf("While you were away (since %s): %d firing, %d resolved", since, firing, resolved)})
+		for _, line := range summary.lines() {
+			alertMsgs = append(alertMsgs, AlertMsg{Channel: ircChannel, Alert: line})
+		}
+	} else {
+		for _, entry := range quietHours.held {
+			alertMsgs = append(alertMsgs, entry.alertMsgs...)
+		}
+	}
+	quietHours.held = nil
+	quietHours.heldAlerts = 0
+	return alertMsgs
+}
+
+func (q *QuietHours) send(ircChannel string, alertMsgs []AlertMsg) {
+	logging.Info("Quiet hours of %s are over, relaying %d messages", ircChannel, len(alertMsgs))
+	for _, alertMsg := range alertMsgs {
+		select {
+		case q.alertMsgs <- alertMsg:
+		default:
+			logging.Error("Could not send alert held during quiet hours to the IRC routine: %s", alertMsg)
+			q.metrics.alertHandlingErrors.WithLabelValues(ircChannel, "internal_comm_channel_full").Inc()
+		}
+	}
+}
+
+// check relays the alerts held for the channels whose quiet hours are over.
+// On shutdown, those still in their quiet hours drop them instead.
+func (q *QuietHours) check(shutdown bool) {
+	q.mu.Lock()
+	now := q.timeTeller.Now()
+	flushed := make(map[string][]AlertMsg)
+	for ircChannel, quietHours := range q.channels {
+		if len(quietHours.held) == 0 {
+			continue
+		}
+		if !quietHours.schedule.Quiet(now) {
+			if alertMsgs := q.unsafeFlush(ircChannel, quietHours, now); len(alertMsgs) > 0 {
+				flushed[ircChannel] = alertMsgs
+			}
+		} else if shutdown {
+			logging.Warn("Dropping %d alerts to %s held during quiet hours on shutdown",
+				quietHours.heldAlerts, ircChannel)
+			q.metrics.quietHoursDroppedAlerts.WithLabelValues(ircChannel, quietHoursDroppedShutdown).Add(
+				float64(quietHours.heldAlerts))
+			quietHours.held = nil
+			quietHours.heldAlerts = 0
+		}
+	}
+	q.mu.Unlock()
+
+	for ircChannel, alertMsgs := range flushed {
+		q.send(ircChannel, alertMsgs)
+	}
+}
+
+// Run relays the alerts held once the quiet hours of their channel are
+// over, until ctx is canceled.
+func (q *QuietHours) Run(ctx context.Context, stopWg *sync.WaitGroup) {
+	defer stopWg.Done()
+
+	for {
+		select {
+		case <-q.timeTeller.After(quietHoursCheckInterval):
+			q.check(false)
+		case <-ctx.Done():
+			q.check(true)
+			return
+		}
+	}
+}
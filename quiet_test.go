@@ -0,0 +1,241 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestQuietSchedule(t *testing.T) {
+	schedule, err := newQuietSchedule(&QuietHoursConfig{
+		Timezone: "Europe/Zurich",
+		Ranges: []QuietHoursRange{
+			{Weekdays: []string{"monday", "tuesday", "wednesday", "thursday", "Friday"}, Start: "18:00", End: "09:00"},
+			{Weekdays: []string{"saturday", "sunday"}, Start: "00:00", End: "24:00"},
+		},
+	})
+	if err != nil {
+		t.Skipf("Could not load timezone: %s", err)
+	}
+	// A night range belongs to the day it starts on.
+	for _, tc := range []struct {
+		time  string
+		quiet bool
+	}{
+		{"2021-10-29T17:59:00+02:00", false},
+		{"2021-10-29T18:00:00+02:00", true},
+		{"2021-10-30T05:00:00+02:00", true},
+		{"2021-10-30T12:00:00+02:00", true},
+		{"2021-11-01T05:00:00+01:00", false},
+		{"2021-11-01T18:30:00+01:00", true},
+		{"2021-11-02T08:59:00+01:00", true},
+		{"2021-11-02T09:00:00+01:00", false},
+	} {
+		at, _ := time.Parse(time.RFC3339, tc.time)
+		if quiet := schedule.Quiet(at); quiet != tc.quiet {
+			t.Errorf("Expected quiet %t at %s, got %t", tc.quiet, tc.time, quiet)
+		}
+	}
+}
+
+func TestQuietScheduleDST(t *testing.T) {
+	schedule, err := newQuietSchedule(&QuietHoursConfig{
+		Timezone: "Europe/Zurich",
+		Ranges:   []QuietHoursRange{{Start: "01:00", End: "03:00"}},
+	})
+	if err != nil {
+		t.Skipf("Could not load timezone: %s", err)
+	}
+	// Quiet hours follow the wall clock: they are an hour shorter when
+	// clocks go forward at 02:00, and an hour longer when they go back at
+	// 03:00.
+	for _, tc := range []struct {
+		time  string
+		quiet bool
+	}{
+		{"2021-03-27T23:59:00Z", false},
+		{"2021-03-28T00:00:00Z", true},
+		{"2021-03-28T00:59:00Z", true},
+		{"2021-03-28T01:00:00Z", false},
+		{"2021-10-30T23:00:00Z", true},
+		{"2021-10-31T00:30:00Z", true},
+		{"2021-10-31T01:30:00Z", true},
+		{"2021-10-31T02:00:00Z", false},
+	} {
+		at, _ := time.Parse(time.RFC3339, tc.time)
+		if quiet := schedule.Quiet(at); quiet != tc.quiet {
+			t.Errorf("Expected quiet %t at %s, got %t", tc.quiet, tc.time, quiet)
+		}
+	}
+}
+
+func makeTestQuietHours(elapsedTime []int) (*QuietHours, chan AlertMsg, *Metrics) {
+	// The Unix epoch was on a Thursday, the quiet hours last until 01:00.
+	quietHours := &QuietHoursConfig{
+		Timezone:         "UTC",
+		Ranges:           []QuietHoursRange{{Start: "00:00", End: "01:00"}},
+		MaxAlerts:        2,
+		TTL:              45 * time.Minute,
+		BypassSeverities: []string{"critical"},
+	}
+	summarized := *quietHours
+	summarized.Summary = true
+	config := &Config{
+		IRCChannels: []IRCChannel{
+			IRCChannel{Name: "#dev", QuietHours: quietHours},
+			IRCChannel{Name: "#summary", QuietHours: &summarized},
+			IRCChannel{Name: "#ops"},
+		},
+	}
+	fakeTime := &FakeTime{
+		timeseries:   elapsedTime,
+		durationUnit: time.Minute,
+		afterChan:    make(chan time.Time, 1),
+	}
+	alertMsgs := make(chan AlertMsg, 10)
+	metrics := NewMetrics(prometheus.NewRegistry())
+	return NewQuietHours(config, alertMsgs, fakeTime, metrics), alertMsgs, metrics
+}
+
+func quietTestAlert(name string, severity string) promtmpl.Alert {
+	alert := digestTestAlert(name, name, "firing", name+" summary")
+	alert.Labels[severityLabel] = severity
+	return alert
+}
+
+func renderQuietTestAlerts(ircChannel string) func(promtmpl.Alerts) []AlertMsg {
+	return func(alerts promtmpl.Alerts) []AlertMsg {
+		alertMsgs := []AlertMsg{}
+		for _, alert := range alerts {
+			alertMsgs = append(alertMsgs, AlertMsg{Channel: ircChannel, Alert: alertName(&alert)})
+		}
+		return alertMsgs
+	}
+}
+
+func TestQuietHours(t *testing.T) {
+	quietHours, alertMsgs, metrics := makeTestQuietHours([]int{20, 30, 40, 50, 60})
+
+	alerts := promtmpl.Alerts{quietTestAlert("airDown", "warning"), quietTestAlert("diskFull", "critical")}
+	if relayed := quietHours.Hold("#ops", alerts, renderQuietTestAlerts("#ops")); !reflect.DeepEqual(alerts, relayed) {
+		t.Errorf("Expected alerts to a channel without quiet hours to be relayed, got %v", relayed)
+	}
+	// Critical alerts bypass the quiet hours.
+	relayed := quietHours.Hold("#dev", alerts, renderQuietTestAlerts("#dev"))
+	if !reflect.DeepEqual(alerts[1:], relayed) {
+		t.Errorf("Expected the critical alert to be relayed, got %v", relayed)
+	}
+	quietHours.Hold("#summary", alerts[:1], renderQuietTestAlerts("#summary"))
+	quietHours.Hold("#summary", promtmpl.Alerts{quietTestAlert("cpuHot", "info")}, renderQuietTestAlerts("#summary"))
+
+	// Nothing is relayed during the quiet hours.
+	quietHours.check(false)
+	select {
+	case alertMsg := <-alertMsgs:
+		t.Fatalf("Unexpected message during quiet hours: %s", alertMsg)
+	default:
+	}
+
+	quietHours.check(false)
+	received := map[string][]string{}
+	for i := 0; i < 4; i++ {
+		alertMsg := <-alertMsgs
+		received[alertMsg.Channel] = append(received[alertMsg.Channel], alertMsg.Alert)
+	}
+	expected := map[string][]string{
+		"#dev": {"airDown"},
+		"#summary": {
+			"While you were away (since Thu 00:30 UTC): 2 firing, 0 resolved",
+			"firing: airDown - airDown summary",
+			"firing: cpuHot - cpuHot summary",
+		},
+	}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("Unexpected messages once quiet hours were over.\nExpected: %q\nActual: %q", expected, received)
+	}
+	if v := testutil.ToFloat64(metrics.quietHoursHeldAlerts.WithLabelValues("#summary")); v != 2 {
+		t.Errorf("Expected 2 held alerts, got %f", v)
+	}
+}
+
+func TestQuietHoursLimits(t *testing.T) {
+	quietHours, alertMsgs, metrics := makeTestQuietHours([]int{0, 10, 20, 50, 60})
+
+	for _, name := range []string{"first", "second", "third"} {
+		quietHours.Hold("#dev", promtmpl.Alerts{quietTestAlert(name, "warning")}, renderQuietTestAlerts("#dev"))
+	}
+	if v := testutil.ToFloat64(metrics.quietHoursDroppedAlerts.WithLabelValues("#dev", "max_alerts")); v != 1 {
+		t.Errorf("Expected 1 alert dropped beyond max_alerts, got %f", v)
+	}
+	quietHours.Hold("#summary", promtmpl.Alerts{quietTestAlert("late", "warning")}, renderQuietTestAlerts("#summary"))
+
+	// Alerts held for longer than the TTL are dropped.
+	quietHours.check(false)
+	received := map[string][]string{}
+	for i := 0; i < 3; i++ {
+		alertMsg := <-alertMsgs
+		received[alertMsg.Channel] = append(received[alertMsg.Channel], alertMsg.Alert)
+	}
+	expected := map[string][]string{
+		"#dev": {"third"},
+		"#summary": {
+			"While you were away (since Thu 00:50 UTC): 1 firing, 0 resolved",
+			"firing: late - late summary",
+		},
+	}
+	if !reflect.DeepEqual(expected, received) {
+		t.Errorf("Unexpected messages once quiet hours were over.\nExpected: %q\nActual: %q", expected, received)
+	}
+	if v := testutil.ToFloat64(metrics.quietHoursDroppedAlerts.WithLabelValues("#dev", "ttl")); v != 1 {
+		t.Errorf("Expected 1 alert dropped after its TTL, got %f", v)
+	}
+}
+
+func TestQuietHoursShutdown(t *testing.T) {
+	quietHours, alertMsgs, metrics := makeTestQuietHours([]int{0, 30})
+
+	quietHours.Hold("#dev", promtmpl.Alerts{quietTestAlert("airDown", "warning")}, renderQuietTestAlerts("#dev"))
+
+	// Alerts still held on shutdown are dropped.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stopWg := sync.WaitGroup{}
+	stopWg.Add(1)
+	quietHours.Run(ctx, &stopWg)
+	select {
+	case alertMsg := <-alertMsgs:
+		t.Errorf("Unexpected message on shutdown: %s", alertMsg)
+	default:
+	}
+	if v := testutil.ToFloat64(metrics.quietHoursDroppedAlerts.WithLabelValues("#dev", "shutdown")); v != 1 {
+		t.Errorf("Expected 1 alert dropped on shutdown, got %f", v)
+	}
+}
+
+func TestNoQuietHours(t *testing.T) {
+	var quietHours *QuietHours
+	alerts := promtmpl.Alerts{quietTestAlert("airDown", "warning")}
+	if relayed := quietHours.Hold("#dev", alerts, renderQuietTestAlerts("#dev")); !reflect.DeepEqual(alerts, relayed) {
+		t.Errorf("Expected alerts to be relayed without quiet hours, got %v", relayed)
+	}
+}
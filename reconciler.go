@@ -16,7 +16,11 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"sort"
+	"strings"
 	"sync"
+	"text/template"
 	"time"
 
 	irc "github.com/fluffle/goirc/client"
@@ -24,39 +28,144 @@ import (
 )
 
 const (
-	ircJoinWaitSecs         = 10
-	ircJoinMaxBackoffSecs   = 300
-	ircJoinBackoffResetSecs = 1800
+	ircErrNoSuchChannel     = "403"
+	ircErrBannedFromChannel = "474"
+	ircErrBadChannelKey     = "475"
+	ircErrNeedReggedNick    = "477"
+
+	// Log the first join attempts of a channel, then one in every few.
+	ircJoinLogFirst = 3
+	ircJoinLogEvery = 10
+)
+
+// Policies for the delays between join attempts: only the backoff of each
+// channel, or also a minimum spacing shared by all channels.
+const (
+	joinPolicyPerChannel = "per_channel"
+	joinPolicyShared     = "shared"
+)
+
+// channelEventsKept is how many of the last events explaining why we left or
+// could not join a channel are kept, see ChannelEvent.
+const channelEventsKept = 5
+
+// Types of ChannelEvent.
+const (
+	channelEventKick           = "kick"
+	channelEventBanned         = "banned"
+	channelEventBadKey         = "bad_key"
+	channelEventNeedReggedNick = "need_regged_nick"
+	channelEventNoSuchChannel  = "no_such_channel"
 )
 
+// joinPriorityAttempts is how many times a channel is tried before letting
+// the channels of lower join priority go ahead, if it was not joined.
+const joinPriorityAttempts = 2
+
 type channelState struct {
-	channel IRCChannel
+	channel      IRCChannel
 	chanservName string
-	client  *irc.Conn
+	client       *irc.Conn
 
 	delayer    Delayer
 	timeTeller TimeTeller
+	// A join is deemed failed without confirmation within joinWait.
+	joinWait time.Duration
+	// joinSlots, if set, is shared by all channels to space their join
+	// attempts out.
+	joinSlots Delayer
+	// waitResumed waits while joins are paused, and tells whether they
+	// were resumed before the context was done.
+	waitResumed func(context.Context) bool
+	// turn, if set, is closed once the channels of higher join priority
+	// are settled, i.e. joined or tried joinPriorityAttempts times.
+	// settled is closed once this channel is.
+	turn     <-chan struct{}
+	settled  chan struct{}
+	attempts int
+	settle   sync.Once
 
 	joinDone chan struct{} // joined when channel is closed
 	joined   bool
 
 	joinUnsetSignal chan bool
+	// retrySignal cuts the backoff before the next join attempt short.
+	retrySignal chan struct{}
+
+	// joinFailingSince is when we started trying to join the channel. If
+	// that lasts joinFailureThreshold, or if we were kicked, notify is
+	// called once, and again once the channel is joined.
+	joinFailingSince     time.Time
+	joinFailureThreshold time.Duration
+	notifiedUnavailable  bool
+	notify               func(note string)
+
+	// joinLog samples the messages repeated on each join attempt, as a
+	// channel we cannot join would otherwise flood the logs.
+	joinLog *logging.SampledLogger
+
+	// noSuchChannel counts the join attempts the server answered with
+	// ERR_NOSUCHCHANNEL since the channel was last joined. Once it reaches
+	// maxNoSuchChannel, if set, joining is given up and gaveUp is closed.
+	noSuchChannel    int
+	maxNoSuchChannel int
+	gaveUp           chan struct{}
+
+	// stop stops the monitor of the channel alone, e.g. once disabled.
+	stop context.CancelFunc
+
+	// banNextProbe is when joining is tried again if we are banned from
+	// the channel, zero otherwise. Joins are tried only every
+	// banRetryInterval while banned, if set.
+	banNextProbe     time.Time
+	banReason        string
+	banRetryInterval time.Duration
+
+	// badKey is set if the server refused the key of the channel since it
+	// was last joined, so that a new key is tried right away.
+	badKey bool
+
+	// events are the last channelEventsKept reasons why we left or could
+	// not join the channel, oldest first.
+	events []ChannelEvent
+
+	// Once joined again after being kicked, rejoinMessage, if set, is
+	// rendered and the lines passed to announce. queuedWhileOut counts
+	// the alerts which arrived meanwhile.
+	rejoinMessage  *template.Template
+	announce       func(lines []string)
+	kicked         bool
+	kicker         string
+	kickReason     string
+	queuedWhileOut int
 
 	mu sync.Mutex
 }
 
-func newChannelState(channel *IRCChannel, client *irc.Conn, delayerMaker DelayerMaker, timeTeller TimeTeller, chanservName string) *channelState {
-	delayer := delayerMaker.NewDelayer(ircJoinMaxBackoffSecs, ircJoinBackoffResetSecs, time.Second)
+func newChannelState(channel *IRCChannel, client *irc.Conn, delayerMaker DelayerMaker, joinSlots Delayer, waitResumed func(context.Context) bool, turn <-chan struct{}, timeTeller TimeTeller, chanservName string, joinFailureThreshold time.Duration, maxNoSuchChannel int, notify func(string), joinWait time.Duration, joinMaxBackoff time.Duration, joinBackoffReset time.Duration) *channelState {
+	delayer := delayerMaker.NewDelayer(joinMaxBackoff.Seconds(), joinBackoffReset.Seconds(), time.Second)
 
 	return &channelState{
-		channel:         *channel,
-		client:          client,
-		delayer:         delayer,
-		timeTeller:      timeTeller,
-		joinDone:        make(chan struct{}),
-		joined:          false,
-		joinUnsetSignal: make(chan bool),
-		chanservName:    chanservName,
+		channel:              *channel,
+		client:               client,
+		delayer:              delayer,
+		joinWait:             joinWait,
+		timeTeller:           timeTeller,
+		joinSlots:            joinSlots,
+		waitResumed:          waitResumed,
+		turn:                 turn,
+		settled:              make(chan struct{}),
+		joinDone:             make(chan struct{}),
+		joined:               false,
+		joinUnsetSignal:      make(chan bool),
+		retrySignal:          make(chan struct{}, 1),
+		joinFailingSince:     timeTeller.Now(),
+		joinFailureThreshold: joinFailureThreshold,
+		notify:               notify,
+		chanservName:         chanservName,
+		joinLog:              logging.NewSampledLogger(ircJoinLogFirst, ircJoinLogEvery),
+		maxNoSuchChannel:     maxNoSuchChannel,
+		gaveUp:               make(chan struct{}),
 	}
 }
 
@@ -78,7 +187,21 @@ func (c *channelState) SetJoined() {
 
 	logging.Info("Setting JOIN state on channel %s", c.channel.Name)
 	c.joined = true
+	c.joinLog.Reset()
+	c.noSuchChannel = 0
+	c.banNextProbe = time.Time{}
+	c.banReason = ""
+	c.badKey = false
 	close(c.joinDone)
+	c.markSettled()
+	if c.kicked {
+		c.kicked = false
+		c.unsafeAnnounceRejoin()
+	}
+	if c.notifiedUnavailable {
+		c.notifiedUnavailable = false
+		c.notify(fmt.Sprintf("Joined %s again, alerts are delivered to it", c.channel.Name))
+	}
 }
 
 func (c *channelState) UnsetJoined() {
@@ -93,6 +216,7 @@ func (c *channelState) UnsetJoined() {
 	logging.Info("Removing JOIN state on channel %s", c.channel.Name)
 	c.joined = false
 	c.joinDone = make(chan struct{})
+	c.joinFailingSince = c.timeTeller.Now()
 
 	// eventually poke monitor routine
 	select {
@@ -101,28 +225,329 @@ func (c *channelState) UnsetJoined() {
 	}
 }
 
+// RetryNow makes the next join attempt happen without waiting for the
+// backoff.
+func (c *channelState) RetryNow() {
+	select {
+	case c.retrySignal <- struct{}{}:
+	default:
+	}
+}
+
+// HandleNoSuchChannel counts a join attempt the server answered with
+// ERR_NOSUCHCHANNEL, and tells whether we just gave up joining the channel.
+func (c *channelState) HandleNoSuchChannel(reason string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.joined || c.hasGivenUp() {
+		return false
+	}
+	c.noSuchChannel++
+	c.joinLog.Warn("Channel %s does not exist according to the server (attempt %d): %s",
+		c.channel.Name, c.noSuchChannel, reason)
+	if c.maxNoSuchChannel == 0 || c.noSuchChannel < c.maxNoSuchChannel {
+		return false
+	}
+	close(c.gaveUp)
+	c.markSettled()
+	return true
+}
+
+// RecordEvent keeps the reason why we left or could not join the channel.
+// Repeats of the last event, e.g. on each join attempt, are counted in it.
+func (c *channelState) RecordEvent(eventType string, by string, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	now := time.Now()
+	if n := len(c.events); n > 0 {
+		last := &c.events[n-1]
+		if last.Type == eventType && last.By == by && last.Reason == reason {
+			last.Time = now
+			last.Count++
+			return
+		}
+	}
+	c.events = append(c.events, ChannelEvent{
+		Type:   eventType,
+		By:     by,
+		Reason: reason,
+		Time:   now,
+		Count:  1,
+	})
+	if len(c.events) > channelEventsKept {
+		c.events = c.events[len(c.events)-channelEventsKept:]
+	}
+}
+
+// HandleBadKey records that the server refused the key of the channel.
+func (c *channelState) HandleBadKey(reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.joined {
+		return
+	}
+	c.badKey = true
+	c.joinLog.Warn("Channel %s: key refused by the server (%s)", c.channel.Name, reason)
+}
+
+// SetKey replaces the key the channel is joined with, and tells whether the
+// server refused the previous one, in which case it is worth retrying now.
+func (c *channelState) SetKey(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.channel.Password == key {
+		return false
+	}
+	c.channel.Password = key
+	return c.badKey && !c.joined
+}
+
+func (c *channelState) key() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	return c.channel.Password
+}
+
+// markSettled lets the channels of lower join priority go ahead.
+func (c *channelState) markSettled() {
+	c.settle.Do(func() { close(c.settled) })
+}
+
+// waitTurn waits until the channels of higher join priority are settled, and
+// tells whether they were before the context was done.
+func (c *channelState) waitTurn(ctx context.Context) bool {
+	if c.turn == nil {
+		return true
+	}
+	select {
+	case <-c.turn:
+		return true
+	default:
+	}
+	c.joinLog.Info("Channel %s monitor: waiting for channels of higher join priority", c.channel.Name)
+	select {
+	case <-c.turn:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// HandleBanned arms the next join probe of the channel we are banned from,
+// and tells whether we were not known to be banned yet.
+func (c *channelState) HandleBanned(reason string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.joined || c.banRetryInterval <= 0 {
+		return false
+	}
+	newlyBanned := c.banNextProbe.IsZero()
+	c.banNextProbe = time.Now().Add(c.banRetryInterval)
+	c.banReason = reason
+	return newlyBanned
+}
+
+// banWait tells how long to wait before the next join probe, if banned.
+func (c *channelState) banWait() (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.banNextProbe.IsZero() {
+		return 0, false
+	}
+	return time.Until(c.banNextProbe), true
+}
+
+// waitBanProbe waits for the next join probe of the channel we are banned
+// from, or for RetryNow, and re-arms it in case the probe fails without an
+// answer. It tells whether to go ahead with the probe.
+func (c *channelState) waitBanProbe(ctx context.Context, wait time.Duration) bool {
+	if wait > 0 {
+		c.joinLog.Info("Channel %s monitor: banned, probing again in %s", c.channel.Name, wait.Round(time.Second))
+		select {
+		case <-c.timeTeller.After(wait):
+		case <-c.retrySignal:
+			c.joinLog.Info("Channel %s monitor: probing ban now", c.channel.Name)
+		case <-c.gaveUp:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.banNextProbe.IsZero() {
+		c.banNextProbe = time.Now().Add(c.banRetryInterval)
+	}
+	return true
+}
+
+// hasGivenUp tells whether joining the channel was given up.
+func (c *channelState) hasGivenUp() bool {
+	select {
+	case <-c.gaveUp:
+		return true
+	default:
+		return false
+	}
+}
+
+// backoff waits before the next join attempt, or for RetryNow, and tells
+// whether to go ahead with it.
+func (c *channelState) backoff(ctx context.Context) bool {
+	c.joinLog.Info("Channel %s monitor: waiting to join", c.channel.Name)
+	delayCtx, cancelDelay := context.WithCancel(ctx)
+	delayed := make(chan struct{})
+	go func() {
+		select {
+		case <-c.retrySignal:
+			c.joinLog.Info("Channel %s monitor: retrying to join now", c.channel.Name)
+			cancelDelay()
+		case <-c.gaveUp:
+			cancelDelay()
+		case <-delayed:
+		}
+	}()
+	ok := c.delayer.DelayContext(delayCtx)
+	close(delayed)
+	cancelDelay()
+	if !ok && ctx.Err() != nil {
+		return false
+	}
+	return !c.hasGivenUp()
+}
+
 func (c *channelState) join(ctx context.Context) {
-	logging.Info("Channel %s monitor: waiting to join", c.channel.Name)
-	if ok := c.delayer.DelayContext(ctx); !ok {
+	// Probing a ban replaces the backoff.
+	if wait, banned := c.banWait(); banned {
+		if !c.waitBanProbe(ctx, wait) {
+			return
+		}
+	} else if !c.backoff(ctx) {
+		return
+	}
+
+	if !c.client.Connected() {
+		// Joins would be lost, or block once the send buffer is full.
+		c.joinLog.Info("Channel %s monitor: not connected, will retry", c.channel.Name)
+		select {
+		case <-c.timeTeller.After(c.joinWait):
+		case <-ctx.Done():
+		}
+		return
+	}
+
+	if !c.waitTurn(ctx) || !c.waitResumed(ctx) {
+		return
+	}
+	if c.joinSlots != nil && !c.joinSlots.DelayContext(ctx) {
 		return
 	}
 
 	// Try to unban ourselves, just in case
 	c.client.Privmsgf(c.chanservName, "UNBAN %s", c.channel.Name)
 
-	c.client.Join(c.channel.Name, c.channel.Password)
-	logging.Info("Channel %s monitor: join request sent", c.channel.Name)
+	c.client.Join(c.channel.Name, c.key())
+	c.joinLog.Info("Channel %s monitor: join request sent", c.channel.Name)
 
 	select {
 	case <-c.JoinDone():
 		logging.Info("Channel %s monitor: join succeeded", c.channel.Name)
-	case <-c.timeTeller.After(ircJoinWaitSecs * time.Second):
-		logging.Warn("Channel %s monitor: could not join after %d seconds, will retry", c.channel.Name, ircJoinWaitSecs)
+	case <-c.timeTeller.After(c.joinWait):
+		c.joinLog.Warn("Channel %s monitor: could not join after %s, will retry", c.channel.Name, c.joinWait)
+		c.maybeNotifyJoinFailure()
+		c.attempts++
+		if c.attempts >= joinPriorityAttempts {
+			c.markSettled()
+		}
+	case <-c.gaveUp:
 	case <-ctx.Done():
 		logging.Info("Channel %s monitor: context canceled while waiting for join", c.channel.Name)
 	}
 }
 
+func (c *channelState) NotifyKick(kicker string, reason string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.notifiedUnavailable = true
+	c.kicked = true
+	c.kicker = kicker
+	c.kickReason = reason
+	c.queuedWhileOut = 0
+	c.notify(fmt.Sprintf("Kicked from %s by %s (%s), alerts to it are not delivered until it is joined again",
+		c.channel.Name, kicker, reason))
+}
+
+// RejoinData is what rejoin_message templates are rendered with.
+type RejoinData struct {
+	Channel string
+	Kicker  string
+	Reason  string
+	// Queued is the number of alerts to the channel which arrived while
+	// we were out of it, whether they were delivered late or dropped.
+	Queued int
+}
+
+// parseRejoinMessage parses a rejoin_message template, nil if unset.
+func parseRejoinMessage(text string) (*template.Template, error) {
+	if text == "" {
+		return nil, nil
+	}
+	return template.New("rejoin_message").Funcs(templateFuncMap).Parse(text)
+}
+
+// CountQueued counts an alert to the channel which arrived while we were out
+// of it after being kicked.
+func (c *channelState) CountQueued() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.kicked {
+		c.queuedWhileOut++
+	}
+}
+
+func (c *channelState) unsafeAnnounceRejoin() {
+	if c.rejoinMessage == nil {
+		return
+	}
+	output := strings.Builder{}
+	err := c.rejoinMessage.Execute(&output, RejoinData{
+		Channel: c.channel.Name,
+		Kicker:  c.kicker,
+		Reason:  c.kickReason,
+		Queued:  c.queuedWhileOut,
+	})
+	if err != nil {
+		logging.Error("Could not render rejoin_message of channel %s: %s", c.channel.Name, err)
+		return
+	}
+	if lines := templateLines(output.String()); len(lines) > 0 {
+		c.announce(lines)
+	}
+}
+
+func (c *channelState) maybeNotifyJoinFailure() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.joinFailureThreshold <= 0 || c.joined || c.notifiedUnavailable {
+		return
+	}
+	if failing := c.timeTeller.Now().Sub(c.joinFailingSince); failing >= c.joinFailureThreshold {
+		c.notifiedUnavailable = true
+		c.notify(fmt.Sprintf("Could not join %s for %s, alerts to it are not delivered",
+			c.channel.Name, failing.Round(time.Second)))
+	}
+}
+
 func (c *channelState) monitorJoinUnset(ctx context.Context) {
 	select {
 	case <-c.joinUnsetSignal:
@@ -143,6 +568,10 @@ func (c *channelState) Monitor(ctx context.Context, wg *sync.WaitGroup) {
 
 	for ctx.Err() != context.Canceled {
 		if !joined() {
+			if c.hasGivenUp() {
+				logging.Info("Channel %s monitor: gave up joining", c.channel.Name)
+				return
+			}
 			c.join(ctx)
 		} else {
 			c.monitorJoinUnset(ctx)
@@ -151,30 +580,112 @@ func (c *channelState) Monitor(ctx context.Context, wg *sync.WaitGroup) {
 }
 
 type ChannelReconciler struct {
+	name            string
 	preJoinChannels []IRCChannel
 	client          *irc.Conn
 
 	delayerMaker DelayerMaker
 	timeTeller   TimeTeller
+	metrics      *Metrics
+	// joinSlots spaces the join attempts of all channels out, if the join
+	// policy is shared.
+	joinSlots Delayer
+
+	// Join timings of the channels, see newChannelState.
+	joinWait         time.Duration
+	joinMaxBackoff   time.Duration
+	joinBackoffReset time.Duration
+
+	channels     map[string]*channelState
+	chanservName string
+
+	// Notes about channels we were kicked from or cannot join are sent
+	// to notificationChannel, through notify.
+	notificationChannel  string
+	joinFailureThreshold time.Duration
+	notify               func(AlertMsg)
+	// joined is called once a channel is joined, without blocking.
+	joined func(channel string)
 
-	channels map[string]*channelState
-	chanservName  string
+	// Joining channels the server says do not exist is given up after
+	// noSuchChannelAttempts, or noSuchChannelAttemptsDynamic for channels
+	// not in preJoinChannels. gaveUp remembers them until we exit.
+	noSuchChannelAttempts        int
+	noSuchChannelAttemptsDynamic int
+	gaveUp                       map[string]bool
+
+	// disabled maps the channels disabled in the config to the channel
+	// their alerts are redirected to, if any. They are not joined.
+	disabled map[string]string
+
+	// Channels we are banned from are probed every banRetryInterval. bans
+	// carries their state over to the next session.
+	banRetryInterval time.Duration
+	bans             map[string]channelBan
+
+	// events carries the events of the channels over to the next session.
+	events map[string][]ChannelEvent
+
+	// rejoinMessages are the parsed rejoin_message of the channels.
+	rejoinMessages map[string]*template.Template
 
 	stopCtx       context.Context
 	stopCtxCancel context.CancelFunc
 	stopWg        sync.WaitGroup
 
 	mu sync.Mutex
+
+	// resumed is closed unless joins are paused, see Pause. It has its own
+	// lock, as monitors wait on it while Stop holds mu.
+	resumed chan struct{}
+	pauseMu sync.Mutex
 }
 
-func NewChannelReconciler(config *Config, client *irc.Conn, delayerMaker DelayerMaker, timeTeller TimeTeller) *ChannelReconciler {
+func NewChannelReconciler(config *Config, client *irc.Conn, delayerMaker DelayerMaker, timeTeller TimeTeller, metrics *Metrics) *ChannelReconciler {
 	reconciler := &ChannelReconciler{
+		name:            config.ConnectionName,
 		preJoinChannels: config.IRCChannels,
 		client:          client,
 		delayerMaker:    delayerMaker,
 		timeTeller:      timeTeller,
+		metrics:         metrics,
 		channels:        make(map[string]*channelState),
 		chanservName:    config.ChanservName,
+
+		joinWait:         config.IRCJoinWait,
+		joinMaxBackoff:   config.IRCJoinMaxBackoff,
+		joinBackoffReset: config.IRCJoinBackoffReset,
+
+		notificationChannel:  config.NotificationChannel,
+		joinFailureThreshold: config.NotificationJoinFailureThreshold,
+		notify:               func(AlertMsg) {},
+		joined:               func(string) {},
+
+		noSuchChannelAttempts:        config.IRCNoSuchChannelAttempts,
+		noSuchChannelAttemptsDynamic: config.IRCNoSuchChannelAttemptsDynamic,
+		gaveUp:                       make(map[string]bool),
+		disabled:                     make(map[string]string),
+
+		banRetryInterval: config.IRCChannelBanRetryInterval,
+		bans:             make(map[string]channelBan),
+
+		events:         make(map[string][]ChannelEvent),
+		rejoinMessages: make(map[string]*template.Template),
+
+		resumed: make(chan struct{}),
+	}
+	close(reconciler.resumed)
+
+	for _, channel := range config.IRCChannels {
+		// The config was validated.
+		reconciler.rejoinMessages[channel.Name], _ = parseRejoinMessage(channel.RejoinMessage)
+		if channel.Disabled {
+			reconciler.disabled[channel.Name] = channel.redirectTo()
+		}
+	}
+
+	if config.IRCJoinPolicy == joinPolicyShared {
+		reconciler.joinSlots = NewSpacer(config.IRCJoinSpacing, &RealTime{})
 	}
 
 	reconciler.registerHandlers()
@@ -190,7 +701,35 @@ func (r *ChannelReconciler) registerHandlers() {
 
 	r.client.HandleFunc(irc.KICK,
 		func(_ *irc.Conn, line *irc.Line) {
-			r.HandleKick(line.Args[1], line.Args[0])
+			r.HandleKick(line.Args[1], line.Args[0], line.Nick, line.Text())
+		})
+
+	r.client.HandleFunc(ircErrNoSuchChannel,
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 1 {
+				r.HandleNoSuchChannel(line.Args[1], line.Text())
+			}
+		})
+
+	r.client.HandleFunc(ircErrBannedFromChannel,
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 1 {
+				r.HandleBannedFromChannel(line.Args[1], line.Text())
+			}
+		})
+
+	r.client.HandleFunc(ircErrBadChannelKey,
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 1 {
+				r.HandleBadChannelKey(line.Args[1], line.Text())
+			}
+		})
+
+	r.client.HandleFunc(ircErrNeedReggedNick,
+		func(_ *irc.Conn, line *irc.Line) {
+			if len(line.Args) > 1 {
+				r.HandleNeedReggedNick(line.Args[1], line.Text())
+			}
 		})
 }
 
@@ -210,9 +749,11 @@ func (r *ChannelReconciler) HandleJoin(nick string, channel string) {
 		return
 	}
 	c.SetJoined()
+	r.metrics.ircChannelBanned.DeleteLabelValues(r.name, channel)
+	r.joined(channel)
 }
 
-func (r *ChannelReconciler) HandleKick(nick string, channel string) {
+func (r *ChannelReconciler) HandleKick(nick string, channel string, kicker string, reason string) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
@@ -220,7 +761,7 @@ func (r *ChannelReconciler) HandleKick(nick string, channel string) {
 		// received kick info for somebody else
 		return
 	}
-	logging.Info("Received KICK for channel %s", channel)
+	logging.Info("Received KICK for channel %s from %s: %s", channel, kicker, reason)
 
 	c, ok := r.channels[channel]
 	if !ok {
@@ -228,26 +769,497 @@ func (r *ChannelReconciler) HandleKick(nick string, channel string) {
 		return
 	}
 	c.UnsetJoined()
+	c.RecordEvent(channelEventKick, kicker, reason)
+	c.NotifyKick(kicker, reason)
 }
 
-func (r *ChannelReconciler) unsafeAddChannel(channel *IRCChannel) *channelState {
-	c := newChannelState(channel, r.client, r.delayerMaker, r.timeTeller, r.chanservName)
+// HandleNeedReggedNick logs that the channel is only open to identified
+// users. Joining it is retried once we are identified, see RetryJoins.
+func (r *ChannelReconciler) HandleNeedReggedNick(channel string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.channels[channel]
+	if !ok {
+		logging.Warn("Not processing ERR_NEEDREGGEDNICK for channel %s: unknown channel", channel)
+		return
+	}
+	c.RecordEvent(channelEventNeedReggedNick, "", reason)
+	c.joinLog.Warn("Channel %s requires being identified to join: %s", channel, reason)
+}
 
+// HandleBadChannelKey logs that the server refused the key of the channel.
+// Joining it is retried right away once its key is changed, see
+// UpdateChannelKeys.
+func (r *ChannelReconciler) HandleBadChannelKey(channel string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.channels[channel]
+	if !ok {
+		logging.Warn("Not processing ERR_BADCHANNELKEY for channel %s: unknown channel", channel)
+		return
+	}
+	c.RecordEvent(channelEventBadKey, "", reason)
+	c.HandleBadKey(reason)
+}
+
+// UpdateChannelKeys replaces the keys of the known channels by those of
+// channels, e.g. after they were rotated. Channels already joined stay so,
+// while those the server refused the previous key of try the new one right
+// away. Channels missing from either side are left alone.
+func (r *ChannelReconciler) UpdateChannelKeys(channels []IRCChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	keys := make(map[string]string)
+	for _, channel := range channels {
+		keys[channel.Name] = channel.Password
+	}
+
+	preJoinChannels := make([]IRCChannel, len(r.preJoinChannels))
+	for i, channel := range r.preJoinChannels {
+		if key, ok := keys[channel.Name]; ok {
+			channel.Password = key
+		}
+		preJoinChannels[i] = channel
+	}
+	r.preJoinChannels = preJoinChannels
+
+	for name, c := range r.channels {
+		key, ok := keys[name]
+		if !ok || !c.SetKey(key) {
+			continue
+		}
+		logging.Info("Channel %s: key changed after being refused, retrying to join now", name)
+		c.RetryNow()
+	}
+}
+
+// UpdateDisabledChannels applies the disabled flag of channels, e.g. after
+// the config was reloaded. Channels newly disabled are parted if joined and
+// no longer monitored, those enabled again are joined, if pre-joined.
+func (r *ChannelReconciler) UpdateDisabledChannels(channels []IRCChannel) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	disabled := make(map[string]string)
+	for _, channel := range channels {
+		if channel.Disabled {
+			disabled[channel.Name] = channel.redirectTo()
+		}
+	}
+	r.disabled = disabled
+
+	for name, c := range r.channels {
+		if _, ok := disabled[name]; !ok {
+			continue
+		}
+		logging.Info("Channel %s was disabled, no longer joining it", name)
+		c.stop()
+		c.markSettled()
+		c.mu.Lock()
+		joined := c.joined
+		c.mu.Unlock()
+		if joined {
+			r.client.Part(name, "channel disabled")
+		}
+		delete(r.channels, name)
+		r.metrics.ircLastMsgSentTimestamp.DeleteLabelValues(name)
+	}
+
+	if r.stopCtx == nil || r.stopCtx.Err() != nil {
+		// Not started, channels are joined on Start.
+		return
+	}
+	for i := range r.preJoinChannels {
+		channel := &r.preJoinChannels[i]
+		_, isDisabled := disabled[channel.Name]
+		_, known := r.channels[channel.Name]
+		if isDisabled || known || r.gaveUp[channel.Name] {
+			continue
+		}
+		logging.Info("Channel %s was enabled, joining it", channel.Name)
+		r.unsafeAddChannel(channel, r.noSuchChannelAttempts, nil)
+	}
+}
+
+// DisabledChannels describes the channels disabled in the config, sorted by
+// name.
+func (r *ChannelReconciler) DisabledChannels() []DisabledChannelStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	channels := []DisabledChannelStatus{}
+	for name, redirectTo := range r.disabled {
+		channels = append(channels, DisabledChannelStatus{Name: name, RedirectTo: redirectTo})
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return channels
+}
+
+// Disabled tells whether the channel is disabled in the config.
+func (r *ChannelReconciler) Disabled(channel string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	_, ok := r.disabled[channel]
+	return ok
+}
+
+// HandleNoSuchChannel gives up joining the channel if the server said too
+// many times that it does not exist, as it is likely misspelled.
+func (r *ChannelReconciler) HandleNoSuchChannel(channel string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.channels[channel]
+	if !ok {
+		logging.Warn("Not processing ERR_NOSUCHCHANNEL for channel %s: unknown channel", channel)
+		return
+	}
+	c.RecordEvent(channelEventNoSuchChannel, "", reason)
+	if !c.HandleNoSuchChannel(reason) {
+		return
+	}
+	logging.Error("Channel %s does not exist, giving up joining it after %d attempts",
+		channel, c.maxNoSuchChannel)
+	r.gaveUp[channel] = true
+	r.metrics.ircChannelGaveUp.WithLabelValues(r.name, channel).Set(1)
+	c.notify(fmt.Sprintf("Channel %s does not exist, giving up joining it, alerts to it are not delivered",
+		channel))
+}
+
+// ConfiguredChannels returns the channels of the config.
+func (r *ChannelReconciler) ConfiguredChannels() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	channels := []string{}
+	for _, channel := range r.preJoinChannels {
+		channels = append(channels, channel.Name)
+	}
+	return channels
+}
+
+// JoinedChannels returns the channels we believe joined, sorted by name.
+func (r *ChannelReconciler) JoinedChannels() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	channels := []string{}
+	for name, c := range r.channels {
+		c.mu.Lock()
+		if c.joined {
+			channels = append(channels, name)
+		}
+		c.mu.Unlock()
+	}
+	sort.Strings(channels)
+	return channels
+}
+
+// HandleNotPresent forgets that the channel was joined, as we turned out not
+// to be in it, so that it is joined again. It tells whether the channel was
+// believed joined.
+func (r *ChannelReconciler) HandleNotPresent(channel string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.channels[channel]
+	if !ok {
+		return false
+	}
+	c.mu.Lock()
+	joined := c.joined
+	c.mu.Unlock()
+	if !joined {
+		return false
+	}
+	c.UnsetJoined()
+	return true
+}
+
+// HandleBannedFromChannel makes joining the channel we are banned from only
+// be probed every banRetryInterval, as bans are usually timed.
+func (r *ChannelReconciler) HandleBannedFromChannel(channel string, reason string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	c, ok := r.channels[channel]
+	if !ok {
+		logging.Warn("Not processing ERR_BANNEDFROMCHAN for channel %s: unknown channel", channel)
+		return
+	}
+	c.RecordEvent(channelEventBanned, "", reason)
+	if !c.HandleBanned(reason) {
+		c.joinLog.Warn("Channel %s: still banned (%s)", channel, reason)
+		return
+	}
+	logging.Warn("Banned from channel %s (%s), trying to join it every %s",
+		channel, reason, r.banRetryInterval)
+	r.metrics.ircChannelBanned.WithLabelValues(r.name, channel).Set(1)
+	c.notify(fmt.Sprintf("Banned from %s (%s), alerts to it are not delivered, trying to join it every %s",
+		channel, reason, r.banRetryInterval))
+}
+
+// ChannelBanStatus describes a channel we are banned from in /status.
+type ChannelBanStatus struct {
+	Name      string    `json:"name"`
+	Reason    string    `json:"reason"`
+	NextProbe time.Time `json:"next_probe"`
+}
+
+// DisabledChannelStatus describes a channel disabled in the config in
+// /status.
+type DisabledChannelStatus struct {
+	Name string `json:"name"`
+	// RedirectTo is the channel its alerts are relayed to instead, if
+	// they are not dropped.
+	RedirectTo string `json:"redirect_to,omitempty"`
+}
+
+// ChannelEvent is a reason why we left or could not join a channel: a kick
+// by By, or an error numeric of the server. Count repeats of the same event
+// are merged, Time being the last one.
+type ChannelEvent struct {
+	Type   string    `json:"type"`
+	By     string    `json:"by,omitempty"`
+	Reason string    `json:"reason"`
+	Time   time.Time `json:"time"`
+	Count  int       `json:"count"`
+}
+
+// ChannelEvents lists the last events of a channel in /status.
+type ChannelEvents struct {
+	Name   string         `json:"name"`
+	Events []ChannelEvent `json:"events"`
+}
+
+// ChannelEvents returns the channels with events, sorted by name, and their
+// events, oldest first.
+func (r *ChannelReconciler) ChannelEvents() []ChannelEvents {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	channels := []ChannelEvents{}
+	for name, c := range r.channels {
+		c.mu.Lock()
+		if len(c.events) > 0 {
+			channels = append(channels, ChannelEvents{
+				Name:   name,
+				Events: append([]ChannelEvent{}, c.events...),
+			})
+		}
+		c.mu.Unlock()
+	}
+	// Between sessions, the events are only kept here.
+	for name, events := range r.events {
+		if _, ok := r.channels[name]; !ok && len(events) > 0 {
+			channels = append(channels, ChannelEvents{
+				Name:   name,
+				Events: append([]ChannelEvent{}, events...),
+			})
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		return channels[i].Name < channels[j].Name
+	})
+	return channels
+}
+
+// channelBan is the ban state of a channel kept between sessions.
+type channelBan struct {
+	reason    string
+	nextProbe time.Time
+}
+
+// BannedChannels returns the channels we are banned from, sorted by name.
+func (r *ChannelReconciler) BannedChannels() []ChannelBanStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	statuses := []ChannelBanStatus{}
+	for name, c := range r.channels {
+		c.mu.Lock()
+		if !c.banNextProbe.IsZero() {
+			statuses = append(statuses, ChannelBanStatus{
+				Name:      name,
+				Reason:    c.banReason,
+				NextProbe: c.banNextProbe,
+			})
+		}
+		c.mu.Unlock()
+	}
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Name < statuses[j].Name
+	})
+	return statuses
+}
+
+// RetryJoins makes the channels not joined yet try again without waiting for
+// their backoff, e.g. once identified to services.
+func (r *ChannelReconciler) RetryJoins() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.channels {
+		c.mu.Lock()
+		joined := c.joined
+		c.mu.Unlock()
+		if !joined {
+			c.RetryNow()
+		}
+	}
+}
+
+// Pause holds the join attempts of all channels back until Resume is called,
+// e.g. while we change nick or identify to services, without forgetting the
+// joined channels or their backoff. Pausing joins already paused does
+// nothing, and a single Resume resumes them.
+func (r *ChannelReconciler) Pause() {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+
+	if r.unsafePaused() {
+		return
+	}
+	logging.Info("Pausing channel joins")
+	r.resumed = make(chan struct{})
+}
+
+// Resume lets the join attempts held back by Pause go on.
+func (r *ChannelReconciler) Resume() {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+
+	if !r.unsafePaused() {
+		return
+	}
+	logging.Info("Resuming channel joins")
+	close(r.resumed)
+}
+
+// Paused tells whether join attempts are paused.
+func (r *ChannelReconciler) Paused() bool {
+	r.pauseMu.Lock()
+	defer r.pauseMu.Unlock()
+
+	return r.unsafePaused()
+}
+
+func (r *ChannelReconciler) unsafePaused() bool {
+	select {
+	case <-r.resumed:
+		return false
+	default:
+		return true
+	}
+}
+
+func (r *ChannelReconciler) waitResumed(ctx context.Context) bool {
+	r.pauseMu.Lock()
+	resumed := r.resumed
+	r.pauseMu.Unlock()
+
+	select {
+	case <-resumed:
+		return true
+	default:
+	}
+	logging.Info("Waiting for channel joins to be resumed")
+	select {
+	case <-resumed:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// HandleDisconnect forgets which channels were joined, so that they are
+// joined again once the connection is back.
+func (r *ChannelReconciler) HandleDisconnect() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for _, c := range r.channels {
+		c.mu.Lock()
+		joined := c.joined
+		c.mu.Unlock()
+		if joined {
+			c.UnsetJoined()
+		}
+	}
+}
+
+// notifyAbout sends a note about the channel to the notification channel,
+// unless it is the one affected, in which case the note could not be
+// delivered anyway.
+func (r *ChannelReconciler) notifyAbout(channel string, note string) {
+	if r.notificationChannel == "" {
+		return
+	}
+	if channel == r.notificationChannel {
+		logging.Warn("Not sending note about the notification channel to itself: %s", note)
+		return
+	}
+	r.notify(AlertMsg{Channel: r.notificationChannel, Alert: note})
+}
+
+func (r *ChannelReconciler) unsafeAddChannel(channel *IRCChannel, maxNoSuchChannel int, turn <-chan struct{}) *channelState {
+	name := channel.Name
+	c := newChannelState(channel, r.client, r.delayerMaker, r.joinSlots, r.waitResumed, turn, r.timeTeller, r.chanservName,
+		r.joinFailureThreshold, maxNoSuchChannel, func(note string) { r.notifyAbout(name, note) },
+		r.joinWait, r.joinMaxBackoff, r.joinBackoffReset)
+	c.banRetryInterval = r.banRetryInterval
+	if ban, ok := r.bans[name]; ok {
+		c.banReason = ban.reason
+		c.banNextProbe = ban.nextProbe
+	}
+	c.events = r.events[name]
+	c.rejoinMessage = r.rejoinMessages[name]
+	c.announce = func(lines []string) {
+		logging.Info("Announcing in %s that it was joined again after being kicked", name)
+		for _, line := range lines {
+			r.notify(AlertMsg{Channel: name, Alert: line})
+		}
+	}
+
+	var ctx context.Context
+	ctx, c.stop = context.WithCancel(r.stopCtx)
 	r.stopWg.Add(1)
-	go c.Monitor(r.stopCtx, &r.stopWg)
+	go c.Monitor(ctx, &r.stopWg)
 
 	r.channels[channel.Name] = c
 	return c
 }
 
+// CountQueued counts an alert to the channel which waits for it to be joined.
+func (r *ChannelReconciler) CountQueued(channel string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if c, ok := r.channels[channel]; ok {
+		c.CountQueued()
+	}
+}
+
 func (r *ChannelReconciler) JoinChannel(channel string) (bool, <-chan struct{}) {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
+	if r.gaveUp[channel] {
+		return false, nil
+	}
+	if _, ok := r.disabled[channel]; ok {
+		return false, nil
+	}
 	c, ok := r.channels[channel]
 	if !ok {
 		logging.Info("Request to JOIN new channel %s", channel)
-		c = r.unsafeAddChannel(&IRCChannel{Name: channel})
+		c = r.unsafeAddChannel(&IRCChannel{Name: channel}, r.noSuchChannelAttemptsDynamic, nil)
 	}
 
 	select {
@@ -265,6 +1277,16 @@ func (r *ChannelReconciler) unsafeStop() {
 	}
 	r.stopCtxCancel()
 	r.stopWg.Wait()
+	for name, c := range r.channels {
+		c.mu.Lock()
+		if c.banNextProbe.IsZero() {
+			delete(r.bans, name)
+		} else {
+			r.bans[name] = channelBan{c.banReason, c.banNextProbe}
+		}
+		r.events[name] = c.events
+		c.mu.Unlock()
+	}
 	r.channels = make(map[string]*channelState)
 }
 
@@ -283,7 +1305,47 @@ func (r *ChannelReconciler) Start(ctx context.Context) {
 
 	r.stopCtx, r.stopCtxCancel = context.WithCancel(ctx)
 
+	channels := []IRCChannel{}
 	for _, channel := range r.preJoinChannels {
-		r.unsafeAddChannel(&channel)
+		if r.gaveUp[channel.Name] {
+			logging.Warn("Not joining channel %s: it does not exist", channel.Name)
+			continue
+		}
+		if _, ok := r.disabled[channel.Name]; ok {
+			logging.Info("Not joining channel %s: it is disabled", channel.Name)
+			continue
+		}
+		channels = append(channels, channel)
+	}
+
+	// Channels of higher join priority are joined first, each priority
+	// taking its turn once the previous one is settled.
+	sort.SliceStable(channels, func(i, j int) bool {
+		return channels[i].JoinPriority > channels[j].JoinPriority
+	})
+	var turn chan struct{}
+	var previous []*channelState
+	for i := range channels {
+		if i > 0 && channels[i].JoinPriority != channels[i-1].JoinPriority {
+			turn = make(chan struct{})
+			r.stopWg.Add(1)
+			go releaseTurn(r.stopCtx, &r.stopWg, previous, turn)
+			previous = nil
+		}
+		previous = append(previous, r.unsafeAddChannel(&channels[i], r.noSuchChannelAttempts, turn))
+	}
+}
+
+// releaseTurn closes turn once all channels are settled.
+func releaseTurn(ctx context.Context, wg *sync.WaitGroup, channels []*channelState, turn chan struct{}) {
+	defer wg.Done()
+
+	for _, c := range channels {
+		select {
+		case <-c.settled:
+		case <-ctx.Done():
+			return
+		}
 	}
+	close(turn)
 }
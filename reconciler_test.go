@@ -17,13 +17,17 @@ package main
 import (
 	"bufio"
 	"context"
+	"fmt"
 	"reflect"
 	"sort"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
 	irc "github.com/fluffle/goirc/client"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 )
 
 func makeTestReconciler(config *Config) (*ChannelReconciler, chan bool, chan bool, *FakeTime) {
@@ -47,7 +51,8 @@ func makeTestReconciler(config *Config) (*ChannelReconciler, chan bool, chan boo
 	fakeTime := &FakeTime{
 		afterChan: make(chan time.Time, 1),
 	}
-	reconciler := NewChannelReconciler(config, client, fakeDelayerMaker, fakeTime)
+	reconciler := NewChannelReconciler(config, client, fakeDelayerMaker, fakeTime,
+		NewMetrics(prometheus.NewRegistry()))
 
 	return reconciler, sessionUp, sessionDown, fakeTime
 }
@@ -180,3 +185,899 @@ func TestKickRejoin(t *testing.T) {
 	server.Stop()
 
 }
+
+func TestKickNotification(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{
+		IRCChannel{Name: "#foo"},
+		IRCChannel{Name: "#alerts"},
+	}
+	config.NotificationChannel = "#alerts"
+	reconciler, sessionUp, sessionDown, _ := makeTestReconciler(config)
+	notes := make(chan AlertMsg, 10)
+	reconciler.notify = func(alertMsg AlertMsg) {
+		notes <- alertMsg
+	}
+
+	var testStep sync.WaitGroup
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		hJOIN(conn, line)
+		testStep.Done()
+		return nil
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(2)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	testStep.Wait()
+
+	// No note about the notification channel itself.
+	testStep.Add(1)
+	server.SendMsg(":op!~op@example.com KICK #alerts foo :Out\n")
+	testStep.Wait()
+
+	testStep.Add(1)
+	server.SendMsg(":op!~op@example.com KICK #foo foo :Bye!\n")
+	testStep.Wait()
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+
+	expectedNotes := []AlertMsg{
+		AlertMsg{Channel: "#alerts", Alert: "Kicked from #foo by op (Bye!), alerts to it are not delivered until it is joined again"},
+		AlertMsg{Channel: "#alerts", Alert: "Joined #foo again, alerts are delivered to it"},
+	}
+	close(notes)
+	actualNotes := []AlertMsg{}
+	for note := range notes {
+		actualNotes = append(actualNotes, note)
+	}
+	if !reflect.DeepEqual(expectedNotes, actualNotes) {
+		t.Errorf("Unexpected notes.\nExpected: %s\nActual: %s", expectedNotes, actualNotes)
+	}
+}
+
+func TestRejoinMessage(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{
+		IRCChannel{
+			Name:          "#foo",
+			RejoinMessage: "Back after {{ .Kicker }} kicked me ({{ .Reason }}),\n{{ .Queued }} alerts arrived meanwhile\x07",
+		},
+	}
+	reconciler, sessionUp, sessionDown, _ := makeTestReconciler(config)
+	notes := make(chan AlertMsg, 10)
+	reconciler.notify = func(alertMsg AlertMsg) {
+		notes <- alertMsg
+	}
+
+	joins := make(chan struct{}, 10)
+	rejoin := make(chan struct{})
+	var joinCounter int
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joinCounter++
+		joins <- struct{}{}
+		if joinCounter == 2 {
+			<-rejoin
+		}
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	<-joins
+	waitChannelJoinedByReconciler(reconciler, "#foo")
+
+	server.SendMsg(":op!~op@example.com KICK #foo foo :Bye!\n")
+	<-joins
+	reconciler.CountQueued("#foo")
+	reconciler.CountQueued("#foo")
+	close(rejoin)
+	waitChannelJoinedByReconciler(reconciler, "#foo")
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+
+	expectedNotes := []AlertMsg{
+		AlertMsg{Channel: "#foo", Alert: "Back after op kicked me (Bye!),"},
+		AlertMsg{Channel: "#foo", Alert: "2 alerts arrived meanwhile"},
+	}
+	close(notes)
+	actualNotes := []AlertMsg{}
+	for note := range notes {
+		actualNotes = append(actualNotes, note)
+	}
+	if !reflect.DeepEqual(expectedNotes, actualNotes) {
+		t.Errorf("Unexpected notes.\nExpected: %s\nActual: %s", expectedNotes, actualNotes)
+	}
+}
+
+func TestJoinFailureNotification(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.NotificationChannel = "#alerts"
+	config.NotificationJoinFailureThreshold = time.Minute
+	reconciler, sessionUp, sessionDown, fakeTime := makeTestReconciler(config)
+	// The first join attempt fails a minute after the channel is added.
+	fakeTime.timeseries = []int{0, 1}
+	fakeTime.durationUnit = time.Minute
+	notes := make(chan AlertMsg, 10)
+	reconciler.notify = func(alertMsg AlertMsg) {
+		notes <- alertMsg
+	}
+
+	var testStep sync.WaitGroup
+
+	// Confirm join only on the second attempt.
+	var joinedCounter int
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joinedCounter++
+		if joinedCounter == 2 {
+			testStep.Done()
+			return hJOIN(conn, line)
+		}
+		fakeTime.afterChan <- time.Now()
+		return nil
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(1)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	testStep.Wait()
+
+	if note := <-notes; note.Channel != "#alerts" || !strings.HasPrefix(note.Alert, "Could not join #foo for ") {
+		t.Errorf("Unexpected join failure note: %s", note)
+	}
+	if note := <-notes; note.Alert != "Joined #foo again, alerts are delivered to it" {
+		t.Errorf("Unexpected joined note: %s", note)
+	}
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+}
+
+func TestDisconnectWhileJoined(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{IRCChannel{Name: "#foo"}}
+	reconciler, sessionUp, sessionDown, fakeTime := makeTestReconciler(config)
+
+	// The monitor may retry joining, keep track of join requests loosely.
+	joins := make(chan string, 10)
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		select {
+		case joins <- line.Args[0]:
+		default:
+		}
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	<-joins
+	waitChannelJoinedByReconciler(reconciler, "#foo")
+
+	// Lose the connection, without restarting the reconciler.
+	server.Client.Close()
+	<-sessionDown
+	reconciler.HandleDisconnect()
+
+	if joined, _ := reconciler.JoinChannel("#foo"); joined {
+		t.Error("Channel still joined after disconnection")
+	}
+
+	// The previous connection may still close the new one as it winds
+	// down, reconnect until the channel is joined again.
+	for joined := false; !joined; {
+		if err := reconciler.client.Connect(); err != nil {
+			time.Sleep(10 * time.Millisecond)
+			continue
+		}
+		select {
+		case <-sessionUp:
+		case <-sessionDown:
+			continue
+		}
+		// Let the monitor retry, if it waited for the connection.
+		select {
+		case fakeTime.afterChan <- time.Now():
+		default:
+		}
+		select {
+		case <-joins:
+			joined = true
+		case <-sessionDown:
+		}
+	}
+	waitChannelJoinedByReconciler(reconciler, "#foo")
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+}
+
+func TestRetryJoins(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	reconciler, sessionUp, sessionDown, _ := makeTestReconciler(config)
+	// Join attempts wait for a backoff that never ends by itself.
+	reconciler.delayerMaker.(*FakeDelayerMaker).DelayOnChan = true
+
+	joins := make(chan string, 10)
+
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joins <- line.Args[0]
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	select {
+	case channel := <-joins:
+		t.Fatalf("Unexpected join of %s before the backoff", channel)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	reconciler.RetryJoins()
+
+	if channel := <-joins; channel != "#foo" {
+		t.Errorf("Expected to join #foo, got %s", channel)
+	}
+	waitChannelJoinedByReconciler(reconciler, "#foo")
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+}
+
+func TestGiveUpNoSuchChannel(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "typo"
+	config.IRCChannels = []IRCChannel{IRCChannel{Name: "#fooo"}}
+	config.IRCNoSuchChannelAttempts = 2
+	config.NotificationChannel = "#alerts"
+	reconciler, sessionUp, sessionDown, fakeTime := makeTestReconciler(config)
+	notes := make(chan AlertMsg, 10)
+	reconciler.notify = func(alertMsg AlertMsg) {
+		notes <- alertMsg
+	}
+
+	joins := make(chan string, 10)
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joins <- line.Args[0]
+		_, err := conn.WriteString(":example.com 403 foo " + line.Args[0] + " :No such channel\n")
+		// Let the first attempt time out, the second one gives up.
+		if len(joins) == 1 {
+			fakeTime.afterChan <- time.Now()
+		}
+		return err
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	note := <-notes
+	if note.Channel != "#alerts" || !strings.HasPrefix(note.Alert, "Channel #fooo does not exist, giving up") {
+		t.Errorf("Unexpected give up note: %s", note)
+	}
+
+	gaveUp := reconciler.metrics.ircChannelGaveUp.WithLabelValues("typo", "#fooo")
+	if v := testutil.ToFloat64(gaveUp); v != 1 {
+		t.Errorf("Expected irc_channel_gave_up to be 1, got %f", v)
+	}
+	if joined, waitJoined := reconciler.JoinChannel("#fooo"); joined || waitJoined != nil {
+		t.Errorf("Expected not to wait for a channel we gave up joining")
+	}
+
+	// The channel is not joined again on the next session.
+	reconciler.Start(context.Background())
+	time.Sleep(50 * time.Millisecond)
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+
+	if len(joins) != 2 {
+		t.Errorf("Expected 2 join attempts, got %d", len(joins))
+	}
+}
+
+func TestGiveUpNoSuchDynamicChannel(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = nil
+	config.IRCNoSuchChannelAttempts = 5
+	config.IRCNoSuchChannelAttemptsDynamic = 1
+	reconciler, sessionUp, sessionDown, _ := makeTestReconciler(config)
+
+	joins := make(chan string, 10)
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joins <- line.Args[0]
+		_, err := conn.WriteString(":example.com 403 foo " + line.Args[0] + " :No such channel\n")
+		return err
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	if joined, waitJoined := reconciler.JoinChannel("#bar"); joined || waitJoined == nil {
+		t.Fatalf("Expected to wait for #bar to be joined")
+	}
+	for {
+		if _, waitJoined := reconciler.JoinChannel("#bar"); waitJoined == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+
+	if len(joins) != 1 {
+		t.Errorf("Expected 1 join attempt, got %d", len(joins))
+	}
+}
+
+func TestSharedJoinPolicy(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{
+		IRCChannel{Name: "#foo"},
+		IRCChannel{Name: "#bar"},
+		IRCChannel{Name: "#baz"},
+	}
+	config.IRCJoinPolicy = joinPolicyShared
+	config.IRCJoinSpacing = 50 * time.Millisecond
+	reconciler, sessionUp, sessionDown, _ := makeTestReconciler(config)
+
+	var testStep sync.WaitGroup
+	var joinTimes []time.Time
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joinTimes = append(joinTimes, time.Now())
+		testStep.Done()
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	testStep.Add(3)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	testStep.Wait()
+
+	// All channels are joined again once reconnected.
+	testStep.Add(3)
+	reconciler.HandleDisconnect()
+	reconciler.Start(context.Background())
+
+	testStep.Wait()
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+
+	// Allow for some scheduling slack on the server side.
+	for i := 1; i < len(joinTimes); i++ {
+		if gap := joinTimes[i].Sub(joinTimes[i-1]); gap < config.IRCJoinSpacing/2 {
+			t.Errorf("Join #%d only %s after the previous one", i, gap)
+		}
+	}
+}
+
+func TestPauseResume(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{IRCChannel{Name: "#foo"}}
+	reconciler, sessionUp, sessionDown, _ := makeTestReconciler(config)
+
+	joins := make(chan string, 10)
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joins <- line.Args[0]
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+
+	// Pausing is idempotent.
+	reconciler.Pause()
+	reconciler.Pause()
+	if !reconciler.Paused() {
+		t.Errorf("Expected joins to be paused")
+	}
+	reconciler.Start(context.Background())
+
+	select {
+	case channel := <-joins:
+		t.Fatalf("Unexpected join of %s while paused", channel)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	reconciler.Resume()
+	reconciler.Resume()
+	if reconciler.Paused() {
+		t.Errorf("Expected joins to be resumed")
+	}
+	if channel := <-joins; channel != "#foo" {
+		t.Errorf("Expected to join #foo, got %s", channel)
+	}
+	waitChannelJoinedByReconciler(reconciler, "#foo")
+
+	// Joined channels are kept while paused.
+	reconciler.Pause()
+	if joined, _ := reconciler.JoinChannel("#foo"); !joined {
+		t.Errorf("Expected #foo to stay joined while paused")
+	}
+	reconciler.Resume()
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+}
+
+func waitChannelJoinedByReconciler(reconciler *ChannelReconciler, channel string) {
+	for {
+		if joined, _ := reconciler.JoinChannel(channel); joined {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestJoinPriority(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{
+		IRCChannel{Name: "#archive"},
+		IRCChannel{Name: "#ops", JoinPriority: 10},
+		IRCChannel{Name: "#team", JoinPriority: 5},
+	}
+	reconciler, sessionUp, sessionDown, fakeTime := makeTestReconciler(config)
+
+	// #ops cannot be joined.
+	joins := make(chan string, 10)
+	joinHandler := func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joins <- line.Args[0]
+		if line.Args[0] == "#ops" {
+			return nil
+		}
+		return hJOIN(conn, line)
+	}
+	server.SetHandler("JOIN", joinHandler)
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	expectJoin := func(expected string) {
+		select {
+		case channel := <-joins:
+			if channel != expected {
+				t.Errorf("Expected join of %s, got %s", expected, channel)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected join of %s", expected)
+		}
+	}
+
+	// Lower priorities wait while #ops is tried.
+	for i := 0; i < joinPriorityAttempts; i++ {
+		expectJoin("#ops")
+		select {
+		case channel := <-joins:
+			t.Fatalf("Unexpected join of %s during attempt %d on #ops", channel, i+1)
+		case <-time.After(50 * time.Millisecond):
+		}
+		fakeTime.afterChan <- time.Now()
+	}
+
+	// Then #team is joined, and #archive after it, while #ops is retried.
+	var others []string
+	for i := 0; i < 3; i++ {
+		select {
+		case channel := <-joins:
+			if channel != "#ops" {
+				others = append(others, channel)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected 3 more joins, got %d", i)
+		}
+	}
+	if expected := []string{"#team", "#archive"}; !reflect.DeepEqual(expected, others) {
+		t.Errorf("Expected joins of %q, got %q", expected, others)
+	}
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+}
+
+func TestChannelBanRetry(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.ConnectionName = "main"
+	config.IRCChannelBanRetryInterval = time.Hour
+	reconciler, sessionUp, sessionDown, fakeTime := makeTestReconciler(config)
+
+	// The ban is lifted after the second attempt.
+	joins := make(chan string, 10)
+	attempts := 0
+	server.SetHandler("JOIN", func(conn *bufio.ReadWriter, line *irc.Line) error {
+		attempts++
+		joins <- line.Args[0]
+		if attempts <= 2 {
+			_, err := conn.WriteString(fmt.Sprintf(
+				":example.com 474 foo %s :Cannot join channel (+b)\n", line.Args[0]))
+			return err
+		}
+		return hJOIN(conn, line)
+	})
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	expectJoin := func() {
+		select {
+		case <-joins:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a join attempt")
+		}
+	}
+	expectNoJoin := func() {
+		select {
+		case <-joins:
+			t.Fatalf("Unexpected join attempt while banned")
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+	waitBanned := func(since time.Time) ChannelBanStatus {
+		for i := 0; i < 100; i++ {
+			if bans := reconciler.BannedChannels(); len(bans) == 1 && bans[0].NextProbe.After(since) {
+				return bans[0]
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("Expected #foo to be banned, got %v", reconciler.BannedChannels())
+		return ChannelBanStatus{}
+	}
+
+	start := time.Now()
+	expectJoin()
+	ban := waitBanned(start)
+	if ban.Name != "#foo" || ban.NextProbe.Before(start.Add(59*time.Minute)) {
+		t.Errorf("Unexpected ban status: %v", ban)
+	}
+	if v := testutil.ToFloat64(reconciler.metrics.ircChannelBanned.WithLabelValues("main", "#foo")); v != 1 {
+		t.Errorf("Expected #foo to be banned, got %f", v)
+	}
+
+	// The join attempt times out, and the next one waits for the probe.
+	fakeTime.afterChan <- time.Now()
+	expectNoJoin()
+
+	// Retrying now probes the ban right away, which re-arms it.
+	reconciler.RetryJoins()
+	expectJoin()
+	waitBanned(ban.NextProbe)
+
+	// The probe is due, the ban is gone.
+	fakeTime.afterChan <- time.Now()
+	fakeTime.afterChan <- time.Now()
+	expectJoin()
+	for i := 0; len(reconciler.BannedChannels()) > 0; i++ {
+		if i == 100 {
+			t.Fatalf("Expected no ban, got %v", reconciler.BannedChannels())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+}
+
+func TestChannelKeyRotation(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{
+		IRCChannel{Name: "#foo", Password: "old"},
+		IRCChannel{Name: "#bar", Password: "old"},
+	}
+	reconciler, sessionUp, sessionDown, fakeTime := makeTestReconciler(config)
+
+	// #foo only accepts the new key.
+	joins := make(chan string, 10)
+	server.SetHandler("JOIN", func(conn *bufio.ReadWriter, line *irc.Line) error {
+		joins <- line.Args[0] + " " + line.Args[1]
+		if line.Args[0] == "#foo" && line.Args[1] != "new" {
+			_, err := conn.WriteString(fmt.Sprintf(
+				":example.com 475 foo %s :Cannot join channel (+k)\n", line.Args[0]))
+			return err
+		}
+		return hJOIN(conn, line)
+	})
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	expectJoin := func(expected string) {
+		t.Helper()
+		select {
+		case join := <-joins:
+			if join != expected {
+				t.Errorf("Expected join '%s', got '%s'", expected, join)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected join '%s'", expected)
+		}
+	}
+	expectJoins := func(expected ...string) {
+		t.Helper()
+		got := []string{}
+		for range expected {
+			select {
+			case join := <-joins:
+				got = append(got, join)
+			case <-time.After(time.Second):
+				t.Fatalf("Expected joins %q, got %q", expected, got)
+			}
+		}
+		sort.Strings(got)
+		sort.Strings(expected)
+		if !reflect.DeepEqual(expected, got) {
+			t.Errorf("Expected joins %q, got %q", expected, got)
+		}
+	}
+
+	expectJoins("#bar old", "#foo old")
+	for i := 0; ; i++ {
+		reconciler.mu.Lock()
+		c := reconciler.channels["#foo"]
+		reconciler.mu.Unlock()
+		c.mu.Lock()
+		badKey := c.badKey
+		c.mu.Unlock()
+		if badKey {
+			break
+		}
+		if i == 100 {
+			t.Fatalf("Expected the key of #foo to be refused")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	// The joined channel is left alone, the other one tries the new key.
+	reconciler.UpdateChannelKeys([]IRCChannel{
+		IRCChannel{Name: "#foo", Password: "new"},
+		IRCChannel{Name: "#bar", Password: "new"},
+	})
+	fakeTime.afterChan <- time.Now()
+	expectJoin("#foo new")
+	select {
+	case join := <-joins:
+		t.Errorf("Unexpected join '%s'", join)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The new keys are used in the next session too.
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+	for _, channel := range reconciler.preJoinChannels {
+		if channel.Password != "new" {
+			t.Errorf("Expected new key for %s, got '%s'", channel.Name, channel.Password)
+		}
+	}
+	if config.IRCChannels[0].Password != "old" {
+		t.Errorf("Expected the config to be left alone")
+	}
+
+	server.Stop()
+}
+
+func TestDisabledChannelsJoins(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	config.IRCChannels = []IRCChannel{
+		IRCChannel{Name: "#foo"},
+		IRCChannel{Name: "#bar", Disabled: true, RedirectTo: "#foo"},
+	}
+	reconciler, sessionUp, sessionDown, _ := makeTestReconciler(config)
+
+	commands := make(chan string, 10)
+	server.SetHandler("JOIN", func(conn *bufio.ReadWriter, line *irc.Line) error {
+		commands <- "JOIN " + line.Args[0]
+		return hJOIN(conn, line)
+	})
+	server.SetHandler("PART", func(conn *bufio.ReadWriter, line *irc.Line) error {
+		commands <- "PART " + line.Args[0]
+		return nil
+	})
+	expectCommand := func(expected string) {
+		t.Helper()
+		select {
+		case command := <-commands:
+			if command != expected {
+				t.Errorf("Expected '%s', got '%s'", expected, command)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Expected '%s'", expected)
+		}
+	}
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	// The disabled channel is neither joined nor joined on demand.
+	expectCommand("JOIN #foo")
+	waitChannelJoinedByReconciler(reconciler, "#foo")
+	if ok, done := reconciler.JoinChannel("#bar"); ok || done != nil {
+		t.Errorf("Expected the disabled channel not to be joined")
+	}
+	expected := []DisabledChannelStatus{{Name: "#bar", RedirectTo: "#foo"}}
+	if got := reconciler.DisabledChannels(); !reflect.DeepEqual(expected, got) {
+		t.Errorf("Expected disabled channels %+v, got %+v", expected, got)
+	}
+
+	// Once the config is reloaded, the channel newly disabled is parted,
+	// and forgotten, and the one enabled joined.
+	reconciler.metrics.ircLastMsgSentTimestamp.WithLabelValues("#foo").SetToCurrentTime()
+	reconciler.UpdateDisabledChannels([]IRCChannel{
+		IRCChannel{Name: "#foo", Disabled: true},
+		IRCChannel{Name: "#bar"},
+	})
+	expectCommand("PART #foo")
+	expectCommand("JOIN #bar")
+	if !reconciler.Disabled("#foo") || reconciler.Disabled("#bar") {
+		t.Errorf("Expected #foo to be disabled, and not #bar")
+	}
+	if reconciler.metrics.ircLastMsgSentTimestamp.DeleteLabelValues("#foo") {
+		t.Error("Expected last message sent series of #foo to be removed")
+	}
+	select {
+	case command := <-commands:
+		t.Errorf("Unexpected command '%s'", command)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	server.Stop()
+}
+
+func TestChannelEvents(t *testing.T) {
+	server, port := makeTestServer(t)
+	config := makeTestIRCConfig(port)
+	reconciler, sessionUp, sessionDown, fakeTime := makeTestReconciler(config)
+
+	// The key is refused twice, then the channel is joined.
+	joins := make(chan string, 10)
+	attempts := 0
+	server.SetHandler("JOIN", func(conn *bufio.ReadWriter, line *irc.Line) error {
+		attempts++
+		defer func() { joins <- line.Args[0] }()
+		if attempts <= 2 {
+			_, err := conn.WriteString(fmt.Sprintf(
+				":example.com 475 foo %s :Cannot join channel (+k)\n", line.Args[0]))
+			return err
+		}
+		return hJOIN(conn, line)
+	})
+
+	reconciler.client.Connect()
+
+	<-sessionUp
+	reconciler.Start(context.Background())
+
+	expectJoin := func() {
+		t.Helper()
+		select {
+		case <-joins:
+		case <-time.After(time.Second):
+			t.Fatalf("Expected a join attempt")
+		}
+	}
+	expectJoin()
+	fakeTime.afterChan <- time.Now()
+	expectJoin()
+	fakeTime.afterChan <- time.Now()
+	expectJoin()
+
+	server.SendMsg(":test!~test@example.com KICK #foo foo :Bye!\n")
+	expectJoin()
+
+	reconciler.client.Quit("see ya")
+	<-sessionDown
+	reconciler.Stop()
+
+	// Events are kept between sessions.
+	channels := reconciler.ChannelEvents()
+	if len(channels) != 1 || channels[0].Name != "#foo" || len(channels[0].Events) != 2 {
+		t.Fatalf("Expected two events for #foo, got %+v", channels)
+	}
+	badKey, kick := channels[0].Events[0], channels[0].Events[1]
+	if badKey.Type != "bad_key" || badKey.Count != 2 || badKey.Reason != "Cannot join channel (+k)" {
+		t.Errorf("Unexpected bad key event: %+v", badKey)
+	}
+	if kick.Type != "kick" || kick.By != "test" || kick.Reason != "Bye!" || kick.Count != 1 {
+		t.Errorf("Unexpected kick event: %+v", kick)
+	}
+	if kick.Time.Before(badKey.Time) {
+		t.Errorf("Expected events in order, got %+v", channels[0].Events)
+	}
+
+	server.Stop()
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+// ConfigReloader reloads the config file on SIGHUP, and applies its message
+// formatting settings, channel keys and disabled channels. The new config is
+// validated in full first, and a config with any error is rejected as a
+// whole, the relay then keeps running with the previous one. Other settings
+// take effect on restart.
+type ConfigReloader struct {
+	path       string
+	httpServer *HTTPServer
+	metrics    *Metrics
+}
+
+func NewConfigReloader(path string, httpServer *HTTPServer, metrics *Metrics) *ConfigReloader {
+	return &ConfigReloader{
+		path:       path,
+		httpServer: httpServer,
+		metrics:    metrics,
+	}
+}
+
+// Reload loads the config file again, and applies it if it is valid.
+func (r *ConfigReloader) Reload() error {
+	config, err := LoadConfig(r.path)
+	var formatter *Formatter
+	if err == nil {
+		formatter, err = NewFormatter(config, r.metrics)
+	}
+	if err != nil {
+		logging.Error("Could not reload config %s, keeping the current one: %s", r.path, err)
+		r.metrics.configReloadFailed.Inc()
+		return err
+	}
+	r.httpServer.SetFormatter(formatter)
+	r.httpServer.SetDisabledChannels(config.DisabledChannels())
+	r.httpServer.SetChannelAllowlist(NewChannelAllowlist(config))
+	for _, connection := range config.ConnectionConfigs() {
+		for _, notifier := range r.httpServer.Notifiers {
+			if notifier.Name == connection.ConnectionName {
+				notifier.UpdateChannels(connection.IRCChannels)
+			}
+		}
+	}
+	logging.Info("Reloaded config %s, message formatting settings, channel keys, disabled and allowed channels applied, others take effect on restart",
+		r.path)
+	return nil
+}
+
+// Run reloads the config on each SIGHUP until ctx is canceled.
+func (r *ConfigReloader) Run(ctx context.Context, stopWg *sync.WaitGroup) {
+	defer stopWg.Done()
+
+	c := make(chan os.Signal, 1)
+	signal.Notify(c, syscall.SIGHUP)
+	defer signal.Stop(c)
+
+	for {
+		select {
+		case <-c:
+			logging.Info("Received SIGHUP, reloading config %s", r.path)
+			r.Reload()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,83 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestConfigReload(t *testing.T) {
+	dir, err := ioutil.TempDir("", "airtestreload")
+	if err != nil {
+		t.Fatalf("Could not create tmpdir for testing: %s", err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "config.yml")
+	writeConfig := func(data string) {
+		if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatalf("Could not write config: %s", err)
+		}
+	}
+
+	writeConfig("msg_template: \"first {{ .Status }}\"\n")
+	config, err := LoadConfig(path)
+	if err != nil {
+		t.Fatalf("Could not load config: %s", err)
+	}
+	metrics := NewMetrics(prometheus.NewRegistry())
+	httpServer, err := NewHTTPServerForTesting(config, make(chan AlertMsg), nil, metrics)
+	if err != nil {
+		t.Fatalf("Could not create HTTP server: %s", err)
+	}
+	reloader := NewConfigReloader(path, httpServer, metrics)
+
+	expectMsg := func(expected string) {
+		t.Helper()
+		lines := httpServer.getFormatter().FormatMsg("#somechannel", &promtmpl.Data{Status: "firing"})
+		if !reflect.DeepEqual([]string{expected}, lines) {
+			t.Errorf("Expected message '%s', got %q", expected, lines)
+		}
+	}
+
+	writeConfig("msg_template: \"second {{ .Status }}\"\n")
+	if err := reloader.Reload(); err != nil {
+		t.Errorf("Expected config to be reloaded, got: %s", err)
+	}
+	expectMsg("second firing")
+
+	// Invalid configs are rejected as a whole.
+	for _, data := range []string{
+		"msg_template: \"third {{ .Status \"\n",
+		"msg_template: \"third {{ .Status }}\"\nmax_lines_per_alert: -1\n",
+		"msg_template: \"third {{ .Status }}\"\nno_such_setting: 1\n",
+	} {
+		writeConfig(data)
+		if err := reloader.Reload(); err == nil {
+			t.Errorf("Expected config to be rejected: %s", data)
+		}
+		expectMsg("second firing")
+	}
+	if v := testutil.ToFloat64(metrics.configReloadFailed); v != 3 {
+		t.Errorf("Expected 3 failed reloads, got %f", v)
+	}
+}
@@ -0,0 +1,121 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+// Limits of a render, as labelled in the format_render_limits_total metric.
+const (
+	renderLimitSize = "size"
+	renderLimitTime = "time"
+)
+
+type renderLimitError struct {
+	limit string
+	err   error
+}
+
+func (e *renderLimitError) Error() string {
+	return e.err.Error()
+}
+
+// limitedWriter buffers the output of a template, and fails writes past max
+// bytes, if set, or once rendering was abandoned, so that runaway templates
+// stop at their next write.
+type limitedWriter struct {
+	max int
+
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	abandoned bool
+}
+
+func (w *limitedWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.abandoned {
+		return 0, errors.New("rendering abandoned")
+	}
+	if w.max > 0 && w.buf.Len()+len(p) > w.max {
+		return 0, &renderLimitError{renderLimitSize,
+			fmt.Errorf("output exceeds %d bytes", w.max)}
+	}
+	return w.buf.Write(p)
+}
+
+func (w *limitedWriter) abandon() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.abandoned = true
+}
+
+// executeTemplate renders the template within MaxRenderBytes and
+// RenderTimeout, if set. Renders taking too long are abandoned: they go on
+// in the background until they write again, or return.
+func (f *Formatter) executeTemplate(tmpl *template.Template, data interface{}) (string, error) {
+	w := &limitedWriter{max: f.MaxRenderBytes}
+	if f.RenderTimeout <= 0 {
+		err := tmpl.Execute(w, data)
+		return w.buf.String(), unwrapRenderError(err)
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- tmpl.Execute(w, data)
+	}()
+	timer := time.NewTimer(f.RenderTimeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return w.buf.String(), unwrapRenderError(err)
+	case <-timer.C:
+		w.abandon()
+		return "", &renderLimitError{renderLimitTime,
+			fmt.Errorf("rendering took longer than %s", f.RenderTimeout)}
+	}
+}
+
+// unwrapRenderError returns the renderLimitError behind a template error,
+// if any, so that it can be told apart.
+func unwrapRenderError(err error) error {
+	var limitErr *renderLimitError
+	if errors.As(err, &limitErr) {
+		return limitErr
+	}
+	return err
+}
+
+// templateLines splits the output of a template into lines, without the
+// empty ones and control characters, for templates rendering whole messages.
+func templateLines(output string) []string {
+	lines := []string{}
+	for _, line := range strings.FieldsFunc(output, func(r rune) bool {
+		return r == '\n' || r == '\r'
+	}) {
+		if line = stripControlCharacters(line); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	return lines
+}
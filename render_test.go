@@ -0,0 +1,112 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"strings"
+	"testing"
+	"text/template"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestRenderSizeLimit(t *testing.T) {
+	testingConfig := Config{
+		MsgTemplate:    "{{ .Labels.alertname }}: {{ .Annotations.description }}",
+		MaxRenderBytes: 100,
+	}
+	f, _ := NewFormatter(&testingConfig, NewMetrics(prometheus.NewRegistry()))
+
+	for _, tc := range []struct {
+		description string
+		expected    string
+	}{
+		{"short", "airDown: short"},
+		{strings.Repeat("x", 1000), ""},
+	} {
+		data := &promtmpl.Data{
+			Alerts: promtmpl.Alerts{
+				promtmpl.Alert{
+					Status:      "firing",
+					Labels:      promtmpl.KV{"alertname": "airDown"},
+					Annotations: promtmpl.KV{"description": tc.description},
+				},
+			},
+		}
+		alertMsgs := f.GetMsgsFromAlertMessage("#somechannel", data)
+		if len(alertMsgs) != 1 {
+			t.Fatalf("Expected 1 message, got %d", len(alertMsgs))
+		}
+		if tc.expected != "" {
+			if alertMsgs[0].Alert != tc.expected {
+				t.Errorf("Expected %q, got %q", tc.expected, alertMsgs[0].Alert)
+			}
+			continue
+		}
+		// The raw alert is sent instead, cut short too.
+		if msg := alertMsgs[0].Alert; len(msg) > 100+len(" "+truncatedMarker) ||
+			!strings.HasPrefix(msg, "{") || !strings.HasSuffix(msg, truncatedMarker) {
+			t.Errorf("Unexpected fallback message %q", msg)
+		}
+	}
+
+	if v := testutil.ToFloat64(f.metrics.formatRenderLimits.WithLabelValues("msg", renderLimitSize)); v != 1 {
+		t.Errorf("Expected the size limit to be counted once, got %f", v)
+	}
+	if v := testutil.ToFloat64(f.metrics.formatRenderErrors.WithLabelValues("msg")); v != 1 {
+		t.Errorf("Expected 1 render error, got %f", v)
+	}
+}
+
+func TestRenderTimeout(t *testing.T) {
+	f := &Formatter{RenderTimeout: 10 * time.Millisecond}
+
+	unblock := make(chan struct{})
+	tmpl := template.Must(template.New("slow").Funcs(template.FuncMap{
+		"slow": func() string {
+			<-unblock
+			return "late"
+		},
+	}).Parse("{{ slow }}{{ slow }}"))
+	_, err := f.executeTemplate(tmpl, nil)
+	limitErr, ok := err.(*renderLimitError)
+	if !ok || limitErr.limit != renderLimitTime {
+		t.Fatalf("Expected the render to time out, got %v", err)
+	}
+	// The abandoned render stops at its next write.
+	close(unblock)
+
+	fast := template.Must(template.New("fast").Parse("fast"))
+	if output, err := f.executeTemplate(fast, nil); err != nil || output != "fast" {
+		t.Errorf("Unexpected render: %q, %v", output, err)
+	}
+}
+
+func TestLimitedWriterAbandoned(t *testing.T) {
+	w := &limitedWriter{}
+	if _, err := w.Write([]byte("before")); err != nil {
+		t.Errorf("Unexpected error: %s", err)
+	}
+	w.abandon()
+	if _, err := w.Write([]byte("after")); err == nil {
+		t.Error("Expected writes to fail once abandoned")
+	}
+	if w.buf.String() != "before" {
+		t.Errorf("Unexpected output %q", w.buf.String())
+	}
+}
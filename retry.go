@@ -0,0 +1,202 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+const (
+	defaultWebhookRetryDedupMaxEntries = 10000
+
+	// Webhooks sent with ?retry_dedup=false are relayed in full.
+	retryDedupParam = "retry_dedup"
+)
+
+type retryDelivery struct {
+	key       string
+	delivered time.Time
+}
+
+// RetryDeduplicator remembers the alerts delivered to each channel by group
+// key, fingerprint and status, so that when Alertmanager retries a webhook
+// which was only partially delivered, the alerts already delivered are
+// skipped. Deliveries are remembered for ttl, up to maxEntries, the oldest
+// being forgotten first. A nil *RetryDeduplicator remembers nothing.
+type RetryDeduplicator struct {
+	ttl        time.Duration
+	maxEntries int
+	timeTeller TimeTeller
+	metrics    *Metrics
+
+	mu        sync.Mutex
+	delivered map[string]*list.Element
+	// order lists the deliveries, the oldest first.
+	order *list.List
+}
+
+// NewRetryDeduplicator returns nil, deduplicating nothing, if ttl is not
+// set.
+func NewRetryDeduplicator(ttl time.Duration, maxEntries int, timeTeller TimeTeller, metrics *Metrics) *RetryDeduplicator {
+	if ttl <= 0 {
+		return nil
+	}
+	return &RetryDeduplicator{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		timeTeller: timeTeller,
+		metrics:    metrics,
+		delivered:  make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+func retryKey(ircChannel string, groupKey string, alert *promtmpl.Alert) string {
+	return ircChannel + "\x00" + groupKey + "\x00" + alertFingerprint(alert) + "\x00" + alert.Status
+}
+
+// Filter splits the alerts of the group into those not delivered to the
+// channel yet, and those which were within ttl.
+func (d *RetryDeduplicator) Filter(ircChannel string, groupKey string, alerts promtmpl.Alerts) (promtmpl.Alerts, promtmpl.Alerts) {
+	if d == nil {
+		return alerts, nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	d.unsafePrune(d.timeTeller.Now())
+	remaining := promtmpl.Alerts{}
+	skipped := promtmpl.Alerts{}
+	for i := range alerts {
+		if _, ok := d.delivered[retryKey(ircChannel, groupKey, &alerts[i])]; ok {
+			skipped = append(skipped, alerts[i])
+		} else {
+			remaining = append(remaining, alerts[i])
+		}
+	}
+	if len(skipped) > 0 {
+		d.metrics.webhookRetryDuplicateAlerts.WithLabelValues(ircChannel).Add(float64(len(skipped)))
+	}
+	return remaining, skipped
+}
+
+// Record remembers that the alerts of the group were delivered to the
+// channel.
+func (d *RetryDeduplicator) Record(ircChannel string, groupKey string, alerts promtmpl.Alerts) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.timeTeller.Now()
+	for i := range alerts {
+		key := retryKey(ircChannel, groupKey, &alerts[i])
+		if element, ok := d.delivered[key]; ok {
+			d.order.Remove(element)
+		}
+		d.delivered[key] = d.order.PushBack(&retryDelivery{key: key, delivered: now})
+	}
+	if evicted := d.order.Len() - d.maxEntries; evicted > 0 {
+		logging.Warn("More than %d alert deliveries within %s, forgetting the %d oldest",
+			d.maxEntries, d.ttl, evicted)
+		d.metrics.webhookRetryDedupEvictions.Add(float64(evicted))
+		for ; evicted > 0; evicted-- {
+			d.unsafeRemove(d.order.Front())
+		}
+	}
+}
+
+func (d *RetryDeduplicator) unsafeRemove(element *list.Element) {
+	d.order.Remove(element)
+	delete(d.delivered, element.Value.(*retryDelivery).key)
+}
+
+// unsafePrune forgets the deliveries older than ttl.
+func (d *RetryDeduplicator) unsafePrune(now time.Time) {
+	for element := d.order.Front(); element != nil; element = d.order.Front() {
+		if now.Sub(element.Value.(*retryDelivery).delivered) < d.ttl {
+			return
+		}
+		d.unsafeRemove(element)
+	}
+}
+
+// ExportState returns the alert deliveries remembered, the oldest first.
+func (d *RetryDeduplicator) ExportState() []DeliveryState {
+	if d == nil {
+		return nil
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	deliveries := []DeliveryState{}
+	for element := d.order.Front(); element != nil; element = element.Next() {
+		delivery := element.Value.(*retryDelivery)
+		deliveries = append(deliveries, DeliveryState{
+			Key:       delivery.key,
+			Delivered: delivery.delivered,
+		})
+	}
+	return deliveries
+}
+
+// ImportState remembers the alert deliveries, in addition to the ones already
+// remembered, up to maxEntries.
+func (d *RetryDeduplicator) ImportState(deliveries []DeliveryState) {
+	if d == nil {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	sorted := append([]DeliveryState{}, deliveries...)
+	sort.SliceStable(sorted, func(i, j int) bool {
+		return sorted[i].Delivered.Before(sorted[j].Delivered)
+	})
+	for _, delivery := range sorted {
+		if element, ok := d.delivered[delivery.Key]; ok {
+			d.order.Remove(element)
+		}
+		d.delivered[delivery.Key] = d.unsafeInsertInOrder(&retryDelivery{
+			key:       delivery.Key,
+			delivered: delivery.Delivered,
+		})
+	}
+	for d.order.Len() > d.maxEntries {
+		d.unsafeRemove(d.order.Front())
+	}
+	d.unsafePrune(d.timeTeller.Now())
+}
+
+// unsafeInsertInOrder inserts the delivery after those delivered before it.
+func (d *RetryDeduplicator) unsafeInsertInOrder(delivery *retryDelivery) *list.Element {
+	for element := d.order.Back(); element != nil; element = element.Prev() {
+		if !element.Value.(*retryDelivery).delivered.After(delivery.delivered) {
+			return d.order.InsertAfter(delivery, element)
+		}
+	}
+	return d.order.PushFront(delivery)
+}
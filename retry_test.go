@@ -0,0 +1,95 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func makeTestRetryDeduplicator(elapsedTime []int, maxEntries int) *RetryDeduplicator {
+	fakeTime := &FakeTime{
+		timeseries:   elapsedTime,
+		durationUnit: time.Second,
+	}
+	return NewRetryDeduplicator(time.Minute, maxEntries, fakeTime, NewMetrics(prometheus.NewRegistry()))
+}
+
+func TestRetryDeduplicator(t *testing.T) {
+	retries := makeTestRetryDeduplicator([]int{0, 10, 20, 30, 80}, 10)
+	airDown := digestTestAlert("a", "airDown", "firing", "")
+	diskFull := digestTestAlert("b", "diskFull", "firing", "")
+	alerts := promtmpl.Alerts{airDown, diskFull}
+
+	remaining, skipped := retries.Filter("#foo", "{}:{}", alerts)
+	if !reflect.DeepEqual(alerts, remaining) || len(skipped) != 0 {
+		t.Errorf("Expected no alert skipped on first delivery, got %v", skipped)
+	}
+	retries.Record("#foo", "{}:{}", promtmpl.Alerts{airDown})
+
+	// Alerts of other channels or groups, or with another status, are not
+	// the same.
+	resolved := digestTestAlert("a", "airDown", "resolved", "")
+	remaining, skipped = retries.Filter("#foo", "{}:{}", promtmpl.Alerts{airDown, diskFull, resolved})
+	if !reflect.DeepEqual(promtmpl.Alerts{diskFull, resolved}, remaining) ||
+		!reflect.DeepEqual(promtmpl.Alerts{airDown}, skipped) {
+		t.Errorf("Unexpected retry filtering, remaining %v, skipped %v", remaining, skipped)
+	}
+	if _, skipped := retries.Filter("#bar", "{}:{}", alerts); len(skipped) != 0 {
+		t.Errorf("Expected no alert skipped in another channel, got %v", skipped)
+	}
+
+	// Deliveries are forgotten after the TTL.
+	if _, skipped := retries.Filter("#foo", "{}:{}", alerts); len(skipped) != 0 {
+		t.Errorf("Expected no alert skipped after the TTL, got %v", skipped)
+	}
+	if v := testutil.ToFloat64(retries.metrics.webhookRetryDuplicateAlerts.WithLabelValues("#foo")); v != 1 {
+		t.Errorf("Expected 1 duplicate alert, got %f", v)
+	}
+}
+
+func TestRetryDeduplicatorBounded(t *testing.T) {
+	retries := makeTestRetryDeduplicator([]int{0, 10, 20}, 2)
+	alerts := promtmpl.Alerts{
+		digestTestAlert("a", "airDown", "firing", ""),
+		digestTestAlert("b", "diskFull", "firing", ""),
+	}
+	retries.Record("#foo", "", alerts[:1])
+	retries.Record("#foo", "", promtmpl.Alerts{alerts[1], digestTestAlert("c", "cpuHot", "firing", "")})
+
+	// The oldest delivery was forgotten.
+	remaining, _ := retries.Filter("#foo", "", alerts)
+	if !reflect.DeepEqual(alerts[:1], remaining) {
+		t.Errorf("Expected the oldest delivery to be forgotten, got %v remaining", remaining)
+	}
+	if v := testutil.ToFloat64(retries.metrics.webhookRetryDedupEvictions); v != 1 {
+		t.Errorf("Expected 1 eviction, got %f", v)
+	}
+}
+
+func TestRetryDeduplicatorDisabled(t *testing.T) {
+	retries := NewRetryDeduplicator(0, 10, &FakeTime{}, NewMetrics(prometheus.NewRegistry()))
+	alerts := promtmpl.Alerts{digestTestAlert("a", "airDown", "firing", "")}
+
+	retries.Record("#foo", "", alerts)
+	if _, skipped := retries.Filter("#foo", "", alerts); len(skipped) != 0 {
+		t.Errorf("Expected no alert skipped while disabled, got %v", skipped)
+	}
+}
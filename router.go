@@ -0,0 +1,101 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+// AlertMsgRouter dispatches alert messages to the IRC connection serving
+// their channel. Channels not configured on any connection are served by the
+// first connection.
+type AlertMsgRouter struct {
+	defaultConnection  string
+	channelConnections map[string]string
+	connectionMsgs     map[string]chan AlertMsg
+	metrics            *Metrics
+	// Pending, if set, tracks the messages queued.
+	Pending *PendingMessages
+	// Sequencer, if set, is told about the messages of webhooks dropped.
+	Sequencer *WebhookSequencer
+}
+
+func NewAlertMsgRouter(configs []*Config, metrics *Metrics) *AlertMsgRouter {
+	router := &AlertMsgRouter{
+		channelConnections: make(map[string]string),
+		connectionMsgs:     make(map[string]chan AlertMsg),
+		metrics:            metrics,
+	}
+	for i, config := range configs {
+		if i == 0 {
+			router.defaultConnection = config.ConnectionName
+		}
+		for _, channel := range config.IRCChannels {
+			router.channelConnections[channel.Name] = config.ConnectionName
+		}
+		router.connectionMsgs[config.ConnectionName] = make(chan AlertMsg, config.AlertBufferSize)
+	}
+	return router
+}
+
+// AlertMsgs returns the channel the named connection should consume.
+func (r *AlertMsgRouter) AlertMsgs(connection string) chan AlertMsg {
+	return r.connectionMsgs[connection]
+}
+
+func (r *AlertMsgRouter) ConnectionFor(channel string) string {
+	if connection, ok := r.channelConnections[channel]; ok {
+		return connection
+	}
+	return r.defaultConnection
+}
+
+func (r *AlertMsgRouter) RouteAlertMsg(alertMsg *AlertMsg) {
+	connection := r.ConnectionFor(alertMsg.Channel)
+
+	routeSpan := alertMsg.Span.StartChild("route")
+	routeSpan.SetAttribute("connection", connection)
+	defer routeSpan.End()
+
+	select {
+	case r.connectionMsgs[connection] <- *alertMsg:
+	default:
+		// Do not let a connection that is down block the others.
+		logging.Error("Could not route alert to connection %s: %s",
+			connection, alertMsg)
+		r.metrics.alertHandlingErrors.WithLabelValues(alertMsg.Channel, "connection_channel_full").Inc()
+		routeSpan.SetError(errors.New("connection channel full"))
+		alertMsg.Span.End()
+		r.Pending.Done(alertMsg)
+		r.Sequencer.Drop(alertMsg)
+	}
+}
+
+func (r *AlertMsgRouter) Run(ctx context.Context, alertMsgs chan AlertMsg, stopWg *sync.WaitGroup) {
+	defer stopWg.Done()
+
+	for {
+		select {
+		case alertMsg := <-alertMsgs:
+			r.RouteAlertMsg(&alertMsg)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,92 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func makeTestRouter() *AlertMsgRouter {
+	config := &Config{
+		AlertBufferSize: 10,
+		IRCConnections: []IRCConnection{
+			IRCConnection{
+				Name:        "a",
+				IRCChannels: []IRCChannel{IRCChannel{Name: "#a"}},
+			},
+			IRCConnection{
+				Name:        "b",
+				IRCChannels: []IRCChannel{IRCChannel{Name: "#b"}},
+			},
+		},
+	}
+	return NewAlertMsgRouter(config.ConnectionConfigs(), NewMetrics(prometheus.NewRegistry()))
+}
+
+func TestRouteToConnection(t *testing.T) {
+	router := makeTestRouter()
+	alertMsgs := make(chan AlertMsg)
+	ctx, cancel := context.WithCancel(context.Background())
+	stopWg := sync.WaitGroup{}
+
+	stopWg.Add(1)
+	go router.Run(ctx, alertMsgs, &stopWg)
+
+	alertMsgs <- AlertMsg{Channel: "#b", Alert: "to b"}
+	alertMsgs <- AlertMsg{Channel: "#a", Alert: "to a"}
+	alertMsgs <- AlertMsg{Channel: "#other", Alert: "to default"}
+
+	expectedA := []AlertMsg{
+		AlertMsg{Channel: "#a", Alert: "to a"},
+		AlertMsg{Channel: "#other", Alert: "to default"},
+	}
+	expectedB := []AlertMsg{
+		AlertMsg{Channel: "#b", Alert: "to b"},
+	}
+
+	receivedA := []AlertMsg{<-router.AlertMsgs("a"), <-router.AlertMsgs("a")}
+	receivedB := []AlertMsg{<-router.AlertMsgs("b")}
+
+	cancel()
+	stopWg.Wait()
+
+	if !reflect.DeepEqual(expectedA, receivedA) {
+		t.Errorf("Unexpected messages for connection a: %s", receivedA)
+	}
+	if !reflect.DeepEqual(expectedB, receivedB) {
+		t.Errorf("Unexpected messages for connection b: %s", receivedB)
+	}
+}
+
+func TestRouteDoesNotBlockOnFullConnection(t *testing.T) {
+	router := makeTestRouter()
+
+	for i := 0; i < 20; i++ {
+		router.RouteAlertMsg(&AlertMsg{Channel: "#a", Alert: "flood"})
+	}
+	router.RouteAlertMsg(&AlertMsg{Channel: "#b", Alert: "still delivered"})
+
+	if len(router.AlertMsgs("a")) != 10 {
+		t.Errorf("Expected connection a buffer to be full")
+	}
+	if alertMsg := <-router.AlertMsgs("b"); alertMsg.Alert != "still delivered" {
+		t.Errorf("Unexpected message for connection b: %s", alertMsg)
+	}
+}
@@ -0,0 +1,254 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sort"
+	"sync"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	webhookOrderingIndependent = "independent"
+	webhookOrderingSequenced   = "sequenced"
+)
+
+// sequencedBlock holds the messages relayed from a webhook to a channel.
+type sequencedBlock struct {
+	// queued is the number of messages queued for the channel, -1 until
+	// the webhook is relayed to all of its channels.
+	queued int
+	// received counts the messages received, including those dropped on
+	// the way.
+	received  int
+	alertMsgs []AlertMsg
+}
+
+func (b *sequencedBlock) complete() bool {
+	return b.queued >= 0 && b.received >= b.queued
+}
+
+// sequencedChannel holds the blocks of messages to a channel, by webhook
+// sequence number, and those released but not taken yet.
+type sequencedChannel struct {
+	connection string
+	blocks     map[uint64]*sequencedBlock
+	released   []AlertMsg
+}
+
+// WebhookSequencer numbers the webhooks as they are received, and holds the
+// messages relayed from each webhook to a channel until they can be sent as
+// a block, after the blocks of the webhooks numbered before. The channels
+// thus get the messages of the webhooks they have in common in the same
+// order, even when the webhooks are relayed concurrently, at the cost of
+// waiting for all the webhooks received before to be relayed. Messages which
+// do not come from webhooks, e.g. digests, are not held.
+//
+// A nil *WebhookSequencer numbers nothing and holds nothing.
+type WebhookSequencer struct {
+	mu   sync.Mutex
+	next uint64
+	// relaying are the webhooks being relayed, which may still queue
+	// messages.
+	relaying map[uint64]bool
+	channels map[string]*sequencedChannel
+	// ready signals each connection that blocks of its channels were
+	// released.
+	ready map[string]chan struct{}
+}
+
+// NewWebhookSequencer returns nil unless webhooks are sequenced.
+func NewWebhookSequencer(config *Config) *WebhookSequencer {
+	if config.WebhookOrdering != webhookOrderingSequenced {
+		return nil
+	}
+	return &WebhookSequencer{
+		relaying: make(map[uint64]bool),
+		channels: make(map[string]*sequencedChannel),
+		ready:    make(map[string]chan struct{}),
+	}
+}
+
+// Begin numbers a webhook about to be relayed. Its messages are to be tagged
+// with the number returned, 0 if webhooks are not sequenced.
+func (s *WebhookSequencer) Begin() uint64 {
+	if s == nil {
+		return 0
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.next++
+	s.relaying[s.next] = true
+	return s.next
+}
+
+// End records the number of messages queued for each channel once the
+// webhook is relayed, and releases the blocks waiting for it.
+func (s *WebhookSequencer) End(sequence uint64, queued map[string]int) {
+	if s == nil || sequence == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	delete(s.relaying, sequence)
+	for channel, count := range queued {
+		if count > 0 {
+			s.block(channel, sequence).queued = count
+		}
+	}
+	for channel := range s.channels {
+		s.release(channel)
+	}
+}
+
+// Add holds a message received by the connection until its block can be
+// sent, and tells whether it did. Messages not coming from webhooks are not
+// held, and are to be sent right away.
+func (s *WebhookSequencer) Add(connection string, alertMsg AlertMsg) bool {
+	if s == nil || alertMsg.sequence == 0 {
+		return false
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	block := s.block(alertMsg.Channel, alertMsg.sequence)
+	block.received++
+	block.alertMsgs = append(block.alertMsgs, alertMsg)
+	s.channels[alertMsg.Channel].connection = connection
+	s.release(alertMsg.Channel)
+	return true
+}
+
+// Drop accounts for a message dropped before reaching its connection, not to
+// wait for it.
+func (s *WebhookSequencer) Drop(alertMsg *AlertMsg) {
+	if s == nil || alertMsg.sequence == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.block(alertMsg.Channel, alertMsg.sequence).received++
+	s.release(alertMsg.Channel)
+}
+
+// Ready signals the connection that blocks of its channels were released,
+// to be taken with Released.
+func (s *WebhookSequencer) Ready(connection string) <-chan struct{} {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.readyChan(connection)
+}
+
+// Released takes the messages released for the channels of the connection,
+// in the order they are to be sent.
+func (s *WebhookSequencer) Released(connection string) []AlertMsg {
+	if s == nil {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	alertMsgs := []AlertMsg{}
+	for name, channel := range s.channels {
+		if channel.connection != connection || len(channel.released) == 0 {
+			continue
+		}
+		alertMsgs = append(alertMsgs, channel.released...)
+		channel.released = nil
+		if len(channel.blocks) == 0 {
+			delete(s.channels, name)
+		}
+	}
+	return alertMsgs
+}
+
+func (s *WebhookSequencer) readyChan(connection string) chan struct{} {
+	ready, ok := s.ready[connection]
+	if !ok {
+		ready = make(chan struct{}, 1)
+		s.ready[connection] = ready
+	}
+	return ready
+}
+
+func (s *WebhookSequencer) block(name string, sequence uint64) *sequencedBlock {
+	channel, ok := s.channels[name]
+	if !ok {
+		channel = &sequencedChannel{blocks: make(map[uint64]*sequencedBlock)}
+		s.channels[name] = channel
+	}
+	block, ok := channel.blocks[sequence]
+	if !ok {
+		block = &sequencedBlock{queued: -1}
+		channel.blocks[sequence] = block
+	}
+	return block
+}
+
+// release releases the complete blocks of the channel in order, up to the
+// first one which is not, or which webhooks numbered before and still being
+// relayed may come before.
+func (s *WebhookSequencer) release(name string) {
+	channel := s.channels[name]
+	var firstRelaying uint64
+	for sequence := range s.relaying {
+		if firstRelaying == 0 || sequence < firstRelaying {
+			firstRelaying = sequence
+		}
+	}
+
+	sequences := []uint64{}
+	for sequence := range channel.blocks {
+		sequences = append(sequences, sequence)
+	}
+	sort.Slice(sequences, func(i, j int) bool { return sequences[i] < sequences[j] })
+
+	released := 0
+	for _, sequence := range sequences {
+		block := channel.blocks[sequence]
+		if (firstRelaying != 0 && firstRelaying < sequence) || !block.complete() {
+			break
+		}
+		logging.Debug("Releasing %d messages of webhook %d to %s", len(block.alertMsgs), sequence, name)
+		channel.released = append(channel.released, block.alertMsgs...)
+		released += len(block.alertMsgs)
+		delete(channel.blocks, sequence)
+	}
+	if len(channel.blocks) == 0 && len(channel.released) == 0 {
+		delete(s.channels, name)
+		return
+	}
+	// The messages released were added by the connection.
+	if released == 0 {
+		return
+	}
+	select {
+	case s.readyChan(channel.connection) <- struct{}{}:
+	default:
+	}
+}
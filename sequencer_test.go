@@ -0,0 +1,150 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func sequencedAlertMsg(channel string, text string, sequence uint64) AlertMsg {
+	return AlertMsg{Channel: channel, Alert: text, sequence: sequence}
+}
+
+func releasedTexts(sequencer *WebhookSequencer, connection string, channel string) []string {
+	texts := []string{}
+	for _, alertMsg := range sequencer.Released(connection) {
+		if alertMsg.Channel == channel {
+			texts = append(texts, alertMsg.Alert)
+		}
+	}
+	return texts
+}
+
+func isReady(sequencer *WebhookSequencer, connection string) bool {
+	select {
+	case <-sequencer.Ready(connection):
+		return true
+	default:
+		return false
+	}
+}
+
+func TestWebhookSequencerOrder(t *testing.T) {
+	sequencer := NewWebhookSequencer(&Config{WebhookOrdering: webhookOrderingSequenced})
+
+	// Two webhooks relayed to two channels at the same time, the second
+	// being relayed first, their messages interleaving.
+	first := sequencer.Begin()
+	second := sequencer.Begin()
+	for _, channel := range []string{"#a", "#b"} {
+		sequencer.Add("conn", sequencedAlertMsg(channel, "second 1", second))
+		sequencer.Add("conn", sequencedAlertMsg(channel, "first 1", first))
+		sequencer.Add("conn", sequencedAlertMsg(channel, "second 2", second))
+	}
+	sequencer.End(second, map[string]int{"#a": 2, "#b": 2})
+	if isReady(sequencer, "conn") {
+		t.Errorf("Expected nothing released before the first webhook is relayed")
+	}
+
+	sequencer.Add("conn", sequencedAlertMsg("#a", "first 2", first))
+	sequencer.End(first, map[string]int{"#a": 2, "#b": 1})
+	if !isReady(sequencer, "conn") {
+		t.Fatalf("Expected messages released once the first webhook is relayed")
+	}
+	released := sequencer.Released("conn")
+	for _, channel := range []string{"#a", "#b"} {
+		texts := []string{}
+		for _, alertMsg := range released {
+			if alertMsg.Channel == channel {
+				texts = append(texts, alertMsg.Alert)
+			}
+		}
+		expected := []string{"first 1", "first 2", "second 1", "second 2"}
+		if channel == "#b" {
+			expected = []string{"first 1", "second 1", "second 2"}
+		}
+		if !reflect.DeepEqual(expected, texts) {
+			t.Errorf("Expected %s to get %q, got %q", channel, expected, texts)
+		}
+	}
+	if len(sequencer.channels) != 0 {
+		t.Errorf("Expected nothing left held, got %d channels", len(sequencer.channels))
+	}
+}
+
+func TestWebhookSequencerWaitsForMessages(t *testing.T) {
+	sequencer := NewWebhookSequencer(&Config{WebhookOrdering: webhookOrderingSequenced})
+
+	// The second webhook is complete, but messages of the first are still
+	// on their way to the connection.
+	first := sequencer.Begin()
+	sequencer.End(first, map[string]int{"#a": 2})
+	second := sequencer.Begin()
+	sequencer.End(second, map[string]int{"#a": 1})
+	sequencer.Add("conn", sequencedAlertMsg("#a", "second", second))
+	sequencer.Add("conn", sequencedAlertMsg("#a", "first 1", first))
+	if texts := releasedTexts(sequencer, "conn", "#a"); len(texts) != 0 {
+		t.Errorf("Expected nothing released while waiting for the first webhook, got %q", texts)
+	}
+
+	// A message dropped on the way is not waited for.
+	dropped := sequencedAlertMsg("#a", "first 2", first)
+	sequencer.Drop(&dropped)
+	expected := []string{"first 1", "second"}
+	if texts := releasedTexts(sequencer, "conn", "#a"); !reflect.DeepEqual(expected, texts) {
+		t.Errorf("Expected %q released, got %q", expected, texts)
+	}
+}
+
+func TestWebhookSequencerConnections(t *testing.T) {
+	sequencer := NewWebhookSequencer(&Config{WebhookOrdering: webhookOrderingSequenced})
+
+	sequence := sequencer.Begin()
+	sequencer.Add("one", sequencedAlertMsg("#a", "to a", sequence))
+	sequencer.Add("two", sequencedAlertMsg("#b", "to b", sequence))
+	sequencer.End(sequence, map[string]int{"#a": 1, "#b": 1})
+
+	if texts := releasedTexts(sequencer, "one", "#b"); len(texts) != 0 {
+		t.Errorf("Expected no message of another connection, got %q", texts)
+	}
+	expected := []string{"to b"}
+	if texts := releasedTexts(sequencer, "two", "#b"); !reflect.DeepEqual(expected, texts) {
+		t.Errorf("Expected %q released, got %q", expected, texts)
+	}
+
+	// Messages not coming from webhooks are not held.
+	if sequencer.Add("one", AlertMsg{Channel: "#a", Alert: "digest"}) {
+		t.Errorf("Expected a message without sequence not to be held")
+	}
+}
+
+func TestWebhookSequencerDisabled(t *testing.T) {
+	sequencer := NewWebhookSequencer(&Config{WebhookOrdering: webhookOrderingIndependent})
+	if sequencer != nil {
+		t.Fatalf("Expected no sequencer with independent ordering")
+	}
+	sequence := sequencer.Begin()
+	if sequence != 0 {
+		t.Errorf("Expected webhooks not to be numbered, got %d", sequence)
+	}
+	if sequencer.Add("conn", sequencedAlertMsg("#a", "text", sequence)) {
+		t.Errorf("Expected messages not to be held")
+	}
+	sequencer.End(sequence, map[string]int{"#a": 1})
+	if released := sequencer.Released("conn"); len(released) != 0 {
+		t.Errorf("Expected nothing released, got %v", released)
+	}
+}
@@ -0,0 +1,176 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	// Signed webhooks carry the HMAC-SHA256 of "<timestamp>.<body>" as
+	// "sha256=<hex>", and the Unix time they were signed at.
+	signatureHeader          = "X-Signature"
+	signatureTimestampHeader = "X-Signature-Timestamp"
+	signaturePrefix          = "sha256="
+
+	defaultWebhookSignatureMaxSkew = 5 * time.Minute
+
+	// At most that many signatures are remembered to detect replays.
+	signaturesSeenMax = 10000
+)
+
+// Why signed webhooks are rejected.
+const (
+	signatureMissing = "missing"
+	signatureInvalid = "invalid"
+	signatureSkewed  = "skewed"
+	signatureReplay  = "replay"
+)
+
+type seenSignature struct {
+	signature string
+	expires   time.Time
+}
+
+// WebhookVerifier checks the signature of webhooks, and that they are not
+// replayed: their timestamp must be within maxSkew of ours, and each
+// signature is accepted once. Signatures are remembered until their
+// timestamp is too old to be accepted anyway, up to signaturesSeenMax, the
+// oldest being forgotten first.
+type WebhookVerifier struct {
+	secret     []byte
+	maxSkew    time.Duration
+	maxSeen    int
+	timeTeller TimeTeller
+	metrics    *Metrics
+
+	mu   sync.Mutex
+	seen map[string]*list.Element
+	// order lists the signatures seen, the first to expire first.
+	order *list.List
+}
+
+// NewWebhookVerifier returns nil, verifying nothing, if no secret is set.
+func NewWebhookVerifier(secret string, maxSkew time.Duration, timeTeller TimeTeller, metrics *Metrics) *WebhookVerifier {
+	if secret == "" {
+		return nil
+	}
+	return &WebhookVerifier{
+		secret:     []byte(secret),
+		maxSkew:    maxSkew,
+		maxSeen:    signaturesSeenMax,
+		timeTeller: timeTeller,
+		metrics:    metrics,
+		seen:       make(map[string]*list.Element),
+		order:      list.New(),
+	}
+}
+
+// sign returns the signature of the body sent at timestamp.
+func (v *WebhookVerifier) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, v.secret)
+	mac.Write([]byte(timestamp + "."))
+	mac.Write(body)
+	return signaturePrefix + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Verify checks the signature of the request and its body, and returns the
+// HTTP status to reject it with and why, or 0 if it is accepted.
+func (v *WebhookVerifier) Verify(r *http.Request, body []byte) (int, string) {
+	if v == nil {
+		return 0, ""
+	}
+	signature := strings.ToLower(r.Header.Get(signatureHeader))
+	timestamp := r.Header.Get(signatureTimestampHeader)
+	if signature == "" || timestamp == "" {
+		return v.reject(http.StatusUnauthorized, signatureMissing)
+	}
+	if !hmac.Equal([]byte(signature), []byte(v.sign(timestamp, body))) {
+		return v.reject(http.StatusUnauthorized, signatureInvalid)
+	}
+	seconds, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return v.reject(http.StatusUnauthorized, signatureInvalid)
+	}
+	signed := time.Unix(seconds, 0)
+	now := v.timeTeller.Now()
+	if skew := now.Sub(signed); skew > v.maxSkew || skew < -v.maxSkew {
+		return v.reject(http.StatusUnauthorized, signatureSkewed)
+	}
+	if !v.remember(signature, signed.Add(v.maxSkew), now) {
+		return v.reject(http.StatusConflict, signatureReplay)
+	}
+	return 0, ""
+}
+
+func (v *WebhookVerifier) reject(status int, reason string) (int, string) {
+	v.metrics.webhookSignatureFailures.WithLabelValues(reason).Inc()
+	return status, reason
+}
+
+// remember records the signature until it expires, and tells whether it
+// was not seen already.
+func (v *WebhookVerifier) remember(signature string, expires time.Time, now time.Time) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	v.unsafePrune(now)
+	if _, ok := v.seen[signature]; ok {
+		return false
+	}
+	// Keep the list ordered by expiry, which is mostly the order in which
+	// signatures arrive.
+	element := v.order.Back()
+	for element != nil && element.Value.(*seenSignature).expires.After(expires) {
+		element = element.Prev()
+	}
+	entry := &seenSignature{signature: signature, expires: expires}
+	if element == nil {
+		v.seen[signature] = v.order.PushFront(entry)
+	} else {
+		v.seen[signature] = v.order.InsertAfter(entry, element)
+	}
+	if v.order.Len() > v.maxSeen {
+		logging.Warn("More than %d signed webhooks within %s, replays of the oldest are no longer detected",
+			v.maxSeen, 2*v.maxSkew)
+		v.unsafeRemove(v.order.Front())
+	}
+	return true
+}
+
+func (v *WebhookVerifier) unsafeRemove(element *list.Element) {
+	v.order.Remove(element)
+	delete(v.seen, element.Value.(*seenSignature).signature)
+}
+
+// unsafePrune forgets the signatures which expired.
+func (v *WebhookVerifier) unsafePrune(now time.Time) {
+	for element := v.order.Front(); element != nil; element = v.order.Front() {
+		if now.Before(element.Value.(*seenSignature).expires) {
+			return
+		}
+		v.unsafeRemove(element)
+	}
+}
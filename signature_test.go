@@ -0,0 +1,90 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWebhookVerifier(t *testing.T) {
+	// Verifications which get as far as checking the timestamp take the
+	// time once.
+	fakeTime := &FakeTime{
+		timeseries:   []int{1000, 1000, 1000, 1000, 1000, 1301},
+		durationUnit: time.Second,
+		afterChan:    make(chan time.Time, 1),
+	}
+	metrics := NewMetrics(prometheus.NewRegistry())
+	verifier := NewWebhookVerifier("secret", 5*time.Minute, fakeTime, metrics)
+	verifier.maxSeen = 2
+
+	body := []byte(`{"alerts": []}`)
+	for _, tc := range []struct {
+		name           string
+		timestamp      string
+		signature      string
+		expectedStatus int
+		expectedReason string
+	}{
+		{"missing", "", "", 401, "missing"},
+		{"invalid", "1000", verifier.sign("1001", body), 401, "invalid"},
+		{"valid", "1000", verifier.sign("1000", body), 0, ""},
+		{"replay", "1000", verifier.sign("1000", body), 409, "replay"},
+		{"replay in upper case", "1000", strings.ToUpper(verifier.sign("1000", body)), 409, "replay"},
+		{"too far in the future", "1301", verifier.sign("1301", body), 401, "skewed"},
+		{"other", "999", verifier.sign("999", body), 0, ""},
+		{"too old", "1000", verifier.sign("1000", body), 401, "skewed"},
+	} {
+		request := httptest.NewRequest("POST", "/api/v1/webhook/somechannel", nil)
+		if tc.signature != "" {
+			request.Header.Set(signatureHeader, tc.signature)
+			request.Header.Set(signatureTimestampHeader, tc.timestamp)
+		}
+		status, reason := verifier.Verify(request, body)
+		if status != tc.expectedStatus || reason != tc.expectedReason {
+			t.Errorf("%s: expected %d (%s), got %d (%s)",
+				tc.name, tc.expectedStatus, tc.expectedReason, status, reason)
+		}
+	}
+	if v := testutil.ToFloat64(metrics.webhookSignatureFailures.WithLabelValues("replay")); v != 2 {
+		t.Errorf("Expected 2 replays, got %f", v)
+	}
+
+	// Expired signatures are forgotten, and the oldest beyond maxSeen.
+	verifier.remember("a", time.Unix(2000, 0), time.Unix(1500, 0))
+	verifier.remember("b", time.Unix(2001, 0), time.Unix(1500, 0))
+	verifier.remember("c", time.Unix(1999, 0), time.Unix(1500, 0))
+	if _, ok := verifier.seen["c"]; ok || len(verifier.seen) != 2 {
+		t.Errorf("Unexpected signatures remembered: %v", verifier.seen)
+	}
+	if verifier.remember("a", time.Unix(2000, 0), time.Unix(2000, 0)) != true {
+		t.Error("Expected an expired signature to be forgotten")
+	}
+}
+
+func TestUnsignedWebhooksAccepted(t *testing.T) {
+	if status, _ := (*WebhookVerifier)(nil).Verify(httptest.NewRequest("POST", "/", nil), nil); status != 0 {
+		t.Errorf("Expected webhooks to be accepted without a secret, got %d", status)
+	}
+	if NewWebhookVerifier("", time.Minute, &RealTime{}, nil) != nil {
+		t.Error("Expected no verifier without a secret")
+	}
+}
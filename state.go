@@ -0,0 +1,212 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+// stateFormatVersion is bumped on incompatible changes of RelayState, whose
+// saved copies are then ignored.
+const stateFormatVersion = 1
+
+// RelayState is the in-memory state of the relay which is handed over to a
+// standby taking over, so that it neither notifies again what was already
+// relayed nor forgets which alerts are flapping. Messages not sent yet, i.e.
+// queued for a connection or held during quiet hours, are not handed over,
+// and are lost if the relay stops before sending them.
+type RelayState struct {
+	Version int       `json:"version"`
+	SavedAt time.Time `json:"saved_at"`
+
+	Deliveries      []DeliveryState `json:"deliveries"`
+	RetryDeliveries []DeliveryState `json:"retry_deliveries"`
+	Cooldowns       []CooldownState `json:"cooldowns"`
+	Flaps           []FlapState     `json:"flaps"`
+}
+
+// DeliveryState is a webhook delivery remembered by WebhookDeduplicator, or
+// an alert delivery remembered by RetryDeduplicator.
+type DeliveryState struct {
+	Key       string    `json:"key"`
+	Delivered time.Time `json:"delivered"`
+}
+
+// CooldownState is an alert in cooldown in AlertCooldown.
+type CooldownState struct {
+	Key          string    `json:"key"`
+	LastNotified time.Time `json:"last_notified"`
+}
+
+// FlapState is an alert followed by FlapDetector.
+type FlapState struct {
+	Key            string      `json:"key"`
+	IRCChannel     string      `json:"ircchannel"`
+	Name           string      `json:"name"`
+	Status         string      `json:"status"`
+	Transitions    []time.Time `json:"transitions"`
+	LastTransition time.Time   `json:"last_transition"`
+	LastSeen       time.Time   `json:"last_seen"`
+	Muted          bool        `json:"muted"`
+}
+
+// StateStore keeps the RelayState where the relay taking over finds it.
+type StateStore interface {
+	// Load returns the state last saved, or nil if there is none.
+	Load() (*RelayState, error)
+	Save(state *RelayState) error
+}
+
+// FileStateStore keeps the state in a JSON file, e.g. on a volume shared
+// with the standby.
+type FileStateStore struct {
+	Path string
+}
+
+func (s *FileStateStore) Load() (*RelayState, error) {
+	data, err := ioutil.ReadFile(s.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	state := &RelayState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("could not parse %s: %s", s.Path, err)
+	}
+	return state, nil
+}
+
+// Save replaces the file at once, so that readers never see a partial state.
+func (s *FileStateStore) Save(state *RelayState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpFile, err := ioutil.TempFile(filepath.Dir(s.Path), filepath.Base(s.Path)+".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		os.Remove(tmpFile.Name())
+		return err
+	}
+	return os.Rename(tmpFile.Name(), s.Path)
+}
+
+// StateKeeper saves the state of the relay periodically and on shutdown, and
+// restores it on startup. The retry deduplicator and the flap detector may be
+// nil.
+type StateKeeper struct {
+	store        StateStore
+	interval     time.Duration
+	deduplicator *WebhookDeduplicator
+	retries      *RetryDeduplicator
+	cooldown     *AlertCooldown
+	flapDetector *FlapDetector
+	timeTeller   TimeTeller
+	metrics      *Metrics
+}
+
+func NewStateKeeper(store StateStore, interval time.Duration, deduplicator *WebhookDeduplicator, retries *RetryDeduplicator, cooldown *AlertCooldown, flapDetector *FlapDetector, timeTeller TimeTeller, metrics *Metrics) *StateKeeper {
+	return &StateKeeper{
+		store:        store,
+		interval:     interval,
+		deduplicator: deduplicator,
+		retries:      retries,
+		cooldown:     cooldown,
+		flapDetector: flapDetector,
+		timeTeller:   timeTeller,
+		metrics:      metrics,
+	}
+}
+
+// Restore imports the state last saved, if any. A state which cannot be
+// loaded is logged and ignored, the relay then starts afresh.
+func (k *StateKeeper) Restore() {
+	state, err := k.store.Load()
+	if err != nil {
+		logging.Error("Could not load relay state, starting afresh: %s", err)
+		k.metrics.stateErrors.WithLabelValues("load").Inc()
+		return
+	}
+	if state == nil {
+		logging.Info("No relay state to restore")
+		return
+	}
+	if state.Version != stateFormatVersion {
+		logging.Warn("Ignoring relay state in format version %d, expected %d",
+			state.Version, stateFormatVersion)
+		return
+	}
+	k.deduplicator.ImportState(state.Deliveries)
+	k.retries.ImportState(state.RetryDeliveries)
+	k.cooldown.ImportState(state.Cooldowns)
+	k.flapDetector.ImportState(state.Flaps)
+	logging.Info("Restored relay state saved at %s: %d deliveries, %d alert deliveries, %d cooldowns, %d flapping alerts",
+		state.SavedAt, len(state.Deliveries), len(state.RetryDeliveries), len(state.Cooldowns), len(state.Flaps))
+}
+
+// Save exports the current state to the store.
+func (k *StateKeeper) Save() {
+	state := &RelayState{
+		Version:         stateFormatVersion,
+		SavedAt:         k.timeTeller.Now(),
+		Deliveries:      k.deduplicator.ExportState(),
+		RetryDeliveries: k.retries.ExportState(),
+		Cooldowns:       k.cooldown.ExportState(),
+		Flaps:           k.flapDetector.ExportState(),
+	}
+	if err := k.store.Save(state); err != nil {
+		logging.Error("Could not save relay state: %s", err)
+		k.metrics.stateErrors.WithLabelValues("save").Inc()
+		return
+	}
+	k.metrics.stateLastSavedTimestamp.Set(float64(state.SavedAt.Unix()))
+}
+
+// Run saves the state every interval, and once more when ctx is canceled.
+func (k *StateKeeper) Run(ctx context.Context, stopWg *sync.WaitGroup) {
+	defer stopWg.Done()
+
+	ticker := time.NewTicker(k.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			k.Save()
+		case <-ctx.Done():
+			logging.Info("Saving relay state before exiting")
+			k.Save()
+			return
+		}
+	}
+}
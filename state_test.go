@@ -0,0 +1,162 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+type memStateStore struct {
+	state *RelayState
+}
+
+func (s *memStateStore) Load() (*RelayState, error) {
+	return s.state, nil
+}
+
+func (s *memStateStore) Save(state *RelayState) error {
+	s.state = state
+	return nil
+}
+
+func TestFileStateStore(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	store := &FileStateStore{Path: filepath.Join(dir, "state.json")}
+
+	if state, err := store.Load(); state != nil || err != nil {
+		t.Errorf("Expected no state before saving, got %v (error %v)", state, err)
+	}
+
+	saved := &RelayState{
+		Version: stateFormatVersion,
+		SavedAt: time.Unix(100, 0).UTC(),
+		Deliveries: []DeliveryState{
+			DeliveryState{Key: "abc", Delivered: time.Unix(10, 0).UTC()},
+		},
+		Cooldowns: []CooldownState{
+			CooldownState{Key: "#foo/abc", LastNotified: time.Unix(20, 0).UTC()},
+		},
+		Flaps: []FlapState{
+			FlapState{
+				Key:            "#foo/abc",
+				IRCChannel:     "#foo",
+				Name:           "airDown",
+				Status:         "firing",
+				Transitions:    []time.Time{time.Unix(30, 0).UTC()},
+				LastTransition: time.Unix(30, 0).UTC(),
+				LastSeen:       time.Unix(40, 0).UTC(),
+				Muted:          true,
+			},
+		},
+	}
+	if err := store.Save(saved); err != nil {
+		t.Fatalf("Could not save state: %s", err)
+	}
+	loaded, err := store.Load()
+	if err != nil {
+		t.Fatalf("Could not load state: %s", err)
+	}
+	if !reflect.DeepEqual(saved, loaded) {
+		t.Errorf("Unexpected state loaded.\nExpected: %+v\nActual: %+v", saved, loaded)
+	}
+
+	if files, _ := ioutil.ReadDir(dir); len(files) != 1 {
+		t.Errorf("Expected only the state file to be left, got %d files", len(files))
+	}
+}
+
+func TestStateHandover(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	makeFakeTime := func(elapsedTime ...int) *FakeTime {
+		return &FakeTime{timeseries: elapsedTime, durationUnit: time.Minute}
+	}
+	body := []byte(`{"status":"firing"}`)
+	alert := promtmpl.Alert{
+		Status:      "firing",
+		Fingerprint: "abc",
+		Labels:      promtmpl.KV{"alertname": "airDown"},
+	}
+	flapConfig := &Config{
+		FlapThreshold:    3,
+		FlapWindow:       2 * time.Minute,
+		FlapStablePeriod: 5 * time.Minute,
+	}
+	alertMsgs := make(chan AlertMsg, 10)
+	store := &memStateStore{}
+
+	// The active relay delivers a webhook, relays an alert and mutes
+	// another which is flapping.
+	deduplicator := NewWebhookDeduplicator(time.Hour, makeFakeTime(0), metrics)
+	retries := NewRetryDeduplicator(time.Hour, 10, makeFakeTime(0), metrics)
+	cooldown := NewAlertCooldown(time.Hour, makeFakeTime(0), metrics)
+	flapDetector := NewFlapDetector(flapConfig, alertMsgs, makeFakeTime(0, 0, 1), metrics)
+	deduplicator.Duplicate("#foo", body)
+	retries.Record("#foo", "group", promtmpl.Alerts{alert})
+	cooldown.Allow("#foo", &alert)
+	for _, status := range []string{"firing", "resolved", "firing"} {
+		flapDetector.FilterAlerts("#bar", flapTestAlert(status))
+	}
+	NewStateKeeper(store, time.Minute, deduplicator, retries, cooldown, flapDetector,
+		makeFakeTime(1), metrics).Save()
+
+	// The standby taking over knows about all of it.
+	deduplicator = NewWebhookDeduplicator(time.Hour, makeFakeTime(2), metrics)
+	retries = NewRetryDeduplicator(time.Hour, 10, makeFakeTime(2, 2), metrics)
+	cooldown = NewAlertCooldown(time.Hour, makeFakeTime(2), metrics)
+	flapDetector = NewFlapDetector(flapConfig, alertMsgs, makeFakeTime(2), metrics)
+	NewStateKeeper(store, time.Minute, deduplicator, retries, cooldown, flapDetector,
+		makeFakeTime(), metrics).Restore()
+
+	if !deduplicator.Duplicate("#foo", body) {
+		t.Errorf("Expected the webhook delivered before the handover to be a duplicate")
+	}
+	if _, skipped := retries.Filter("#foo", "group", promtmpl.Alerts{alert}); len(skipped) != 1 {
+		t.Errorf("Expected the alert delivered before the handover to be skipped on retry")
+	}
+	if cooldown.Allow("#foo", &alert) {
+		t.Errorf("Expected the alert relayed before the handover to be in cooldown")
+	}
+	if relayed := flapDetector.FilterAlerts("#bar", flapTestAlert("resolved")); len(relayed) != 0 {
+		t.Errorf("Expected the alert flapping before the handover to stay muted")
+	}
+}
+
+func TestStateVersionMismatch(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	store := &memStateStore{state: &RelayState{
+		Version:   stateFormatVersion + 1,
+		Cooldowns: []CooldownState{CooldownState{Key: "#foo/abc", LastNotified: time.Now()}},
+	}}
+	cooldown := NewAlertCooldown(time.Hour, &RealTime{}, metrics)
+
+	NewStateKeeper(store, time.Minute, NewWebhookDeduplicator(0, &RealTime{}, metrics), nil,
+		cooldown, nil, &RealTime{}, metrics).Restore()
+
+	if len(cooldown.ExportState()) != 0 {
+		t.Errorf("Expected state in another format version to be ignored")
+	}
+}
@@ -0,0 +1,299 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+const (
+	defaultStormWindow   = time.Minute
+	defaultStormCoolDown = 5 * time.Minute
+	defaultStormInterval = 5 * time.Minute
+
+	// Channels in storm mode are checked that often for their summary to
+	// be sent, or for the storm to be over.
+	stormCheckInterval = 15 * time.Second
+
+	defaultStormTemplate = `Alert storm: {{ .Firing }} firing, {{ .Resolved }} resolved in the last {{ .Period }}
+{{ range .Alerts }}{{ .Status }}: {{ .Name }}{{ with .Summary }} - {{ . }}{{ end }}
+{{ end }}{{ if .More }}... and {{ .More }} more{{ end }}`
+)
+
+// Modes of a channel, as labelled in the storm_mode_changes metric.
+const (
+	stormModeStorm  = "storm"
+	stormModeNormal = "normal"
+)
+
+// StormSummary is the data of the storm template, summarizing the alerts to
+// a channel in storm mode received over Period.
+type StormSummary struct {
+	Channel  string
+	Period   time.Duration
+	Firing   int
+	Resolved int
+	// Alerts are the first digestMaxAlerts alerts, with their last status,
+	// More counting the others.
+	Alerts []StormAlert
+	More   int
+}
+
+type StormAlert struct {
+	Status  string
+	Name    string
+	Summary string
+}
+
+// parseStormTemplate parses a storm template, the default one if empty.
+func parseStormTemplate(text string) (*template.Template, error) {
+	if text == "" {
+		text = defaultStormTemplate
+	}
+	return template.New("storm").Funcs(templateFuncMap).Parse(text)
+}
+
+type stormEvent struct {
+	at     time.Time
+	alerts int
+}
+
+type channelStorm struct {
+	threshold     int
+	window        time.Duration
+	calmThreshold int
+	coolDown      time.Duration
+	interval      time.Duration
+	template      *template.Template
+
+	// events are the webhooks received within window.
+	events []stormEvent
+	// While storming, alerts are summarized every interval, since being
+	// when the summary started. calmSince is when the rate went down to
+	// calmThreshold, if it stayed there.
+	storming  bool
+	since     time.Time
+	calmSince time.Time
+	alerts    alertSummary
+}
+
+// rate returns the number of alerts received within window.
+func (s *channelStorm) rate(now time.Time) int {
+	i := 0
+	for i < len(s.events) && now.Sub(s.events[i].at) >= s.window {
+		i++
+	}
+	s.events = s.events[i:]
+	rate := 0
+	for _, event := range s.events {
+		rate += event.alerts
+	}
+	return rate
+}
+
+// StormDetector switches the channels receiving alerts too fast to storm
+// mode, in which their alerts are summarized periodically, announcing the
+// mode changes in the channel. A nil *StormDetector has no channel with
+// storm detection.
+type StormDetector struct {
+	alertMsgs  chan AlertMsg
+	timeTeller TimeTeller
+	metrics    *Metrics
+
+	mu       sync.Mutex
+	channels map[string]*channelStorm
+}
+
+func NewStormDetector(config *Config, alertMsgs chan AlertMsg, timeTeller TimeTeller, metrics *Metrics) *StormDetector {
+	channels := make(map[string]*channelStorm)
+	for _, connection := range config.ConnectionConfigs() {
+		for _, channel := range connection.IRCChannels {
+			if channel.Storm == nil {
+				continue
+			}
+			// The config was validated.
+			tmpl, _ := parseStormTemplate(channel.Storm.Template)
+			storm := &channelStorm{
+				threshold:     channel.Storm.Threshold,
+				window:        channel.Storm.Window,
+				calmThreshold: channel.Storm.CalmThreshold,
+				coolDown:      channel.Storm.CoolDown,
+				interval:      channel.Storm.Interval,
+				template:      tmpl,
+				alerts:        newAlertSummary(),
+			}
+			if storm.window == 0 {
+				storm.window = defaultStormWindow
+			}
+			if storm.coolDown == 0 {
+				storm.coolDown = defaultStormCoolDown
+			}
+			if storm.interval == 0 {
+				storm.interval = defaultStormInterval
+			}
+			channels[channel.Name] = storm
+		}
+	}
+	if len(channels) == 0 {
+		return nil
+	}
+	return &StormDetector{
+		alertMsgs:  alertMsgs,
+		timeTeller: timeTeller,
+		metrics:    metrics,
+		channels:   channels,
+	}
+}
+
+func (d *StormDetector) send(ircChannel string, lines []string) {
+	for _, line := range lines {
+		select {
+		case d.alertMsgs <- AlertMsg{Channel: ircChannel, Alert: line}:
+		default:
+			logging.Error("Could not send storm summary to the IRC routine: %s", line)
+			d.metrics.alertHandlingErrors.WithLabelValues(ircChannel, "internal_comm_channel_full").Inc()
+		}
+	}
+}
+
+// Add records the alerts to the channel, and tells whether it is in storm
+// mode, in which case they are kept for its next summary instead of being
+// relayed.
+func (d *StormDetector) Add(ircChannel string, alerts promtmpl.Alerts) bool {
+	if d == nil {
+		return false
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	storm, ok := d.channels[ircChannel]
+	if !ok {
+		return false
+	}
+	now := d.timeTeller.Now()
+	storm.events = append(storm.events, stormEvent{at: now, alerts: len(alerts)})
+	if rate := storm.rate(now); !storm.storming && rate > storm.threshold {
+		logging.Warn("Alert storm in %s: %d alerts within %s, summarizing them every %s",
+			ircChannel, rate, storm.window, storm.interval)
+		storm.storming = true
+		storm.since = now
+		storm.calmSince = time.Time{}
+		d.metrics.stormModeChanges.WithLabelValues(ircChannel, stormModeStorm).Inc()
+		d.metrics.stormMode.WithLabelValues(ircChannel).Set(1)
+		d.send(ircChannel, []string{fmt.Sprintf("Alert storm: %d alerts within %s, summarizing them every %s",
+			rate, storm.window, storm.interval)})
+	}
+	if !storm.storming {
+		return false
+	}
+	storm.alerts.add(ircChannel, alerts)
+	d.metrics.stormSummarizedAlerts.WithLabelValues(ircChannel).Add(float64(len(alerts)))
+	return true
+}
+
+// unsafeSummary renders the summary of the alerts to the channel since the
+// last one, if any, and starts the next one.
+func (d *StormDetector) unsafeSummary(ircChannel string, storm *channelStorm, now time.Time) []string {
+	alerts := storm.alerts
+	summary := StormSummary{
+		Channel: ircChannel,
+		Period:  now.Sub(storm.since).Round(time.Second),
+		Alerts:  []StormAlert{},
+	}
+	storm.alerts = newAlertSummary()
+	storm.since = now
+	if len(alerts.order) == 0 {
+		return nil
+	}
+	summary.Firing, summary.Resolved = alerts.counts()
+	for i, key := range alerts.order {
+		if i == digestMaxAlerts {
+			summary.More = len(alerts.order) - i
+			break
+		}
+		entry := alerts.entries[key]
+		summary.Alerts = append(summary.Alerts, StormAlert{
+			Status:  entry.status,
+			Name:    entry.name,
+			Summary: entry.summary,
+		})
+	}
+	output := strings.Builder{}
+	if err := storm.template.Execute(&output, summary); err != nil {
+		logging.Error("Could not render storm summary of %s: %s", ircChannel, err)
+		d.metrics.formatRenderErrors.WithLabelValues("storm").Inc()
+		return nil
+	}
+	return templateLines(output.String())
+}
+
+// check sends the summaries due, and leaves storm mode in the channels where
+// the storm is over. On shutdown, the pending summaries are all sent.
+func (d *StormDetector) check(shutdown bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := d.timeTeller.Now()
+	for ircChannel, storm := range d.channels {
+		if !storm.storming {
+			continue
+		}
+		over := false
+		if storm.rate(now) > storm.calmThreshold {
+			storm.calmSince = time.Time{}
+		} else if storm.calmSince.IsZero() {
+			storm.calmSince = now
+		} else {
+			over = now.Sub(storm.calmSince) >= storm.coolDown
+		}
+		if shutdown || over || now.Sub(storm.since) >= storm.interval {
+			d.send(ircChannel, d.unsafeSummary(ircChannel, storm, now))
+		}
+		if over {
+			logging.Info("Alert storm in %s is over, relaying alerts as they arrive", ircChannel)
+			storm.storming = false
+			d.metrics.stormModeChanges.WithLabelValues(ircChannel, stormModeNormal).Inc()
+			d.metrics.stormMode.WithLabelValues(ircChannel).Set(0)
+			d.send(ircChannel, []string{"Alert storm is over, relaying alerts as they arrive"})
+		}
+	}
+}
+
+// Run checks the channels in storm mode every stormCheckInterval, until ctx
+// is canceled.
+func (d *StormDetector) Run(ctx context.Context, stopWg *sync.WaitGroup) {
+	defer stopWg.Done()
+
+	for {
+		select {
+		case <-d.timeTeller.After(stormCheckInterval):
+			d.check(false)
+		case <-ctx.Done():
+			// Alerts kept for a summary are not lost silently,
+			// though they may not make it to IRC.
+			d.check(true)
+			return
+		}
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func makeTestStormDetector(elapsedTime []int, template string) (*StormDetector, chan AlertMsg, *Metrics) {
+	config := &Config{
+		IRCChannels: []IRCChannel{
+			IRCChannel{Name: "#dev", Storm: &StormConfig{
+				Threshold:     3,
+				Window:        time.Minute,
+				CalmThreshold: 1,
+				CoolDown:      time.Minute,
+				Interval:      2 * time.Minute,
+				Template:      template,
+			}},
+			IRCChannel{Name: "#ops"},
+		},
+	}
+	fakeTime := &FakeTime{
+		timeseries:   elapsedTime,
+		durationUnit: time.Second,
+		afterChan:    make(chan time.Time, 1),
+	}
+	alertMsgs := make(chan AlertMsg, 10)
+	metrics := NewMetrics(prometheus.NewRegistry())
+	return NewStormDetector(config, alertMsgs, fakeTime, metrics), alertMsgs, metrics
+}
+
+func expectNoStormMsg(t *testing.T, alertMsgs chan AlertMsg) {
+	select {
+	case alertMsg := <-alertMsgs:
+		t.Errorf("Unexpected message: %s", alertMsg)
+	default:
+	}
+}
+
+func TestStorm(t *testing.T) {
+	storms, alertMsgs, metrics := makeTestStormDetector([]int{0, 10, 20, 60, 90, 130, 150, 160}, "")
+
+	if storms.Add("#ops", promtmpl.Alerts{digestTestAlert("a", "airDown", "firing", "")}) {
+		t.Error("Alert to a channel without storm detection kept for a summary")
+	}
+	if storms.Add("#dev", promtmpl.Alerts{
+		digestTestAlert("c", "cpuHot", "firing", ""),
+		digestTestAlert("d", "dnsDown", "firing", ""),
+	}) {
+		t.Error("Alerts kept for a summary below the storm threshold")
+	}
+	if !storms.Add("#dev", promtmpl.Alerts{
+		digestTestAlert("a", "airDown", "firing", "Not enough air"),
+		digestTestAlert("b", "diskFull", "firing", "Disk \x07full"),
+	}) {
+		t.Error("Alerts not kept for a summary above the storm threshold")
+	}
+	expected := AlertMsg{Channel: "#dev", Alert: "Alert storm: 4 alerts within 1m0s, summarizing them every 2m0s"}
+	if alertMsg := <-alertMsgs; !reflect.DeepEqual(expected, alertMsg) {
+		t.Errorf("Unexpected storm announcement.\nExpected: %s\nActual: %s", expected, alertMsg)
+	}
+	storms.Add("#dev", promtmpl.Alerts{digestTestAlert("a", "airDown", "resolved", "Not enough air")})
+
+	// The rate is still above calm_threshold, then below it, but not for
+	// cool_down yet.
+	storms.check(false)
+	storms.check(false)
+	expectNoStormMsg(t, alertMsgs)
+
+	// The summary is due.
+	storms.check(false)
+	expectedSummary := []AlertMsg{
+		AlertMsg{Channel: "#dev", Alert: "Alert storm: 1 firing, 1 resolved in the last 2m0s"},
+		AlertMsg{Channel: "#dev", Alert: "resolved: airDown - Not enough air"},
+		AlertMsg{Channel: "#dev", Alert: "firing: diskFull - Disk full"},
+	}
+	if summary := receiveDigest(alertMsgs, 3); !reflect.DeepEqual(expectedSummary, summary) {
+		t.Errorf("Unexpected storm summary.\nExpected: %s\nActual: %s", expectedSummary, summary)
+	}
+
+	// The storm is over, with nothing left to summarize.
+	storms.check(false)
+	expected = AlertMsg{Channel: "#dev", Alert: "Alert storm is over, relaying alerts as they arrive"}
+	if alertMsg := <-alertMsgs; !reflect.DeepEqual(expected, alertMsg) {
+		t.Errorf("Unexpected storm announcement.\nExpected: %s\nActual: %s", expected, alertMsg)
+	}
+	expectNoStormMsg(t, alertMsgs)
+	if storms.Add("#dev", promtmpl.Alerts{digestTestAlert("a", "airDown", "firing", "")}) {
+		t.Error("Alert kept for a summary after the storm")
+	}
+
+	for mode, expected := range map[string]float64{stormModeStorm: 1, stormModeNormal: 1} {
+		if v := testutil.ToFloat64(metrics.stormModeChanges.WithLabelValues("#dev", mode)); v != expected {
+			t.Errorf("Expected %f changes to %s mode, got %f", expected, mode, v)
+		}
+	}
+	if v := testutil.ToFloat64(metrics.stormMode.WithLabelValues("#dev")); v != 0 {
+		t.Errorf("Expected #dev out of storm mode, got %f", v)
+	}
+	if v := testutil.ToFloat64(metrics.stormSummarizedAlerts.WithLabelValues("#dev")); v != 3 {
+		t.Errorf("Expected 3 summarized alerts, got %f", v)
+	}
+}
+
+func TestStormTemplate(t *testing.T) {
+	storms, alertMsgs, _ := makeTestStormDetector([]int{0, 30},
+		"{{ .Channel }} storm: {{ range .Alerts }}{{ .Name }} {{ end }}")
+
+	storms.Add("#dev", promtmpl.Alerts{
+		digestTestAlert("a", "airDown", "firing", ""),
+		digestTestAlert("b", "diskFull", "firing", ""),
+		digestTestAlert("c", "cpuHot", "firing", ""),
+		digestTestAlert("d", "dnsDown", "firing", ""),
+	})
+	<-alertMsgs
+
+	// Pending summaries are sent on shutdown.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	stopWg := sync.WaitGroup{}
+	stopWg.Add(1)
+	storms.Run(ctx, &stopWg)
+	expected := AlertMsg{Channel: "#dev", Alert: "#dev storm: airDown diskFull cpuHot dnsDown "}
+	if alertMsg := <-alertMsgs; !reflect.DeepEqual(expected, alertMsg) {
+		t.Errorf("Unexpected storm summary.\nExpected: %s\nActual: %s", expected, alertMsg)
+	}
+}
+
+func TestNoStorm(t *testing.T) {
+	var storms *StormDetector
+	if storms.Add("#dev", promtmpl.Alerts{digestTestAlert("a", "airDown", "firing", "")}) {
+		t.Error("Alert kept for a summary without storm detection")
+	}
+}
@@ -0,0 +1,346 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+)
+
+const (
+	tracingBatchSize     = 512
+	tracingFlushInterval = 5 * time.Second
+	tracingExportTimeout = 10 * time.Second
+)
+
+// OTLP span kinds.
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+)
+
+// Tracer records the spans of alerts going through the relay and exports
+// them with OTLP/HTTP (JSON encoding). A nil *Tracer, and the nil *Span it
+// returns, are valid and do nothing, so that disabled tracing costs nothing
+// but nil checks.
+type Tracer struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+	spans       chan *Span
+	metrics     *Metrics
+}
+
+func NewTracer(config *Config, metrics *Metrics) *Tracer {
+	if config.OTLPTracesEndpoint == "" {
+		return nil
+	}
+	return &Tracer{
+		endpoint:    config.OTLPTracesEndpoint,
+		serviceName: config.TracingServiceName,
+		client:      &http.Client{Timeout: tracingExportTimeout},
+		spans:       make(chan *Span, 4*tracingBatchSize),
+		metrics:     metrics,
+	}
+}
+
+type Span struct {
+	tracer   *Tracer
+	parent   *Span
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	kind     int
+	name     string
+
+	start time.Time
+
+	mu         sync.Mutex
+	end        time.Time
+	ended      bool
+	attributes map[string]string
+	errMsg     string
+}
+
+func (t *Tracer) newSpan(name string, kind int, start time.Time) *Span {
+	span := &Span{
+		tracer:     t,
+		kind:       kind,
+		name:       name,
+		start:      start,
+		attributes: make(map[string]string),
+	}
+	rand.Read(span.spanID[:])
+	return span
+}
+
+// parseTraceparent decodes a W3C Trace Context header, e.g.
+// "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01".
+func parseTraceparent(header string) (traceID [16]byte, parentID [8]byte, sampled bool, ok bool) {
+	parts := strings.Split(strings.TrimSpace(header), "-")
+	if len(parts) < 4 || parts[0] == "ff" || len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(traceID[:], []byte(parts[1])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if _, err := hex.Decode(parentID[:], []byte(parts[2])); err != nil {
+		return traceID, parentID, false, false
+	}
+	if traceID == [16]byte{} || parentID == [8]byte{} {
+		return traceID, parentID, false, false
+	}
+	flags, err := strconv.ParseUint(parts[3], 16, 8)
+	if err != nil {
+		return traceID, parentID, false, false
+	}
+	return traceID, parentID, flags&1 == 1, true
+}
+
+// StartSpanFromRequest starts the root span for an HTTP request, continuing
+// the trace of the caller if it sent a traceparent header. Requests the
+// caller chose not to sample are not traced either.
+func (t *Tracer) StartSpanFromRequest(r *http.Request, name string) *Span {
+	if t == nil {
+		return nil
+	}
+	span := t.newSpan(name, spanKindServer, time.Now())
+	if header := r.Header.Get("traceparent"); header != "" {
+		traceID, parentID, sampled, ok := parseTraceparent(header)
+		if ok && !sampled {
+			return nil
+		}
+		if ok {
+			span.traceID = traceID
+			span.parentID = parentID
+			return span
+		}
+		logging.Debug("Ignoring invalid traceparent header '%s'", header)
+	}
+	rand.Read(span.traceID[:])
+	return span
+}
+
+func (s *Span) StartChild(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	child := s.tracer.newSpan(name, spanKindInternal, time.Now())
+	child.parent = s
+	child.traceID = s.traceID
+	child.parentID = s.spanID
+	return child
+}
+
+// StartSibling starts a span with the same parent, for work following s.
+func (s *Span) StartSibling(name string) *Span {
+	if s == nil {
+		return nil
+	}
+	if s.parent == nil {
+		return s.StartChild(name)
+	}
+	return s.parent.StartChild(name)
+}
+
+func (s *Span) SetAttribute(key string, value string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes[key] = value
+}
+
+func (s *Span) SetError(err error) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMsg = err.Error()
+}
+
+// End records the span for export. Spans are only ended once: the span of
+// a message sent again is ended by the first attempt, the next ones only
+// start siblings of it.
+func (s *Span) End() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	if s.ended {
+		s.mu.Unlock()
+		return
+	}
+	s.ended = true
+	s.end = time.Now()
+	s.mu.Unlock()
+
+	select {
+	case s.tracer.spans <- s:
+	default:
+		s.tracer.metrics.tracingSpansDropped.Inc()
+	}
+}
+
+type otlpAnyValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpScopeSpans struct {
+	Scope struct {
+		Name string `json:"name"`
+	} `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpResourceSpans struct {
+	Resource struct {
+		Attributes []otlpKeyValue `json:"attributes"`
+	} `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpTracesRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+func (s *Span) toOTLP() otlpSpan {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	span := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: strconv.FormatInt(s.start.UnixNano(), 10),
+		EndTimeUnixNano:   strconv.FormatInt(s.end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for key, value := range s.attributes {
+		span.Attributes = append(span.Attributes,
+			otlpKeyValue{Key: key, Value: otlpAnyValue{StringValue: value}})
+	}
+	if s.errMsg != "" {
+		span.Status = otlpStatus{Code: 2, Message: s.errMsg}
+	}
+	return span
+}
+
+func (t *Tracer) export(batch []*Span) {
+	scopeSpans := otlpScopeSpans{}
+	scopeSpans.Scope.Name = "alertmanager-irc-relay"
+	for _, span := range batch {
+		scopeSpans.Spans = append(scopeSpans.Spans, span.toOTLP())
+	}
+	resourceSpans := otlpResourceSpans{ScopeSpans: []otlpScopeSpans{scopeSpans}}
+	resourceSpans.Resource.Attributes = []otlpKeyValue{
+		otlpKeyValue{Key: "service.name", Value: otlpAnyValue{StringValue: t.serviceName}},
+		otlpKeyValue{Key: "service.version", Value: otlpAnyValue{StringValue: GetBuildInfo().Version}},
+	}
+	request := otlpTracesRequest{ResourceSpans: []otlpResourceSpans{resourceSpans}}
+
+	body, err := json.Marshal(request)
+	if err == nil {
+		var response *http.Response
+		response, err = t.client.Post(t.endpoint, "application/json", bytes.NewReader(body))
+		if err == nil {
+			response.Body.Close()
+			if response.StatusCode/100 != 2 {
+				err = fmt.Errorf("unexpected status %s", response.Status)
+			}
+		}
+	}
+	if err != nil {
+		logging.Warn("Could not export %d spans: %s", len(batch), err)
+		t.metrics.tracingSpansDropped.Add(float64(len(batch)))
+	}
+}
+
+// Run exports ended spans in batches until ctx is canceled, then exports the
+// remaining ones.
+func (t *Tracer) Run(ctx context.Context, stopWg *sync.WaitGroup) {
+	defer stopWg.Done()
+
+	ticker := time.NewTicker(tracingFlushInterval)
+	defer ticker.Stop()
+
+	batch := []*Span{}
+	flush := func() {
+		if len(batch) > 0 {
+			t.export(batch)
+			batch = []*Span{}
+		}
+	}
+
+	for {
+		select {
+		case span := <-t.spans:
+			batch = append(batch, span)
+			if len(batch) >= tracingBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		case <-ctx.Done():
+			for {
+				select {
+				case span := <-t.spans:
+					batch = append(batch, span)
+				default:
+					flush()
+					return
+				}
+			}
+		}
+	}
+}
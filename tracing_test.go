@@ -0,0 +1,122 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestTracingDisabled(t *testing.T) {
+	tracer := NewTracer(&Config{}, NewMetrics(prometheus.NewRegistry()))
+	if tracer != nil {
+		t.Fatalf("Expected no tracer without endpoint")
+	}
+
+	request := httptest.NewRequest("POST", "/somechannel", nil)
+	span := tracer.StartSpanFromRequest(request, "webhook")
+	child := span.StartChild("decode")
+	child.SetAttribute("key", "value")
+	child.SetError(errors.New("failed"))
+	child.StartSibling("render").End()
+	child.End()
+	span.End()
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for _, tc := range []struct {
+		header  string
+		ok      bool
+		sampled bool
+	}{
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", true, true},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-00", true, false},
+		{"00-00000000000000000000000000000000-b7ad6b7169203331-01", false, false},
+		{"00-0af7651916cd43dd8448eb211c80319c-b7ad6b716920333-01", false, false},
+		{"ff-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01", false, false},
+		{"garbage", false, false},
+	} {
+		_, _, sampled, ok := parseTraceparent(tc.header)
+		if ok != tc.ok || sampled != tc.sampled {
+			t.Errorf("Header '%s': expected ok=%t sampled=%t, got ok=%t sampled=%t",
+				tc.header, tc.ok, tc.sampled, ok, sampled)
+		}
+	}
+}
+
+func TestSpansExported(t *testing.T) {
+	received := make(chan otlpTracesRequest, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		request := otlpTracesRequest{}
+		if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+			t.Errorf("Could not decode exported spans: %s", err)
+		}
+		received <- request
+	}))
+	defer collector.Close()
+
+	config := &Config{
+		OTLPTracesEndpoint: collector.URL + "/v1/traces",
+		TracingServiceName: "test-relay",
+	}
+	tracer := NewTracer(config, NewMetrics(prometheus.NewRegistry()))
+
+	request := httptest.NewRequest("POST", "/somechannel", nil)
+	request.Header.Set("traceparent", "00-0af7651916cd43dd8448eb211c80319c-b7ad6b7169203331-01")
+	span := tracer.StartSpanFromRequest(request, "webhook")
+	queueSpan := span.StartChild("queue_wait")
+	span.End()
+	queueSpan.End()
+	sendSpan := queueSpan.StartSibling("irc_write")
+	sendSpan.SetError(errors.New("not connected"))
+	sendSpan.End()
+	// Sending again ends the queue span again, which must not export it
+	// twice.
+	queueSpan.End()
+	queueSpan.StartSibling("irc_write").End()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopWg := sync.WaitGroup{}
+	stopWg.Add(1)
+	go tracer.Run(ctx, &stopWg)
+	cancel()
+	stopWg.Wait()
+
+	exported := <-received
+	spans := exported.ResourceSpans[0].ScopeSpans[0].Spans
+	if len(spans) != 4 {
+		t.Fatalf("Expected 4 spans, got %d", len(spans))
+	}
+	webhook, queueWait, ircWrite := spans[0], spans[1], spans[2]
+
+	if webhook.TraceID != "0af7651916cd43dd8448eb211c80319c" || webhook.ParentSpanID != "b7ad6b7169203331" {
+		t.Errorf("Trace context not propagated: %+v", webhook)
+	}
+	for _, span := range []otlpSpan{queueWait, ircWrite} {
+		if span.TraceID != webhook.TraceID || span.ParentSpanID != webhook.SpanID {
+			t.Errorf("Span %s is not a child of the webhook span: %+v", span.Name, span)
+		}
+	}
+	if ircWrite.Status.Code != 2 || ircWrite.Status.Message != "not connected" {
+		t.Errorf("Error not recorded on span: %+v", ircWrite)
+	}
+}
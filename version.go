@@ -0,0 +1,63 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"runtime/debug"
+)
+
+// Set at build time with e.g.
+//
+//	go build -ldflags "-X main.Version=v1.2.3 -X main.Revision=$(git rev-parse HEAD)"
+var (
+	Version  = ""
+	Revision = ""
+)
+
+type BuildInfo struct {
+	Version   string `json:"version"`
+	Revision  string `json:"revision"`
+	GoVersion string `json:"go_version"`
+}
+
+// GetBuildInfo returns the version information reported in logs, metrics,
+// /status and CTCP VERSION replies.
+func GetBuildInfo() BuildInfo {
+	info := BuildInfo{
+		Version:   Version,
+		Revision:  Revision,
+		GoVersion: runtime.Version(),
+	}
+	if info.Version == "" {
+		// Binaries installed with "go install module@version" know
+		// their module version.
+		if buildInfo, ok := debug.ReadBuildInfo(); ok && buildInfo.Main.Version != "" {
+			info.Version = buildInfo.Main.Version
+		} else {
+			info.Version = "unknown"
+		}
+	}
+	if info.Revision == "" {
+		info.Revision = "unknown"
+	}
+	return info
+}
+
+func (b BuildInfo) String() string {
+	return fmt.Sprintf("alertmanager-irc-relay %s (revision %s, %s)",
+		b.Version, b.Revision, b.GoVersion)
+}
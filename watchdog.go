@@ -0,0 +1,120 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/alertmanager-irc-relay/logging"
+	promtmpl "github.com/prometheus/alertmanager/template"
+)
+
+// Watchdog is a dead man's switch for the whole alerting pipeline: it expects
+// an always firing alert (such as the Watchdog alert of kube-prometheus) to
+// be received regularly, and reports to a channel when it was not received
+// for timeout. A nil *Watchdog does nothing.
+type Watchdog struct {
+	alertName  string
+	timeout    time.Duration
+	ircChannel string
+	alertMsgs  chan AlertMsg
+	timeTeller TimeTeller
+	metrics    *Metrics
+
+	received chan bool
+}
+
+func NewWatchdog(config *Config, alertMsgs chan AlertMsg, timeTeller TimeTeller, metrics *Metrics) *Watchdog {
+	if config.WatchdogAlertName == "" {
+		return nil
+	}
+	return &Watchdog{
+		alertName:  config.WatchdogAlertName,
+		timeout:    config.WatchdogTimeout,
+		ircChannel: config.WatchdogChannel,
+		alertMsgs:  alertMsgs,
+		timeTeller: timeTeller,
+		metrics:    metrics,
+		received:   make(chan bool, 1),
+	}
+}
+
+// FilterAlerts consumes the watchdog alerts of the group, which are not
+// relayed, and returns the other ones.
+func (w *Watchdog) FilterAlerts(alerts promtmpl.Alerts) promtmpl.Alerts {
+	if w == nil {
+		return alerts
+	}
+	filtered := promtmpl.Alerts{}
+	for _, alert := range alerts {
+		if alert.Labels["alertname"] != w.alertName {
+			filtered = append(filtered, alert)
+			continue
+		}
+		if alert.Status != "firing" {
+			logging.Warn("Watchdog alert %s was resolved", w.alertName)
+			continue
+		}
+		w.metrics.watchdogLastReceivedTimestamp.SetToCurrentTime()
+		select {
+		case w.received <- true:
+		default:
+		}
+	}
+	return filtered
+}
+
+func (w *Watchdog) sendNote(note string) {
+	select {
+	case w.alertMsgs <- AlertMsg{Channel: w.ircChannel, Alert: note}:
+	default:
+		logging.Error("Could not send watchdog note to the IRC routine: %s", note)
+		w.metrics.alertHandlingErrors.WithLabelValues(w.ircChannel, "internal_comm_channel_full").Inc()
+	}
+}
+
+// Run reports when the watchdog alert stops being received, and when it is
+// received again, until ctx is canceled. The timeout starts at startup.
+func (w *Watchdog) Run(ctx context.Context, stopWg *sync.WaitGroup) {
+	defer stopWg.Done()
+
+	expired := false
+	for {
+		select {
+		case <-w.received:
+			if expired {
+				logging.Info("Watchdog alert %s received again", w.alertName)
+				w.sendNote(fmt.Sprintf(
+					"Watchdog alert %s received again, alerts are flowing", w.alertName))
+				w.metrics.watchdogExpired.Set(0)
+				expired = false
+			}
+		case <-w.timeTeller.After(w.timeout):
+			if !expired {
+				logging.Error("Watchdog alert %s not received for %s", w.alertName, w.timeout)
+				w.sendNote(fmt.Sprintf(
+					"Watchdog alert %s not received for %s, alerts may not be reaching IRC",
+					w.alertName, w.timeout))
+				w.metrics.watchdogExpired.Set(1)
+				expired = true
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
@@ -0,0 +1,94 @@
+// Copyright 2021 Google LLC
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     https://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	promtmpl "github.com/prometheus/alertmanager/template"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestWatchdogExpiresAndRecovers(t *testing.T) {
+	config := &Config{
+		WatchdogAlertName: "Watchdog",
+		WatchdogTimeout:   5 * time.Minute,
+		WatchdogChannel:   "#watchdog",
+	}
+	fakeTime := &FakeTime{
+		afterChan: make(chan time.Time),
+	}
+	alertMsgs := make(chan AlertMsg, 10)
+	metrics := NewMetrics(prometheus.NewRegistry())
+	watchdog := NewWatchdog(config, alertMsgs, fakeTime, metrics)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	stopWg := sync.WaitGroup{}
+	stopWg.Add(1)
+	go watchdog.Run(ctx, &stopWg)
+
+	fakeTime.afterChan <- time.Now()
+	expectedNote := AlertMsg{
+		Channel: "#watchdog",
+		Alert:   "Watchdog alert Watchdog not received for 5m0s, alerts may not be reaching IRC",
+	}
+	if note := <-alertMsgs; note.Channel != expectedNote.Channel || note.Alert != expectedNote.Alert {
+		t.Errorf("Unexpected note.\nExpected: %s\nActual: %s", expectedNote, note)
+	}
+	if v := testutil.ToFloat64(metrics.watchdogExpired); v != 1 {
+		t.Errorf("Expected watchdog to be expired, got %f", v)
+	}
+
+	alerts := promtmpl.Alerts{
+		promtmpl.Alert{Status: "firing", Labels: promtmpl.KV{"alertname": "Watchdog"}},
+		promtmpl.Alert{Status: "firing", Labels: promtmpl.KV{"alertname": "airDown"}},
+	}
+	filtered := watchdog.FilterAlerts(alerts)
+	if len(filtered) != 1 || filtered[0].Labels["alertname"] != "airDown" {
+		t.Errorf("Expected only the watchdog alert to be consumed, got %+v", filtered)
+	}
+
+	expectedNote.Alert = "Watchdog alert Watchdog received again, alerts are flowing"
+	if note := <-alertMsgs; note.Channel != expectedNote.Channel || note.Alert != expectedNote.Alert {
+		t.Errorf("Unexpected note.\nExpected: %s\nActual: %s", expectedNote, note)
+	}
+
+	cancel()
+	stopWg.Wait()
+
+	if v := testutil.ToFloat64(metrics.watchdogExpired); v != 0 {
+		t.Errorf("Expected watchdog not to be expired, got %f", v)
+	}
+	if testutil.ToFloat64(metrics.watchdogLastReceivedTimestamp) == 0 {
+		t.Error("Watchdog reception timestamp not set")
+	}
+}
+
+func TestWatchdogDisabled(t *testing.T) {
+	watchdog := NewWatchdog(&Config{}, nil, &FakeTime{}, NewMetrics(prometheus.NewRegistry()))
+	if watchdog != nil {
+		t.Fatalf("Expected no watchdog without alert name")
+	}
+	alerts := promtmpl.Alerts{
+		promtmpl.Alert{Status: "firing", Labels: promtmpl.KV{"alertname": "Watchdog"}},
+	}
+	if len(watchdog.FilterAlerts(alerts)) != 1 {
+		t.Errorf("Alert consumed with watchdog disabled")
+	}
+}